@@ -21,7 +21,7 @@ func main() {
 	}
 
 	if err := internal.RunCommand(os.Args[1], os.Args[2:], version); err != nil {
-		internal.Error("Command failed", err)
+		internal.Error("Command failed", "error", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,36 @@
+// Package internal provides admin endpoint protection for github-copilot-svcs.
+package internal
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards an admin endpoint. When admin.token is configured the
+// request must send it as a bearer token; otherwise only loopback clients are
+// allowed.
+func requireAdmin(config *ConfigStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(config.Load(), r) {
+			Warn("Rejected admin request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			WriteAuthorizationError(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func isAdminRequest(cfg *Config, r *http.Request) bool {
+	if cfg.Admin.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(cfg.Admin.Token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,756 @@
+// Package internal provides the Anthropic Messages API translation layer for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// anthropicLog tags records about Anthropic Messages API requests.
+var anthropicLog = Component("anthropic")
+
+const (
+	// Rough characters-per-token ratio used for local token estimation
+	charsPerTokenEstimate = 4
+
+	anthropicMessageIDPrefix = "msg_"
+	anthropicToolIDPrefix    = "toolu_"
+)
+
+// MessagesHandler returns an HTTP handler for the Anthropic /v1/messages endpoint.
+func (s *ProxyService) MessagesHandler() http.HandlerFunc {
+	return s.handle(s.processMessagesRequest, writeAnthropicError)
+}
+
+// CountTokensHandler returns an HTTP handler for /v1/messages/count_tokens.
+// Copilot has no tokenizer endpoint, so the count is a local estimate.
+func (s *ProxyService) CountTokensHandler() http.HandlerFunc {
+	return s.handle(s.processCountTokensRequest, writeAnthropicError)
+}
+
+func (s *ProxyService) processCountTokensRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
+
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
+	}
+
+	var req transform.MessagesRequest
+	if jsonErr := json.Unmarshal(body, &req); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	model := s.config.Load().resolveModelAlias(req.Model)
+	requestInfoFromContext(ctx).setCaller(identity, model)
+	if err := identity.authorize(r.URL.Path, model); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(transform.CountTokensResponse{InputTokens: estimateMessagesTokens(&req)})
+}
+
+func (s *ProxyService) processMessagesRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	anthropicLog.DebugContext(ctx, "Starting messages request", "method", r.Method, "path", r.URL.Path)
+
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
+
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
+	}
+
+	var req transform.MessagesRequest
+	if jsonErr := json.Unmarshal(body, &req); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	model := s.config.Load().resolveModelAlias(req.Model)
+	requestInfoFromContext(ctx).setCaller(identity, model)
+	if err := identity.authorize(r.URL.Path, model); err != nil {
+		return err
+	}
+
+	payload, err := anthropicToChatPayload(&req)
+	if err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	payload["model"] = model
+
+	resp, _, route, err := s.forwardWithFallback(ctx, http.MethodPost, identity.Email, model, fixedRoute("/chat/completions", payload, nil))
+	if err != nil {
+		return err
+	}
+	servedModel := route.model
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			anthropicLog.WarnContext(ctx, "Error closing response body", "error", err)
+		}
+	}()
+	setServedModel(ctx, w, identity.Email, servedModel)
+
+	if resp.StatusCode >= statusClientError {
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		upstreamBody, _ := io.ReadAll(resp.Body)
+		writeAnthropicError(w, resp.StatusCode, upstreamErrorMessage(upstreamBody))
+		return nil
+	}
+
+	if servedModel == model {
+		restoreModelAlias(resp, req.Model, model)
+	}
+	streaming := resp.Header.Get("Content-Type") == "text/event-stream"
+	meter := meterResponseBody(resp, streaming)
+
+	if streaming {
+		requestInfoFromContext(ctx).setStreaming()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		stream := newAnthropicStreamWriter(w, req.Model, estimateMessagesTokens(&req))
+		if err := stream.translate(ctx, resp.Body); err != nil {
+			return err
+		}
+		s.recordUsage(r.URL.Path, servedModel, identity, meter, streaming)
+		return nil
+	}
+
+	var completion transform.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return NewProxyError("decode_response", "failed to decode chat completion response", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(chatToAnthropicResponse(&completion, req.Model)); err != nil {
+		return err
+	}
+	s.recordUsage(r.URL.Path, servedModel, identity, meter, streaming)
+	return nil
+}
+
+// anthropicToChatPayload converts an Anthropic Messages request into a Copilot chat/completions payload.
+func anthropicToChatPayload(req *transform.MessagesRequest) (map[string]any, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+
+	messages := make([]map[string]any, 0, len(req.Messages)+1)
+
+	system, err := anthropicSystemText(req.System)
+	if err != nil {
+		return nil, err
+	}
+	if system != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": system})
+	}
+
+	for i, msg := range req.Messages {
+		converted, convErr := anthropicMessageToChat(msg)
+		if convErr != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, convErr)
+		}
+		messages = append(messages, converted...)
+	}
+
+	payload := map[string]any{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	if req.MaxTokens > 0 {
+		payload["max_tokens"] = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		payload["top_p"] = *req.TopP
+	}
+	if len(req.StopSequences) > 0 {
+		payload["stop"] = req.StopSequences
+	}
+	if req.Stream {
+		payload["stream"] = true
+		payload["stream_options"] = map[string]any{"include_usage": true}
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		payload["user"] = req.Metadata.UserID
+	}
+
+	tools := make([]map[string]any, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		if len(tool.InputSchema) == 0 {
+			anthropicLog.Warn("Skipping Anthropic server tool without input_schema", "tool", tool.Name, "type", tool.Type)
+			continue
+		}
+		function := map[string]any{
+			"name":       tool.Name,
+			"parameters": tool.InputSchema,
+		}
+		if tool.Description != "" {
+			function["description"] = tool.Description
+		}
+		tools = append(tools, map[string]any{"type": "function", "function": function})
+	}
+	if len(tools) > 0 {
+		payload["tools"] = tools
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto":
+			payload["tool_choice"] = "auto"
+		case "any":
+			payload["tool_choice"] = "required"
+		case "none":
+			payload["tool_choice"] = "none"
+		case "tool":
+			payload["tool_choice"] = map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": req.ToolChoice.Name},
+			}
+		}
+		if req.ToolChoice.DisableParallelToolUse && len(tools) > 0 {
+			payload["parallel_tool_calls"] = false
+		}
+	}
+
+	return payload, nil
+}
+
+// anthropicSystemText flattens the system prompt, which may be a string or a list of text blocks.
+func anthropicSystemText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var blocks []transform.AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", fmt.Errorf("system must be a string or a list of text blocks")
+	}
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" && block.Text != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// anthropicContentBlocks decodes message content, normalising the string shorthand into a text block.
+func anthropicContentBlocks(raw json.RawMessage) ([]transform.AnthropicContentBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []transform.AnthropicContentBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []transform.AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, fmt.Errorf("content must be a string or a list of content blocks")
+	}
+	return blocks, nil
+}
+
+// anthropicMessageToChat converts one Anthropic turn into one or more chat messages.
+// tool_result blocks become separate "tool" messages that precede the remaining user content.
+func anthropicMessageToChat(msg transform.AnthropicMessage) ([]map[string]any, error) {
+	blocks, err := anthropicContentBlocks(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Role {
+	case "user":
+		return anthropicUserToChat(blocks)
+	case "assistant":
+		return anthropicAssistantToChat(blocks)
+	default:
+		return nil, fmt.Errorf("unsupported role %q", msg.Role)
+	}
+}
+
+func anthropicUserToChat(blocks []transform.AnthropicContentBlock) ([]map[string]any, error) {
+	var (
+		messages []map[string]any
+		parts    []map[string]any
+	)
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, map[string]any{"type": "text", "text": block.Text})
+		case "image":
+			part, err := anthropicImageToChat(block.Source)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		case "tool_result":
+			resultBlocks, err := anthropicContentBlocks(block.Content)
+			if err != nil {
+				return nil, fmt.Errorf("tool_result %s: %w", block.ToolUseID, err)
+			}
+			var texts []string
+			for _, rb := range resultBlocks {
+				switch rb.Type {
+				case "text":
+					texts = append(texts, rb.Text)
+				case "image":
+					// Tool messages are text-only upstream, so images are forwarded as user content
+					part, imgErr := anthropicImageToChat(rb.Source)
+					if imgErr != nil {
+						return nil, imgErr
+					}
+					parts = append(parts, part)
+				}
+			}
+			content := strings.Join(texts, "\n")
+			if block.IsError && content != "" {
+				content = "Error: " + content
+			}
+			messages = append(messages, map[string]any{
+				"role":         "tool",
+				"tool_call_id": block.ToolUseID,
+				"content":      content,
+			})
+		default:
+			anthropicLog.Debug("Dropping unsupported user content block", "type", block.Type)
+		}
+	}
+
+	if len(parts) > 0 {
+		messages = append(messages, map[string]any{"role": "user", "content": chatContentFromParts(parts)})
+	}
+	return messages, nil
+}
+
+func anthropicAssistantToChat(blocks []transform.AnthropicContentBlock) ([]map[string]any, error) {
+	var (
+		texts     []string
+		toolCalls []map[string]any
+	)
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 {
+				arguments = string(block.Input)
+			}
+			toolCalls = append(toolCalls, map[string]any{
+				"id":   block.ID,
+				"type": "function",
+				"function": map[string]any{
+					"name":      block.Name,
+					"arguments": arguments,
+				},
+			})
+		default:
+			// thinking / redacted_thinking blocks have no chat equivalent
+			anthropicLog.Debug("Dropping unsupported assistant content block", "type", block.Type)
+		}
+	}
+
+	message := map[string]any{"role": "assistant", "content": nil}
+	if len(texts) > 0 {
+		message["content"] = strings.Join(texts, "")
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+	return []map[string]any{message}, nil
+}
+
+func anthropicImageToChat(source *transform.AnthropicImageSource) (map[string]any, error) {
+	if source == nil {
+		return nil, fmt.Errorf("image block is missing source")
+	}
+	var url string
+	switch source.Type {
+	case "base64":
+		url = fmt.Sprintf("data:%s;base64,%s", source.MediaType, source.Data)
+	case "url":
+		url = source.URL
+	default:
+		return nil, fmt.Errorf("unsupported image source type %q", source.Type)
+	}
+	return map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}}, nil
+}
+
+// chatContentFromParts collapses text-only content into a plain string.
+func chatContentFromParts(parts []map[string]any) any {
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part["type"] != "text" {
+			return parts
+		}
+		texts = append(texts, part["text"].(string))
+	}
+	return strings.Join(texts, "\n")
+}
+
+// chatToAnthropicResponse converts a chat completion into an Anthropic message.
+// Copilot may split text and tool calls across several choices, so all choices are merged.
+func chatToAnthropicResponse(completion *transform.ChatCompletionResponse, requestedModel string) *transform.MessagesResponse {
+	model := completion.Model
+	if model == "" {
+		model = requestedModel
+	}
+
+	content := make([]transform.AnthropicContentBlock, 0, len(completion.Choices))
+	finishReason := ""
+	for _, choice := range completion.Choices {
+		if choice.Message.Content != "" {
+			content = append(content, transform.AnthropicContentBlock{Type: "text", Text: choice.Message.Content})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			input := json.RawMessage(call.Function.Arguments)
+			if !json.Valid(input) {
+				input = json.RawMessage("{}")
+			}
+			content = append(content, transform.AnthropicContentBlock{
+				Type:  "tool_use",
+				ID:    anthropicToolID(call.ID),
+				Name:  call.Function.Name,
+				Input: input,
+			})
+		}
+		if choice.FinishReason != "" && finishReason != "tool_calls" {
+			finishReason = choice.FinishReason
+		}
+	}
+
+	return &transform.MessagesResponse{
+		ID:         anthropicMessageID(completion.ID),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    content,
+		StopReason: anthropicStopReason(finishReason),
+		Usage:      anthropicUsage(&completion.Usage),
+	}
+}
+
+func anthropicUsage(usage *transform.ChatCompletionUsage) transform.AnthropicUsage {
+	if usage == nil {
+		return transform.AnthropicUsage{}
+	}
+	result := transform.AnthropicUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+	}
+	if usage.PromptTokensDetails != nil && usage.PromptTokensDetails.CachedTokens > 0 {
+		result.CacheReadInputTokens = usage.PromptTokensDetails.CachedTokens
+		result.InputTokens -= usage.PromptTokensDetails.CachedTokens
+	}
+	return result
+}
+
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+func anthropicMessageID(id string) string {
+	if strings.HasPrefix(id, anthropicMessageIDPrefix) {
+		return id
+	}
+	return anthropicMessageIDPrefix + randomBase36(24)
+}
+
+func anthropicToolID(id string) string {
+	if id == "" {
+		return anthropicToolIDPrefix + randomBase36(24)
+	}
+	return id
+}
+
+// estimateMessagesTokens gives a rough input token count for a Messages request.
+func estimateMessagesTokens(req *transform.MessagesRequest) int {
+	chars := len(req.System)
+	for _, msg := range req.Messages {
+		chars += len(msg.Content)
+	}
+	for _, tool := range req.Tools {
+		chars += len(tool.Name) + len(tool.Description) + len(tool.InputSchema)
+	}
+	return (chars + charsPerTokenEstimate - 1) / charsPerTokenEstimate
+}
+
+// anthropicStreamWriter converts chat completion chunks into Anthropic stream events.
+type anthropicStreamWriter struct {
+	w           io.Writer
+	model       string
+	inputTokens int
+
+	started    bool
+	nextIndex  int
+	openIndex  int
+	openType   string
+	toolIndex  int
+	stopReason string
+	usage      *transform.ChatCompletionUsage
+}
+
+func newAnthropicStreamWriter(w io.Writer, model string, inputTokens int) *anthropicStreamWriter {
+	return &anthropicStreamWriter{
+		w:           w,
+		model:       model,
+		inputTokens: inputTokens,
+		openIndex:   -1,
+		toolIndex:   -1,
+	}
+}
+
+func (a *anthropicStreamWriter) translate(ctx context.Context, body io.Reader) error {
+	err := readSSEEvents(body, func(event sseEvent) error {
+		data := strings.TrimSpace(event.Data)
+		if data == "" || data == "[DONE]" {
+			return nil
+		}
+		var chunk transform.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			anthropicLog.WarnContext(ctx, "Skipping undecodable stream chunk", "error", err)
+			return nil
+		}
+		return a.handleChunk(&chunk)
+	})
+	if err != nil {
+		anthropicLog.ErrorContext(ctx, "Error translating messages stream", "error", err)
+		return err
+	}
+	return a.finish()
+}
+
+func (a *anthropicStreamWriter) handleChunk(chunk *transform.ChatCompletionChunk) error {
+	if err := a.start(chunk); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		a.usage = chunk.Usage
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			if err := a.ensureBlock("text", map[string]any{"type": "text", "text": ""}); err != nil {
+				return err
+			}
+			if err := a.emit("content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": a.openIndex,
+				"delta": map[string]any{"type": "text_delta", "text": choice.Delta.Content},
+			}); err != nil {
+				return err
+			}
+		}
+
+		for _, call := range choice.Delta.ToolCalls {
+			if call.ID != "" || a.openType != "tool_use" || call.Index != a.toolIndex {
+				if err := a.closeBlock(); err != nil {
+					return err
+				}
+				a.toolIndex = call.Index
+				if err := a.openBlock("tool_use", map[string]any{
+					"type":  "tool_use",
+					"id":    anthropicToolID(call.ID),
+					"name":  call.Function.Name,
+					"input": map[string]any{},
+				}); err != nil {
+					return err
+				}
+			}
+			if call.Function.Arguments != "" {
+				if err := a.emit("content_block_delta", map[string]any{
+					"type":  "content_block_delta",
+					"index": a.openIndex,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if choice.FinishReason != nil && *choice.FinishReason != "" && a.stopReason != "tool_use" {
+			a.stopReason = anthropicStopReason(*choice.FinishReason)
+		}
+	}
+	return nil
+}
+
+func (a *anthropicStreamWriter) start(chunk *transform.ChatCompletionChunk) error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	if chunk != nil && chunk.Model != "" {
+		a.model = chunk.Model
+	}
+	id := ""
+	if chunk != nil {
+		id = chunk.ID
+	}
+	return a.emit("message_start", map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id":            anthropicMessageID(id),
+			"type":          "message",
+			"role":          "assistant",
+			"model":         a.model,
+			"content":       []any{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         map[string]any{"input_tokens": a.inputTokens, "output_tokens": 0},
+		},
+	})
+}
+
+func (a *anthropicStreamWriter) ensureBlock(blockType string, contentBlock map[string]any) error {
+	if a.openType == blockType {
+		return nil
+	}
+	if err := a.closeBlock(); err != nil {
+		return err
+	}
+	return a.openBlock(blockType, contentBlock)
+}
+
+func (a *anthropicStreamWriter) openBlock(blockType string, contentBlock map[string]any) error {
+	a.openIndex = a.nextIndex
+	a.nextIndex++
+	a.openType = blockType
+	return a.emit("content_block_start", map[string]any{
+		"type":          "content_block_start",
+		"index":         a.openIndex,
+		"content_block": contentBlock,
+	})
+}
+
+func (a *anthropicStreamWriter) closeBlock() error {
+	if a.openType == "" {
+		return nil
+	}
+	index := a.openIndex
+	a.openType = ""
+	return a.emit("content_block_stop", map[string]any{"type": "content_block_stop", "index": index})
+}
+
+func (a *anthropicStreamWriter) finish() error {
+	if err := a.start(nil); err != nil {
+		return err
+	}
+	if err := a.closeBlock(); err != nil {
+		return err
+	}
+	if a.stopReason == "" {
+		a.stopReason = "end_turn"
+	}
+	usage := anthropicUsage(a.usage)
+	deltaUsage := map[string]any{"output_tokens": usage.OutputTokens}
+	if a.usage != nil {
+		deltaUsage["input_tokens"] = usage.InputTokens
+		if usage.CacheReadInputTokens > 0 {
+			deltaUsage["cache_read_input_tokens"] = usage.CacheReadInputTokens
+		}
+	}
+	if err := a.emit("message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": a.stopReason, "stop_sequence": nil},
+		"usage": deltaUsage,
+	}); err != nil {
+		return err
+	}
+	return a.emit("message_stop", map[string]any{"type": "message_stop"})
+}
+
+func (a *anthropicStreamWriter) emit(event string, payload map[string]any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return writeSSEEvent(a.w, event, data)
+}
+
+// upstreamErrorMessage extracts a human readable message from an upstream error body.
+func upstreamErrorMessage(body []byte) string {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if parsed.Error.Message != "" {
+			return parsed.Error.Message
+		}
+		if parsed.Message != "" {
+			return parsed.Message
+		}
+	}
+	message := strings.TrimSpace(string(bytes.ToValidUTF8(body, nil)))
+	if message == "" {
+		return http.StatusText(http.StatusBadGateway)
+	}
+	return message
+}
+
+// writeAnthropicError writes an error in the Anthropic API error format.
+func writeAnthropicError(w http.ResponseWriter, statusCode int, message string) {
+	errorType := "api_error"
+	switch statusCode {
+	case http.StatusBadRequest:
+		errorType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case http.StatusForbidden:
+		errorType = "permission_error"
+	case http.StatusNotFound:
+		errorType = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		errorType = "request_too_large"
+	case http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case http.StatusServiceUnavailable, http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		errorType = "overloaded_error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]any{"type": errorType, "message": message},
+	}); err != nil {
+		anthropicLog.Error("Failed to encode anthropic error response", "error", err)
+	}
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+func TestAnthropicToChatPayload(t *testing.T) {
+	raw := `{
+		"model": "claude-sonnet-4",
+		"max_tokens": 1024,
+		"system": [{"type": "text", "text": "You are helpful."}],
+		"stream": true,
+		"tools": [{"name": "get_weather", "description": "Weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"},
+		"messages": [
+			{"role": "user", "content": "What's the weather?"},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Checking."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": "Sunny"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AAAA"}},
+				{"type": "text", "text": "And this picture?"}
+			]}
+		]
+	}`
+
+	var req transform.MessagesRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+
+	payload, err := anthropicToChatPayload(&req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages := payload["messages"].([]map[string]any)
+	wantRoles := []string{"system", "user", "assistant", "tool", "user"}
+	if len(messages) != len(wantRoles) {
+		t.Fatalf("expected %d messages, got %d", len(wantRoles), len(messages))
+	}
+	for i, role := range wantRoles {
+		if messages[i]["role"] != role {
+			t.Errorf("message %d: expected role %s, got %v", i, role, messages[i]["role"])
+		}
+	}
+
+	if messages[0]["content"] != "You are helpful." {
+		t.Errorf("unexpected system content: %v", messages[0]["content"])
+	}
+
+	toolCalls := messages[2]["tool_calls"].([]map[string]any)
+	if len(toolCalls) != 1 || toolCalls[0]["id"] != "toolu_1" {
+		t.Errorf("unexpected tool calls: %v", toolCalls)
+	}
+	if args := toolCalls[0]["function"].(map[string]any)["arguments"]; args != `{"city": "Paris"}` {
+		t.Errorf("unexpected tool arguments: %v", args)
+	}
+
+	if messages[3]["tool_call_id"] != "toolu_1" || messages[3]["content"] != "Sunny" {
+		t.Errorf("unexpected tool message: %v", messages[3])
+	}
+
+	parts, ok := messages[4]["content"].([]map[string]any)
+	if !ok || len(parts) != 2 || parts[0]["type"] != "image_url" {
+		t.Fatalf("expected image and text parts, got %v", messages[4]["content"])
+	}
+	if url := parts[0]["image_url"].(map[string]any)["url"]; url != "data:image/png;base64,AAAA" {
+		t.Errorf("unexpected image url: %v", url)
+	}
+
+	if payload["tool_choice"] != "required" {
+		t.Errorf("expected tool_choice required, got %v", payload["tool_choice"])
+	}
+	if payload["stream_options"] == nil {
+		t.Error("expected stream_options to request usage")
+	}
+	if !hasVisionInput(payload["messages"]) {
+		t.Error("expected vision input to be detected")
+	}
+}
+
+func TestAnthropicToChatPayload_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  transform.MessagesRequest
+	}{
+		{name: "missing model", req: transform.MessagesRequest{Messages: []transform.AnthropicMessage{{Role: "user", Content: json.RawMessage(`"hi"`)}}}},
+		{name: "no messages", req: transform.MessagesRequest{Model: "claude-sonnet-4"}},
+		{name: "bad role", req: transform.MessagesRequest{Model: "m", Messages: []transform.AnthropicMessage{{Role: "system", Content: json.RawMessage(`"hi"`)}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := anthropicToChatPayload(&tt.req); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestChatToAnthropicResponse(t *testing.T) {
+	raw := `{
+		"id": "chatcmpl-1",
+		"model": "claude-sonnet-4",
+		"choices": [
+			{"index": 0, "message": {"role": "assistant", "content": "Let me check."}, "finish_reason": "stop"},
+			{"index": 1, "message": {"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}
+			]}, "finish_reason": "tool_calls"}
+		],
+		"usage": {"prompt_tokens": 20, "completion_tokens": 5, "total_tokens": 25, "prompt_tokens_details": {"cached_tokens": 8}}
+	}`
+
+	var completion transform.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(raw), &completion); err != nil {
+		t.Fatalf("failed to parse completion: %v", err)
+	}
+
+	msg := chatToAnthropicResponse(&completion, "claude-sonnet-4")
+
+	if !strings.HasPrefix(msg.ID, "msg_") {
+		t.Errorf("expected msg_ id, got %s", msg.ID)
+	}
+	if msg.StopReason != "tool_use" {
+		t.Errorf("expected stop_reason tool_use, got %s", msg.StopReason)
+	}
+	if len(msg.Content) != 2 || msg.Content[0].Type != "text" || msg.Content[1].Type != "tool_use" {
+		t.Fatalf("unexpected content blocks: %+v", msg.Content)
+	}
+	if string(msg.Content[1].Input) != `{"city":"Paris"}` {
+		t.Errorf("unexpected tool input: %s", msg.Content[1].Input)
+	}
+	if msg.Usage.InputTokens != 12 || msg.Usage.CacheReadInputTokens != 8 || msg.Usage.OutputTokens != 5 {
+		t.Errorf("unexpected usage: %+v", msg.Usage)
+	}
+}
+
+func TestAnthropicStreamWriter(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"id":"c1","model":"claude-sonnet-4","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		``,
+		`data: {"id":"c1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":4,"total_tokens":14}}`,
+		``,
+		`data: [DONE]`,
+		``,
+	}, "\n")
+
+	var out bytes.Buffer
+	stream := newAnthropicStreamWriter(&out, "claude-sonnet-4", 3)
+	if err := stream.translate(t.Context(), strings.NewReader(upstream)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var events []string
+	var lastDelta map[string]any
+	err := readSSEEvents(&out, func(event sseEvent) error {
+		events = append(events, event.Event)
+		if event.Event == "message_delta" {
+			if err := json.Unmarshal([]byte(event.Data), &lastDelta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse translated stream: %v", err)
+	}
+
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected events:\n got  %v\n want %v", events, want)
+	}
+
+	delta := lastDelta["delta"].(map[string]any)
+	if delta["stop_reason"] != "tool_use" {
+		t.Errorf("expected stop_reason tool_use, got %v", delta["stop_reason"])
+	}
+	usage := lastDelta["usage"].(map[string]any)
+	if usage["output_tokens"] != float64(4) {
+		t.Errorf("expected output_tokens 4, got %v", usage["output_tokens"])
+	}
+}
+
+func TestCountTokensHandler(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upstream should not be called")
+	})
+	body := `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hello there, how are you?"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages/count_tokens?email=user@example.com", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	s.CountTokensHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp transform.CountTokensResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.InputTokens <= 0 {
+		t.Errorf("expected positive token estimate, got %d", resp.InputTokens)
+	}
+
+	// Without allow_email_param the caller needs an API key
+	s.config.Load().APIKeys.AllowEmailParam = false
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages/count_tokens?email=user@example.com", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	s.CountTokensHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `"type":"error"`) {
+		t.Errorf("expected an Anthropic 401 error, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWriteAnthropicError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeAnthropicError(rr, http.StatusTooManyRequests, "slow down")
+
+	var resp struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode error: %v", err)
+	}
+	if resp.Type != "error" || resp.Error.Type != "rate_limit_error" || resp.Error.Message != "slow down" {
+		t.Errorf("unexpected error body: %+v", resp)
+	}
+}
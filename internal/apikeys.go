@@ -0,0 +1,314 @@
+// Package internal provides proxy-issued API key management for github-copilot-svcs.
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APIKeyPrefix marks proxy-issued API keys so they can be told apart from legacy bearer values.
+	APIKeyPrefix = "sk-copilot-"
+
+	apiKeysFileName    = "api_keys.json"
+	apiKeySecretBytes  = 24
+	apiKeyIDLength     = 12
+	apiKeyDisplayChars = 4
+)
+
+// ErrAPIKeyNotFound is returned when an API key ID does not exist.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKeyScopes restricts which endpoints and models an API key may use.
+// Empty lists allow everything. Entries may contain glob patterns such as "gpt-4*".
+type APIKeyScopes struct {
+	Endpoints []string `json:"endpoints,omitempty"`
+	Models    []string `json:"models,omitempty"`
+}
+
+// APIKey is a proxy-issued credential mapped to a user email. Only the SHA-256 hash of the secret is stored.
+type APIKey struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name,omitempty"`
+	Email     string       `json:"email"`
+	Hash      string       `json:"hash"`
+	Hint      string       `json:"hint"`
+	Scopes    APIKeyScopes `json:"scopes"`
+	CreatedAt int64        `json:"created_at"`
+	ExpiresAt int64        `json:"expires_at,omitempty"`
+	RevokedAt int64        `json:"revoked_at,omitempty"`
+}
+
+// Status returns a human-readable key status.
+func (k *APIKey) Status(now time.Time) string {
+	switch {
+	case k.RevokedAt != 0:
+		return "revoked"
+	case k.ExpiresAt != 0 && now.Unix() >= k.ExpiresAt:
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// AllowsEndpoint reports whether the key may call the given request path.
+func (k *APIKey) AllowsEndpoint(endpoint string) bool {
+	return matchesAnyPattern(k.Scopes.Endpoints, endpoint)
+}
+
+// AllowsModel reports whether the key may use the given model.
+func (k *APIKey) AllowsModel(model string) bool {
+	return matchesAnyPattern(k.Scopes.Models, model)
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == value {
+			return true
+		}
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore persists API keys in a JSON file. The file is re-read when it
+// changes on disk so keys created or revoked from the CLI apply to a running server.
+type APIKeyStore struct {
+	path    string
+	mutex   sync.RWMutex
+	keys    []*APIKey
+	byHash  map[string]*APIKey
+	modTime time.Time
+	size    int64
+}
+
+// NewAPIKeyStore creates a store backed by the API key file at path.
+// The file is loaded lazily; a missing file is treated as an empty store.
+func NewAPIKeyStore(path string) *APIKeyStore {
+	return &APIKeyStore{path: path, byHash: make(map[string]*APIKey)}
+}
+
+// DefaultAPIKeysPath returns the API key file path configured in cfg, or the default next to config.json.
+func DefaultAPIKeysPath(cfg *Config) string {
+	if cfg != nil && cfg.APIKeys.File != "" {
+		return cfg.APIKeys.File
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return apiKeysFileName
+	}
+	return filepath.Join(filepath.Dir(configPath), apiKeysFileName)
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// reload re-reads the key file if it changed since the last load.
+func (s *APIKeyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.mutex.Lock()
+		s.keys = nil
+		s.byHash = make(map[string]*APIKey)
+		s.modTime = time.Time{}
+		s.size = 0
+		s.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	unchanged := info.ModTime().Equal(s.modTime) && info.Size() == s.size
+	s.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys []*APIKey
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return NewConfigError("api_keys.file", s.path, "failed to parse api key file", err)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setKeys(keys)
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return nil
+}
+
+func (s *APIKeyStore) setKeys(keys []*APIKey) {
+	s.keys = keys
+	s.byHash = make(map[string]*APIKey, len(keys))
+	for _, key := range keys {
+		s.byHash[key.Hash] = key
+	}
+}
+
+// save writes the keys atomically with owner-only permissions. Callers must hold the write lock.
+func (s *APIKeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, tokenFilePerm); err != nil {
+		return err
+	}
+	if info, statErr := os.Stat(s.path); statErr == nil {
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+	return nil
+}
+
+// Create issues a new API key for email and returns the plaintext secret, which is not stored.
+// A zero ttl creates a key that never expires.
+func (s *APIKeyStore) Create(email, name string, scopes APIKeyScopes, ttl time.Duration) (string, *APIKey, error) {
+	if email == "" {
+		return "", nil, NewValidationError("email", "", "email cannot be empty", nil)
+	}
+	for _, pattern := range append(append([]string{}, scopes.Endpoints...), scopes.Models...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", nil, NewValidationError("scope", pattern, "invalid glob pattern", err)
+		}
+	}
+
+	secretBytes := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, fmt.Errorf("failed to generate api key: %w", err)
+	}
+	secret := APIKeyPrefix + hex.EncodeToString(secretBytes)
+
+	now := time.Now()
+	key := &APIKey{
+		ID:        "key_" + randomBase36(apiKeyIDLength),
+		Name:      name,
+		Email:     email,
+		Hash:      hashAPIKey(secret),
+		Hint:      secret[len(secret)-apiKeyDisplayChars:],
+		Scopes:    scopes,
+		CreatedAt: now.Unix(),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = now.Add(ttl).Unix()
+	}
+
+	if err := s.reload(); err != nil {
+		return "", nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setKeys(append(s.keys, key))
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// Revoke marks the key with the given ID as revoked.
+func (s *APIKeyStore) Revoke(id string) error {
+	if err := s.reload(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.keys {
+		if key.ID == id {
+			if key.RevokedAt == 0 {
+				key.RevokedAt = time.Now().Unix()
+			}
+			return s.save()
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// List returns copies of all keys ordered by creation time.
+func (s *APIKeyStore) List() ([]APIKey, error) {
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+	return keys, nil
+}
+
+// HasKeys reports whether any API key has been issued.
+// An unreadable key file counts as having keys so that key enforcement fails closed.
+func (s *APIKeyStore) HasKeys() bool {
+	if err := s.reload(); err != nil {
+		Warn("Failed to reload api keys", "path", s.path, "error", err)
+		return true
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.keys) > 0
+}
+
+// Authenticate returns the active key matching secret.
+func (s *APIKeyStore) Authenticate(secret string) (*APIKey, error) {
+	if err := s.reload(); err != nil {
+		Warn("Failed to reload api keys", "path", s.path, "error", err)
+	}
+	s.mutex.RLock()
+	key, ok := s.byHash[hashAPIKey(secret)]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, NewAuthError("invalid API key", nil)
+	}
+	switch key.Status(time.Now()) {
+	case "revoked":
+		return nil, NewAuthError("API key has been revoked", nil)
+	case "expired":
+		return nil, NewAuthError("API key has expired", nil)
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// requestAPIKey extracts a proxy-issued API key from the Authorization or x-api-key header.
+// Values without APIKeyPrefix are ignored so legacy clients sending placeholder keys keep working.
+func requestAPIKey(r *http.Request) string {
+	if value := strings.TrimSpace(r.Header.Get("x-api-key")); strings.HasPrefix(value, APIKeyPrefix) {
+		return value
+	}
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		if value := strings.TrimSpace(auth[len("Bearer "):]); strings.HasPrefix(value, APIKeyPrefix) {
+			return value
+		}
+	}
+	return ""
+}
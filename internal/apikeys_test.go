@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyStore_CreateAuthenticateRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys.json")
+	store := NewAPIKeyStore(path)
+
+	if store.HasKeys() {
+		t.Fatal("expected empty store")
+	}
+
+	secret, key, err := store.Create("user@example.com", "ci", APIKeyScopes{}, 0)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		t.Errorf("expected key prefix %s, got %s", APIKeyPrefix, secret)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read key file: %v", err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Error("key file must not contain the plaintext key")
+	}
+	if info, statErr := os.Stat(path); statErr != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected key file permissions 0600, got %v (%v)", info.Mode().Perm(), statErr)
+	}
+
+	// A second store instance sees keys written by the first, as the CLI and server do.
+	other := NewAPIKeyStore(path)
+	authenticated, err := other.Authenticate(secret)
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if authenticated.ID != key.ID || authenticated.Email != "user@example.com" {
+		t.Errorf("unexpected key: %+v", authenticated)
+	}
+
+	if _, err := other.Authenticate(APIKeyPrefix + "wrong"); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+
+	if err := store.Revoke(key.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := other.Authenticate(secret); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("expected revoked key error, got %v", err)
+	}
+	if err := store.Revoke("key_missing"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("expected ErrAPIKeyNotFound, got %v", err)
+	}
+}
+
+func TestAPIKeyStore_Expiry(t *testing.T) {
+	store := NewAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	secret, key, err := store.Create("user@example.com", "", APIKeyScopes{}, time.Hour)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if key.Status(time.Now()) != "active" {
+		t.Errorf("expected active key, got %s", key.Status(time.Now()))
+	}
+	if key.Status(time.Now().Add(2*time.Hour)) != "expired" {
+		t.Error("expected key to be expired after its ttl")
+	}
+	if _, err := store.Authenticate(secret); err != nil {
+		t.Errorf("expected unexpired key to authenticate, got %v", err)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	key := &APIKey{Scopes: APIKeyScopes{
+		Endpoints: []string{"/v1/chat/completions"},
+		Models:    []string{"gpt-4*", "claude-sonnet-4"},
+	}}
+
+	tests := []struct {
+		endpoint string
+		model    string
+		want     bool
+	}{
+		{"/v1/chat/completions", "gpt-4o", true},
+		{"/v1/chat/completions", "claude-sonnet-4", true},
+		{"/v1/chat/completions", "o3", false},
+		{"/v1/responses", "gpt-4o", false},
+	}
+	for _, tt := range tests {
+		identity := &requestIdentity{Email: "user@example.com", Key: key}
+		err := identity.authorize(tt.endpoint, tt.model)
+		if (err == nil) != tt.want {
+			t.Errorf("authorize(%s, %s) = %v, want allowed=%v", tt.endpoint, tt.model, err, tt.want)
+		}
+		if err != nil && proxyErrorStatus(err) != http.StatusForbidden {
+			t.Errorf("expected 403 for scope error, got %d", proxyErrorStatus(err))
+		}
+	}
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	store := NewAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	s := &ProxyService{config: NewConfigStore(&Config{}, ""), apiKeys: store}
+
+	// The legacy email parameter is rejected unless explicitly allowed, even
+	// before any key has been issued.
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=legacy@example.com", nil)
+	_, err := s.authenticateRequest(req)
+	if err == nil || proxyErrorStatus(err) != http.StatusUnauthorized || !strings.Contains(err.Error(), "API key required") {
+		t.Errorf("expected 401 API key required for the email parameter, got %v", err)
+	}
+
+	secret, _, err := store.Create("user@example.com", "", APIKeyScopes{}, 0)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	for _, header := range []string{"Authorization", "x-api-key"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=someone-else@example.com", nil)
+		if header == "Authorization" {
+			req.Header.Set(header, "Bearer "+secret)
+		} else {
+			req.Header.Set(header, secret)
+		}
+		identity, err := s.authenticateRequest(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", header, err)
+		}
+		if identity.Email != "user@example.com" {
+			t.Errorf("%s: expected key owner email, got %s", header, identity.Email)
+		}
+	}
+
+	// allow_email_param opts in to the legacy parameter.
+	s.config.Load().APIKeys.AllowEmailParam = true
+	if identity, err := s.authenticateRequest(req); err != nil || identity.Key != nil {
+		t.Errorf("expected email parameter to be allowed, got %+v, %v", identity, err)
+	}
+}
+
+func TestIdentify_AuthenticatesOnce(t *testing.T) {
+	cfg := &Config{}
+	cfg.APIKeys.AllowEmailParam = true
+	s := &ProxyService{config: NewConfigStore(cfg, "")}
+	info := &proxyRequestInfo{}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com", nil)
+	first, err := s.identify(info, req)
+	if err != nil {
+		t.Fatalf("identify failed: %v", err)
+	}
+	// Later stages reuse the identity instead of authenticating again
+	req.URL.RawQuery = ""
+	if second, err := s.identify(info, req); err != nil || second != first {
+		t.Errorf("expected the first identity to be reused, got %+v, %v", second, err)
+	}
+}
@@ -0,0 +1,723 @@
+// Package internal provides the prompt/completion audit log for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditDirName        = "audit"
+	auditActiveFileName = "audit.jsonl"
+	auditRotatedPrefix  = "audit-"
+	auditFileSuffix     = ".jsonl"
+	auditRotatedFormat  = "20060102T150405.000000000Z"
+
+	defaultAuditRotateSizeMB   = 100
+	defaultAuditRotateAgeHours = 24
+	defaultAuditRetentionDays  = 30
+	defaultAuditReplacement    = "[REDACTED]"
+
+	// auditKeepForever disables retention when set as retention_days.
+	auditKeepForever = -1
+
+	// maxAuditCaptureBytes bounds the request payload and reconstructed
+	// completion kept for a single audit record.
+	maxAuditCaptureBytes = maxUsageCaptureBytes
+
+	// auditWildcard matches any object key or array element in a redaction field path.
+	auditWildcard = "*"
+)
+
+// AuditRedaction is a per-field redaction rule. Field is a dotted path into
+// the audit record, e.g. "request.messages.*.content", where "*" matches any
+// key or array element. Without a Pattern the whole value is replaced;
+// with one, only matching substrings of the strings under Field are. An empty
+// Field applies Pattern to every string in the record.
+type AuditRedaction struct {
+	Field   string `json:"field"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"` // Default: "[REDACTED]"
+}
+
+// AuditRecord is one line of the audit log: who sent what to which model and
+// what came back.
+type AuditRecord struct {
+	Time        time.Time        `json:"time"`
+	RequestID   string           `json:"request_id,omitempty"`
+	Email       string           `json:"email,omitempty"`
+	KeyID       string           `json:"key_id,omitempty"`
+	Endpoint    string           `json:"endpoint"`
+	Model       string           `json:"model,omitempty"`
+	ServedModel string           `json:"served_model,omitempty"`
+	Status      int              `json:"status"`
+	LatencyMS   int64            `json:"latency_ms"`
+	Streaming   bool             `json:"streaming"`
+	Request     json.RawMessage  `json:"request,omitempty"`
+	Truncated   bool             `json:"request_truncated,omitempty"`
+	Completion  *AuditCompletion `json:"completion,omitempty"`
+	Usage       *TokenUsage      `json:"usage,omitempty"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// AuditCompletion is the final completion returned to the client. For
+// streamed responses it is assembled from the SSE deltas.
+type AuditCompletion struct {
+	Content      string          `json:"content"`
+	ToolCalls    []AuditToolCall `json:"tool_calls,omitempty"`
+	FinishReason string          `json:"finish_reason,omitempty"`
+	Truncated    bool            `json:"truncated,omitempty"`
+}
+
+// AuditToolCall is a tool call made by the model.
+type AuditToolCall struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// WithAuditLog records every proxied request and its completion in log.
+func WithAuditLog(log *AuditLog) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.audit = log
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// auditCapture collects the parts of one request that end up in its audit record.
+type auditCapture struct {
+	request    cappedBuffer
+	completion *completionCapture
+	meter      *usageMeter
+}
+
+func newAuditCapture() *auditCapture {
+	return &auditCapture{request: cappedBuffer{limit: maxAuditCaptureBytes}}
+}
+
+// completionCapture observes response bytes like usageMeter and rebuilds the
+// completion from Chat Completions or Responses API bodies and event streams.
+type completionCapture struct {
+	streaming bool
+	buf       cappedBuffer
+	result    AuditCompletion
+	found     bool
+	toolCalls map[toolCallKey]*AuditToolCall
+	toolOrder []toolCallKey
+}
+
+// toolCallKey identifies a tool call by its choice and its index within the
+// choice, since Copilot may spread tool calls over several choices.
+type toolCallKey struct {
+	choice, index int
+}
+
+func newCompletionCapture(streaming bool) *completionCapture {
+	return &completionCapture{
+		streaming: streaming,
+		buf:       cappedBuffer{limit: maxAuditCaptureBytes},
+		toolCalls: make(map[toolCallKey]*AuditToolCall),
+	}
+}
+
+func (c *completionCapture) Write(p []byte) (int, error) {
+	if !c.streaming {
+		return c.buf.Write(p)
+	}
+	for rest := p; len(rest) > 0; {
+		line, tail, complete := bytes.Cut(rest, []byte("\n"))
+		rest = tail
+		_, _ = c.buf.Write(line)
+		if !complete {
+			break
+		}
+		c.scanLine()
+	}
+	return len(p), nil
+}
+
+func (c *completionCapture) scanLine() {
+	line := bytes.TrimRight(c.buf.Bytes(), "\r")
+	if data, ok := bytes.CutPrefix(line, []byte("data:")); ok && !c.buf.truncated {
+		data = bytes.TrimSpace(data)
+		var event map[string]any
+		if !bytes.Equal(data, []byte("[DONE]")) && json.Unmarshal(data, &event) == nil {
+			c.addEvent(event)
+		}
+	}
+	c.buf.Reset()
+	c.buf.truncated = false
+}
+
+// addEvent folds one stream event into the completion.
+func (c *completionCapture) addEvent(event map[string]any) {
+	switch event["type"] {
+	case "response.output_text.delta":
+		delta, _ := event["delta"].(string)
+		c.appendContent(delta)
+		return
+	case "response.completed", "response.incomplete", "response.failed":
+		// The final event carries the whole response; prefer it to the deltas
+		response, _ := event["response"].(map[string]any)
+		if output, _ := response["output"].([]any); len(output) > 0 {
+			truncated := c.result.Truncated
+			c.result, c.toolCalls, c.toolOrder = AuditCompletion{}, make(map[toolCallKey]*AuditToolCall), nil
+			c.addResponsesOutput(response)
+			c.result.Truncated = c.result.Truncated || truncated
+		} else if status, _ := response["status"].(string); status != "" {
+			c.result.FinishReason = status
+			c.found = true
+		}
+		return
+	}
+
+	choices, _ := event["choices"].([]any)
+	for position, raw := range choices {
+		choice, _ := raw.(map[string]any)
+		c.addChatChoice(choice, position, "delta")
+	}
+}
+
+// addChatMessage reads a non-streamed Chat Completions response.
+func (c *completionCapture) addChatMessage(doc map[string]any) {
+	choices, _ := doc["choices"].([]any)
+	for position, raw := range choices {
+		choice, _ := raw.(map[string]any)
+		c.addChatChoice(choice, position, "message")
+	}
+}
+
+// addChatChoice folds the message or stream delta (field) of one choice into
+// the completion. Copilot may return the text and the tool calls of a
+// response in separate choices; a tool_calls finish reason wins over the
+// others.
+func (c *completionCapture) addChatChoice(choice map[string]any, position int, field string) {
+	choiceIndex, ok := getIntFromInterface(choice["index"])
+	if !ok {
+		choiceIndex = position
+	}
+	message, _ := choice[field].(map[string]any)
+	if content, ok := message["content"].(string); ok {
+		c.appendContent(content)
+	}
+	calls, _ := message["tool_calls"].([]any)
+	for callPosition, raw := range calls {
+		call, _ := raw.(map[string]any)
+		index, ok := getIntFromInterface(call["index"])
+		if !ok {
+			index = callPosition
+		}
+		tool := c.toolCall(toolCallKey{choice: choiceIndex, index: index})
+		if id, _ := call["id"].(string); id != "" {
+			tool.ID = id
+		}
+		function, _ := call["function"].(map[string]any)
+		if name, _ := function["name"].(string); name != "" {
+			tool.Name = name
+		}
+		arguments, _ := function["arguments"].(string)
+		tool.Arguments += arguments
+	}
+	if reason, _ := choice["finish_reason"].(string); reason != "" && c.result.FinishReason != "tool_calls" {
+		c.result.FinishReason = reason
+		c.found = true
+	}
+}
+
+// addResponsesOutput reads the output items of a Responses API response.
+func (c *completionCapture) addResponsesOutput(response map[string]any) {
+	output, _ := response["output"].([]any)
+	for _, raw := range output {
+		item, _ := raw.(map[string]any)
+		switch item["type"] {
+		case "message":
+			parts, _ := item["content"].([]any)
+			for _, rawPart := range parts {
+				part, _ := rawPart.(map[string]any)
+				if text, ok := part["text"].(string); ok && part["type"] == "output_text" {
+					c.appendContent(text)
+				}
+			}
+		case "function_call":
+			tool := c.toolCall(toolCallKey{index: len(c.toolOrder)})
+			tool.ID, _ = item["call_id"].(string)
+			tool.Name, _ = item["name"].(string)
+			tool.Arguments, _ = item["arguments"].(string)
+		}
+	}
+	if status, _ := response["status"].(string); status != "" {
+		c.result.FinishReason = status
+		c.found = true
+	}
+}
+
+func (c *completionCapture) appendContent(text string) {
+	c.found = true
+	if room := maxAuditCaptureBytes - len(c.result.Content); len(text) > room {
+		c.result.Content += text[:max(room, 0)]
+		c.result.Truncated = true
+		return
+	}
+	c.result.Content += text
+}
+
+func (c *completionCapture) toolCall(key toolCallKey) *AuditToolCall {
+	c.found = true
+	tool, ok := c.toolCalls[key]
+	if !ok {
+		tool = &AuditToolCall{}
+		c.toolCalls[key] = tool
+		c.toolOrder = append(c.toolOrder, key)
+	}
+	return tool
+}
+
+// Completion returns the reconstructed completion, or nil when the response
+// carried none (e.g. an error or embeddings body).
+func (c *completionCapture) Completion() *AuditCompletion {
+	if c.streaming {
+		if c.buf.Len() > 0 {
+			c.scanLine()
+		}
+	} else {
+		var doc map[string]any
+		if !c.buf.truncated && json.Unmarshal(c.buf.Bytes(), &doc) == nil {
+			if _, ok := doc["output"]; ok {
+				c.addResponsesOutput(doc)
+			} else {
+				c.addChatMessage(doc)
+			}
+		}
+		c.buf.Reset()
+	}
+	if !c.found {
+		return nil
+	}
+	result := c.result
+	for _, key := range c.toolOrder {
+		result.ToolCalls = append(result.ToolCalls, *c.toolCalls[key])
+	}
+	return &result
+}
+
+// auditRequestBody tees the client's request body into the audit capture of info.
+func auditRequestBody(r *http.Request, info *proxyRequestInfo) {
+	if info.audit == nil || r.Body == nil {
+		return
+	}
+	r.Body = readCloser{Reader: io.TeeReader(r.Body, &info.audit.request), Closer: r.Body}
+}
+
+// auditStatus returns the status the client received for a processed request.
+func auditStatus(ctx context.Context, rw *responseWrapper, err error) int {
+	switch {
+	case rw.headersSent:
+		return int(rw.statusCode.Load())
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	default:
+		return proxyErrorStatus(err)
+	}
+}
+
+// writeAudit appends the audit record of a finished proxy request.
+func (s *ProxyService) writeAudit(ctx context.Context, r *http.Request, info *proxyRequestInfo, status int, latency time.Duration, err error) {
+	if s.audit == nil || info.audit == nil {
+		return
+	}
+	info.mutex.Lock()
+	rec := AuditRecord{
+		Time:        time.Now().UTC(),
+		RequestID:   RequestIDFromContext(ctx),
+		Email:       info.email,
+		KeyID:       info.keyID,
+		Endpoint:    r.URL.Path,
+		Model:       info.requestedModel,
+		ServedModel: info.model,
+		Status:      status,
+		LatencyMS:   latency.Milliseconds(),
+		Streaming:   info.streaming,
+		Truncated:   info.audit.request.truncated,
+	}
+	completion, meter := info.audit.completion, info.audit.meter
+	info.mutex.Unlock()
+
+	if request := info.audit.request.Bytes(); len(request) > 0 {
+		if !rec.Truncated && json.Valid(request) {
+			rec.Request = json.RawMessage(request)
+		} else {
+			rec.Request, _ = json.Marshal(string(request))
+		}
+	}
+	if completion != nil {
+		rec.Completion = completion.Completion()
+	}
+	if meter != nil {
+		if usage, ok := meter.Usage(); ok {
+			rec.Usage = &usage
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if writeErr := s.audit.Write(rec); writeErr != nil {
+		proxyLog.WarnContext(ctx, "Failed to write audit record", "error", writeErr)
+	}
+}
+
+// auditRule is a compiled AuditRedaction.
+type auditRule struct {
+	path    []string
+	pattern *regexp.Regexp
+	replace string
+}
+
+func compileAuditRedactions(rules []AuditRedaction) ([]auditRule, error) {
+	compiled := make([]auditRule, 0, len(rules))
+	for i, rule := range rules {
+		field := fmt.Sprintf("audit.redact[%d]", i)
+		if rule.Field == "" && rule.Pattern == "" {
+			return nil, NewValidationError(field, rule, "must set field, pattern or both", nil)
+		}
+		compiledRule := auditRule{replace: rule.Replace}
+		if compiledRule.replace == "" {
+			compiledRule.replace = defaultAuditReplacement
+		}
+		if rule.Field != "" {
+			compiledRule.path = strings.Split(rule.Field, ".")
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, NewValidationError(field+".pattern", rule.Pattern, "must be a valid regular expression", err)
+			}
+			compiledRule.pattern = pattern
+		}
+		compiled = append(compiled, compiledRule)
+	}
+	return compiled, nil
+}
+
+// redact applies the rule to value at the remaining field path.
+func (r *auditRule) redact(value any, path []string) any {
+	if len(path) == 0 {
+		if r.pattern == nil {
+			return r.replace
+		}
+		return r.redactStrings(value)
+	}
+	key, rest := path[0], path[1:]
+	switch v := value.(type) {
+	case map[string]any:
+		for name, child := range v {
+			if key == auditWildcard || key == name {
+				v[name] = r.redact(child, rest)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if key == auditWildcard || key == strconv.Itoa(i) {
+				v[i] = r.redact(child, rest)
+			}
+		}
+	}
+	return value
+}
+
+// redactStrings replaces pattern matches in every string below value.
+func (r *auditRule) redactStrings(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.pattern.ReplaceAllString(v, r.replace)
+	case map[string]any:
+		for name, child := range v {
+			v[name] = r.redactStrings(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = r.redactStrings(child)
+		}
+	}
+	return value
+}
+
+// AuditLog is a JSON Lines audit file that rotates by size and age and
+// prunes rotated files past the retention period.
+type AuditLog struct {
+	mutex      sync.Mutex
+	dir        string
+	rotateSize int64
+	rotateAge  time.Duration
+	retention  time.Duration // zero keeps rotated files forever
+	rules      []auditRule
+	now        func() time.Time
+
+	file    *os.File
+	size    int64
+	started time.Time // time of the first record in the active file
+}
+
+// NewAuditLog opens the audit log configured in cfg, or returns nil when
+// auditing is disabled.
+func NewAuditLog(cfg *Config) (*AuditLog, error) {
+	if !cfg.Audit.Enabled {
+		return nil, nil
+	}
+	rules, err := compileAuditRedactions(cfg.Audit.Redact)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AuditLog{
+		dir:        DefaultAuditDir(cfg),
+		rotateSize: int64(defaultAuditRotateSizeMB) << 20,
+		rotateAge:  defaultAuditRotateAgeHours * time.Hour,
+		retention:  defaultAuditRetentionDays * 24 * time.Hour,
+		rules:      rules,
+		now:        time.Now,
+	}
+	if cfg.Audit.RotateSizeMB > 0 {
+		l.rotateSize = int64(cfg.Audit.RotateSizeMB) << 20
+	}
+	if cfg.Audit.RotateAgeHours > 0 {
+		l.rotateAge = time.Duration(cfg.Audit.RotateAgeHours) * time.Hour
+	}
+	switch {
+	case cfg.Audit.RetentionDays == auditKeepForever:
+		l.retention = 0
+	case cfg.Audit.RetentionDays > 0:
+		l.retention = time.Duration(cfg.Audit.RetentionDays) * 24 * time.Hour
+	}
+
+	if err := os.MkdirAll(l.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.prune()
+	return l, nil
+}
+
+// DefaultAuditDir returns the configured audit directory, or the default next to config.json.
+func DefaultAuditDir(cfg *Config) string {
+	if cfg != nil && cfg.Audit.Dir != "" {
+		return cfg.Audit.Dir
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return auditDirName
+	}
+	return filepath.Join(filepath.Dir(configPath), auditDirName)
+}
+
+// open opens the active file, resuming its age from its first record.
+func (l *AuditLog) open() error {
+	path := filepath.Join(l.dir, auditActiveFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, tokenFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size, l.started = file, info.Size(), time.Time{}
+	if l.size > 0 {
+		l.started = firstAuditRecordTime(path, info.ModTime())
+	}
+	return nil
+}
+
+// firstAuditRecordTime reads the time of the first record in path, falling
+// back to fallback when it cannot be decoded.
+func firstAuditRecordTime(path string, fallback time.Time) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer func() { _ = file.Close() }()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return fallback
+	}
+	var first struct {
+		Time time.Time `json:"time"`
+	}
+	if json.Unmarshal(line, &first) != nil || first.Time.IsZero() {
+		return fallback
+	}
+	return first.Time
+}
+
+// Write redacts rec and appends it to the active file, rotating it first
+// when it has grown past the size or age limit.
+func (l *AuditLog) Write(rec AuditRecord) error {
+	data, err := l.encode(rec)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+	now := l.now()
+	if l.size > 0 && (l.size+int64(len(data)) > l.rotateSize || now.Sub(l.started) >= l.rotateAge) {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if l.started.IsZero() {
+		l.started = rec.Time
+	}
+	return err
+}
+
+// encode marshals rec with the redaction rules applied. Prompts often hold
+// markup, so HTML characters are not escaped.
+func (l *AuditLog) encode(rec AuditRecord) ([]byte, error) {
+	var doc any = rec
+	if len(l.rules) > 0 {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		for i := range l.rules {
+			doc = l.rules[i].redact(doc, l.rules[i].path)
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rotate renames the active file after the current time and starts a new one.
+func (l *AuditLog) rotate(now time.Time) error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	active := filepath.Join(l.dir, auditActiveFileName)
+	rotated := filepath.Join(l.dir, auditRotatedPrefix+now.UTC().Format(auditRotatedFormat)+auditFileSuffix)
+	if err := os.Rename(active, rotated); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+// prune deletes rotated files older than the retention period.
+func (l *AuditLog) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		Warn("Failed to list audit log files", "dir", l.dir, "error", err)
+		return
+	}
+	cutoff := l.now().Add(-l.retention)
+	for _, path := range rotated {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			Warn("Failed to delete expired audit log", "path", path, "error", err)
+		} else {
+			Info("Deleted expired audit log", "path", path)
+		}
+	}
+}
+
+// rotatedFiles lists the rotated audit files, oldest first.
+func (l *AuditLog) rotatedFiles() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, auditRotatedPrefix) && strings.HasSuffix(name, auditFileSuffix) {
+			paths = append(paths, filepath.Join(l.dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Close closes the active file.
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (c *Config) validateAudit() error {
+	if c.Audit.RotateSizeMB < 0 {
+		return NewValidationError("audit.rotate_size_mb", c.Audit.RotateSizeMB, "must not be negative", nil)
+	}
+	if c.Audit.RotateAgeHours < 0 {
+		return NewValidationError("audit.rotate_age_hours", c.Audit.RotateAgeHours, "must not be negative", nil)
+	}
+	if c.Audit.RetentionDays < auditKeepForever {
+		return NewValidationError("audit.retention_days", c.Audit.RetentionDays, "must be -1 (keep forever), 0 (default) or a number of days", nil)
+	}
+	_, err := compileAuditRedactions(c.Audit.Redact)
+	return err
+}
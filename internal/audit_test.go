@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAuditRecords decodes the active audit file in dir.
+func readAuditRecords(t *testing.T, dir string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, auditActiveFileName))
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	var records []map[string]any
+	for line := range strings.Lines(string(data)) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func newTestAuditLog(t *testing.T, configure func(cfg *Config)) *AuditLog {
+	t.Helper()
+	cfg := &Config{}
+	cfg.Audit.Enabled = true
+	cfg.Audit.Dir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+	log, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatalf("NewAuditLog failed: %v", err)
+	}
+	t.Cleanup(func() { _ = log.Close() })
+	return log
+}
+
+func TestAudit_StreamedChatCompletion(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, strings.Join([]string{
+			`data: {"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+			`data: {"choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+			`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"lookup","arguments":"{\"q\":"}}]}}]}`,
+			`data: {"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"x\"}"}}]}}]}`,
+			`data: {"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":7,"completion_tokens":3}}`,
+			`data: [DONE]`,
+		}, "\n\n")+"\n\n")
+	})
+	log := newTestAuditLog(t, func(cfg *Config) {
+		cfg.Audit.Redact = []AuditRedaction{{Field: "request.messages.*.content", Pattern: `\d{4}-\d{4}`}}
+	})
+	s.audit = log
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"card 1234-5678"}]}`))
+	rr := httptest.NewRecorder()
+	RequestIDMiddleware(s.Handler()).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	records := readAuditRecords(t, log.dir)
+	if len(records) != 1 {
+		t.Fatalf("expected one audit record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec["email"] != "user@example.com" || rec["model"] != "gpt-4o" || rec["endpoint"] != "/v1/chat/completions" ||
+		rec["status"] != float64(200) || rec["streaming"] != true || rec["request_id"] != rr.Header().Get(RequestIDHeader) {
+		t.Errorf("unexpected record metadata %v", rec)
+	}
+	request, _ := rec["request"].(map[string]any)
+	messages, _ := request["messages"].([]any)
+	if message, _ := messages[0].(map[string]any); message["content"] != "card [REDACTED]" {
+		t.Errorf("expected the request content to be redacted, got %v", request)
+	}
+	completion, _ := rec["completion"].(map[string]any)
+	if completion["content"] != "Hello" || completion["finish_reason"] != "tool_calls" {
+		t.Errorf("unexpected completion %v", completion)
+	}
+	calls, _ := completion["tool_calls"].([]any)
+	if call, _ := calls[0].(map[string]any); len(calls) != 1 || call["id"] != "call_1" || call["name"] != "lookup" || call["arguments"] != `{"q":"x"}` {
+		t.Errorf("unexpected tool calls %v", calls)
+	}
+	if usage, _ := rec["usage"].(map[string]any); usage["total_tokens"] != float64(10) {
+		t.Errorf("unexpected usage %v", rec["usage"])
+	}
+}
+
+func TestAudit_RecordsFailedRequests(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upstream should not be called")
+	})
+	s.audit = newTestAuditLog(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	records := readAuditRecords(t, s.audit.dir)
+	if len(records) != 1 || records[0]["status"] != float64(http.StatusUnauthorized) || records[0]["error"] == nil {
+		t.Errorf("expected a 401 record with the error, got %v", records)
+	}
+}
+
+func TestAudit_RecordsRateLimitedRequests(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upstream should not be called")
+	})
+	s.audit = newTestAuditLog(t, nil)
+	policy := RateLimitPolicy{DailyQuota: 1}
+	s.config.Load().RateLimits.Default = policy
+	s.rateLimiter = NewRateLimiter("")
+	if _, err := s.rateLimiter.Acquire("user@example.com", policy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com", strings.NewReader(`{"model":"gpt-4o"}`))
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+
+	records := readAuditRecords(t, s.audit.dir)
+	if len(records) != 1 {
+		t.Fatalf("expected one audit record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec["status"] != float64(http.StatusTooManyRequests) || rec["email"] != "user@example.com" || rec["error"] == nil {
+		t.Errorf("expected a 429 record with the caller, got %v", rec)
+	}
+	if request, _ := rec["request"].(map[string]any); request["model"] != "gpt-4o" {
+		t.Errorf("expected the rejected request body, got %v", rec["request"])
+	}
+}
+
+func TestCompletionCapture_ResponsesAPI(t *testing.T) {
+	body := `{"id":"resp_1","status":"completed","output":[` +
+		`{"type":"message","content":[{"type":"output_text","text":"Hi there"}]},` +
+		`{"type":"function_call","call_id":"call_9","name":"search","arguments":"{}"}]}`
+	capture := newCompletionCapture(false)
+	_, _ = io.WriteString(capture, body)
+	completion := capture.Completion()
+	if completion == nil || completion.Content != "Hi there" || completion.FinishReason != "completed" ||
+		len(completion.ToolCalls) != 1 || completion.ToolCalls[0].ID != "call_9" {
+		t.Errorf("unexpected completion %+v", completion)
+	}
+
+	stream := newCompletionCapture(true)
+	_, _ = io.WriteString(stream, "event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"Hi\"}\n\n"+
+		"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"status\":\"completed\",\"output\":[]}}\n\n")
+	if completion := stream.Completion(); completion == nil || completion.Content != "Hi" || completion.FinishReason != "completed" {
+		t.Errorf("unexpected streamed completion %+v", completion)
+	}
+}
+
+func TestCompletionCapture_SplitChoices(t *testing.T) {
+	// Copilot returns the text and the tool calls of Claude models in separate choices
+	body := `{"choices":[` +
+		`{"index":0,"message":{"role":"assistant","content":"Let me check."},"finish_reason":"tool_calls"},` +
+		`{"index":1,"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`
+	capture := newCompletionCapture(false)
+	_, _ = io.WriteString(capture, body)
+	completion := capture.Completion()
+	if completion == nil || completion.Content != "Let me check." || completion.FinishReason != "tool_calls" ||
+		len(completion.ToolCalls) != 1 || completion.ToolCalls[0].ID != "call_1" || completion.ToolCalls[0].Name != "lookup" {
+		t.Errorf("unexpected completion %+v", completion)
+	}
+
+	stream := newCompletionCapture(true)
+	_, _ = io.WriteString(stream, `data: {"choices":[{"index":0,"delta":{"content":"Let me check."}}]}`+"\n\n"+
+		`data: {"choices":[{"index":1,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"lookup","arguments":"{}"}}]}}]}`+"\n\n"+
+		`data: {"choices":[{"index":2,"delta":{"tool_calls":[{"index":0,"id":"call_2","function":{"name":"fetch","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`+"\n\n")
+	completion = stream.Completion()
+	if completion == nil || completion.Content != "Let me check." || completion.FinishReason != "tool_calls" ||
+		len(completion.ToolCalls) != 2 || completion.ToolCalls[1].ID != "call_2" {
+		t.Errorf("unexpected streamed completion %+v", completion)
+	}
+}
+
+func TestAuditLog_Redaction(t *testing.T) {
+	log := newTestAuditLog(t, func(cfg *Config) {
+		cfg.Audit.Redact = []AuditRedaction{
+			{Field: "email"},
+			{Field: "completion.content", Replace: "<hidden>"},
+			{Pattern: `sk-[a-z0-9]+`, Replace: "sk-***"},
+		}
+	})
+	err := log.Write(AuditRecord{
+		Time:       time.Now().UTC(),
+		Email:      "user@example.com",
+		Endpoint:   "/v1/chat/completions",
+		Request:    json.RawMessage(`{"messages":[{"content":"my key is sk-abc123"}],"n":12345678901234567890}`),
+		Completion: &AuditCompletion{Content: "secret answer"},
+	})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(log.dir, auditActiveFileName))
+	line := string(data)
+	for _, want := range []string{`"email":"[REDACTED]"`, `"content":"<hidden>"`, `my key is sk-***`, `"n":12345678901234567890`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %s in %s", want, line)
+		}
+	}
+	if strings.Contains(line, "user@example.com") || strings.Contains(line, "sk-abc123") {
+		t.Errorf("unredacted values in %s", line)
+	}
+}
+
+func TestAuditLog_RotationAndRetention(t *testing.T) {
+	log := newTestAuditLog(t, func(cfg *Config) {
+		cfg.Audit.RotateAgeHours = 1
+		cfg.Audit.RetentionDays = 1
+	})
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	log.now = func() time.Time { return now }
+	write := func() {
+		t.Helper()
+		if err := log.Write(AuditRecord{Time: now, Endpoint: "/v1/chat/completions"}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	write()
+	now = now.Add(30 * time.Minute)
+	write()
+	if rotated, _ := log.rotatedFiles(); len(rotated) != 0 {
+		t.Fatalf("rotated too early: %v", rotated)
+	}
+
+	// Age-based rotation
+	now = now.Add(time.Hour)
+	write()
+	rotated, _ := log.rotatedFiles()
+	if len(rotated) != 1 || len(readAuditRecords(t, log.dir)) != 1 {
+		t.Fatalf("expected one rotated file and a fresh active file, got %v", rotated)
+	}
+
+	// Size-based rotation
+	log.rotateSize = log.size + 10
+	now = now.Add(time.Minute)
+	write()
+	if rotated, _ = log.rotatedFiles(); len(rotated) != 2 {
+		t.Fatalf("expected a size-based rotation, got %v", rotated)
+	}
+
+	// Retention removes rotated files older than a day
+	old := now.Add(-48 * time.Hour)
+	if err := os.Chtimes(rotated[0], old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	log.prune()
+	if remaining, _ := log.rotatedFiles(); len(remaining) != 1 || remaining[0] != rotated[1] {
+		t.Errorf("expected only the recent rotated file to remain, got %v", remaining)
+	}
+
+	// A reopened log resumes the age of the active file from its first record
+	if err := log.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := log.open(); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if !log.started.Equal(now) {
+		t.Errorf("expected the active file to start at %v, got %v", now, log.started)
+	}
+}
+
+func TestValidateAudit(t *testing.T) {
+	cfg := &Config{}
+	cfg.Audit.Redact = []AuditRedaction{{Field: "request", Pattern: "("}}
+	if err := cfg.validateAudit(); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	cfg.Audit.Redact = []AuditRedaction{{}}
+	if err := cfg.validateAudit(); err == nil {
+		t.Error("expected an empty rule to be rejected")
+	}
+	cfg.Audit.Redact = nil
+	cfg.Audit.RetentionDays = -2
+	if err := cfg.validateAudit(); err == nil {
+		t.Error("expected a negative retention to be rejected")
+	}
+}
@@ -4,6 +4,7 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -24,6 +25,10 @@ const (
 	baseRetryDelay    = 2 // seconds
 )
 
+// authLog tags authentication and token refresh records.
+var authLog = Component("auth")
+
+// getDatabaseURL returns the default endpoint of the HTTP token store.
 func getDatabaseURL() string {
 	// Check if AUTOREVIEW_UI_HOST is set (for Docker environment)
 	if host := os.Getenv("AUTOREVIEW_UI_HOST"); host != "" {
@@ -51,6 +56,7 @@ type copilotTokenResponse struct {
 	Token     string `json:"token"`
 	ExpiresAt int64  `json:"expires_at"`
 	RefreshIn int64  `json:"refresh_in"`
+	SKU       string `json:"sku"`
 	Endpoints struct {
 		API string `json:"api"`
 	} `json:"endpoints"`
@@ -60,6 +66,12 @@ type copilotTokenResponse struct {
 type AuthService struct {
 	httpClient *http.Client
 
+	// Per-user token persistence backend
+	store TokenStore
+
+	// In-process cache of per-user Copilot tokens
+	cache *tokenCache
+
 	// For testability: override config save path
 	configPath string
 
@@ -71,13 +83,24 @@ type AuthService struct {
 func NewAuthService(httpClient *http.Client, opts ...func(*AuthService)) *AuthService {
 	svc := &AuthService{
 		httpClient: httpClient,
+		cache:      newTokenCache(),
 	}
 	for _, opt := range opts {
 		opt(svc)
 	}
+	if svc.store == nil {
+		svc.store = NewHTTPTokenStore(httpClient, getDatabaseURL())
+	}
 	return svc
 }
 
+// WithTokenStore sets the token store used to persist per-user tokens.
+func WithTokenStore(store TokenStore) func(*AuthService) {
+	return func(s *AuthService) {
+		s.store = store
+	}
+}
+
 // WithConfigPath sets the config path for AuthService.
 // WithConfigPath is used for tests.
 func WithConfigPath(path string) func(*AuthService) {
@@ -111,7 +134,7 @@ func (s *AuthService) AuthenticateStage1(cfg *Config) (*DeviceCodeResult, error)
 		return nil, fmt.Errorf("failed to get device code: %w", err)
 	}
 
-	Info("Device code generated", "user_code", dc.UserCode, "expires_in", dc.ExpiresIn)
+	authLog.Info("Device code generated", "user_code", dc.UserCode, "expires_in", dc.ExpiresIn)
 
 	return &DeviceCodeResult{
 		DeviceCode:      dc.DeviceCode,
@@ -133,14 +156,14 @@ func (s *AuthService) AuthenticateStage2(email string, deviceCode string, interv
 	// Step 2: Get GitHub token (poll or single check based on mode)
 	if pollMode {
 		// CLI mode: backend polls until authorized or timeout
-		Info("Polling for GitHub token", "device_code", deviceCode, "interval", interval, "expires_in", expiresIn)
+		authLog.Info("Polling for GitHub token", "device_code", deviceCode, "interval", interval, "expires_in", expiresIn)
 		githubToken, err = s.pollForGitHubToken(cfg, deviceCode, interval, expiresIn)
 		if err != nil {
 			return fmt.Errorf("failed to get GitHub token: %w", err)
 		}
 	} else {
 		// Frontend polling mode: check once and return status
-		Info("Checking GitHub token once", "device_code", deviceCode)
+		authLog.Info("Checking GitHub token once", "device_code", deviceCode)
 		githubToken, err = s.checkGitHubTokenOnce(cfg, deviceCode)
 		if err != nil {
 			return fmt.Errorf("failed to check GitHub token: %w", err)
@@ -150,19 +173,20 @@ func (s *AuthService) AuthenticateStage2(email string, deviceCode string, interv
 	cfg.GitHubToken = githubToken
 
 	// Step 3: Exchange GitHub token for Copilot token
-	copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(cfg, githubToken)
+	ctr, err := s.getCopilotToken(context.Background(), cfg, githubToken)
 	if err != nil {
 		return fmt.Errorf("failed to get Copilot token: %w", err)
 	}
 
-	cfg.CopilotToken = copilotToken
-	cfg.ExpiresAt = expiresAt
-	cfg.RefreshIn = refreshIn
+	cfg.CopilotToken = ctr.Token
+	cfg.ExpiresAt = ctr.ExpiresAt
+	cfg.RefreshIn = ctr.RefreshIn
+	cfg.CopilotAPIEndpoint = ctr.Endpoints.API
+	cfg.CopilotSKU = ctr.SKU
 
-	// Save to database
-	_, err = s.updateTokenInDatabase(email, cfg)
-	if err != nil {
-		return fmt.Errorf("failed to save token to database: %w", err)
+	// Save to token store
+	if err := s.saveToken(context.Background(), email, cfg); err != nil {
+		return fmt.Errorf("failed to save token to token store: %w", err)
 	}
 
 	// Original file-based save (commented out for tracking)
@@ -176,7 +200,7 @@ func (s *AuthService) AuthenticateStage2(email string, deviceCode string, interv
 	// 	return fmt.Errorf("failed to save config: %w", saveErr)
 	// }
 
-	Info("Authentication successful", "email", email)
+	authLog.Info("Authentication successful", "email", email)
 	return nil
 }
 
@@ -185,14 +209,14 @@ func (s *AuthService) AuthenticateStage2(email string, deviceCode string, interv
 func (s *AuthService) Authenticate(email string, cfg *Config) error {
 	now := time.Now().Unix()
 	if cfg.CopilotToken != "" && cfg.ExpiresAt > now+60 {
-		Info("Token still valid", "expires_in", cfg.ExpiresAt-now)
+		authLog.Info("Token still valid", "expires_in", cfg.ExpiresAt-now)
 		return nil // Already authenticated
 	}
 
 	if cfg.CopilotToken != "" {
-		Info("Token expired or expiring soon, triggering re-auth", "expires_in", cfg.ExpiresAt-now)
+		authLog.Info("Token expired or expiring soon, triggering re-auth", "expires_in", cfg.ExpiresAt-now)
 	} else {
-		Info("No token found, starting authentication flow")
+		authLog.Info("No token found, starting authentication flow")
 	}
 
 	// Stage 1: Get device code
@@ -222,7 +246,9 @@ func (s *AuthService) RefreshToken(email string, cfg *Config) error {
 func (s *AuthService) RefreshTokenWithContext(ctx context.Context, email string, cfg *Config) error {
 	if s.refreshFunc != nil {
 		// Use injected refresh function for tests
-		return s.refreshFunc(cfg)
+		err := s.refreshFunc(cfg)
+		recordTokenRefresh(err)
+		return err
 
 		// Original file-based save (commented out)
 		// if s.configPath != "" {
@@ -232,43 +258,49 @@ func (s *AuthService) RefreshTokenWithContext(ctx context.Context, email string,
 	}
 
 	if cfg.GitHubToken == "" {
-		Warn("Cannot refresh token: no GitHub token available")
-		return NewAuthError("no GitHub token available for refresh", nil)
+		authLog.WarnContext(ctx, "Cannot refresh token: no GitHub token available")
+		err := NewAuthError("no GitHub token available for refresh", nil)
+		recordTokenRefresh(err)
+		return err
 	}
 
 	// Retry with exponential backoff
 	for attempt := 1; attempt <= maxRefreshRetries; attempt++ {
-		Info("Attempting to refresh Copilot token", "attempt", attempt, "max_attempts", maxRefreshRetries)
+		authLog.InfoContext(ctx, "Attempting to refresh Copilot token", "attempt", attempt, "max_attempts", maxRefreshRetries)
 
-		copilotToken, expiresAt, refreshIn, err := s.getCopilotToken(cfg, cfg.GitHubToken)
+		ctr, err := s.getCopilotToken(ctx, cfg, cfg.GitHubToken)
 		if err != nil {
 			if attempt == maxRefreshRetries {
-				Error("Token refresh failed after max attempts", "attempts", maxRefreshRetries, "error", err)
+				authLog.ErrorContext(ctx, "Token refresh failed after max attempts", "attempts", maxRefreshRetries, "error", err)
+				recordTokenRefresh(err)
 				return err
 			}
 
 			// Wait before retry with exponential backoff
 			waitTime := time.Duration(baseRetryDelay*attempt*attempt) * time.Second
-			Warn("Token refresh failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
+			authLog.WarnContext(ctx, "Token refresh failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
 
 			// Use context-aware sleep
 			select {
 			case <-time.After(waitTime):
 				continue
 			case <-ctx.Done():
+				recordTokenRefresh(ctx.Err())
 				return ctx.Err()
 			}
 		}
 
-		Info("Token refresh successful", "expires_in", expiresAt-time.Now().Unix())
-		cfg.CopilotToken = copilotToken
-		cfg.ExpiresAt = expiresAt
-		cfg.RefreshIn = refreshIn
-
-		// Update to database instead of file
-		_, err = s.updateTokenInDatabase(email, cfg)
-		if err != nil {
-			return fmt.Errorf("failed to update token in database: %w", err)
+		authLog.InfoContext(ctx, "Token refresh successful", "expires_in", ctr.ExpiresAt-time.Now().Unix())
+		recordTokenRefresh(nil)
+		cfg.CopilotToken = ctr.Token
+		cfg.ExpiresAt = ctr.ExpiresAt
+		cfg.RefreshIn = ctr.RefreshIn
+		cfg.CopilotAPIEndpoint = ctr.Endpoints.API
+		cfg.CopilotSKU = ctr.SKU
+
+		// Update the token store instead of file
+		if err := s.saveToken(ctx, email, cfg); err != nil {
+			return fmt.Errorf("failed to update token in token store: %w", err)
 		}
 		return nil
 
@@ -282,24 +314,57 @@ func (s *AuthService) RefreshTokenWithContext(ctx context.Context, email string,
 	return NewAuthError("maximum retry attempts exceeded", nil)
 }
 
-// EnsureValidToken ensures we have a valid token, refreshing if necessary
-func (s *AuthService) EnsureValidToken(email string, baseConfig *Config) (*Config, error) {
-	// Fetch token status from database
-	cfg, err := s.fetchTokenFromDatabase(email)
+// recordTokenRefresh counts a finished token refresh attempt by result.
+func recordTokenRefresh(err error) {
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch token from database: %w", err)
+		metrics.TokenRefreshes.Inc("failure")
+		return
 	}
+	metrics.TokenRefreshes.Inc("success")
+}
+
+// EnsureValidToken ensures we have a valid token, refreshing if necessary.
+// Tokens are served from the in-process cache until they approach expiry.
+func (s *AuthService) EnsureValidToken(email string, baseConfig *Config) (*Config, error) {
+	return s.EnsureValidTokenContext(context.Background(), email, baseConfig)
+}
+
+// EnsureValidTokenContext is EnsureValidToken for a request; token store
+// calls and refreshes carry the request ID of ctx.
+func (s *AuthService) EnsureValidTokenContext(ctx context.Context, email string, baseConfig *Config) (*Config, error) {
+	ctx, span := startSpan(ctx, "auth.ensure_valid_token", SpanKindInternal)
+	defer span.End()
 
-	// Merge baseConfig settings into cfg (preserve tokens, update other settings from baseConfig)
-	if baseConfig != nil {
-		cfg.Port = baseConfig.Port
-		cfg.AllowedModels = baseConfig.AllowedModels
-		cfg.Headers = baseConfig.Headers
-		cfg.CORS = baseConfig.CORS
-		cfg.Timeouts = baseConfig.Timeouts
+	token, err := s.cachedToken(ctx, email, baseConfig)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to fetch token from token store: %w", err)
 	}
 
-	return s.EnsureValidTokenWithConfig(email, cfg)
+	cfg := &Config{
+		GitHubToken:        token.GitHubToken,
+		CopilotToken:       token.CopilotToken,
+		ExpiresAt:          token.ExpiresAt,
+		RefreshIn:          token.RefreshIn,
+		CopilotAPIEndpoint: token.APIEndpoint,
+		CopilotSKU:         token.SKU,
+	}
+	applyBaseConfig(cfg, baseConfig)
+	return cfg, nil
+}
+
+// applyBaseConfig merges baseConfig settings into cfg (preserve tokens, update other settings from baseConfig)
+func applyBaseConfig(cfg, baseConfig *Config) {
+	if baseConfig == nil {
+		return
+	}
+	cfg.Port = baseConfig.Port
+	cfg.AllowedModels = baseConfig.AllowedModels
+	cfg.ModelAliases = baseConfig.ModelAliases
+	cfg.Headers = baseConfig.Headers
+	cfg.CORS = baseConfig.CORS
+	cfg.Timeouts = baseConfig.Timeouts
+	cfg.Upstream = baseConfig.Upstream
 }
 
 // EnsureValidTokenWithConfig validates and refreshes token for a given config
@@ -311,7 +376,7 @@ func (s *AuthService) EnsureValidTokenWithConfig(email string, cfg *Config) (*Co
 	}
 
 	// Check if token needs refresh (within 5 minutes of expiry or already expired)
-	if cfg.ExpiresAt <= now+300 {
+	if cfg.ExpiresAt <= now+tokenRefreshMargin {
 		err := s.RefreshToken(email, cfg)
 		if err != nil {
 			return nil, err
@@ -321,141 +386,40 @@ func (s *AuthService) EnsureValidTokenWithConfig(email string, cfg *Config) (*Co
 	return cfg, nil
 }
 
-// fetchTokenFromDatabase fetches CopilotUser data from database
-func (s *AuthService) fetchTokenFromDatabase(email string) (*Config, error) {
-	return s.fetchTokenFromDatabaseWithContext(context.Background(), email)
-}
-
-// fetchTokenFromDatabaseWithContext fetches CopilotUser data from database with context
-func (s *AuthService) fetchTokenFromDatabaseWithContext(ctx context.Context, email string) (*Config, error) {
-	// Create request with context and timeout
-	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	url := fmt.Sprintf("%s?email=%s", getDatabaseURL(), email)
-	req, err := http.NewRequestWithContext(reqCtx, "GET", url, http.NoBody)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := s.httpClient.Do(req)
+// loadToken fetches the stored token for email from the token store
+func (s *AuthService) loadToken(ctx context.Context, email string) (*Config, error) {
+	token, err := s.store.Get(ctx, email)
 	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
+		if errors.Is(err, ErrTokenNotFound) {
+			return nil, NewAuthError("user not found in token store", err)
 		}
-	}()
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, NewAuthError("user not found in database", nil)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, NewNetworkError("fetchTokenFromDatabase", url, fmt.Sprintf("HTTP %d response", resp.StatusCode), nil)
-	}
-
-	var result struct {
-		Success bool `json:"success"`
-		Data    struct {
-			Email        string `json:"email"`
-			GithubToken  string `json:"githubToken"`
-			CopilotToken string `json:"copilotToken"`
-			ExpiresAt    int64  `json:"expiresAt,string"`
-			RefreshIn    int64  `json:"refreshIn,string"`
-		} `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
 	}
 
-	if !result.Success {
-		return nil, NewAuthError("failed to fetch token from database", nil)
-	}
-
-	// Create a new Config with only token-related fields from database
+	// Create a new Config with only token-related fields from the store
 	// Other settings (Headers, CORS, Timeouts) will be merged from baseConfig in EnsureValidToken
 	cfg := &Config{
-		GitHubToken:  result.Data.GithubToken,
-		CopilotToken: result.Data.CopilotToken,
-		ExpiresAt:    result.Data.ExpiresAt,
-		RefreshIn:    result.Data.RefreshIn,
+		GitHubToken:        token.GitHubToken,
+		CopilotToken:       token.CopilotToken,
+		ExpiresAt:          token.ExpiresAt,
+		RefreshIn:          token.RefreshIn,
+		CopilotAPIEndpoint: token.APIEndpoint,
+		CopilotSKU:         token.SKU,
 	}
 
 	return cfg, nil
 }
 
-// updateTokenInDatabase updates CopilotUser data in database
-func (s *AuthService) updateTokenInDatabase(email string, cfg *Config) (bool, error) {
-	return s.updateTokenInDatabaseWithContext(context.Background(), email, cfg)
-}
-
-// updateTokenInDatabaseWithContext updates CopilotUser data in database with context
-func (s *AuthService) updateTokenInDatabaseWithContext(ctx context.Context, email string, cfg *Config) (bool, error) {
-	// Create request with context and timeout
-	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	// Prepare request body
-	requestBody := map[string]interface{}{
-		"email":        email,
-		"githubToken":  cfg.GitHubToken,
-		"copilotToken": cfg.CopilotToken,
-		"expiresAt":    cfg.ExpiresAt,
-		"refreshIn":    cfg.RefreshIn,
-	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return false, fmt.Errorf("failed to marshal request body: %w", err)
-	}
-
-	databaseURL := getDatabaseURL()
-	req, err := http.NewRequestWithContext(reqCtx, "POST", databaseURL, strings.NewReader(string(jsonData)))
-	if err != nil {
-		return false, err
-	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
-		}
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		return false, NewNetworkError("updateTokenInDatabase", databaseURL, fmt.Sprintf("HTTP %d response", resp.StatusCode), nil)
-	}
-
-	var result struct {
-		Success bool `json:"success"`
-		Data    struct {
-			Email        string `json:"email"`
-			GithubToken  string `json:"githubToken"`
-			CopilotToken string `json:"copilotToken"`
-			ExpiresAt    string `json:"expiresAt"`
-			RefreshIn    string `json:"refreshIn"`
-		} `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return false, err
-	}
-
-	if !result.Success {
-		return false, NewAuthError("failed to update token in database", nil)
+// saveToken persists the token fields of cfg for email in the token store
+func (s *AuthService) saveToken(ctx context.Context, email string, cfg *Config) error {
+	token := storedTokenFromConfig(email, cfg)
+	if err := s.store.Put(ctx, &token); err != nil {
+		return err
 	}
+	s.cache.put(token)
 
-	Info("Token updated in database successfully", "email", email)
-	return true, nil
+	authLog.InfoContext(ctx, "Token updated in token store successfully", "email", email)
+	return nil
 }
 
 func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
@@ -463,7 +427,7 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 
 	for attempt := 1; attempt <= maxRetries+1; attempt++ {
 		body := fmt.Sprintf(`{"client_id":%q,"scope":%q}`, copilotClientID, copilotScope)
-		req, err := http.NewRequest("POST", copilotDeviceCodeURL, strings.NewReader(body))
+		req, err := http.NewRequest("POST", cfg.deviceCodeEndpoint(), strings.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
@@ -471,7 +435,7 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("User-Agent", cfg.Headers.UserAgent)
 
-		Info("Sending device code request", "url", copilotDeviceCodeURL, "attempt", attempt)
+		authLog.Info("Sending device code request", "url", cfg.deviceCodeEndpoint(), "attempt", attempt)
 		resp, err := s.httpClient.Do(req)
 		if err != nil {
 			// 检查是否是 TLS 握手超时错误
@@ -480,7 +444,7 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 			if isTLSTimeout && attempt <= maxRetries {
 				// TLS 超时且还有重试次数，等待后重试
 				waitTime := time.Duration(attempt*2) * time.Second
-				Warn("Device code request failed (TLS timeout), retrying",
+				authLog.Warn("Device code request failed (TLS timeout), retrying",
 					"attempt", attempt,
 					"max_retries", maxRetries,
 					"wait_time", waitTime,
@@ -490,12 +454,12 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 			}
 
 			// 最后一次尝试失败或非 TLS 超时错误
-			Error("Device code request failed", "attempt", attempt, "error", err)
+			authLog.Error("Device code request failed", "attempt", attempt, "error", err)
 			return nil, err
 		}
 		defer func() {
 			if err := resp.Body.Close(); err != nil {
-				Warn("Error closing response body", "error", err)
+				authLog.Warn("Error closing response body", "error", err)
 			}
 		}()
 
@@ -504,7 +468,7 @@ func (s *AuthService) getDeviceCode(cfg *Config) (*deviceCodeResponse, error) {
 			return nil, err
 		}
 
-		Info("Device code request successful", "attempt", attempt)
+		authLog.Info("Device code request successful", "attempt", attempt)
 		return &dc, nil
 	}
 
@@ -531,7 +495,7 @@ func (s *AuthService) pollForGitHubTokenWithContext(ctx context.Context, cfg *Co
 
 		body := fmt.Sprintf(`{"client_id":%q,"device_code":%q,"grant_type":"urn:ietf:params:oauth:grant-type:device_code"}`,
 			copilotClientID, deviceCode)
-		req, err := http.NewRequest("POST", copilotTokenURL, strings.NewReader(body))
+		req, err := http.NewRequest("POST", cfg.accessTokenEndpoint(), strings.NewReader(body))
 		if err != nil {
 			return "", err
 		}
@@ -547,12 +511,12 @@ func (s *AuthService) pollForGitHubTokenWithContext(ctx context.Context, cfg *Co
 		var tr tokenResponse
 		if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
 			if err := resp.Body.Close(); err != nil {
-				Warn("Error closing response body", "error", err)
+				authLog.Warn("Error closing response body", "error", err)
 			}
 			continue
 		}
 		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
+			authLog.Warn("Error closing response body", "error", err)
 		}
 
 		if tr.Error != "" {
@@ -575,7 +539,7 @@ func (s *AuthService) pollForGitHubTokenWithContext(ctx context.Context, cfg *Co
 func (s *AuthService) checkGitHubTokenOnce(cfg *Config, deviceCode string) (string, error) {
 	body := fmt.Sprintf(`{"client_id":%q,"device_code":%q,"grant_type":"urn:ietf:params:oauth:grant-type:device_code"}`,
 		copilotClientID, deviceCode)
-	req, err := http.NewRequest("POST", copilotTokenURL, strings.NewReader(body))
+	req, err := http.NewRequest("POST", cfg.accessTokenEndpoint(), strings.NewReader(body))
 	if err != nil {
 		return "", err
 	}
@@ -583,7 +547,7 @@ func (s *AuthService) checkGitHubTokenOnce(cfg *Config, deviceCode string) (stri
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", cfg.Headers.UserAgent)
 
-	Debug("Checking GitHub token once", "header", req.Header)
+	authLog.Debug("Checking GitHub token once", "header", req.Header)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -591,7 +555,7 @@ func (s *AuthService) checkGitHubTokenOnce(cfg *Config, deviceCode string) (stri
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
+			authLog.Warn("Error closing response body", "error", err)
 		}
 	}()
 
@@ -612,28 +576,29 @@ func (s *AuthService) checkGitHubTokenOnce(cfg *Config, deviceCode string) (stri
 	return "", NewAuthError("no access token in response", nil)
 }
 
-func (s *AuthService) getCopilotToken(cfg *Config, githubToken string) (token string, expiresAt, refreshIn int64, err error) {
-	req, err := http.NewRequest("GET", copilotAPIKeyURL, http.NoBody)
+func (s *AuthService) getCopilotToken(ctx context.Context, cfg *Config, githubToken string) (*copilotTokenResponse, error) {
+	tokenURL := cfg.copilotTokenEndpoint()
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL, http.NoBody)
 	if err != nil {
-		return "", 0, 0, err
+		return nil, err
 	}
 	req.Header.Set("Authorization", "token "+githubToken)
 	req.Header.Set("User-Agent", cfg.Headers.UserAgent)
 
-	Debug("Requesting Copilot token",
-		"url", copilotAPIKeyURL,
+	authLog.DebugContext(ctx, "Requesting Copilot token",
+		"url", tokenURL,
 		"method", "GET",
 		"user_agent", cfg.Headers.UserAgent,
-		"github_token_prefix", githubToken[:10]+"...")
+		"github_token", secretFingerprint(githubToken))
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		Error("Failed to request Copilot token", "error", err)
-		return "", 0, 0, err
+		authLog.ErrorContext(ctx, "Failed to request Copilot token", "error", err)
+		return nil, err
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
+			authLog.WarnContext(ctx, "Error closing response body", "error", err)
 		}
 	}()
 
@@ -643,22 +608,23 @@ func (s *AuthService) getCopilotToken(cfg *Config, githubToken string) (token st
 		if readErr == nil && len(bodyBytes) > 0 {
 			errMsg = fmt.Errorf("response body: %s", string(bodyBytes))
 		}
-		Error("Copilot token request failed",
+		authLog.ErrorContext(ctx, "Copilot token request failed",
 			"status_code", resp.StatusCode,
 			"status", resp.Status,
 			"response_body", string(bodyBytes),
 			"content_type", resp.Header.Get("Content-Type"))
-		return "", 0, 0, NewNetworkError("get_copilot_token", copilotAPIKeyURL, fmt.Sprintf("HTTP %d response", resp.StatusCode), errMsg)
+		return nil, NewNetworkError("get_copilot_token", tokenURL, fmt.Sprintf("HTTP %d response", resp.StatusCode), errMsg)
 	}
 
-	Info("Copilot token response received",
+	authLog.InfoContext(ctx, "Copilot token response received",
 		"status_code", resp.StatusCode,
 		"content_type", resp.Header.Get("Content-Type"))
 
 	var ctr copilotTokenResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ctr); err != nil {
-		return "", 0, 0, err
+		return nil, err
 	}
+	authLog.DebugContext(ctx, "Copilot token issued", "api_endpoint", ctr.Endpoints.API)
 
-	return ctr.Token, ctr.ExpiresAt, ctr.RefreshIn, nil
+	return &ctr, nil
 }
@@ -10,15 +10,33 @@ import (
 // AuthAPIService provides authentication API endpoints
 type AuthAPIService struct {
 	authService *AuthService
-	config      *Config
+	config      *ConfigStore
 }
 
 // NewAuthAPIService creates a new authentication API service
-func NewAuthAPIService(authService *AuthService, config *Config) *AuthAPIService {
-	return &AuthAPIService{
+func NewAuthAPIService(authService *AuthService, config *Config, opts ...func(*AuthAPIService)) *AuthAPIService {
+	s := &AuthAPIService{
 		authService: authService,
-		config:      config,
+		config:      NewConfigStore(config, ""),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithAuthAPIConfig makes the auth API use the current snapshot in store.
+func WithAuthAPIConfig(store *ConfigStore) func(*AuthAPIService) {
+	return func(s *AuthAPIService) {
+		s.config = store
+	}
+}
+
+// requestConfig returns a private copy of the current configuration, since
+// the authentication flow writes the new tokens into it.
+func (s *AuthAPIService) requestConfig() *Config {
+	cfg := *s.config.Load()
+	return &cfg
 }
 
 // Stage1Request represents the request body for stage 1 (device code generation)
@@ -124,7 +142,7 @@ func (s *AuthAPIService) Stage1Handler() http.HandlerFunc {
 		Info("Starting authentication stage 1 for user", "email", req.Email)
 
 		// Call AuthenticateStage1
-		dcResult, err := s.authService.AuthenticateStage1(s.config)
+		dcResult, err := s.authService.AuthenticateStage1(s.requestConfig())
 		if err != nil {
 			Error("Stage 1 authentication failed", "email", req.Email, "error", err)
 			s.sendStage1ErrorResponse(w, http.StatusInternalServerError, err.Error())
@@ -215,7 +233,7 @@ func (s *AuthAPIService) Stage2Handler() http.HandlerFunc {
 
 		// Call AuthenticateStage2 with poll mode
 		// If poll_mode is false (frontend polling), only check once and return authorization_pending if not ready
-		err = s.authService.AuthenticateStage2(req.Email, req.DeviceCode, req.Interval, req.ExpiresIn, s.config, req.PollMode)
+		err = s.authService.AuthenticateStage2(req.Email, req.DeviceCode, req.Interval, req.ExpiresIn, s.requestConfig(), req.PollMode)
 		if err != nil {
 			// If it's authorization_pending error and frontend polling mode, return 202 Accepted
 			// GitHub returns "authorization_pending" when user hasn't completed authorization yet
@@ -230,8 +248,8 @@ func (s *AuthAPIService) Stage2Handler() http.HandlerFunc {
 			return
 		}
 
-		// Fetch the updated token info from database
-		cfg, err := s.authService.fetchTokenFromDatabase(req.Email)
+		// Fetch the updated token info from the token store
+		cfg, err := s.authService.loadToken(r.Context(), req.Email)
 		if err != nil {
 			Error("Failed to fetch token after authentication", "email", req.Email, "error", err)
 			s.sendStage2ErrorResponse(w, http.StatusInternalServerError, "authentication succeeded but failed to retrieve token info")
@@ -309,15 +327,15 @@ func (s *AuthAPIService) Handler() http.HandlerFunc {
 		Info("Starting authentication for user", "email", req.Email)
 
 		// Call Authenticate function
-		err = s.authService.Authenticate(req.Email, s.config)
+		err = s.authService.Authenticate(req.Email, s.requestConfig())
 		if err != nil {
 			Error("Authentication failed", "email", req.Email, "error", err)
 			s.sendErrorResponse(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		// Fetch the updated token info from database
-		cfg, err := s.authService.fetchTokenFromDatabase(req.Email)
+		// Fetch the updated token info from the token store
+		cfg, err := s.authService.loadToken(r.Context(), req.Email)
 		if err != nil {
 			Error("Failed to fetch token after authentication", "email", req.Email, "error", err)
 			s.sendErrorResponse(w, http.StatusInternalServerError, "authentication succeeded but failed to retrieve token info")
@@ -0,0 +1,450 @@
+// Package internal provides upstream circuit breakers for github-copilot-svcs.
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerWindow    = 60 // seconds
+	defaultCircuitBreakerProbes    = 1
+
+	// Circuit breaker scopes
+	CircuitScopeUpstream = "upstream" // one breaker per upstream host and model
+	CircuitScopeUser     = "user"     // one breaker per user's token refreshes
+
+	// halfOpenRetryAfter is the back-off suggested while every half-open probe is in flight.
+	halfOpenRetryAfter = time.Second
+)
+
+// CircuitBreakerState represents the state of the circuit breaker
+type CircuitBreakerState int
+
+const (
+	// CircuitClosed allows all requests through
+	CircuitClosed CircuitBreakerState = iota
+	// CircuitOpen rejects all requests
+	CircuitOpen
+	// CircuitHalfOpen allows limited requests through
+	CircuitHalfOpen
+)
+
+// String returns the metric label for the state.
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreakerSettings are the effective circuit breaker settings of a configuration.
+type circuitBreakerSettings struct {
+	threshold int           // failures within window that open the breaker
+	window    time.Duration // how long a failure counts
+	timeout   time.Duration // how long the breaker stays open
+	probes    int           // concurrent requests allowed while half-open
+}
+
+func (c *Config) circuitBreakerSettings() circuitBreakerSettings {
+	settings := circuitBreakerSettings{
+		threshold: c.CircuitBreakers.FailureThreshold,
+		window:    time.Duration(c.CircuitBreakers.Window) * time.Second,
+		timeout:   time.Duration(c.Timeouts.CircuitBreaker) * time.Second,
+		probes:    c.CircuitBreakers.HalfOpenProbes,
+	}
+	if settings.threshold <= 0 {
+		settings.threshold = defaultCircuitBreakerThreshold
+	}
+	if settings.window <= 0 {
+		settings.window = defaultCircuitBreakerWindow * time.Second
+	}
+	if settings.timeout <= 0 {
+		settings.timeout = defaultCircuitBreakerTimeout * time.Second
+	}
+	if settings.probes <= 0 {
+		settings.probes = defaultCircuitBreakerProbes
+	}
+	return settings
+}
+
+func (c *Config) validateCircuitBreakers() error {
+	if c.CircuitBreakers.FailureThreshold < 0 {
+		return NewValidationError("circuit_breakers.failure_threshold", c.CircuitBreakers.FailureThreshold, "must not be negative", nil)
+	}
+	if c.CircuitBreakers.Window < 0 {
+		return NewValidationError("circuit_breakers.window", c.CircuitBreakers.Window, "must not be negative", nil)
+	}
+	if c.CircuitBreakers.HalfOpenProbes < 0 {
+		return NewValidationError("circuit_breakers.half_open_probes", c.CircuitBreakers.HalfOpenProbes, "must not be negative", nil)
+	}
+	return nil
+}
+
+// CircuitBreaker implements the circuit breaker pattern for one upstream host
+// and model, or for one user. Every request admitted by allow must report its
+// outcome with onSuccess or onFailure.
+type CircuitBreaker struct {
+	mutex    sync.Mutex
+	settings circuitBreakerSettings
+	state    CircuitBreakerState
+	failures []time.Time // failures within the window while closed
+	openedAt time.Time
+	probes   int       // half-open requests in flight
+	lastUsed time.Time // last time the breaker was handed out for a request
+}
+
+func newCircuitBreaker(settings circuitBreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{settings: settings, state: CircuitClosed}
+}
+
+// State returns the current circuit breaker state.
+func (cb *CircuitBreaker) State() CircuitBreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.state
+}
+
+// setState changes the state and records the transition. Callers must hold the lock.
+func (cb *CircuitBreaker) setState(state CircuitBreakerState) {
+	if cb.state == state {
+		return
+	}
+	metrics.CircuitBreakerTransitions.Inc(cb.state.String(), state.String())
+	cb.state = state
+}
+
+// allow reports whether a request may be sent. An open breaker turns
+// half-open once its timeout has passed and then admits a limited number of
+// probe requests.
+func (cb *CircuitBreaker) allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case CircuitClosed:
+		return true
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.settings.timeout {
+			return false
+		}
+		cb.setState(CircuitHalfOpen)
+		cb.probes = 0
+	}
+	if cb.probes >= cb.settings.probes {
+		return false
+	}
+	cb.probes++
+	return true
+}
+
+// retryAfter returns how long until the breaker may let a request through.
+func (cb *CircuitBreaker) retryAfter() time.Duration {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitHalfOpen {
+		return halfOpenRetryAfter
+	}
+	return max(cb.settings.timeout-time.Since(cb.openedAt), 0)
+}
+
+func (cb *CircuitBreaker) onSuccess() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures = nil
+	cb.probes = 0
+	cb.setState(CircuitClosed)
+}
+
+func (cb *CircuitBreaker) onFailure() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.open(now)
+	case CircuitClosed:
+		cutoff := now.Add(-cb.settings.window)
+		kept := cb.failures[:0]
+		for _, failure := range cb.failures {
+			if failure.After(cutoff) {
+				kept = append(kept, failure)
+			}
+		}
+		cb.failures = append(kept, now)
+		if len(cb.failures) >= cb.settings.threshold {
+			cb.open(now)
+		}
+	}
+}
+
+// idle reports whether the breaker is closed, has no failures within the
+// window and has not been used for a window, so it behaves like a new one.
+func (cb *CircuitBreaker) idle(now time.Time) bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state != CircuitClosed || now.Sub(cb.lastUsed) < cb.settings.window {
+		return false
+	}
+	cutoff := now.Add(-cb.settings.window)
+	for _, failure := range cb.failures {
+		if failure.After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// open trips the breaker. Callers must hold the lock.
+func (cb *CircuitBreaker) open(now time.Time) {
+	cb.setState(CircuitOpen)
+	cb.openedAt = now
+	cb.failures = nil
+	cb.probes = 0
+}
+
+// reset closes the breaker and forgets its failures.
+func (cb *CircuitBreaker) reset() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures = nil
+	cb.probes = 0
+	cb.setState(CircuitClosed)
+}
+
+// CircuitKey identifies a circuit breaker.
+type CircuitKey struct {
+	Scope string `json:"scope"`
+	Host  string `json:"host,omitempty"`
+	Model string `json:"model,omitempty"`
+	User  string `json:"user,omitempty"`
+}
+
+func (k CircuitKey) String() string {
+	if k.Scope == CircuitScopeUser {
+		return "user " + k.User
+	}
+	return fmt.Sprintf("%s model %s", k.Host, k.Model)
+}
+
+// matches reports whether k matches filter. Empty filter fields match anything.
+func (k CircuitKey) matches(filter CircuitKey) bool {
+	return (filter.Scope == "" || filter.Scope == k.Scope) &&
+		(filter.Host == "" || filter.Host == k.Host) &&
+		(filter.Model == "" || filter.Model == k.Model) &&
+		(filter.User == "" || filter.User == k.User)
+}
+
+// CircuitBreakerStatus is the admin view of one circuit breaker.
+type CircuitBreakerStatus struct {
+	CircuitKey
+	State             string     `json:"state"`
+	Failures          int        `json:"failures"`
+	OpenedAt          *time.Time `json:"opened_at,omitempty"`
+	RetryAfterSeconds int        `json:"retry_after_seconds,omitempty"`
+}
+
+// CircuitOpenError is returned when a circuit breaker rejects a request.
+type CircuitOpenError struct {
+	Key        CircuitKey
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "service temporarily unavailable: circuit breaker open for " + e.Key.String()
+}
+
+// CircuitBreakers holds one circuit breaker per upstream host and model and
+// one per user, created on first use with the current configuration. Idle
+// breakers are dropped, so breakers for arbitrary model names do not pile up.
+type CircuitBreakers struct {
+	settings  func() circuitBreakerSettings
+	mutex     sync.Mutex
+	breakers  map[CircuitKey]*CircuitBreaker
+	lastPrune time.Time
+}
+
+// NewCircuitBreakers creates an empty set of breakers using the settings of config.
+func NewCircuitBreakers(config func() *Config) *CircuitBreakers {
+	return &CircuitBreakers{
+		settings: func() circuitBreakerSettings { return config().circuitBreakerSettings() },
+		breakers: make(map[CircuitKey]*CircuitBreaker),
+	}
+}
+
+// get returns the breaker for key, applying the current settings so reloaded
+// configuration takes effect on existing breakers.
+func (c *CircuitBreakers) get(key CircuitKey) *CircuitBreaker {
+	settings := c.settings()
+	now := time.Now()
+	c.mutex.Lock()
+	cb, ok := c.breakers[key]
+	if !ok {
+		if now.Sub(c.lastPrune) >= settings.window {
+			c.prune(now)
+		}
+		cb = newCircuitBreaker(settings)
+		c.breakers[key] = cb
+	}
+	c.mutex.Unlock()
+
+	cb.mutex.Lock()
+	cb.settings = settings
+	cb.lastUsed = now
+	cb.mutex.Unlock()
+	return cb
+}
+
+// prune drops idle breakers. Callers must hold c.mutex.
+func (c *CircuitBreakers) prune(now time.Time) {
+	c.lastPrune = now
+	for key, cb := range c.breakers {
+		if cb.idle(now) {
+			delete(c.breakers, key)
+		}
+	}
+}
+
+// upstream returns the breaker for model on the upstream at apiBase.
+func (c *CircuitBreakers) upstream(apiBase, model string) (*CircuitBreaker, CircuitKey) {
+	host := apiBase
+	if u, err := url.Parse(apiBase); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	key := CircuitKey{Scope: CircuitScopeUpstream, Host: host, Model: model}
+	return c.get(key), key
+}
+
+// user returns the breaker guarding email's token refreshes.
+func (c *CircuitBreakers) user(email string) (*CircuitBreaker, CircuitKey) {
+	key := CircuitKey{Scope: CircuitScopeUser, User: email}
+	return c.get(key), key
+}
+
+// allow admits a request through cb or returns a CircuitOpenError for key.
+func (c *CircuitBreakers) allow(cb *CircuitBreaker, key CircuitKey) error {
+	if cb.allow() {
+		return nil
+	}
+	retryAfter := cb.retryAfter()
+	Warn("Circuit breaker is open, rejecting request", "breaker", key.String(), "retry_after", retryAfter)
+	return &CircuitOpenError{Key: key, RetryAfter: retryAfter}
+}
+
+// List returns the status of every breaker that is not idle, sorted by
+// scope, host, model and user.
+func (c *CircuitBreakers) List() []CircuitBreakerStatus {
+	c.mutex.Lock()
+	c.prune(time.Now())
+	keys := make([]CircuitKey, 0, len(c.breakers))
+	breakers := make([]*CircuitBreaker, 0, len(c.breakers))
+	for key, cb := range c.breakers {
+		keys = append(keys, key)
+		breakers = append(breakers, cb)
+	}
+	c.mutex.Unlock()
+
+	statuses := make([]CircuitBreakerStatus, 0, len(keys))
+	for i, cb := range breakers {
+		cb.mutex.Lock()
+		status := CircuitBreakerStatus{CircuitKey: keys[i], State: cb.state.String(), Failures: len(cb.failures)}
+		if cb.state != CircuitClosed {
+			openedAt := cb.openedAt
+			status.OpenedAt = &openedAt
+		}
+		if cb.state == CircuitOpen {
+			remaining := max(cb.settings.timeout-time.Since(cb.openedAt), 0)
+			status.RetryAfterSeconds = int((remaining + time.Second - 1) / time.Second)
+		}
+		cb.mutex.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i].CircuitKey, statuses[j].CircuitKey
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.User < b.User
+	})
+	return statuses
+}
+
+// Reset closes every breaker matching filter and returns how many were reset.
+func (c *CircuitBreakers) Reset(filter CircuitKey) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for key, cb := range c.breakers {
+		if key.matches(filter) {
+			cb.reset()
+			count++
+		}
+	}
+	if count > 0 {
+		Info("Circuit breakers reset", "count", count, "scope", filter.Scope, "host", filter.Host, "model", filter.Model, "user", filter.User)
+	}
+	return count
+}
+
+// summary returns the most severe state (open, then half-open) and the number of open breakers.
+func (c *CircuitBreakers) summary() (CircuitBreakerState, int) {
+	state, open := CircuitClosed, 0
+	for _, status := range c.List() {
+		switch status.State {
+		case CircuitOpen.String():
+			state = CircuitOpen
+			open++
+		case CircuitHalfOpen.String():
+			if state != CircuitOpen {
+				state = CircuitHalfOpen
+			}
+		}
+	}
+	return state, open
+}
+
+// CircuitBreakersHandler lists circuit breaker states on GET and resets the
+// breakers matching the scope, host, model and user query parameters on POST.
+func CircuitBreakersHandler(breakers *CircuitBreakers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"circuit_breakers": breakers.List()})
+		case http.MethodPost:
+			query := r.URL.Query()
+			filter := CircuitKey{
+				Scope: query.Get("scope"),
+				Host:  query.Get("host"),
+				Model: query.Get("model"),
+				User:  query.Get("user"),
+			}
+			if filter.Scope != "" && filter.Scope != CircuitScopeUpstream && filter.Scope != CircuitScopeUser {
+				WriteValidationError(w, "scope must be one of upstream, user")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"reset": breakers.Reset(filter)})
+		default:
+			WriteHTTPError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_WindowAndProbes(t *testing.T) {
+	cb := newCircuitBreaker(circuitBreakerSettings{
+		threshold: 3,
+		window:    50 * time.Millisecond,
+		timeout:   20 * time.Millisecond,
+		probes:    1,
+	})
+
+	cb.onFailure()
+	cb.onFailure()
+	time.Sleep(60 * time.Millisecond)
+	cb.onFailure()
+	if cb.State() != CircuitClosed {
+		t.Fatal("failures outside the window must not open the breaker")
+	}
+
+	cb.onFailure()
+	cb.onFailure()
+	if cb.State() != CircuitOpen || cb.allow() {
+		t.Fatalf("expected an open breaker rejecting requests, got %s", cb.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !cb.allow() {
+		t.Fatal("expected one half-open probe to be allowed")
+	}
+	if cb.allow() {
+		t.Error("expected a second concurrent probe to be rejected")
+	}
+	if got := cb.retryAfter(); got != halfOpenRetryAfter {
+		t.Errorf("expected half-open retry after %v, got %v", halfOpenRetryAfter, got)
+	}
+	cb.onSuccess()
+	if cb.State() != CircuitClosed || !cb.allow() {
+		t.Errorf("expected a successful probe to close the breaker, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreakers_PrunesIdle(t *testing.T) {
+	cfg := &Config{}
+	cfg.CircuitBreakers.FailureThreshold = 1
+	breakers := NewCircuitBreakers(func() *Config { return cfg })
+
+	for _, model := range []string{"junk-1", "junk-2"} {
+		breakers.upstream(copilotAPIBase, model)
+	}
+	failing, _ := breakers.upstream(copilotAPIBase, "gpt-4o")
+	failing.onFailure()
+	breakers.user("user@example.com")
+
+	// Age every breaker past the window
+	breakers.mutex.Lock()
+	for _, cb := range breakers.breakers {
+		cb.lastUsed = time.Now().Add(-2 * defaultCircuitBreakerWindow * time.Second)
+	}
+	breakers.mutex.Unlock()
+
+	statuses := breakers.List()
+	if len(statuses) != 1 || statuses[0].Model != "gpt-4o" || statuses[0].State != CircuitOpen.String() {
+		t.Errorf("expected only the open breaker to remain, got %+v", statuses)
+	}
+}
+
+func TestProcessProxyRequest_CircuitBreakerPerModel(t *testing.T) {
+	var brokenCalls atomic.Int32
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"broken"`) {
+			brokenCalls.Add(1)
+			w.Header().Set("Retry-After", "120") // longer than we retry for
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"c1","choices":[]}`)
+	})
+	s.config.Load().CircuitBreakers.FailureThreshold = 2
+
+	post := func(model string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+			strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`)))
+		return rr
+	}
+
+	for range 2 {
+		if rr := post("broken"); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected upstream 500, got %d", rr.Code)
+		}
+	}
+	rr := post("broken")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After from the open breaker, got %d %v", rr.Code, rr.Header())
+	}
+	if brokenCalls.Load() != 2 {
+		t.Errorf("expected the open breaker to stop upstream calls, got %d", brokenCalls.Load())
+	}
+	if rr := post("gpt-4o"); rr.Code != http.StatusOK {
+		t.Errorf("expected other models to be unaffected, got %d", rr.Code)
+	}
+
+	handler := CircuitBreakersHandler(s.breakers)
+	list := httptest.NewRecorder()
+	handler(list, httptest.NewRequest(http.MethodGet, "/admin/circuit-breakers", nil))
+	var listed struct {
+		CircuitBreakers []CircuitBreakerStatus `json:"circuit_breakers"`
+	}
+	if err := json.Unmarshal(list.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("invalid list response %s: %v", list.Body.String(), err)
+	}
+	open := 0
+	for _, status := range listed.CircuitBreakers {
+		if status.State == "open" {
+			open++
+			if status.Model != "broken" || status.Scope != CircuitScopeUpstream || status.RetryAfterSeconds == 0 {
+				t.Errorf("unexpected open breaker %+v", status)
+			}
+		}
+	}
+	if open != 1 {
+		t.Errorf("expected one open breaker, got %s", list.Body.String())
+	}
+
+	reset := httptest.NewRecorder()
+	handler(reset, httptest.NewRequest(http.MethodPost, "/admin/circuit-breakers?model=broken", nil))
+	if !strings.Contains(reset.Body.String(), `"reset":1`) {
+		t.Errorf("expected one breaker reset, got %s", reset.Body.String())
+	}
+	post("broken")
+	if brokenCalls.Load() != 3 {
+		t.Errorf("expected requests to reach the upstream after a reset, got %d calls", brokenCalls.Load())
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
@@ -21,6 +23,10 @@ const (
 	cmdConfig  = "config"
 	cmdStatus  = "status"
 	cmdRefresh = "refresh"
+	cmdKeys    = "keys"
+	cmdUsage   = "usage"
+	cmdMock    = "mock"
+	cmdRotate  = "rotate-key"
 
 	// Constants to avoid magic numbers
 	defaultRefreshThreshold = 300 // 5 minutes minimum refresh threshold
@@ -50,25 +56,39 @@ Commands:
   auth     Authenticate with GitHub Copilot using device flow (requires email)
   status   Show detailed authentication and token status
   config   Display current configuration details
-  models   List all available AI models
+  models   List the AI models available to a user (optional email)
   refresh  Manually force token refresh (requires email)
+  keys     Manage client API keys (create <email> | list | revoke <id>)
+  usage    Summarize token usage from the usage ledger
+  mock     Run a mock Copilot upstream for tests and demos
+  rotate-key  Re-encrypt stored tokens under a new encryption key
   help     Show this help message
   version  Show version information
 
 Examples:
   %s auth user@example.com      # Authenticate with GitHub using email
   %s run --port 8080            # Run server on port 8080
+  %s run --record bug.json      # Record upstream traffic into a cassette
+  %s run --replay bug.json      # Serve upstream traffic from a cassette
   %s status --json              # Show status in JSON format
   %s refresh user@example.com   # Force refresh token for specific user
+  %s keys create user@example.com --models 'gpt-4*' --expires 720h
+  %s usage --since 168h --group-by email,model
+  %s mock --port 9090 --chunk-delay 50ms
+  %s rotate-key --key-file ~/.local/share/github-copilot-svcs/token.key
 
 Environment Variables:
   COPILOT_PORT      Server port (default: 8081)
   GITHUB_TOKEN      GitHub OAuth token
   COPILOT_TOKEN     GitHub Copilot API token
   LOG_LEVEL         Log level (debug, info, warn, error)
+  LOG_FORMAT        Log format (dense, json, logfmt)
+  COPILOT_ENCRYPTION_KEY         Token encryption key (hex or base64, 32 bytes)
+  COPILOT_ENCRYPTION_KEY_FILE    File holding the token encryption key
+  COPILOT_ENCRYPTION_PASSPHRASE  Passphrase the token encryption key is derived from
 
 Options:
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -89,9 +109,20 @@ func RunCommand(command string, args []string, version string) error {
 		}
 		return handleAuth(email)
 	case cmdRun, cmdStart:
-		return handleRun()
+		return handleRun(args)
 	case cmdModels:
-		return handleModels()
+		// An optional email selects whose seat type is listed
+		if len(args) > 1 {
+			return fmt.Errorf("models command accepts at most one argument (email address), got %d arguments", len(args))
+		}
+		email := ""
+		if len(args) == 1 {
+			email = args[0]
+			if !isValidEmail(email) {
+				return fmt.Errorf("invalid email format: %s", email)
+			}
+		}
+		return handleModels(email)
 	case cmdConfig:
 		return handleConfig()
 	case cmdStatus:
@@ -106,6 +137,14 @@ func RunCommand(command string, args []string, version string) error {
 			return fmt.Errorf("invalid email format: %s", email)
 		}
 		return handleRefresh(email)
+	case cmdKeys:
+		return handleKeys(args)
+	case cmdUsage:
+		return handleUsage(args)
+	case cmdMock:
+		return handleMock(args)
+	case cmdRotate:
+		return handleRotateKey(args)
 	case "version":
 		fmt.Printf("github-copilot-svcs version %s\n", version)
 		return nil
@@ -127,7 +166,7 @@ func handleAuth(email string) error {
 
 	// Create HTTP client with timeouts
 	httpClient := CreateHTTPClient(cfg)
-	authService := NewAuthService(httpClient)
+	authService := NewAuthService(httpClient, WithTokenStore(NewTokenStore(cfg, httpClient)))
 
 	fmt.Println("Starting GitHub Copilot authentication...")
 	// Use the provided email for authentication
@@ -274,7 +313,15 @@ func getCurrentTime() int64 {
 	return time.Now().Unix()
 }
 
-func handleRun() error {
+func handleRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	record := fs.String("record", "", "record upstream exchanges into this cassette file")
+	replay := fs.String("replay", "", "serve upstream exchanges from this cassette file")
+	ignoreTiming := fs.Bool("ignore-timing", false, "replay response chunks without their recorded delays")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
 	cfg, err := LoadConfig(true)
 	if err != nil {
 		if errors.Is(err, ErrMissingTokens) {
@@ -285,6 +332,24 @@ func handleRun() error {
 		}
 	}
 
+	// Command line record/replay overrides the vcr section of the config
+	switch {
+	case *record != "" && *replay != "":
+		return fmt.Errorf("--record and --replay cannot be used together")
+	case *record != "":
+		cfg.VCR.Mode, cfg.VCR.Cassette = VCRRecord, *record
+	case *replay != "":
+		cfg.VCR.Mode, cfg.VCR.Cassette = VCRReplay, *replay
+	}
+	if *ignoreTiming {
+		cfg.VCR.IgnoreTiming = true
+	}
+	if cfg.VCR.Mode == VCRReplay {
+		if _, err := LoadCassette(cfg.VCR.Cassette); err != nil {
+			return fmt.Errorf("failed to load cassette: %w", err)
+		}
+	}
+
 	// Create HTTP client and start server
 	httpClient := CreateHTTPClient(cfg)
 
@@ -300,7 +365,7 @@ func handleRun() error {
 	return srv.Start()
 }
 
-func handleModels() error {
+func handleModels(email string) error {
 	cfg, err := LoadConfig(true)
 	if err != nil {
 		if errors.Is(err, ErrMissingTokens) {
@@ -310,30 +375,14 @@ func handleModels() error {
 		return fmt.Errorf("failed to load config: %v", err)
 	}
 
-	// Create HTTP client and auth service
+	// Use the same catalog as the server: Copilot, then models.dev, then defaults
 	httpClient := CreateHTTPClient(cfg)
+	authService := NewAuthService(httpClient, WithTokenStore(NewTokenStore(cfg, httpClient)))
+	catalog := NewModelCatalog(httpClient, authService, NewConfigStore(cfg, ""))
+	models, source := catalog.Models(email)
+	fmt.Printf("Model catalog source: %s\n", source)
 
-	// 原有逻辑：在获取模型列表前确保有效的 token 存在
-	// 现在的逻辑：不再需要在启动前确保有效的 token 存在，但由于这是一个独立的命令操作，
-	// 暂时保留原有逻辑（需要后续优化以支持 email 参数）
-	// authService := NewAuthService(httpClient)
-	// if authErr := authService.EnsureValidToken(email); authErr != nil {
-	//     return fmt.Errorf("authentication failed: %v", authErr)
-	// }
-
-	// Fetch models
-	modelList, err := FetchFromModelsDev(httpClient)
-	if err != nil {
-		fmt.Printf("Failed to fetch models from models.dev: %v\n", err)
-		fmt.Println("Using default models:")
-		defaultModels := GetDefault()
-		for _, model := range defaultModels {
-			fmt.Printf("  - %s (%s)\n", model.ID, model.OwnedBy)
-		}
-		return nil
-	}
-
-	filtered := modelList.Data
+	filtered := models
 	var unknown []string
 	filteredMsg := ""
 	if len(cfg.AllowedModels) > 0 {
@@ -382,7 +431,7 @@ func handleRefresh(email string) error {
 
 	// Create HTTP client and auth service
 	httpClient := CreateHTTPClient(cfg)
-	authService := NewAuthService(httpClient)
+	authService := NewAuthService(httpClient, WithTokenStore(NewTokenStore(cfg, httpClient)))
 
 	fmt.Println("Forcing token refresh...")
 	// Use the provided email for token refresh
@@ -401,3 +450,265 @@ func handleRefresh(email string) error {
 
 	return nil
 }
+
+func handleKeys(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("keys command requires a subcommand: create, list or revoke")
+	}
+
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	store := NewAPIKeyStore(DefaultAPIKeysPath(cfg))
+
+	switch args[0] {
+	case "create":
+		return handleKeysCreate(store, args[1:])
+	case "list":
+		return handleKeysList(store)
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("keys revoke requires exactly one argument (key id), got %d arguments", len(args)-1)
+		}
+		if err := store.Revoke(args[1]); err != nil {
+			return fmt.Errorf("failed to revoke key %s: %w", args[1], err)
+		}
+		fmt.Printf("Revoked API key %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown keys subcommand: %s", args[0])
+	}
+}
+
+func handleKeysCreate(store *APIKeyStore, args []string) error {
+	if len(args) == 0 || !isValidEmail(args[0]) {
+		return fmt.Errorf("keys create requires a valid email address as first argument")
+	}
+	email := args[0]
+
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	name := fs.String("name", "", "descriptive name for the key")
+	endpoints := fs.String("endpoints", "", "comma-separated endpoint paths the key may call (default: all)")
+	models := fs.String("models", "", "comma-separated model names or glob patterns the key may use (default: all)")
+	expires := fs.Duration("expires", 0, "key lifetime, e.g. 720h (default: never expires)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	scopes := APIKeyScopes{Endpoints: splitList(*endpoints), Models: splitList(*models)}
+	secret, key, err := store.Create(email, *name, scopes, *expires)
+	if err != nil {
+		return fmt.Errorf("failed to create key: %w", err)
+	}
+
+	fmt.Printf("Created API key %s for %s\n", key.ID, key.Email)
+	if key.ExpiresAt > 0 {
+		fmt.Printf("Expires at: %s\n", time.Unix(key.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	fmt.Printf("\n  %s\n\nStore this key now; it cannot be shown again.\n", secret)
+	return nil
+}
+
+func handleKeysList(store *APIKeyStore) error {
+	keys, err := store.List()
+	if err != nil {
+		return fmt.Errorf("failed to list keys: %w", err)
+	}
+	if len(keys) == 0 {
+		fmt.Println("No API keys issued. Create one with 'keys create <email>'.")
+		return nil
+	}
+
+	now := time.Now()
+	fmt.Printf("%-16s %-8s %-30s %-10s %-20s %s\n", "ID", "KEY", "EMAIL", "STATUS", "EXPIRES", "SCOPES")
+	for _, key := range keys {
+		expires := "never"
+		if key.ExpiresAt > 0 {
+			expires = time.Unix(key.ExpiresAt, 0).Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-16s %-8s %-30s %-10s %-20s %s\n",
+			key.ID, "..."+key.Hint, key.Email, key.Status(now), expires, formatScopes(key.Scopes))
+	}
+	return nil
+}
+
+func formatScopes(scopes APIKeyScopes) string {
+	endpoints, models := "*", "*"
+	if len(scopes.Endpoints) > 0 {
+		endpoints = strings.Join(scopes.Endpoints, ",")
+	}
+	if len(scopes.Models) > 0 {
+		models = strings.Join(scopes.Models, ",")
+	}
+	return "endpoints=" + endpoints + " models=" + models
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func handleUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	email := fs.String("email", "", "only include requests by this email")
+	model := fs.String("model", "", "only include requests for this model")
+	since := fs.String("since", "", "start time: RFC 3339, YYYY-MM-DD or a duration ago, e.g. 24h")
+	until := fs.String("until", "", "end time: RFC 3339, YYYY-MM-DD or a duration ago")
+	groupBy := fs.String("group-by", "email,model", "comma-separated grouping: email, model, endpoint, day")
+	jsonOutput := fs.Bool("json", false, "print the summary as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+
+	now := time.Now()
+	filter := UsageFilter{Email: *email, Model: *model}
+	if filter.Since, err = parseUsageTime(*since, now); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if filter.Until, err = parseUsageTime(*until, now); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+
+	records, err := NewUsageLedger(DefaultUsageLedgerPath(cfg)).Records(filter)
+	if err != nil {
+		return fmt.Errorf("failed to read usage ledger: %w", err)
+	}
+	fields := splitList(*groupBy)
+	summaries, err := SummarizeUsage(records, fields)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		data, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	if len(summaries) == 0 {
+		fmt.Println("No usage recorded for the selected period.")
+		return nil
+	}
+
+	header := make([]string, 0, len(fields))
+	for _, field := range fields {
+		header = append(header, strings.ToUpper(field))
+	}
+	fmt.Printf("%-40s %9s %12s %12s %12s %12s\n", strings.Join(header, " / "), "REQUESTS", "PROMPT", "COMPLETION", "CACHED", "TOTAL")
+	var total UsageSummary
+	for _, summary := range summaries {
+		fmt.Printf("%-40s %9d %12d %12d %12d %12d\n", usageGroupLabel(summary, fields),
+			summary.Requests, summary.PromptTokens, summary.CompletionTokens, summary.CachedTokens, summary.TotalTokens)
+		total.Requests += summary.Requests
+		total.add(summary.TokenUsage)
+	}
+	fmt.Printf("%-40s %9d %12d %12d %12d %12d\n", "TOTAL",
+		total.Requests, total.PromptTokens, total.CompletionTokens, total.CachedTokens, total.TotalTokens)
+	return nil
+}
+
+func usageGroupLabel(summary UsageSummary, fields []string) string {
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		switch field {
+		case UsageGroupEmail:
+			parts = append(parts, summary.Email)
+		case UsageGroupModel:
+			parts = append(parts, summary.Model)
+		case UsageGroupEndpoint:
+			parts = append(parts, summary.Endpoint)
+		case UsageGroupDay:
+			parts = append(parts, summary.Day)
+		}
+	}
+	return strings.Join(parts, " / ")
+}
+
+func handleMock(args []string) error {
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	port := fs.Int("port", 9090, "port to listen on")
+	reply := fs.String("reply", "", "canned reply for every completion (default: echo the last user message)")
+	latency := fs.Duration("latency", 0, "delay before every response")
+	chunkDelay := fs.Duration("chunk-delay", 0, "delay between streamed chunks")
+	errorStatus := fs.Int("error-status", http.StatusServiceUnavailable, "status of injected errors")
+	errorEvery := fs.Int("error-every", 0, "fail every nth completion request (0 disables)")
+	pendingPolls := fs.Int("pending-polls", 0, "authorization_pending answers before a device code is authorized")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	mock := NewMockUpstream(
+		WithMockReply(*reply),
+		WithMockLatency(*latency, *chunkDelay),
+		WithMockErrors(*errorStatus, *errorEvery),
+		WithMockPendingPolls(*pendingPolls))
+	base := fmt.Sprintf("http://127.0.0.1:%d", *port)
+	fmt.Printf("Mock Copilot upstream listening on %s\n", base)
+	fmt.Println("Point the proxy at it with this config section:")
+	fmt.Printf(`  "upstream": {
+    "copilot_api": %[1]q,
+    "device_code_url": "%[2]s/login/device/code",
+    "access_token_url": "%[2]s/login/oauth/access_token",
+    "copilot_token_url": "%[2]s/copilot_internal/v2/token"
+  }
+`, base, base)
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", *port),
+		Handler:           mock.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return srv.ListenAndServe()
+}
+
+func handleRotateKey(args []string) error {
+	fs := flag.NewFlagSet(cmdRotate, flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "file to write the generated key to (default: the configured key file)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(true)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return err
+	}
+
+	result, err := RotateTokenEncryption(cfg, configPath, *keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to rotate encryption key: %w", err)
+	}
+
+	if result.ConfigUpdated {
+		fmt.Printf("Re-encrypted tokens in %s\n", configPath)
+	}
+	fmt.Printf("Re-encrypted %d token file(s)\n", result.TokenFiles)
+	if result.KeyFile != "" {
+		fmt.Printf("New encryption key written to %s\n", result.KeyFile)
+		if *keyFile != "" && *keyFile != encryptionKeyFile(cfg) {
+			fmt.Printf("Point encryption.key_file or %s at it before restarting the proxy.\n", EncryptionKeyFileEnv)
+			return nil
+		}
+		fmt.Println("Send SIGHUP to a running proxy (or restart it) so it loads the new key.")
+		return nil
+	}
+	fmt.Printf("Set %s or %s to the new value before restarting the proxy.\n", EncryptionKeyEnv, EncryptionPassphraseEnv)
+	return nil
+}
@@ -57,6 +57,25 @@ type Config struct {
 	RefreshIn     int64    `json:"refresh_in"`
 	AllowedModels []string `json:"allowed_models"`
 
+	// Copilot API base issued with the token (endpoints.api); set per user
+	CopilotAPIEndpoint string `json:"copilot_api_endpoint,omitempty"`
+	// Copilot seat type issued with the token (sku); set per user
+	CopilotSKU string `json:"copilot_sku,omitempty"`
+
+	// Client-facing model names mapped to Copilot model IDs
+	ModelAliases []ModelAlias `json:"model_aliases"`
+
+	// Copilot model ID -> models tried in order when it is unavailable
+	ModelFallbacks map[string][]string `json:"model_fallbacks"`
+
+	// Copilot model ID or glob -> upstream API ("chat" or "responses")
+	ModelAPIs map[string]string `json:"model_apis"`
+
+	// Model catalog served by /v1/models
+	ModelCatalog struct {
+		TTL int `json:"ttl"` // Default: 900s; how long a seat type's model list is cached
+	} `json:"model_catalog"`
+
 	// HTTP Headers configuration
 	Headers struct {
 		UserAgent            string `json:"user_agent"`             // Default: "GitHubCopilotChat/0.29.1"
@@ -86,6 +105,91 @@ type Config struct {
 		DialTimeout     int `json:"dial_timeout"`      // Default: 10s for connection dialing
 		IdleConnTimeout int `json:"idle_conn_timeout"` // Default: 90s for idle connection timeout
 	} `json:"timeouts"`
+
+	// Upstream circuit breakers, one per upstream host and model and one per user
+	CircuitBreakers struct {
+		FailureThreshold int `json:"failure_threshold"` // Default: 5 failures within the window open a breaker
+		Window           int `json:"window"`            // Default: 60s; older failures are forgotten
+		HalfOpenProbes   int `json:"half_open_probes"`  // Default: 1 request let through while half-open
+	} `json:"circuit_breakers"`
+
+	// Per-user token storage backend
+	TokenStore struct {
+		Type string `json:"type"` // Default: "http" (one of "http", "file", "memory")
+		URL  string `json:"url"`  // Default: copilot-auth-status API derived from AUTOREVIEW_UI_HOST
+		Dir  string `json:"dir"`  // Default: "tokens" next to config.json
+	} `json:"token_store"`
+
+	// Proxy-issued client API keys
+	APIKeys struct {
+		File            string `json:"file"`              // Default: "api_keys.json" next to config.json
+		AllowEmailParam bool   `json:"allow_email_param"` // Default: false; ?email= is rejected unless set
+	} `json:"api_keys"`
+
+	// Per-user and per-key rate limits and quotas
+	RateLimits struct {
+		Default   RateLimitPolicy            `json:"default"`    // Default: unlimited
+		Groups    map[string]RateLimitPolicy `json:"groups"`     // Named policies
+		Users     map[string]string          `json:"users"`      // Email or API key ID -> group name
+		StateFile string                     `json:"state_file"` // Default: "ratelimit_state.json" next to config.json
+	} `json:"rate_limits"`
+
+	// Token usage ledger
+	Usage struct {
+		File string `json:"file"` // Default: "usage.jsonl" next to config.json
+	} `json:"usage"`
+
+	// Upstream URL overrides, e.g. to point the service at a local stub server
+	Upstream struct {
+		CopilotAPI      string `json:"copilot_api"`       // Default: the token's endpoints.api, else "https://api.githubcopilot.com"
+		DeviceCodeURL   string `json:"device_code_url"`   // Default: "https://github.com/login/device/code"
+		AccessTokenURL  string `json:"access_token_url"`  // Default: "https://github.com/login/oauth/access_token"
+		CopilotTokenURL string `json:"copilot_token_url"` // Default: "https://api.github.com/copilot_internal/v2/token"
+		ModelsDevURL    string `json:"models_dev_url"`    // Default: "https://models.dev/api.json"
+	} `json:"upstream"`
+
+	// Upstream record/replay for reproducing proxy bugs
+	VCR struct {
+		Mode         string `json:"mode"`          // Default: "" (off); "record" or "replay"
+		Cassette     string `json:"cassette"`      // Cassette file written or read
+		IgnoreTiming bool   `json:"ignore_timing"` // Default: false; replay chunks without their recorded delays
+	} `json:"vcr"`
+
+	// Log output
+	Logging struct {
+		Level      string            `json:"level"`      // Default: "info"; LOG_LEVEL takes precedence
+		Format     string            `json:"format"`     // Default: "dense"; "json" or "logfmt"; LOG_FORMAT takes precedence
+		Output     string            `json:"output"`     // Default: "stdout"; or "stderr"
+		Components map[string]string `json:"components"` // Component name -> level, e.g. {"auth": "debug"}
+	} `json:"logging"`
+
+	// Distributed tracing
+	Tracing struct {
+		Exporter    string `json:"exporter"`     // Default: "" (off); "otlp" or "file"
+		Endpoint    string `json:"endpoint"`     // Default: "http://localhost:4318/v1/traces" (OTLP/HTTP collector)
+		File        string `json:"file"`         // Default: "traces.jsonl" next to config.json
+		ServiceName string `json:"service_name"` // Default: "github-copilot-svcs"
+	} `json:"tracing"`
+
+	// Prompt/completion audit log
+	Audit struct {
+		Enabled        bool             `json:"enabled"`          // Default: false
+		Dir            string           `json:"dir"`              // Default: "audit" next to config.json
+		RotateSizeMB   int              `json:"rotate_size_mb"`   // Default: 100 MB before the active file is rotated
+		RotateAgeHours int              `json:"rotate_age_hours"` // Default: 24h before the active file is rotated
+		RetentionDays  int              `json:"retention_days"`   // Default: 30 days; -1 keeps rotated files forever
+		Redact         []AuditRedaction `json:"redact"`           // Per-field redaction rules applied before writing
+	} `json:"audit"`
+
+	// At-rest encryption of stored tokens
+	Encryption struct {
+		KeyFile string `json:"key_file"` // Default: "" (COPILOT_ENCRYPTION_KEY_FILE takes precedence)
+	} `json:"encryption"`
+
+	// Admin endpoints (/admin/*)
+	Admin struct {
+		Token string `json:"token"` // Default: "" (admin endpoints only accept loopback clients)
+	} `json:"admin"`
 }
 
 // GetConfigPath returns the path to the config file
@@ -108,6 +212,30 @@ func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
 		return nil, err
 	}
 
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate configuration
+	skip := len(skipTokenValidation) > 0 && skipTokenValidation[0]
+	if skip {
+		if err := cfg.validateCore(); err != nil {
+			return nil, fmt.Errorf("configuration validation failed: %w", err)
+		}
+	} else {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("configuration validation failed: %w", err)
+		}
+	}
+
+	ConfigureLogging(cfg)
+	return cfg, nil
+}
+
+// readConfigFile builds a configuration from the defaults, the file at path
+// (when it exists) and environment variables, without validating it.
+func readConfigFile(path string) (*Config, error) {
 	Debug("Loading config", "path", path)
 
 	// Start with default config
@@ -140,6 +268,21 @@ func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
 		Debug("Config file not found, using defaults", "path", path)
 	}
 
+	// Decrypt stored tokens, encrypting plaintext ones once a key is configured
+	if cfg.GitHubToken != "" || cfg.CopilotToken != "" {
+		tokenCipher, err := LoadTokenCipher(cfg)
+		if err != nil {
+			return nil, err
+		}
+		stale, err := decryptConfigTokens(cfg, tokenCipher)
+		if err != nil {
+			return nil, err
+		}
+		if stale && tokenCipher != nil {
+			migrateConfigTokens(path, tokenCipher)
+		}
+	}
+
 	// Override with environment variables if present
 	if port := os.Getenv("COPILOT_PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil {
@@ -158,18 +301,6 @@ func LoadConfig(skipTokenValidation ...bool) (*Config, error) {
 		cfg.Port = defaultServerPort
 	}
 
-	// Validate configuration
-	skip := len(skipTokenValidation) > 0 && skipTokenValidation[0]
-	if skip {
-		if err := cfg.validateCore(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-	} else {
-		if err := cfg.Validate(); err != nil {
-			return nil, fmt.Errorf("configuration validation failed: %w", err)
-		}
-	}
-
 	return cfg, nil
 }
 
@@ -256,6 +387,42 @@ func (c *Config) Validate() error {
 	if err := c.validateCORS(); err != nil {
 		return err
 	}
+	if err := c.validateTokenStore(); err != nil {
+		return err
+	}
+	if err := c.validateRateLimits(); err != nil {
+		return err
+	}
+	if err := c.validateUpstream(); err != nil {
+		return err
+	}
+	if err := c.validateModelAliases(); err != nil {
+		return err
+	}
+	if err := c.validateModelFallbacks(); err != nil {
+		return err
+	}
+	if err := c.validateModelAPIs(); err != nil {
+		return err
+	}
+	if err := c.validateCircuitBreakers(); err != nil {
+		return err
+	}
+	if err := c.validateModelCatalog(); err != nil {
+		return err
+	}
+	if err := c.validateVCR(); err != nil {
+		return err
+	}
+	if err := c.validateLogging(); err != nil {
+		return err
+	}
+	if err := c.validateTracing(); err != nil {
+		return err
+	}
+	if err := c.validateAudit(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -428,7 +595,20 @@ func (c *Config) validateCORS() error {
 	return nil
 }
 
-// SaveConfig saves the configuration to file
+func (c *Config) validateTokenStore() error {
+	switch c.TokenStore.Type {
+	case "", TokenStoreHTTP, TokenStoreFile, TokenStoreMemory:
+	default:
+		return NewValidationError("token_store.type", c.TokenStore.Type, "must be one of http, file, memory", nil)
+	}
+	if c.TokenStore.URL != "" && !strings.HasPrefix(c.TokenStore.URL, "http://") && !strings.HasPrefix(c.TokenStore.URL, "https://") {
+		return NewValidationError("token_store.url", c.TokenStore.URL, "must be an http or https URL", nil)
+	}
+	return nil
+}
+
+// SaveConfig atomically saves the configuration to file with owner-only
+// permissions, encrypting the tokens when an encryption key is configured.
 func (c *Config) SaveConfig(pathOverride ...string) error {
 	var path string
 	var err error
@@ -440,16 +620,26 @@ func (c *Config) SaveConfig(pathOverride ...string) error {
 			return err
 		}
 	}
-	f, err := os.Create(path)
+
+	// Encrypt the tokens when a key is configured, without touching c
+	stored := *c
+	tokenCipher, err := LoadTokenCipher(c)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			Error("Failed to close config file", "error", closeErr)
+	if tokenCipher != nil {
+		if stored.GitHubToken, err = tokenCipher.Encrypt(c.GitHubToken, configGitHubTokenContext); err != nil {
+			return err
+		}
+		if stored.CopilotToken, err = tokenCipher.Encrypt(c.CopilotToken, configCopilotTokenContext); err != nil {
+			return err
 		}
-	}()
-	return json.NewEncoder(f).Encode(c)
+	}
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), tokenFilePerm)
 }
 
 // UnmarshalConfig is a helper for direct config JSON parsing in tests
@@ -474,5 +664,41 @@ func (c *Config) validateCore() error {
 	if err := c.validateCORS(); err != nil {
 		return err
 	}
+	if err := c.validateTokenStore(); err != nil {
+		return err
+	}
+	if err := c.validateRateLimits(); err != nil {
+		return err
+	}
+	if err := c.validateUpstream(); err != nil {
+		return err
+	}
+	if err := c.validateModelAliases(); err != nil {
+		return err
+	}
+	if err := c.validateModelFallbacks(); err != nil {
+		return err
+	}
+	if err := c.validateModelAPIs(); err != nil {
+		return err
+	}
+	if err := c.validateCircuitBreakers(); err != nil {
+		return err
+	}
+	if err := c.validateModelCatalog(); err != nil {
+		return err
+	}
+	if err := c.validateVCR(); err != nil {
+		return err
+	}
+	if err := c.validateLogging(); err != nil {
+		return err
+	}
+	if err := c.validateTracing(); err != nil {
+		return err
+	}
+	if err := c.validateAudit(); err != nil {
+		return err
+	}
 	return nil
 }
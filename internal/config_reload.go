@@ -0,0 +1,245 @@
+// Package internal provides hot configuration reloading for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultConfigWatchInterval is how often the config file is checked for changes.
+const defaultConfigWatchInterval = 2 * time.Second
+
+// restartOnlyConfigFields are settings read once at startup; changing them in
+// a reload is logged but has no effect until the next restart.
+var restartOnlyConfigFields = []string{
+	"port",
+	"timeouts.http_client",
+	"timeouts.server_read",
+	"timeouts.server_write",
+	"timeouts.server_idle",
+	"timeouts.circuit_breaker",
+	"timeouts.keep_alive",
+	"timeouts.tls_handshake",
+	"timeouts.dial_timeout",
+	"timeouts.idle_conn_timeout",
+	"token_store",
+	"api_keys.file",
+	"vcr",
+	"rate_limits.state_file",
+	"usage.file",
+	"tracing",
+	"audit",
+	"encryption",
+}
+
+// ConfigStore holds the active configuration as an immutable snapshot that is
+// swapped atomically on reload. Readers call Load for every request, so
+// in-flight requests finish with the snapshot they started with.
+type ConfigStore struct {
+	current atomic.Pointer[Config]
+	path    string
+
+	mutex   sync.Mutex // serialises reloads
+	modTime time.Time
+	size    int64
+}
+
+// NewConfigStore returns a store serving cfg, reloadable from path. An empty
+// path disables reloading.
+func NewConfigStore(cfg *Config, path string) *ConfigStore {
+	s := &ConfigStore{path: path}
+	s.current.Store(cfg)
+	if path != "" {
+		if info, err := os.Stat(path); err == nil {
+			s.modTime, s.size = info.ModTime(), info.Size()
+		}
+	}
+	return s
+}
+
+// Load returns the current configuration snapshot. It must not be modified.
+func (s *ConfigStore) Load() *Config {
+	return s.current.Load()
+}
+
+// Reload reads and validates the config file and swaps it in. On any error
+// the current configuration stays active.
+func (s *ConfigStore) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.path == "" {
+		return NewValidationError("config_path", "", "configuration reload is not available without a config file", nil)
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		metrics.ConfigReloads.Inc("failure")
+		return fmt.Errorf("config file not readable: %w", err)
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+
+	next, err := readConfigFile(s.path)
+	if err == nil {
+		err = validateReloadedConfig(next)
+	}
+	if err != nil {
+		metrics.ConfigReloads.Inc("failure")
+		Error("Configuration reload rejected, keeping current configuration", "path", s.path, "error", err)
+		return err
+	}
+
+	previous := s.current.Swap(next)
+	metrics.ConfigReloads.Inc("success")
+	ConfigureLogging(next)
+
+	changes := diffConfig(previous, next)
+	if len(changes) == 0 {
+		Info("Configuration reloaded, no changes", "path", s.path)
+		return nil
+	}
+	for _, change := range changes {
+		Info("Configuration changed", "field", change.Field, "old", change.Old, "new", change.New)
+		if change.restartOnly() {
+			Warn("Configuration change takes effect after a restart", "field", change.Field)
+		}
+	}
+	Info("Configuration reloaded", "path", s.path, "changes", len(changes))
+	return nil
+}
+
+// Watch reloads the configuration whenever the file's modification time or
+// size changes, polling every interval until ctx is done.
+func (s *ConfigStore) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.changed() {
+				Info("Config file changed, reloading", "path", s.path)
+				_ = s.Reload()
+			}
+		}
+	}
+}
+
+func (s *ConfigStore) changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// validateReloadedConfig applies Config.Validate. Missing global tokens are
+// accepted because the server serves per-user tokens from the token store.
+func validateReloadedConfig(cfg *Config) error {
+	err := cfg.Validate()
+	if errors.Is(err, ErrMissingTokens) {
+		err = cfg.validateCore()
+	}
+	if err != nil {
+		return fmt.Errorf("configuration validation failed: %w", err)
+	}
+	return nil
+}
+
+// ConfigChange is one setting that differs between two configurations.
+type ConfigChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c ConfigChange) restartOnly() bool {
+	return slices.ContainsFunc(restartOnlyConfigFields, func(field string) bool {
+		return c.Field == field || strings.HasPrefix(c.Field, field+".")
+	})
+}
+
+// diffConfig lists the settings that differ between old and new, keyed by
+// their dotted JSON path. Secret values are redacted.
+func diffConfig(old, new *Config) []ConfigChange {
+	before, after := flattenConfig(old), flattenConfig(new)
+	fields := make(map[string]struct{}, len(before)+len(after))
+	for field := range before {
+		fields[field] = struct{}{}
+	}
+	for field := range after {
+		fields[field] = struct{}{}
+	}
+
+	var changes []ConfigChange
+	for field := range fields {
+		if before[field] == after[field] {
+			continue
+		}
+		change := ConfigChange{Field: field, Old: before[field], New: after[field]}
+		if isSecretConfigField(field) {
+			change.Old, change.New = redactConfigValue(change.Old), redactConfigValue(change.New)
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func flattenConfig(cfg *Config) map[string]string {
+	out := map[string]string{}
+	if cfg == nil {
+		return out
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return out
+	}
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return out
+	}
+	flattenConfigValue("", tree, out)
+	return out
+}
+
+func flattenConfigValue(prefix string, value any, out map[string]string) {
+	if object, ok := value.(map[string]any); ok && len(object) > 0 {
+		for key, child := range object {
+			field := key
+			if prefix != "" {
+				field = prefix + "." + key
+			}
+			flattenConfigValue(field, child, out)
+		}
+		return
+	}
+	encoded, _ := json.Marshal(value)
+	out[prefix] = string(encoded)
+}
+
+func isSecretConfigField(field string) bool {
+	last := field[strings.LastIndex(field, ".")+1:]
+	return strings.Contains(last, "token")
+}
+
+func redactConfigValue(value string) string {
+	if value == "" || value == `""` || value == "null" {
+		return value
+	}
+	return `"[redacted]"`
+}
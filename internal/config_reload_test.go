@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func TestConfigStore_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, `{"port": 8081, "allowed_models": ["gpt-4o"]}`)
+	initial, err := readConfigFile(path)
+	if err != nil {
+		t.Fatalf("readConfigFile failed: %v", err)
+	}
+	store := NewConfigStore(initial, path)
+
+	writeTestConfig(t, path, `{"port": 8081, "allowed_models": ["gpt-4o", "claude-sonnet-4"], "cors": {"allowed_origins": ["https://app.example.com"]}}`)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	cfg := store.Load()
+	if len(cfg.AllowedModels) != 2 || cfg.CORS.AllowedOrigins[0] != "https://app.example.com" {
+		t.Errorf("reloaded config not applied: %+v", cfg)
+	}
+	if initial.AllowedModels[0] != "gpt-4o" || len(initial.AllowedModels) != 1 {
+		t.Error("previous snapshot must not be modified")
+	}
+
+	writeTestConfig(t, path, `{"port": 99999}`)
+	if err := store.Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if store.Load() != cfg {
+		t.Error("expected the previous config to stay active after a rejected reload")
+	}
+}
+
+func TestConfigStore_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, `{"allowed_models": ["gpt-4o"]}`)
+	initial, _ := readConfigFile(path)
+	store := NewConfigStore(initial, path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, 10*time.Millisecond)
+
+	writeTestConfig(t, path, `{"allowed_models": ["gpt-4o", "o3-mini"]}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(store.Load().AllowedModels) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("config change was not picked up by the watcher")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := &Config{Port: 8081}
+	old.Admin.Token = "old-secret"
+	updated := &Config{Port: 9090, AllowedModels: []string{"gpt-4o"}}
+	updated.Admin.Token = "new-secret"
+	updated.Headers.UserAgent = "test-agent"
+
+	changes := map[string]ConfigChange{}
+	for _, change := range diffConfig(old, updated) {
+		changes[change.Field] = change
+	}
+
+	if c := changes["port"]; c.Old != "8081" || c.New != "9090" || !c.restartOnly() {
+		t.Errorf("unexpected port change %+v", c)
+	}
+	if c := changes["headers.user_agent"]; c.New != `"test-agent"` || c.restartOnly() {
+		t.Errorf("unexpected user agent change %+v", c)
+	}
+	if c := changes["admin.token"]; c.Old != `"[redacted]"` || c.New != `"[redacted]"` {
+		t.Errorf("expected admin token to be redacted, got %+v", c)
+	}
+	if _, ok := changes["allowed_models"]; !ok {
+		t.Error("expected allowed_models change")
+	}
+	if _, ok := changes["timeouts.http_client"]; ok {
+		t.Error("unchanged fields must not be reported")
+	}
+}
+
+func TestReloadableCORSMiddleware(t *testing.T) {
+	cfg := &Config{}
+	cfg.CORS.AllowedOrigins = []string{"https://old.example.com"}
+	store := NewConfigStore(cfg, "")
+	handler := ReloadableCORSMiddleware(store)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.Header.Set("Origin", "https://new.example.com")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	if got := request(); got != "" {
+		t.Errorf("expected origin to be rejected, got %q", got)
+	}
+	next := &Config{}
+	next.CORS.AllowedOrigins = []string{"https://new.example.com"}
+	store.current.Store(next)
+	if got := request(); got != "https://new.example.com" {
+		t.Errorf("expected reloaded origin to be allowed, got %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+// Package internal provides the embeddings endpoint for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// embeddingsLog tags records about embeddings requests.
+var embeddingsLog = Component("embeddings")
+
+// maxEmbeddingInputsPerRequest is the most inputs sent to Copilot in one
+// embeddings call; larger arrays are split into sequential batches.
+const maxEmbeddingInputsPerRequest = 512
+
+// EmbeddingsHandler returns an HTTP handler for the /v1/embeddings endpoint.
+func (s *ProxyService) EmbeddingsHandler() http.HandlerFunc {
+	return s.handle(s.processEmbeddingsRequest, writePlainProxyError)
+}
+
+func (s *ProxyService) processEmbeddingsRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	embeddingsLog.DebugContext(ctx, "Starting embeddings request", "method", r.Method, "path", r.URL.Path)
+
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
+
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
+	}
+
+	var payload map[string]any
+	if jsonErr := json.Unmarshal(body, &payload); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	requestedModel, _ := payload["model"].(string)
+	model := s.config.Load().resolveModelAlias(requestedModel)
+	requestInfoFromContext(ctx).setCaller(identity, model)
+	if model == "" {
+		return fmt.Errorf("bad request: model is required")
+	}
+	payload["model"] = model
+	if err := identity.authorize(r.URL.Path, model); err != nil {
+		return err
+	}
+
+	inputs, err := embeddingInputs(payload["input"])
+	if err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+
+	merged := transform.EmbeddingsResponse{Object: "list", Model: requestedModel, Data: make([]transform.Embedding, 0, len(inputs))}
+	var cfg *Config
+	for offset := 0; offset < len(inputs); offset += maxEmbeddingInputsPerRequest {
+		batch := inputs[offset:min(offset+maxEmbeddingInputsPerRequest, len(inputs))]
+		batchPayload := maps.Clone(payload)
+		batchPayload["input"] = batch
+
+		resp, batchCfg, err := s.forwardRequest(ctx, http.MethodPost, identity.Email, "/embeddings", batchPayload, nil)
+		if err != nil {
+			return err
+		}
+		cfg = batchCfg
+
+		if resp.StatusCode >= statusClientError {
+			// Pass the failing batch's error through unchanged; earlier
+			// batches are discarded since the response cannot be partial.
+			defer func() { _ = resp.Body.Close() }()
+			if offset > 0 {
+				embeddingsLog.WarnContext(ctx, "Embeddings batch failed after earlier batches succeeded", "offset", offset, "status", resp.StatusCode)
+			}
+			for key, values := range resp.Header {
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
+			setCORSHeaders(w, cfg)
+			w.WriteHeader(resp.StatusCode)
+			_, err := io.Copy(w, resp.Body)
+			return err
+		}
+
+		var result transform.EmbeddingsResponse
+		decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if decodeErr != nil {
+			return NewProxyError("decode_response", "failed to decode embeddings response", decodeErr)
+		}
+		if len(result.Data) != len(batch) {
+			return NewProxyError("decode_response",
+				fmt.Sprintf("embeddings response has %d vectors for %d inputs", len(result.Data), len(batch)), nil)
+		}
+
+		for _, item := range result.Data {
+			item.Index += offset
+			merged.Data = append(merged.Data, item)
+		}
+		if result.Model != "" && requestedModel == model {
+			merged.Model = result.Model
+		}
+		merged.Usage.PromptTokens += result.Usage.PromptTokens
+		merged.Usage.TotalTokens += result.Usage.TotalTokens
+	}
+
+	setCORSHeaders(w, cfg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(merged); err != nil {
+		return err
+	}
+
+	s.appendUsage(r.URL.Path, model, identity, TokenUsage{
+		PromptTokens: merged.Usage.PromptTokens,
+		TotalTokens:  merged.Usage.TotalTokens,
+	}, true, false)
+	return nil
+}
+
+// embeddingInputs normalises the input field into a list of single inputs.
+// A string or a token array is one input; an array of strings or of token
+// arrays is one input per element.
+func embeddingInputs(input any) ([]any, error) {
+	switch value := input.(type) {
+	case string:
+		return []any{value}, nil
+	case []any:
+		if len(value) == 0 {
+			return nil, fmt.Errorf("input must not be empty")
+		}
+		if isTokenArray(value) {
+			return []any{value}, nil
+		}
+		for i, item := range value {
+			switch typed := item.(type) {
+			case string:
+			case []any:
+				if len(typed) == 0 || !isTokenArray(typed) {
+					return nil, fmt.Errorf("input[%d] must be a string or an array of token ids", i)
+				}
+			default:
+				return nil, fmt.Errorf("input[%d] must be a string or an array of token ids", i)
+			}
+		}
+		return value, nil
+	case nil:
+		return nil, fmt.Errorf("input is required")
+	default:
+		return nil, fmt.Errorf("input must be a string, an array of strings or an array of token ids")
+	}
+}
+
+// isTokenArray reports whether every element is an integral JSON number.
+func isTokenArray(values []any) bool {
+	for _, v := range values {
+		number, ok := v.(float64)
+		if !ok || number != float64(int64(number)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// redirectTransport sends every request to target, keeping the original path.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newUpstreamTestService returns a proxy whose Copilot requests go to handler,
+// with a valid token for user@example.com.
+func newUpstreamTestService(t *testing.T, handler http.HandlerFunc) *ProxyService {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+	client := &http.Client{Transport: redirectTransport{target: target}}
+
+	store := NewMemoryTokenStore()
+	if err := store.Put(context.Background(), &StoredToken{
+		Email:        "user@example.com",
+		GitHubToken:  "gh",
+		CopilotToken: "copilot-test-token",
+		ExpiresAt:    time.Now().Add(time.Hour).Unix(),
+	}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	cfg.APIKeys.AllowEmailParam = true
+	wp := NewWorkerPool(2)
+	t.Cleanup(wp.Stop)
+	return NewProxyService(cfg, client, NewAuthService(client, WithTokenStore(store)), wp)
+}
+
+func TestEmbeddingInputs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		count int
+		ok    bool
+	}{
+		{"string", `"hello"`, 1, true},
+		{"strings", `["a", "b", "c"]`, 3, true},
+		{"token array", `[1, 2, 3]`, 1, true},
+		{"token arrays", `[[1, 2], [3]]`, 2, true},
+		{"empty", `[]`, 0, false},
+		{"mixed", `["a", 1]`, 0, false},
+		{"object", `{"text": "a"}`, 0, false},
+		{"missing", `null`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input any
+			_ = json.Unmarshal([]byte(tt.input), &input)
+			got, err := embeddingInputs(input)
+			if (err == nil) != tt.ok || len(got) != tt.count {
+				t.Errorf("embeddingInputs(%s) = %d inputs, %v; want %d inputs, ok=%v", tt.input, len(got), err, tt.count, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEmbeddingsHandler_BatchesAndMerges(t *testing.T) {
+	var calls atomic.Int32
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/embeddings" {
+			t.Errorf("unexpected upstream path %s", r.URL.Path)
+		}
+		var req struct {
+			Input []any `json:"input"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		resp := transform.EmbeddingsResponse{Object: "list", Model: "text-embedding-3-small"}
+		for i := range req.Input {
+			resp.Data = append(resp.Data, transform.Embedding{Object: "embedding", Index: i, Embedding: json.RawMessage(`[0.5]`)})
+		}
+		resp.Usage = transform.EmbeddingsUsage{PromptTokens: len(req.Input), TotalTokens: len(req.Input)}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	inputs := make([]string, maxEmbeddingInputsPerRequest+3)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("text %d", i)
+	}
+	body, _ := json.Marshal(map[string]any{"model": "text-embedding-3-small", "input": inputs})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings?email=user@example.com", strings.NewReader(string(body)))
+	s.EmbeddingsHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 upstream batches, got %d", calls.Load())
+	}
+
+	var resp transform.EmbeddingsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Data) != len(inputs) {
+		t.Fatalf("expected %d embeddings, got %d", len(inputs), len(resp.Data))
+	}
+	for i, item := range resp.Data {
+		if item.Index != i {
+			t.Fatalf("embedding %d has index %d", i, item.Index)
+		}
+	}
+	if resp.Usage.PromptTokens != len(inputs) || resp.Usage.TotalTokens != len(inputs) {
+		t.Errorf("expected aggregated usage %d, got %+v", len(inputs), resp.Usage)
+	}
+}
+
+func TestEmbeddingsHandler_UpstreamError(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"message":"model not supported"}}`))
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","input":"hi"}`))
+	s.EmbeddingsHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "model not supported") {
+		t.Errorf("expected upstream error to pass through, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -2,6 +2,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 )
@@ -140,6 +141,20 @@ func WriteHTTPErrorWithDetails(w http.ResponseWriter, statusCode int, errorType,
 		message, errorType, statusCode, details)
 }
 
+// WriteOpenAIError writes an error body in the OpenAI API format, with a string error code.
+func WriteOpenAIError(w http.ResponseWriter, statusCode int, errorType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+}
+
 // WriteAuthenticationError ...
 func WriteAuthenticationError(w http.ResponseWriter) {
 	WriteHTTPError(w, http.StatusUnauthorized, "Authentication required")
@@ -0,0 +1,152 @@
+// Package internal provides model fallback chains for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// servedModelHeader reports the Copilot model that actually served a request.
+const servedModelHeader = "X-Served-Model"
+
+// maxFallbackPeekBytes bounds how much of an error body is read to decide
+// whether it reports an unsupported model.
+const maxFallbackPeekBytes = 64 * 1024
+
+// modelFallbackChain returns model followed by its configured fallbacks.
+// Fallbacks excluded by allowed_models and repeated entries are skipped.
+func (c *Config) modelFallbackChain(model string) []string {
+	chain := []string{model}
+	for _, candidate := range c.ModelFallbacks[model] {
+		if slices.Contains(chain, candidate) {
+			continue
+		}
+		if len(c.AllowedModels) > 0 && !slices.Contains(c.AllowedModels, candidate) {
+			Warn("Skipping fallback model not in allowed_models", "model", model, "fallback", candidate)
+			continue
+		}
+		chain = append(chain, candidate)
+	}
+	return chain
+}
+
+func (c *Config) validateModelFallbacks() error {
+	for model, chain := range c.ModelFallbacks {
+		field := "model_fallbacks." + model
+		if model == "" {
+			return NewValidationError("model_fallbacks", "", "model name cannot be empty", nil)
+		}
+		for _, candidate := range chain {
+			if candidate == "" {
+				return NewValidationError(field, "", "fallback model cannot be empty", nil)
+			}
+			if candidate == model {
+				return NewValidationError(field, candidate, "a model cannot fall back to itself", nil)
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamRoute is the upstream request for one model of a fallback chain.
+type upstreamRoute struct {
+	model     string
+	path      string
+	payload   map[string]any
+	body      []byte // sent verbatim when non-nil, otherwise payload is encoded
+	translate bool   // payload was translated from the client's API
+}
+
+// routeFunc builds the upstream request for model.
+type routeFunc func(model string) (*upstreamRoute, error)
+
+// fixedRoute sends payload to path for every model, replacing only its model.
+// body is sent verbatim for the model payload was built for.
+func fixedRoute(path string, payload map[string]any, body []byte) routeFunc {
+	primary, _ := payload["model"].(string)
+	return func(model string) (*upstreamRoute, error) {
+		route := &upstreamRoute{model: model, path: path, payload: payload, body: body}
+		if model != primary {
+			route.payload = maps.Clone(payload)
+			route.payload["model"] = model
+			route.body = nil
+		}
+		return route, nil
+	}
+}
+
+// forwardWithFallback sends the request built by route for model like
+// forwardRequest. While the upstream reports the model unavailable it retries
+// with the next model of the model's fallback chain, before anything has been
+// written to the client. A model whose circuit breaker is open is skipped the
+// same way. Each model gets its own route, so a fallback configured for
+// another upstream API receives a payload of the right shape. It returns the
+// route that produced the response.
+func (s *ProxyService) forwardWithFallback(ctx context.Context, method, email, model string, route routeFunc) (*http.Response, *Config, *upstreamRoute, error) {
+	chain := s.config.Load().modelFallbackChain(model)
+
+	for i, candidate := range chain {
+		request, err := route(candidate)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		resp, cfg, err := s.forwardRequest(ctx, method, email, request.path, request.payload, request.body)
+		var openErr *CircuitOpenError
+		if errors.As(err, &openErr) && openErr.Key.Scope == CircuitScopeUpstream && i < len(chain)-1 {
+			WarnContext(ctx, "Model circuit breaker open, trying fallback", "model", candidate, "fallback", chain[i+1])
+			metrics.ModelFallbacks.Inc(candidate, chain[i+1])
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if i == len(chain)-1 || !isModelUnavailable(resp) {
+			if i > 0 {
+				InfoContext(ctx, "Request served by fallback model", "requested_model", model, "served_model", candidate, "status", resp.StatusCode)
+			}
+			return resp, cfg, request, nil
+		}
+
+		WarnContext(ctx, "Model unavailable, trying fallback", "model", candidate, "status", resp.StatusCode, "fallback", chain[i+1])
+		metrics.ModelFallbacks.Inc(candidate, chain[i+1])
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxFallbackPeekBytes))
+		_ = resp.Body.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, nil, ctxErr
+		}
+	}
+	return nil, nil, nil, errors.New("empty model fallback chain")
+}
+
+// isModelUnavailable reports whether resp shows that its model is overloaded,
+// failing or not supported. The body is left readable from the start.
+func isModelUnavailable(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= statusCodeServerError {
+		return true
+	}
+	if resp.StatusCode < statusClientError {
+		return false
+	}
+	peek, _ := io.ReadAll(io.LimitReader(resp.Body, maxFallbackPeekBytes))
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(peek), resp.Body), Closer: resp.Body}
+	message := strings.ToLower(string(peek))
+	return strings.Contains(message, "model_not_supported") ||
+		strings.Contains(message, "model not supported") ||
+		strings.Contains(message, "unsupported model")
+}
+
+// setServedModel reports the model that served the request to the client and
+// in the request's metrics and logs.
+func setServedModel(ctx context.Context, w http.ResponseWriter, email, model string) {
+	if model == "" {
+		return
+	}
+	w.Header().Set(servedModelHeader, model)
+	requestInfoFromContext(ctx).setServedModel(email, model)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestModelFallbackChain(t *testing.T) {
+	cfg := &Config{
+		AllowedModels:  []string{"claude-sonnet-4.5", "gpt-5", "gpt-4.1"},
+		ModelFallbacks: map[string][]string{"claude-sonnet-4.5": {"gpt-5", "o3", "gpt-5", "gpt-4.1"}},
+	}
+	got := cfg.modelFallbackChain("claude-sonnet-4.5")
+	want := []string{"claude-sonnet-4.5", "gpt-5", "gpt-4.1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("modelFallbackChain = %v, want %v", got, want)
+	}
+	if got := cfg.modelFallbackChain("gpt-4.1"); len(got) != 1 {
+		t.Errorf("expected no fallbacks for gpt-4.1, got %v", got)
+	}
+
+	cfg.ModelFallbacks["gpt-5"] = []string{"gpt-5"}
+	if err := cfg.validateModelFallbacks(); err == nil {
+		t.Error("expected self fallback to be rejected")
+	}
+}
+
+func TestIsModelUnavailable(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusOK, `{}`, false},
+		{http.StatusTooManyRequests, `{}`, true},
+		{http.StatusServiceUnavailable, `{}`, true},
+		{http.StatusBadRequest, `{"error":{"code":"model_not_supported","message":"The requested model is not supported"}}`, true},
+		{http.StatusBadRequest, `{"error":{"message":"messages must not be empty"}}`, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))}
+		if got := isModelUnavailable(resp); got != tt.want {
+			t.Errorf("isModelUnavailable(%d, %s) = %v, want %v", tt.status, tt.body, got, tt.want)
+		}
+		if rest, _ := io.ReadAll(resp.Body); string(rest) != tt.body {
+			t.Errorf("expected body to stay readable, got %q", rest)
+		}
+	}
+}
+
+func TestProcessProxyRequest_ModelFallback(t *testing.T) {
+	var mutex sync.Mutex
+	var tried []string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		model, _ := payload["model"].(string)
+		mutex.Lock()
+		tried = append(tried, model)
+		mutex.Unlock()
+
+		switch model {
+		case "claude-sonnet-4.5":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"error":{"code":"model_not_supported","message":"The requested model is not supported"}}`)
+		case "gpt-5":
+			w.Header().Set("retry-after-ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"id":"c1","model":"`+model+`","choices":[]}`)
+		}
+	})
+	s.config.Load().ModelFallbacks = map[string][]string{"claude-sonnet-4.5": {"gpt-5", "gpt-4.1"}}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"claude-sonnet-4.5","messages":[{"role":"user","content":"hi"}]}`))
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get(servedModelHeader); got != "gpt-4.1" {
+		t.Errorf("expected %s gpt-4.1, got %q", servedModelHeader, got)
+	}
+	if tried[0] != "claude-sonnet-4.5" || tried[len(tried)-1] != "gpt-4.1" {
+		t.Errorf("unexpected upstream attempts %v", tried)
+	}
+}
@@ -1,25 +1,85 @@
+// Package internal provides structured logging for github-copilot-svcs.
 package internal
 
 import (
+	"cmp"
 	"context"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
-	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// DenseTextHandler outputs only values, space-separated, in a fixed order.
+// Log formats selectable through logging.format or LOG_FORMAT.
+const (
+	LogFormatDense  = "dense"  // timestamp, level, quoted message and attribute values
+	LogFormatJSON   = "json"   // one JSON object per record
+	LogFormatLogfmt = "logfmt" // key=value pairs
+)
+
+// Log outputs selectable through logging.output.
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+)
+
+const (
+	defaultLogLevel  = "info"
+	defaultLogFormat = LogFormatDense
+)
+
+// componentKey is the attribute naming the component a record came from.
+const componentKey = "component"
+
+// parseLogLevel maps a level name to its slog level.
+func parseLogLevel(level string) (slog.Level, bool) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, true
+	case defaultLogLevel:
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	}
+	return slog.LevelInfo, false
+}
+
+func validLogFormat(format string) bool {
+	return format == LogFormatDense || format == LogFormatJSON || format == LogFormatLogfmt
+}
+
+// DenseTextHandler writes compact single-line records: the timestamp, level
+// and quoted message followed by attribute values without their keys.
 type DenseTextHandler struct {
-	level slog.Level
+	output io.Writer
+	mutex  *sync.Mutex
+	level  slog.Leveler
+	attrs  string // values preformatted by WithAttrs
+}
+
+// NewDenseTextHandler returns a DenseTextHandler writing to w. Only the Level
+// of opts is used.
+func NewDenseTextHandler(w io.Writer, opts *slog.HandlerOptions) *DenseTextHandler {
+	h := &DenseTextHandler{output: w, mutex: &sync.Mutex{}, level: slog.LevelInfo}
+	if opts != nil && opts.Level != nil {
+		h.level = opts.Level
+	}
+	return h
 }
 
 // Enabled reports whether the handler is enabled for the given level.
 func (h *DenseTextHandler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= h.level
+	return level >= h.level.Level()
 }
 
-// Handle formats the log record as dense values and writes to stdout.
+// Handle formats the log record as dense values and writes it to the output.
 func (h *DenseTextHandler) Handle(_ context.Context, r slog.Record) error {
 	var b strings.Builder
 	b.WriteString(r.Time.Format(time.RFC3339))
@@ -27,94 +87,314 @@ func (h *DenseTextHandler) Handle(_ context.Context, r slog.Record) error {
 	b.WriteString(r.Level.String())
 	b.WriteString(" ")
 	b.WriteString(fmt.Sprintf("%q\t", r.Message))
+	b.WriteString(h.attrs)
 	r.Attrs(func(a slog.Attr) bool {
-		b.WriteString(" ")
-		switch v := a.Value.Any().(type) {
-		case string:
-			b.WriteString(v)
-		default:
-			b.WriteString(fmt.Sprintf("%v", v))
-		}
+		appendDenseAttr(&b, a)
 		return true
 	})
 	b.WriteString("\n")
-	_, err := os.Stdout.WriteString(b.String())
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err := io.WriteString(h.output, b.String())
 	return err
 }
 
-// WithAttrs returns the handler unchanged (attrs unused).
-func (h *DenseTextHandler) WithAttrs(_ []slog.Attr) slog.Handler { return h }
-// WithGroup returns the handler unchanged (name unused).
-func (h *DenseTextHandler) WithGroup(_ string) slog.Handler       { return h }
+// WithAttrs returns a handler that writes attrs before every record's own.
+func (h *DenseTextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendDenseAttr(&b, a)
+	}
+	next := *h
+	next.attrs = b.String()
+	return &next
+}
 
+// WithGroup returns the handler unchanged; dense records carry no keys, so
+// group names have nothing to qualify.
+func (h *DenseTextHandler) WithGroup(_ string) slog.Handler { return h }
 
+// appendDenseAttr writes the value of a, flattening groups into their values.
+func appendDenseAttr(b *strings.Builder, a slog.Attr) {
+	value := a.Value.Resolve()
+	if a.Key == "" && value.Equal(slog.Value{}) {
+		return
+	}
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			appendDenseAttr(b, member)
+		}
+		return
+	}
+	b.WriteString(" ")
+	if value.Kind() == slog.KindTime {
+		b.WriteString(value.Time().Format(time.RFC3339))
+		return
+	}
+	b.WriteString(value.String())
+}
 
-const (
-	defaultLogLevel = "info"
-)
+type loggerOptions struct {
+	format     string
+	output     io.Writer
+	components map[string]string
+}
+
+// WithLogFormat selects the output format (LogFormatDense, LogFormatJSON or
+// LogFormatLogfmt). Unknown formats fall back to dense.
+func WithLogFormat(format string) func(*loggerOptions) {
+	return func(o *loggerOptions) {
+		if format != "" {
+			o.format = strings.ToLower(format)
+		}
+	}
+}
+
+// WithLogOutput sets where records are written (default: stdout).
+func WithLogOutput(w io.Writer) func(*loggerOptions) {
+	return func(o *loggerOptions) {
+		o.output = w
+	}
+}
+
+// WithComponentLevels overrides the level for the named component loggers.
+func WithComponentLevels(levels map[string]string) func(*loggerOptions) {
+	return func(o *loggerOptions) {
+		o.components = levels
+	}
+}
+
+// logSink is one configured destination: a format handler that writes every
+// record it is given, plus the level thresholds deciding what reaches it.
+type logSink struct {
+	handler    slog.Handler
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+func newLogSink(level string, opts ...func(*loggerOptions)) *logSink {
+	o := loggerOptions{format: defaultLogFormat, output: os.Stdout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Levels are filtered by logHandler, so the format handler accepts everything
+	handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	sink := &logSink{components: make(map[string]slog.Level, len(o.components))}
+	switch o.format {
+	case LogFormatJSON:
+		sink.handler = slog.NewJSONHandler(o.output, handlerOpts)
+	case LogFormatLogfmt:
+		sink.handler = slog.NewTextHandler(o.output, handlerOpts)
+	default:
+		sink.handler = NewDenseTextHandler(o.output, handlerOpts)
+	}
+	sink.level, _ = parseLogLevel(level)
+	for component, componentLevel := range o.components {
+		if parsed, ok := parseLogLevel(componentLevel); ok {
+			sink.components[component] = parsed
+		}
+	}
+	return sink
+}
+
+func (s *logSink) enabled(component string, level slog.Level) bool {
+	threshold, ok := s.components[component]
+	if !ok {
+		threshold = s.level
+	}
+	return level >= threshold
+}
+
+// logHandler resolves its sink on every record, so loggers created before the
+// global logger is configured or reconfigured follow the current settings.
+// WithAttrs and WithGroup calls are recorded and replayed onto each new sink.
+// Credentials and email addresses are masked before any format handler sees
+// them, and records logged with a request context carry its correlation IDs.
+type logHandler struct {
+	sink      func() *logSink
+	component string
+	ops       []func(slog.Handler) slog.Handler
+	bound     atomic.Pointer[boundLogHandler]
+}
+
+// boundLogHandler caches a sink's handler with the recorded calls applied.
+type boundLogHandler struct {
+	sink    *logSink
+	handler slog.Handler
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	sink := h.sink()
+	return sink != nil && sink.enabled(h.component, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	sink := h.sink()
+	if sink == nil {
+		return nil
+	}
+	r = redactLogRecord(r)
+	r.AddAttrs(correlationLogAttrs(ctx)...)
+	if bound := h.bound.Load(); bound != nil && bound.sink == sink {
+		return bound.handler.Handle(ctx, r)
+	}
+	handler := sink.handler
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	h.bound.Store(&boundLogHandler{sink: sink, handler: handler})
+	return handler.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	attrs = redactLogAttrs(attrs)
+	return h.with(h.component, func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(h.component, func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *logHandler) with(component string, op func(slog.Handler) slog.Handler) *logHandler {
+	return &logHandler{
+		sink:      h.sink,
+		component: component,
+		ops:       append(slices.Clip(h.ops), op),
+	}
+}
 
 // Logger wraps slog.Logger for structured logging
 type Logger struct {
 	*slog.Logger
 }
 
-// NewLogger creates a new logger with the specified level
-func NewLogger(level string) *Logger {
-	var logLevel slog.Level
-	switch strings.ToLower(level) {
-	case "debug":
-		logLevel = slog.LevelDebug
-	case defaultLogLevel:
-		logLevel = slog.LevelInfo
-	case "warn":
-		logLevel = slog.LevelWarn
-	case "error":
-		logLevel = slog.LevelError
-	default:
-		logLevel = slog.LevelInfo
-	}
+// NewLogger creates a new logger with the specified level, writing dense
+// records to stdout unless options say otherwise.
+func NewLogger(level string, opts ...func(*loggerOptions)) *Logger {
+	sink := newLogSink(level, opts...)
+	return &Logger{slog.New(&logHandler{sink: func() *logSink { return sink }})}
+}
 
-	handler := &DenseTextHandler{level: logLevel}
-	return &Logger{slog.New(handler)}
+// Component returns a child logger tagging every record with
+// component=name. Its level can be set separately in logging.components.
+func (l *Logger) Component(name string) *Logger {
+	if h, ok := l.Handler().(*logHandler); ok {
+		attrs := []slog.Attr{slog.String(componentKey, name)}
+		child := h.with(name, func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+		return &Logger{slog.New(child)}
+	}
+	return &Logger{l.With(componentKey, name)}
 }
 
-var logger *Logger
+// globalLogSink is the sink behind the global logger; nil discards records.
+var globalLogSink atomic.Pointer[logSink]
 
-// Init initializes the global logger from environment variable
+var logger = &Logger{slog.New(&logHandler{sink: globalLogSink.Load})}
+
+// Init initializes the global logger from the LOG_LEVEL and LOG_FORMAT
+// environment variables. ConfigureLogging later applies the config file.
 func Init() {
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = defaultLogLevel
+	ConfigureLogging(&Config{})
+}
+
+// ConfigureLogging applies the logging section of cfg to the global logger.
+// LOG_LEVEL and LOG_FORMAT take precedence over the file.
+func ConfigureLogging(cfg *Config) {
+	level := cmp.Or(os.Getenv("LOG_LEVEL"), cfg.Logging.Level, defaultLogLevel)
+	format := strings.ToLower(cmp.Or(os.Getenv("LOG_FORMAT"), cfg.Logging.Format, defaultLogFormat))
+	output := io.Writer(os.Stdout)
+	if cfg.Logging.Output == LogOutputStderr {
+		output = os.Stderr
+	}
+
+	globalLogSink.Store(newLogSink(level,
+		WithLogFormat(format),
+		WithLogOutput(output),
+		WithComponentLevels(cfg.Logging.Components),
+	))
+
+	if _, ok := parseLogLevel(level); !ok {
+		Warn("Unknown log level, using info", "level", level)
+	}
+	if !validLogFormat(format) {
+		Warn("Unknown log format, using dense", "format", format)
+	}
+}
+
+func (c *Config) validateLogging() error {
+	if _, ok := parseLogLevel(c.Logging.Level); c.Logging.Level != "" && !ok {
+		return NewValidationError("logging.level", c.Logging.Level, "must be one of debug, info, warn, error", nil)
+	}
+	if c.Logging.Format != "" && !validLogFormat(strings.ToLower(c.Logging.Format)) {
+		return NewValidationError("logging.format", c.Logging.Format, "must be one of dense, json, logfmt", nil)
+	}
+	if output := c.Logging.Output; output != "" && output != LogOutputStdout && output != LogOutputStderr {
+		return NewValidationError("logging.output", output, "must be stdout or stderr", nil)
+	}
+	for component, level := range c.Logging.Components {
+		if component == "" {
+			return NewValidationError("logging.components", component, "component name must not be empty", nil)
+		}
+		if _, ok := parseLogLevel(level); !ok {
+			return NewValidationError("logging.components."+component, level, "must be one of debug, info, warn, error", nil)
+		}
 	}
-	logger = NewLogger(logLevel)
+	return nil
+}
+
+// Component returns a logger for the named component that follows the global
+// logger's configuration.
+func Component(name string) *Logger {
+	return logger.Component(name)
+}
+
+// DebugContext logs a debug message with the request IDs of ctx
+func DebugContext(ctx context.Context, msg string, args ...any) {
+	logger.DebugContext(ctx, msg, args...)
+}
+
+// InfoContext logs an info message with the request IDs of ctx
+func InfoContext(ctx context.Context, msg string, args ...any) {
+	logger.InfoContext(ctx, msg, args...)
+}
+
+// WarnContext logs a warning message with the request IDs of ctx
+func WarnContext(ctx context.Context, msg string, args ...any) {
+	logger.WarnContext(ctx, msg, args...)
+}
+
+// ErrorContext logs an error message with the request IDs of ctx
+func ErrorContext(ctx context.Context, msg string, args ...any) {
+	logger.ErrorContext(ctx, msg, args...)
 }
 
 // Debug logs a debug message
 func Debug(msg string, args ...any) {
-	if logger != nil {
-		logger.Debug(msg, args...)
-	}
+	logger.Debug(msg, args...)
 }
 
 // Info logs an info message
 func Info(msg string, args ...any) {
-	if logger != nil {
-		logger.Info(msg, args...)
-	}
+	logger.Info(msg, args...)
 }
 
 // Warn logs a warning message
 func Warn(msg string, args ...any) {
-	if logger != nil {
-		logger.Warn(msg, args...)
-	}
+	logger.Warn(msg, args...)
 }
 
 // Error logs an error message
 func Error(msg string, args ...any) {
-	if logger != nil {
-		logger.Error(msg, args...)
-	}
+	logger.Error(msg, args...)
 }
 
 // GetLogger returns the global logger instance
@@ -1,6 +1,10 @@
 package internal
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -10,3 +14,92 @@ func TestNewLogger(t *testing.T) {
 		t.Error("NewLogger returned nil")
 	}
 }
+
+func TestLogger_JSONFormat(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger("info", WithLogFormat(LogFormatJSON), WithLogOutput(&out))
+
+	log.Component("auth").With("email", "user@example.com").WithGroup("upstream").
+		Info("Token refreshed", "status", 200, "error", errors.New("boom"))
+	log.Debug("Not written")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one record, got %q", out.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("record is not JSON: %v: %s", err, lines[0])
+	}
+	if record["msg"] != "Token refreshed" || record["component"] != "auth" || record["email"] != "u***@example.com" {
+		t.Errorf("unexpected record %v", record)
+	}
+	upstream, _ := record["upstream"].(map[string]any)
+	if upstream["status"] != float64(200) || upstream["error"] != "boom" {
+		t.Errorf("expected grouped attributes, got %v", record)
+	}
+}
+
+func TestLogger_LogfmtFormat(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger("debug", WithLogFormat(LogFormatLogfmt), WithLogOutput(&out))
+
+	log.WithGroup("request").Debug("Proxying", "model", "gpt-4o", "path", "/v1/chat completions")
+
+	line := out.String()
+	for _, want := range []string{"level=DEBUG", `msg=Proxying`, "request.model=gpt-4o", `request.path="/v1/chat completions"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in %q", want, line)
+		}
+	}
+}
+
+func TestLogger_DenseFormat(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger("info", WithLogOutput(&out))
+
+	log.With("email", "user@example.com").WithGroup("g").Warn("Retrying", "attempt", 2)
+
+	line := out.String()
+	if !strings.Contains(line, `WARN "Retrying"`) || !strings.HasSuffix(line, " u***@example.com 2\n") {
+		t.Errorf("unexpected dense record %q", line)
+	}
+}
+
+func TestLogger_ComponentLevels(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger("warn", WithLogFormat(LogFormatJSON), WithLogOutput(&out),
+		WithComponentLevels(map[string]string{"auth": "debug"}))
+
+	log.Info("Dropped")
+	log.Component("proxy").Info("Dropped too")
+	log.Component("auth").Debug("Kept")
+
+	if got := out.String(); strings.Contains(got, "Dropped") || !strings.Contains(got, `"msg":"Kept"`) {
+		t.Errorf("component levels not applied: %q", got)
+	}
+}
+
+func TestConfigureLogging_Reconfigures(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "json")
+	previous := globalLogSink.Load()
+	t.Cleanup(func() { globalLogSink.Store(previous) })
+
+	component := Component("catalog")
+	cfg := &Config{}
+	cfg.Logging.Format = LogFormatLogfmt
+	cfg.Logging.Level = "error"
+	ConfigureLogging(cfg)
+	if sink := globalLogSink.Load(); sink.level.String() != "ERROR" {
+		t.Errorf("expected the config level, got %s", sink.level)
+	}
+	if component.Enabled(t.Context(), 0) {
+		t.Error("expected loggers created earlier to follow the new level")
+	}
+
+	cfg.Logging.Format = "xml"
+	if err := cfg.validateLogging(); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,461 @@
+// Package internal provides Prometheus metrics for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsNamespace   = "copilot_svcs"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	userHashLength     = 12
+)
+
+// requestDurationBuckets are the latency histogram buckets in seconds. They
+// extend to several minutes because streaming completions stay open that long.
+var requestDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Metrics holds all metrics exported by the service.
+type Metrics struct {
+	registry *MetricsRegistry
+
+	// Sampled at scrape time by the worker pool and circuit breaker gauges
+	workerPool atomic.Pointer[WorkerPool]
+	breakers   atomic.Pointer[CircuitBreakers]
+
+	Requests                  *CounterVec
+	RequestDuration           *HistogramVec
+	UpstreamRetries           *CounterVec
+	CircuitBreakerTransitions *CounterVec
+	TokenRefreshes            *CounterVec
+	CoalescingHits            *CounterVec
+	StreamedBytes             *CounterVec
+	RateLimitRejections       *CounterVec
+	ConfigReloads             *CounterVec
+	ModelFallbacks            *CounterVec
+}
+
+// metrics is the process-wide metrics set, shared like the global logger.
+var metrics = NewMetrics()
+
+// NewMetrics creates the service metrics in a new registry.
+func NewMetrics() *Metrics {
+	r := NewMetricsRegistry()
+	m := &Metrics{
+		registry: r,
+		Requests: r.NewCounterVec("requests_total",
+			"Proxied requests by endpoint, model, status code and user hash.",
+			"endpoint", "model", "status", "user"),
+		RequestDuration: r.NewHistogramVec("request_duration_seconds",
+			"Proxied request latency in seconds by endpoint, model, status code and user hash.",
+			requestDurationBuckets, "endpoint", "model", "status", "user"),
+		UpstreamRetries: r.NewCounterVec("upstream_retries_total",
+			"Upstream request retries by the status code (or \"error\") that triggered them.",
+			"reason"),
+		CircuitBreakerTransitions: r.NewCounterVec("circuit_breaker_transitions_total",
+			"Circuit breaker state transitions.",
+			"from", "to"),
+		TokenRefreshes: r.NewCounterVec("token_refreshes_total",
+			"Copilot token refresh attempts by result.",
+			"result"),
+		CoalescingHits: r.NewCounterVec("coalescing_hits_total",
+			"Requests served by joining an identical in-flight request."),
+		StreamedBytes: r.NewCounterVec("streamed_bytes_total",
+			"Bytes streamed to clients in event-stream responses by endpoint.",
+			"endpoint"),
+		RateLimitRejections: r.NewCounterVec("rate_limit_rejections_total",
+			"Requests rejected by per-user or per-key rate limits and quotas by reason.",
+			"reason"),
+		ConfigReloads: r.NewCounterVec("config_reloads_total",
+			"Configuration reload attempts by result.",
+			"result"),
+		ModelFallbacks: r.NewCounterVec("model_fallbacks_total",
+			"Requests moved to the next model of a fallback chain, by unavailable and next model.",
+			"from", "to"),
+	}
+
+	r.NewGaugeFunc("worker_pool_queue_depth", "Jobs waiting in the worker pool queue.", func() float64 {
+		if wp := m.workerPool.Load(); wp != nil {
+			return float64(wp.QueueDepth())
+		}
+		return 0
+	})
+	r.NewGaugeFunc("worker_pool_busy_workers", "Worker pool workers currently running a job.", func() float64 {
+		if wp := m.workerPool.Load(); wp != nil {
+			return float64(wp.BusyWorkers())
+		}
+		return 0
+	})
+	r.NewGaugeFunc("worker_pool_workers", "Worker pool size.", func() float64 {
+		if wp := m.workerPool.Load(); wp != nil {
+			return float64(wp.workers)
+		}
+		return 0
+	})
+	r.NewGaugeFunc("circuit_breaker_state", "Most severe circuit breaker state (0 closed, 1 open, 2 half-open; open wins).", func() float64 {
+		if breakers := m.breakers.Load(); breakers != nil {
+			state, _ := breakers.summary()
+			return float64(state)
+		}
+		return 0
+	})
+	r.NewGaugeFunc("circuit_breakers_open", "Circuit breakers currently open.", func() float64 {
+		if breakers := m.breakers.Load(); breakers != nil {
+			_, open := breakers.summary()
+			return float64(open)
+		}
+		return 0
+	})
+	return m
+}
+
+// TrackWorkerPool makes the worker pool gauges report wp.
+func (m *Metrics) TrackWorkerPool(wp *WorkerPool) {
+	m.workerPool.Store(wp)
+}
+
+// TrackCircuitBreakers makes the circuit breaker gauges report breakers.
+func (m *Metrics) TrackCircuitBreakers(breakers *CircuitBreakers) {
+	m.breakers.Store(breakers)
+}
+
+// Handler returns an HTTP handler serving the Prometheus text exposition format.
+func (m *Metrics) Handler() http.HandlerFunc {
+	return m.registry.Handler()
+}
+
+// userHash returns a short stable hash identifying a user without exposing the email.
+func userHash(email string) string {
+	if email == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(sum[:])[:userHashLength]
+}
+
+// metricFamily is a named metric that can write itself in text format.
+type metricFamily interface {
+	write(w *bufio.Writer)
+}
+
+// MetricsRegistry collects metric families and renders them in Prometheus text format.
+type MetricsRegistry struct {
+	mutex    sync.RWMutex
+	families []metricFamily
+}
+
+// NewMetricsRegistry creates an empty registry.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+func (r *MetricsRegistry) register(family metricFamily) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, family)
+}
+
+// Handler returns an HTTP handler serving all registered metrics.
+func (r *MetricsRegistry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		bw := bufio.NewWriter(w)
+		r.mutex.RLock()
+		for _, family := range r.families {
+			family.write(bw)
+		}
+		r.mutex.RUnlock()
+		if err := bw.Flush(); err != nil {
+			Warn("Failed to write metrics response", "error", err)
+		}
+	}
+}
+
+func writeFamilyHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func checkLabelCount(name string, labelNames, values []string) {
+	if len(values) != len(labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", name, len(labelNames), len(values)))
+	}
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	series     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (r *MetricsRegistry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		labelNames: labelNames,
+		series:     make(map[string]*counterSeries),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for the label values by delta.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	checkLabelCount(c.name, c.labelNames, labelValues)
+	key := labelKey(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labels: append([]string(nil), labelValues...)}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+// Value returns the current counter value for the label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s, ok := c.series[labelKey(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeFamilyHeader(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, s.labels, "", ""), formatFloat(s.value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bucket bounds and label names.
+func (r *MetricsRegistry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    sorted,
+		series:     make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records value for the label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	checkLabelCount(h.name, h.labelNames, labelValues)
+	key := labelKey(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations for the label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if s, ok := h.series[labelKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeFamilyHeader(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, s.labels, "", ""), s.count)
+	}
+}
+
+// gaugeFunc is a gauge sampled from a callback at scrape time.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time.
+func (r *MetricsRegistry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: metricsNamespace + "_" + name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	writeFamilyHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// otherModelLabel stands in for model names the proxy does not know, so that
+// arbitrary names sent by clients cannot add request series.
+const otherModelLabel = "other"
+
+// metricsModel returns the model label for a finished request: the model if
+// it served the request successfully or is known from the configuration or
+// the model catalog, and otherModelLabel otherwise.
+func (s *ProxyService) metricsModel(info *proxyRequestInfo, status int) string {
+	info.mutex.Lock()
+	model, served := info.model, info.served
+	info.mutex.Unlock()
+
+	if model == "" || (served && status < statusClientError) || s.config.Load().knowsModel(model) {
+		return model
+	}
+	if s.catalog != nil && s.catalog.has(model) {
+		return model
+	}
+	return otherModelLabel
+}
+
+// knowsModel reports whether model is named in allowed_models, as an exact
+// alias or alias target, or in model_fallbacks.
+func (c *Config) knowsModel(model string) bool {
+	if slices.Contains(c.AllowedModels, model) {
+		return true
+	}
+	for _, alias := range c.ModelAliases {
+		if alias.Model == model || (alias.matchType() == ModelAliasExact && alias.Alias == model) {
+			return true
+		}
+	}
+	for primary, chain := range c.ModelFallbacks {
+		if primary == model || slices.Contains(chain, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// observeRequest records the count and latency of a finished proxy request.
+func (m *Metrics) observeRequest(endpoint, model string, status int, email string, duration time.Duration) {
+	if model == "" {
+		model = "unknown"
+	}
+	labels := []string{endpoint, model, strconv.Itoa(status), userHash(email)}
+	m.Requests.Inc(labels...)
+	m.RequestDuration.Observe(duration.Seconds(), labels...)
+}
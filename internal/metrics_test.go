@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 from metrics handler, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	return rr.Body.String()
+}
+
+func TestMetricsRegistry_TextFormat(t *testing.T) {
+	r := NewMetricsRegistry()
+	counter := r.NewCounterVec("things_total", "Things counted.", "kind")
+	histogram := r.NewHistogramVec("wait_seconds", "Wait time.", []float64{1, 0.1}, "kind")
+	r.NewGaugeFunc("level", "Current level.", func() float64 { return 7 })
+
+	counter.Inc(`a"b`)
+	counter.Add(2, "plain")
+	histogram.Observe(0.05, "x")
+	histogram.Observe(0.5, "x")
+	histogram.Observe(5, "x")
+
+	out := scrapeMetrics(t, r.Handler())
+	for _, want := range []string{
+		"# TYPE copilot_svcs_things_total counter",
+		`copilot_svcs_things_total{kind="a\"b"} 1`,
+		`copilot_svcs_things_total{kind="plain"} 2`,
+		"# TYPE copilot_svcs_wait_seconds histogram",
+		`copilot_svcs_wait_seconds_bucket{kind="x",le="0.1"} 1`,
+		`copilot_svcs_wait_seconds_bucket{kind="x",le="1"} 2`,
+		`copilot_svcs_wait_seconds_bucket{kind="x",le="+Inf"} 3`,
+		`copilot_svcs_wait_seconds_sum{kind="x"} 5.55`,
+		`copilot_svcs_wait_seconds_count{kind="x"} 3`,
+		"# TYPE copilot_svcs_level gauge",
+		"copilot_svcs_level 7",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestUserHash(t *testing.T) {
+	hash := userHash("User@Example.com")
+	if hash != userHash("user@example.com") {
+		t.Error("expected user hash to be case-insensitive")
+	}
+	if len(hash) != userHashLength || strings.Contains(hash, "example") {
+		t.Errorf("unexpected user hash %q", hash)
+	}
+	if userHash("") != "anonymous" {
+		t.Errorf("expected anonymous for empty email, got %q", userHash(""))
+	}
+}
+
+func TestMetrics_ProxyInstrumentation(t *testing.T) {
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	wp := NewWorkerPool(1)
+	defer wp.Stop()
+	s := NewProxyService(cfg, &http.Client{}, nil, wp)
+
+	before := metrics.Requests.Value("/v1/chat/completions", "unknown", "405", "anonymous")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/chat/completions", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rr.Code)
+	}
+	if got := metrics.Requests.Value("/v1/chat/completions", "unknown", "405", "anonymous"); got != before+1 {
+		t.Errorf("expected request counter to increase by one, got %v -> %v", before, got)
+	}
+
+	// Open the circuit breaker and check the transition is counted.
+	transitions := metrics.CircuitBreakerTransitions.Value("closed", "open")
+	breaker, _ := s.breakers.upstream(copilotAPIBase, "gpt-4o")
+	for i := 0; i < defaultCircuitBreakerThreshold; i++ {
+		breaker.onFailure()
+	}
+	if got := metrics.CircuitBreakerTransitions.Value("closed", "open"); got != transitions+1 {
+		t.Errorf("expected one closed->open transition, got %v -> %v", transitions, got)
+	}
+	if breaker.State() != CircuitOpen {
+		t.Errorf("expected open circuit breaker, got %s", breaker.State())
+	}
+}
+
+func TestMetrics_UnknownModelsShareSeries(t *testing.T) {
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		if strings.HasPrefix(payload["model"].(string), "made-up-") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"error":{"message":"The requested model is not supported"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"choices":[{"message":{"content":"ok"}}]}`)
+	})
+	s.config.Load().AllowedModels = []string{"gpt-4o", "made-up-allowed"}
+	seriesCount := func() int {
+		metrics.Requests.mutex.Lock()
+		defer metrics.Requests.mutex.Unlock()
+		return len(metrics.Requests.series)
+	}
+	send := func(model string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+			strings.NewReader(`{"model":"`+model+`"}`))
+		s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	user := userHash("user@example.com")
+
+	send("made-up-0")
+	before := seriesCount()
+	others := metrics.Requests.Value("/v1/chat/completions", otherModelLabel, "400", user)
+	for i := 1; i <= 5; i++ {
+		send(fmt.Sprintf("made-up-%d", i))
+	}
+	if got := seriesCount(); got != before {
+		t.Errorf("expected unknown models to add no series, got %d -> %d", before, got)
+	}
+	if got := metrics.Requests.Value("/v1/chat/completions", otherModelLabel, "400", user); got != others+5 {
+		t.Errorf("expected unknown models to be counted as %q, got %v -> %v", otherModelLabel, others, got)
+	}
+
+	// Models that served the request or are configured keep their name
+	send("gpt-4o")
+	send("made-up-allowed")
+	if metrics.Requests.Value("/v1/chat/completions", "gpt-4o", "200", user) == 0 ||
+		metrics.Requests.Value("/v1/chat/completions", "made-up-allowed", "400", user) == 0 {
+		t.Error("expected known models to be recorded by name")
+	}
+}
+
+func TestWorkerPool_Gauges(t *testing.T) {
+	wp := NewWorkerPool(1)
+	defer wp.Stop()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.Submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	wp.Submit(func() {})
+
+	deadline := time.Now().Add(time.Second)
+	for wp.QueueDepth() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if wp.BusyWorkers() != 1 || wp.QueueDepth() != 1 {
+		t.Errorf("expected 1 busy worker and 1 queued job, got %d busy, %d queued", wp.BusyWorkers(), wp.QueueDepth())
+	}
+	close(release)
+}
@@ -46,6 +46,13 @@ func (lrw *LoggingResponseWriter) Write(body []byte) (int, error) {
 	return lrw.ResponseWriter.Write(body)
 }
 
+// Flush forwards to the underlying writer so streamed responses are not held back.
+func (lrw *LoggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Hijack ...
 func (lrw *LoggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hijacker, ok := lrw.ResponseWriter.(http.Hijacker); ok {
@@ -92,7 +99,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 
 		// Log request
 		if modelName != "" {
-			Info("HTTP Request",
+			InfoContext(r.Context(), "HTTP Request",
 				"method", r.Method,
 				"url", r.URL.String(),
 				"model", modelName,
@@ -102,7 +109,7 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 				"has_body", len(requestBody) > 0,
 			)
 		} else {
-			Info("HTTP Request",
+			InfoContext(r.Context(), "HTTP Request",
 				"method", r.Method,
 				"url", r.URL.String(),
 				"remote_addr", getClientIP(r),
@@ -134,16 +141,16 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		// Log response with appropriate level
 		switch {
 		case statusCode >= statusServerError:
-			Error("HTTP Response", logArgs...)
+			ErrorContext(r.Context(), "HTTP Response", logArgs...)
 		case statusCode >= statusClientError:
-			Warn("HTTP Response", logArgs...)
+			WarnContext(r.Context(), "HTTP Response", logArgs...)
 		default:
-			Info("HTTP Response", logArgs...)
+			InfoContext(r.Context(), "HTTP Response", logArgs...)
 		}
 
 		// Log response body for debugging if it's small and there was an error
 		if statusCode >= 400 && responseSize > 0 && responseSize < 1024 {
-			Debug("HTTP Response Body", "body", string(lrw.Body()))
+			DebugContext(r.Context(), "HTTP Response Body", "body", string(lrw.Body()))
 		}
 	})
 }
@@ -153,7 +160,7 @@ func RecoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				Error("HTTP Handler Panic",
+				ErrorContext(r.Context(), "HTTP Handler Panic",
 					"error", err,
 					"method", r.Method,
 					"url", r.URL.String(),
@@ -169,8 +176,15 @@ func RecoveryMiddleware(next http.Handler) http.Handler {
 
 // CORSMiddleware ...
 func CORSMiddleware(config *Config) func(http.Handler) http.Handler {
+	return ReloadableCORSMiddleware(NewConfigStore(config, ""))
+}
+
+// ReloadableCORSMiddleware applies the CORS settings of the current
+// configuration snapshot in store to each request.
+func ReloadableCORSMiddleware(store *ConfigStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			config := store.Load()
 			origin := r.Header.Get("Origin")
 
 			// Set CORS headers based on configuration
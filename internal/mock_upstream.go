@@ -0,0 +1,482 @@
+// Package internal provides a mock Copilot upstream for github-copilot-svcs.
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMockTokenTTL = 30 * time.Minute
+	// mockErrorModelPrefix makes every request for a model such as
+	// "mock-error-503" fail with that status.
+	mockErrorModelPrefix = "mock-error-"
+)
+
+// defaultMockModels are listed by the mock /models endpoint.
+var defaultMockModels = []string{"gpt-4o", "gpt-4.1", "gpt-5", "claude-sonnet-4.5"}
+
+// MockUpstream behaves like the GitHub device flow and the Copilot API
+// closely enough to run the real AuthService and ProxyService against it.
+type MockUpstream struct {
+	reply        string
+	models       []string
+	latency      time.Duration
+	chunkDelay   time.Duration
+	errorStatus  int
+	errorEvery   int
+	pendingPolls int
+	tokenTTL     time.Duration
+
+	mutex       sync.Mutex
+	calls       map[string]int
+	polls       map[string]int
+	completions int
+}
+
+// NewMockUpstream creates a mock upstream. By default it echoes the last user
+// message and authorizes device codes on the first poll.
+func NewMockUpstream(opts ...func(*MockUpstream)) *MockUpstream {
+	m := &MockUpstream{
+		models:   defaultMockModels,
+		tokenTTL: defaultMockTokenTTL,
+		calls:    make(map[string]int),
+		polls:    make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// WithMockReply makes every completion return reply instead of an echo.
+func WithMockReply(reply string) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.reply = reply
+	}
+}
+
+// WithMockModels sets the models listed by /models.
+func WithMockModels(models ...string) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.models = models
+	}
+}
+
+// WithMockLatency delays every response by latency and every streamed chunk
+// after the first by chunkDelay.
+func WithMockLatency(latency, chunkDelay time.Duration) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.latency = latency
+		m.chunkDelay = chunkDelay
+	}
+}
+
+// WithMockErrors makes every nth completion request fail with status.
+func WithMockErrors(status, every int) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.errorStatus = status
+		m.errorEvery = every
+	}
+}
+
+// WithMockPendingPolls answers authorization_pending to the first polls of
+// every device code.
+func WithMockPendingPolls(polls int) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.pendingPolls = polls
+	}
+}
+
+// WithMockTokenTTL sets the lifetime of issued Copilot tokens.
+func WithMockTokenTTL(ttl time.Duration) func(*MockUpstream) {
+	return func(m *MockUpstream) {
+		m.tokenTTL = ttl
+	}
+}
+
+// Calls returns how many requests were made to path.
+func (m *MockUpstream) Calls(path string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.calls[path]
+}
+
+// Handler returns the mock's HTTP handler.
+func (m *MockUpstream) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/device/code", m.handleDeviceCode)
+	mux.HandleFunc("POST /login/oauth/access_token", m.handleAccessToken)
+	mux.HandleFunc("GET /copilot_internal/v2/token", m.handleCopilotToken)
+	mux.HandleFunc("GET /models", m.requireToken(m.handleModels))
+	mux.HandleFunc("POST /chat/completions", m.requireToken(m.completion(m.writeChatCompletion)))
+	mux.HandleFunc("POST /completions", m.requireToken(m.completion(m.writeTextCompletion)))
+	mux.HandleFunc("POST /responses", m.requireToken(m.completion(m.writeResponse)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		m.calls[r.URL.Path]++
+		m.mutex.Unlock()
+		Debug("Mock upstream request", "method", r.Method, "path", r.URL.Path)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (m *MockUpstream) handleDeviceCode(w http.ResponseWriter, _ *http.Request) {
+	writeMockJSON(w, http.StatusOK, map[string]any{
+		"device_code":      "mock-device-" + mockID(),
+		"user_code":        "MOCK-1234",
+		"verification_uri": "https://github.com/login/device",
+		"expires_in":       900,
+		"interval":         1,
+	})
+}
+
+func (m *MockUpstream) handleAccessToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DeviceCode string `json:"device_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceCode == "" {
+		writeMockJSON(w, http.StatusOK, map[string]any{"error": "incorrect_device_code", "error_description": "missing device_code"})
+		return
+	}
+	m.mutex.Lock()
+	m.polls[req.DeviceCode]++
+	pending := m.polls[req.DeviceCode] <= m.pendingPolls
+	m.mutex.Unlock()
+	if pending {
+		writeMockJSON(w, http.StatusOK, map[string]any{"error": "authorization_pending"})
+		return
+	}
+	writeMockJSON(w, http.StatusOK, map[string]any{
+		"access_token": "gho_mock" + mockID(),
+		"token_type":   "bearer",
+		"scope":        copilotScope,
+	})
+}
+
+func (m *MockUpstream) handleCopilotToken(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "token ") {
+		writeMockJSON(w, http.StatusUnauthorized, map[string]any{"message": "Bad credentials"})
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	expiresAt := time.Now().Add(m.tokenTTL).Unix()
+	writeMockJSON(w, http.StatusOK, map[string]any{
+		"token":      fmt.Sprintf("tid=mock-%s;exp=%d;sku=mock_seat", mockID(), expiresAt),
+		"expires_at": expiresAt,
+		"refresh_in": int64(m.tokenTTL.Seconds()) / 2,
+		"sku":        "mock_seat",
+		"endpoints":  map[string]string{"api": scheme + "://" + r.Host},
+	})
+}
+
+func (m *MockUpstream) handleModels(w http.ResponseWriter, _ *http.Request) {
+	data := make([]map[string]any, 0, len(m.models))
+	for _, id := range m.models {
+		data = append(data, map[string]any{
+			"id":     id,
+			"object": "model",
+			"name":   id,
+			"vendor": modelOwner(id),
+			"policy": map[string]string{"state": "enabled"},
+		})
+	}
+	writeMockJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+}
+
+// requireToken rejects requests without a Copilot bearer token.
+func (m *MockUpstream) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok || token == "" {
+			writeMockError(w, http.StatusUnauthorized, "unauthorized", "missing Copilot token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// mockCompletion is a parsed completion request and the reply to send.
+type mockCompletion struct {
+	model  string
+	stream bool
+	prompt string
+	reply  string
+}
+
+type mockWriter func(w http.ResponseWriter, r *http.Request, c mockCompletion)
+
+// completion parses the request, applies latency and injected errors and
+// hands the reply to write.
+func (m *MockUpstream) completion(write mockWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeMockError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON: "+err.Error())
+			return
+		}
+		c := mockCompletion{prompt: mockPrompt(payload)}
+		c.model, _ = payload["model"].(string)
+		c.stream, _ = payload["stream"].(bool)
+		c.reply = m.reply
+		if c.reply == "" {
+			c.reply = "Echo: " + c.prompt
+		}
+
+		if !m.sleep(r, m.latency) {
+			return
+		}
+		if status := m.injectedError(c.model); status != 0 {
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("retry-after-ms", "10")
+			}
+			writeMockError(w, status, "mock_error", fmt.Sprintf("mock upstream error %d", status))
+			return
+		}
+		write(w, r, c)
+	}
+}
+
+// injectedError returns the status a request for model should fail with, or 0.
+func (m *MockUpstream) injectedError(model string) int {
+	if code, ok := strings.CutPrefix(model, mockErrorModelPrefix); ok {
+		if status, err := strconv.Atoi(code); err == nil && status >= statusClientError {
+			return status
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.completions++
+	if m.errorEvery > 0 && m.errorStatus != 0 && m.completions%m.errorEvery == 0 {
+		return m.errorStatus
+	}
+	return 0
+}
+
+// sleep waits d unless the request is cancelled first.
+func (m *MockUpstream) sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (m *MockUpstream) writeChatCompletion(w http.ResponseWriter, r *http.Request, c mockCompletion) {
+	id, created := "chatcmpl-mock-"+mockID(), time.Now().Unix()
+	usage := mockUsage(c, "prompt_tokens", "completion_tokens")
+	if !c.stream {
+		writeMockJSON(w, http.StatusOK, map[string]any{
+			"id": id, "object": "chat.completion", "created": created, "model": c.model,
+			"choices": []any{map[string]any{
+				"index":         0,
+				"message":       map[string]any{"role": "assistant", "content": c.reply},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+		return
+	}
+
+	events := make([]any, 0)
+	for i, piece := range mockPieces(c.reply) {
+		delta := map[string]any{"content": piece}
+		if i == 0 {
+			delta["role"] = "assistant"
+		}
+		events = append(events, map[string]any{
+			"id": id, "object": "chat.completion.chunk", "created": created, "model": c.model,
+			"choices": []any{map[string]any{"index": 0, "delta": delta}},
+		})
+	}
+	events = append(events, map[string]any{
+		"id": id, "object": "chat.completion.chunk", "created": created, "model": c.model,
+		"choices": []any{map[string]any{"index": 0, "delta": map[string]any{}, "finish_reason": "stop"}},
+		"usage":   usage,
+	})
+	m.writeEvents(w, r, events, true)
+}
+
+func (m *MockUpstream) writeTextCompletion(w http.ResponseWriter, r *http.Request, c mockCompletion) {
+	id, created := "cmpl-mock-"+mockID(), time.Now().Unix()
+	usage := mockUsage(c, "prompt_tokens", "completion_tokens")
+	if !c.stream {
+		writeMockJSON(w, http.StatusOK, map[string]any{
+			"id": id, "object": "text_completion", "created": created, "model": c.model,
+			"choices": []any{map[string]any{"index": 0, "text": c.reply, "finish_reason": "stop"}},
+			"usage":   usage,
+		})
+		return
+	}
+
+	events := make([]any, 0)
+	for _, piece := range mockPieces(c.reply) {
+		events = append(events, map[string]any{
+			"id": id, "object": "text_completion", "created": created, "model": c.model,
+			"choices": []any{map[string]any{"index": 0, "text": piece}},
+		})
+	}
+	events = append(events, map[string]any{
+		"id": id, "object": "text_completion", "created": created, "model": c.model,
+		"choices": []any{map[string]any{"index": 0, "text": "", "finish_reason": "stop"}},
+		"usage":   usage,
+	})
+	m.writeEvents(w, r, events, true)
+}
+
+func (m *MockUpstream) writeResponse(w http.ResponseWriter, r *http.Request, c mockCompletion) {
+	response := map[string]any{
+		"id": "resp_mock_" + mockID(), "object": "response", "created_at": time.Now().Unix(),
+		"model": c.model, "status": "completed",
+		"output": []any{map[string]any{
+			"type": "message", "id": "msg_mock", "role": "assistant", "status": "completed",
+			"content": []any{map[string]any{"type": "output_text", "text": c.reply, "annotations": []any{}}},
+		}},
+		"usage": mockUsage(c, "input_tokens", "output_tokens"),
+	}
+	if !c.stream {
+		writeMockJSON(w, http.StatusOK, response)
+		return
+	}
+
+	created := map[string]any{}
+	for k, v := range response {
+		created[k] = v
+	}
+	created["status"], created["output"] = "in_progress", []any{}
+	delete(created, "usage")
+	events := []any{map[string]any{"type": "response.created", "response": created}}
+	for _, piece := range mockPieces(c.reply) {
+		events = append(events, map[string]any{
+			"type": "response.output_text.delta", "item_id": "msg_mock", "output_index": 0, "content_index": 0, "delta": piece,
+		})
+	}
+	events = append(events, map[string]any{"type": "response.completed", "response": response})
+	m.writeEvents(w, r, events, false)
+}
+
+// writeEvents streams events as SSE. Chat and text completions end with
+// [DONE]; Responses API events are sent with their type as the event name.
+func (m *MockUpstream) writeEvents(w http.ResponseWriter, r *http.Request, events []any, done bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for i, event := range events {
+		if i > 0 && !m.sleep(r, m.chunkDelay) {
+			return
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		if !done {
+			eventType, _ := event.(map[string]any)["type"].(string)
+			_, _ = fmt.Fprintf(w, "event: %s\n", eventType)
+		}
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if done {
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}
+}
+
+// mockPrompt returns the text of the last user message, prompt or input.
+func mockPrompt(payload map[string]any) string {
+	if messages, ok := payload["messages"].([]any); ok {
+		for i := len(messages) - 1; i >= 0; i-- {
+			if msg, ok := messages[i].(map[string]any); ok && msg["role"] == "user" {
+				return mockText(msg["content"])
+			}
+		}
+	}
+	if prompt, ok := payload["prompt"]; ok {
+		return mockText(prompt)
+	}
+	if input, ok := payload["input"].([]any); ok {
+		for i := len(input) - 1; i >= 0; i-- {
+			if item, ok := input[i].(map[string]any); ok && item["role"] == "user" {
+				return mockText(item["content"])
+			}
+		}
+	}
+	return mockText(payload["input"])
+}
+
+// mockText flattens string content and arrays of text parts.
+func mockText(content any) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []any:
+		var parts []string
+		for _, part := range v {
+			switch p := part.(type) {
+			case string:
+				parts = append(parts, p)
+			case map[string]any:
+				if text, ok := p["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, " ")
+	default:
+		return ""
+	}
+}
+
+// mockPieces splits reply into word-sized streaming chunks.
+func mockPieces(reply string) []string {
+	pieces := strings.SplitAfter(reply, " ")
+	if len(pieces) > 0 && pieces[len(pieces)-1] == "" {
+		pieces = pieces[:len(pieces)-1]
+	}
+	return pieces
+}
+
+// mockUsage counts words as tokens.
+func mockUsage(c mockCompletion, inputKey, outputKey string) map[string]int {
+	input, output := max(len(strings.Fields(c.prompt)), 1), len(strings.Fields(c.reply))
+	return map[string]int{inputKey: input, outputKey: output, "total_tokens": input + output}
+}
+
+func mockID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		Warn("Failed to write mock upstream response", "error", err)
+	}
+}
+
+func writeMockError(w http.ResponseWriter, status int, code, message string) {
+	writeMockJSON(w, status, map[string]any{
+		"error": map[string]any{"message": message, "type": code, "code": code},
+	})
+}
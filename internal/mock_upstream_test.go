@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mockRequest(t *testing.T, h http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer tid=mock")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMockUpstream_ResponsesStream(t *testing.T) {
+	h := NewMockUpstream(WithMockReply("canned reply")).Handler()
+	rr := mockRequest(t, h, "/responses", `{"model":"gpt-5","stream":true,"input":[{"role":"user","content":[{"type":"input_text","text":"hi"}]}]}`)
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"event: response.created\n",
+		`"delta":"canned "`,
+		"event: response.completed\n",
+		`"output_tokens":2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in stream:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "[DONE]") {
+		t.Error("Responses API streams must not end with [DONE]")
+	}
+}
+
+func TestMockUpstream_InjectedErrorsAndLatency(t *testing.T) {
+	h := NewMockUpstream(WithMockErrors(http.StatusTooManyRequests, 2), WithMockLatency(20*time.Millisecond, 0)).Handler()
+	chat := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+
+	start := time.Now()
+	if rr := mockRequest(t, h, "/chat/completions", chat); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Echo: hi") {
+		t.Errorf("expected echo reply, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("expected the configured latency")
+	}
+	if rr := mockRequest(t, h, "/chat/completions", chat); rr.Code != http.StatusTooManyRequests || rr.Header().Get("retry-after-ms") == "" {
+		t.Errorf("expected every second request to fail with 429, got %d", rr.Code)
+	}
+	if rr := mockRequest(t, h, "/completions", `{"model":"mock-error-503","prompt":"hi"}`); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the model to select a 503, got %d", rr.Code)
+	}
+}
+
+func TestMockUpstream_DeviceFlow(t *testing.T) {
+	mock := NewMockUpstream(WithMockPendingPolls(1))
+	srv := httptest.NewServer(mock.Handler())
+	defer srv.Close()
+
+	cfg := &Config{}
+	SetDefaultHeaders(cfg)
+	cfg.Upstream.DeviceCodeURL = srv.URL + "/login/device/code"
+	cfg.Upstream.AccessTokenURL = srv.URL + "/login/oauth/access_token"
+	cfg.Upstream.CopilotTokenURL = srv.URL + "/copilot_internal/v2/token"
+	auth := NewAuthService(srv.Client(), WithTokenStore(NewMemoryTokenStore()))
+
+	dc, err := auth.AuthenticateStage1(cfg)
+	if err != nil {
+		t.Fatalf("AuthenticateStage1 failed: %v", err)
+	}
+	if err := auth.AuthenticateStage2("user@example.com", dc.DeviceCode, dc.Interval, dc.ExpiresIn, cfg, false); err == nil ||
+		!strings.Contains(err.Error(), "authorization_pending") {
+		t.Fatalf("expected authorization_pending on the first poll, got %v", err)
+	}
+	if err := auth.AuthenticateStage2("user@example.com", dc.DeviceCode, dc.Interval, dc.ExpiresIn, cfg, false); err != nil {
+		t.Fatalf("AuthenticateStage2 failed: %v", err)
+	}
+	if cfg.CopilotSKU != "mock_seat" || cfg.CopilotAPIEndpoint != srv.URL || !strings.HasPrefix(cfg.CopilotToken, "tid=mock-") {
+		t.Errorf("unexpected token config: sku %q endpoint %q", cfg.CopilotSKU, cfg.CopilotAPIEndpoint)
+	}
+}
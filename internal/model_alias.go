@@ -0,0 +1,236 @@
+// Package internal provides model aliasing for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// Model alias match types.
+const (
+	ModelAliasExact  = "exact"
+	ModelAliasPrefix = "prefix"
+	ModelAliasGlob   = "glob"
+)
+
+// ModelAlias maps a client-facing model name to a Copilot model ID.
+type ModelAlias struct {
+	Alias string `json:"alias"`           // Model name or pattern sent by clients
+	Model string `json:"model"`           // Copilot model ID used upstream
+	Match string `json:"match,omitempty"` // "exact" (default), "prefix" or "glob"
+}
+
+func (a ModelAlias) matchType() string {
+	if a.Match == "" {
+		return ModelAliasExact
+	}
+	return a.Match
+}
+
+func (a ModelAlias) matches(model string) bool {
+	switch a.matchType() {
+	case ModelAliasExact:
+		return model == a.Alias
+	case ModelAliasPrefix:
+		return strings.HasPrefix(model, a.Alias)
+	case ModelAliasGlob:
+		matched, err := path.Match(a.Alias, model)
+		return err == nil && matched
+	default:
+		return false
+	}
+}
+
+// resolveModelAlias returns the Copilot model ID for a client model name.
+// Exact aliases win over prefixes, the longest prefix wins over shorter ones
+// and globs are tried last in configuration order. Unmatched names are
+// returned unchanged.
+func (c *Config) resolveModelAlias(model string) string {
+	if model == "" || len(c.ModelAliases) == 0 {
+		return model
+	}
+	var prefix, glob *ModelAlias
+	for i := range c.ModelAliases {
+		alias := &c.ModelAliases[i]
+		if !alias.matches(model) {
+			continue
+		}
+		switch alias.matchType() {
+		case ModelAliasExact:
+			return alias.Model
+		case ModelAliasPrefix:
+			if prefix == nil || len(alias.Alias) > len(prefix.Alias) {
+				prefix = alias
+			}
+		case ModelAliasGlob:
+			if glob == nil {
+				glob = alias
+			}
+		}
+	}
+	if prefix != nil {
+		return prefix.Model
+	}
+	if glob != nil {
+		return glob.Model
+	}
+	return model
+}
+
+func (c *Config) validateModelAliases() error {
+	exact := make(map[string]struct{})
+	for i, alias := range c.ModelAliases {
+		field := fmt.Sprintf("model_aliases[%d]", i)
+		if alias.Alias == "" {
+			return NewValidationError(field+".alias", "", "alias cannot be empty", nil)
+		}
+		if alias.Model == "" {
+			return NewValidationError(field+".model", "", "model cannot be empty", nil)
+		}
+		switch alias.matchType() {
+		case ModelAliasExact:
+			if _, dup := exact[alias.Alias]; dup {
+				return NewValidationError(field+".alias", alias.Alias, "duplicate exact alias", nil)
+			}
+			exact[alias.Alias] = struct{}{}
+		case ModelAliasPrefix:
+		case ModelAliasGlob:
+			if _, err := path.Match(alias.Alias, ""); err != nil {
+				return NewValidationError(field+".alias", alias.Alias, "invalid glob pattern", err)
+			}
+		default:
+			return NewValidationError(field+".match", alias.Match, "must be one of exact, prefix, glob", nil)
+		}
+	}
+	return nil
+}
+
+// appendModelAliases adds an entry for every exact alias whose target is in
+// models, so clients can discover the names they may send.
+func (c *Config) appendModelAliases(models []transform.Model) []transform.Model {
+	models = slices.Clip(models) // never append into the shared cached list
+	byID := make(map[string]transform.Model, len(models))
+	for _, m := range models {
+		byID[m.ID] = m
+	}
+	for _, alias := range c.ModelAliases {
+		if alias.matchType() != ModelAliasExact {
+			continue
+		}
+		target, ok := byID[alias.Model]
+		if _, exists := byID[alias.Alias]; !ok || exists {
+			continue
+		}
+		entry := target
+		entry.ID = alias.Alias
+		models = append(models, entry)
+		byID[alias.Alias] = entry
+	}
+	return models
+}
+
+// restoreModelAlias rewrites the model reported in a successful JSON or
+// event-stream response from model back to the alias the client requested.
+func restoreModelAlias(resp *http.Response, alias, model string) {
+	if alias == "" || alias == model || resp.StatusCode >= statusClientError {
+		return
+	}
+	if resp.Header.Get("Content-Type") == "text/event-stream" {
+		resp.Body = readCloser{Reader: &modelAliasReader{src: bufio.NewReader(resp.Body), alias: alias}, Closer: resp.Body}
+		return
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), errReader{err}), Closer: resp.Body}
+		return
+	}
+	if rewritten, ok := replaceModelField(data, alias); ok {
+		data = rewritten
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+	resp.Body = readCloser{Reader: bytes.NewReader(data), Closer: resp.Body}
+}
+
+// errReader returns err from every Read.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// modelAliasReader rewrites the model of each event-stream data line.
+type modelAliasReader struct {
+	src     *bufio.Reader
+	alias   string
+	pending []byte
+	err     error
+}
+
+func (r *modelAliasReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.src.ReadBytes('\n')
+		r.err = err
+		r.pending = rewriteModelDataLine(line, r.alias)
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func rewriteModelDataLine(line []byte, alias string) []byte {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok || !bytes.Contains(data, []byte(`"model"`)) {
+		return line
+	}
+	content := bytes.TrimRight(data, "\r\n")
+	ending := data[len(content):]
+	rewritten, ok := replaceModelField(bytes.TrimSpace(content), alias)
+	if !ok {
+		return line
+	}
+	out := make([]byte, 0, len(rewritten)+len(ending)+6)
+	out = append(out, "data: "...)
+	out = append(out, rewritten...)
+	return append(out, ending...)
+}
+
+// replaceModelField sets the top-level "model" field, and that of an embedded
+// Responses API "response" object, to alias.
+func replaceModelField(data []byte, alias string) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var parsed map[string]any
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, false
+	}
+	changed := false
+	if _, ok := parsed["model"].(string); ok {
+		parsed["model"] = alias
+		changed = true
+	}
+	if response, ok := parsed["response"].(map[string]any); ok {
+		if _, ok := response["model"].(string); ok {
+			response["model"] = alias
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+	encoded, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, false
+	}
+	return encoded, true
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+func testAliasConfig() *Config {
+	return &Config{ModelAliases: []ModelAlias{
+		{Alias: "gpt-4", Model: "gpt-4.1"},
+		{Alias: "claude-3-5-sonnet", Model: "claude-sonnet-4", Match: ModelAliasPrefix},
+		{Alias: "claude-3-5-sonnet-2024", Model: "claude-sonnet-4.5", Match: ModelAliasPrefix},
+		{Alias: "gpt-4o-*", Model: "gpt-4o", Match: ModelAliasGlob},
+	}}
+}
+
+func TestResolveModelAlias(t *testing.T) {
+	cfg := testAliasConfig()
+	tests := map[string]string{
+		"gpt-4":                           "gpt-4.1",
+		"gpt-4-turbo":                     "gpt-4-turbo",
+		"claude-3-5-sonnet-latest":        "claude-sonnet-4",
+		"claude-3-5-sonnet-20241022":      "claude-sonnet-4.5",
+		"gpt-4o-2024-08-06":               "gpt-4o",
+		"gpt-4o":                          "gpt-4o",
+		"":                                "",
+		"claude-3-5-sonnet-2024-extended": "claude-sonnet-4.5",
+	}
+	for requested, want := range tests {
+		if got := cfg.resolveModelAlias(requested); got != want {
+			t.Errorf("resolveModelAlias(%q) = %q, want %q", requested, got, want)
+		}
+	}
+}
+
+func TestValidateModelAliases(t *testing.T) {
+	if err := testAliasConfig().validateModelAliases(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, alias := range map[string]ModelAlias{
+		"empty model": {Alias: "gpt-4"},
+		"bad match":   {Alias: "gpt-4", Model: "gpt-4.1", Match: "regex"},
+		"bad glob":    {Alias: "gpt-[", Model: "gpt-4.1", Match: ModelAliasGlob},
+	} {
+		cfg := &Config{ModelAliases: []ModelAlias{alias}}
+		if err := cfg.validateModelAliases(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestAppendModelAliases(t *testing.T) {
+	cached := make([]transform.Model, 1, 4)
+	cached[0] = transform.Model{ID: "gpt-4.1", Object: "model", OwnedBy: "openai"}
+	models := testAliasConfig().appendModelAliases(cached)
+	if len(models) != 2 || models[1].ID != "gpt-4" || models[1].OwnedBy != "openai" {
+		t.Errorf("expected gpt-4 alias entry, got %+v", models)
+	}
+	if cached[:2][1].ID == "gpt-4" {
+		t.Error("alias entries must not be written into the input slice")
+	}
+}
+
+func TestRestoreModelAlias_Stream(t *testing.T) {
+	upstream := "data: {\"id\":\"c1\",\"model\":\"gpt-4.1\",\"choices\":[]}\n\n" +
+		"event: response.created\ndata: {\"response\":{\"model\":\"gpt-4.1\"}}\n\n" +
+		"data: [DONE]\n\n"
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(upstream)),
+	}
+	restoreModelAlias(resp, "gpt-4", "gpt-4.1")
+	out, _ := io.ReadAll(resp.Body)
+
+	if strings.Contains(string(out), "gpt-4.1") {
+		t.Errorf("expected upstream model to be replaced, got %s", out)
+	}
+	if strings.Count(string(out), `"model":"gpt-4"`) != 2 || !strings.Contains(string(out), "data: [DONE]\n\n") {
+		t.Errorf("unexpected stream %s", out)
+	}
+}
+
+func TestProcessProxyRequest_ModelAlias(t *testing.T) {
+	var upstreamModel string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		upstreamModel, _ = payload["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "64")
+		_, _ = io.WriteString(w, `{"id":"c1","model":"gpt-4.1","choices":[]}`+strings.Repeat(" ", 22))
+	})
+	s.config.Load().ModelAliases = testAliasConfig().ModelAliases
+	s.config.Load().AllowedModels = []string{"gpt-4.1"}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`))
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstreamModel != "gpt-4.1" {
+		t.Errorf("expected upstream model gpt-4.1, got %q", upstreamModel)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if resp["model"] != "gpt-4" {
+		t.Errorf("expected response model to be the alias, got %v", resp["model"])
+	}
+}
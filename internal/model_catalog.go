@@ -0,0 +1,359 @@
+// Package internal provides the live Copilot model catalog for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// Model catalog sources, in the order they are tried.
+const (
+	ModelSourceCopilot   = "copilot"
+	ModelSourceModelsDev = "models.dev"
+	ModelSourceDefaults  = "defaults"
+)
+
+// catalogLog tags model catalog records.
+var catalogLog = Component("catalog")
+
+const (
+	defaultModelCatalogTTL = 15 * time.Minute
+	// modelCatalogRetryInterval bounds how long a fallback catalog is served
+	// before Copilot is asked again.
+	modelCatalogRetryInterval = time.Minute
+	// anonymousSeat keys the catalog used when no user token is available.
+	anonymousSeat = "anonymous"
+)
+
+// copilotModelsResponse is the catalog returned by Copilot's /models endpoint.
+type copilotModelsResponse struct {
+	Data []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Vendor string `json:"vendor"`
+		Policy *struct {
+			State string `json:"state"`
+		} `json:"policy,omitempty"`
+	} `json:"data"`
+}
+
+// catalogTTL returns how long a seat type's catalog is served before it is refreshed.
+func (c *Config) catalogTTL() time.Duration {
+	if c.ModelCatalog.TTL > 0 {
+		return time.Duration(c.ModelCatalog.TTL) * time.Second
+	}
+	return defaultModelCatalogTTL
+}
+
+func (c *Config) validateModelCatalog() error {
+	if c.ModelCatalog.TTL < 0 {
+		return NewValidationError("model_catalog.ttl", c.ModelCatalog.TTL, "must not be negative", nil)
+	}
+	return nil
+}
+
+// seatType identifies the Copilot plan a per-user config belongs to. Users
+// of the same plan see the same catalog.
+func seatType(cfg *Config) string {
+	if cfg == nil {
+		return anonymousSeat
+	}
+	if cfg.CopilotSKU != "" {
+		return cfg.CopilotSKU
+	}
+	if u, err := url.Parse(cfg.apiBase()); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return anonymousSeat
+}
+
+// ModelCatalog serves the models Copilot offers, cached per seat type. The
+// catalog is fetched from Copilot's /models endpoint with a user's token and
+// falls back to models.dev and then to the built-in defaults.
+type ModelCatalog struct {
+	httpClient *http.Client
+	auth       *AuthService
+	config     *ConfigStore
+
+	mutex       sync.Mutex
+	entries     map[string]*catalogEntry
+	defaultUser string
+}
+
+type catalogEntry struct {
+	email      string // user whose token refreshes the entry
+	models     []transform.Model
+	source     string
+	expires    time.Time
+	refreshing bool
+	loaded     chan struct{} // closed once models is set
+	loadOnce   sync.Once
+}
+
+// NewModelCatalog creates a catalog. Without auth, or while no user has a
+// token, only models.dev and the defaults are used. A nil config uses defaults.
+func NewModelCatalog(httpClient *http.Client, auth *AuthService, config *ConfigStore) *ModelCatalog {
+	return &ModelCatalog{
+		httpClient: httpClient,
+		auth:       auth,
+		config:     config,
+		entries:    make(map[string]*catalogEntry),
+	}
+}
+
+func (c *ModelCatalog) baseConfig() *Config {
+	if c.config != nil {
+		return c.config.Load()
+	}
+	return &Config{}
+}
+
+// Models returns the catalog for email's seat type and the source it came
+// from. An empty email uses any user with a stored token. The first call for
+// a seat type waits for the fetch; later calls get the cached list while an
+// expired one is refreshed in the background.
+func (c *ModelCatalog) Models(email string) ([]transform.Model, string) {
+	cfg, email := c.userConfig(email)
+	seat := seatType(cfg)
+
+	c.mutex.Lock()
+	entry, ok := c.entries[seat]
+	if !ok {
+		entry = &catalogEntry{loaded: make(chan struct{})}
+		c.entries[seat] = entry
+	}
+	if email != "" {
+		entry.email = email
+	}
+	start := !entry.refreshing && (!ok || time.Now().After(entry.expires))
+	if start {
+		entry.refreshing = true
+	}
+	c.mutex.Unlock()
+
+	if start {
+		if ok {
+			go c.refresh(seat, entry)
+		} else {
+			c.refresh(seat, entry)
+		}
+	}
+	<-entry.loaded
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return entry.models, entry.source
+}
+
+// has reports whether the cached catalog of any seat type lists model. It
+// never fetches.
+func (c *ModelCatalog) has(model string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, entry := range c.entries {
+		if slices.ContainsFunc(entry.models, func(m transform.Model) bool { return m.ID == model }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run refreshes every cached seat type shortly before it expires until ctx is done.
+func (c *ModelCatalog) Run(ctx context.Context) {
+	for {
+		interval := c.baseConfig().catalogTTL() / 2
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		due := time.Now().Add(interval)
+		c.mutex.Lock()
+		stale := make(map[string]*catalogEntry)
+		for seat, entry := range c.entries {
+			if !entry.refreshing && entry.expires.Before(due) {
+				entry.refreshing = true
+				stale[seat] = entry
+			}
+		}
+		c.mutex.Unlock()
+
+		for seat, entry := range stale {
+			c.refresh(seat, entry)
+		}
+	}
+}
+
+// refresh fetches the catalog for entry's user and stores it. The caller
+// must have set entry.refreshing.
+func (c *ModelCatalog) refresh(seat string, entry *catalogEntry) {
+	c.mutex.Lock()
+	email := entry.email
+	c.mutex.Unlock()
+
+	var cfg *Config
+	if seat != anonymousSeat {
+		cfg, _ = c.userConfig(email)
+	}
+	models, source := c.fetch(cfg)
+
+	ttl := c.baseConfig().catalogTTL()
+	if source != ModelSourceCopilot {
+		ttl = min(ttl, modelCatalogRetryInterval)
+	}
+	c.mutex.Lock()
+	entry.models, entry.source = models, source
+	entry.expires = time.Now().Add(ttl)
+	entry.refreshing = false
+	c.mutex.Unlock()
+	entry.loadOnce.Do(func() { close(entry.loaded) })
+
+	catalogLog.Info("Model catalog refreshed", "seat", seat, "source", source, "count", len(models), "ttl", ttl)
+}
+
+// userConfig returns the per-user config for email, or for any stored user
+// when email is empty. It returns nil when no usable token exists.
+func (c *ModelCatalog) userConfig(email string) (*Config, string) {
+	if c.auth == nil {
+		return nil, ""
+	}
+	if email == "" {
+		email = c.anyUser()
+		if email == "" {
+			return nil, ""
+		}
+	}
+	cfg, err := c.auth.EnsureValidToken(email, c.baseConfig())
+	if err != nil {
+		catalogLog.Warn("No token for model catalog", "email", email, "error", err)
+		c.mutex.Lock()
+		if c.defaultUser == email {
+			c.defaultUser = ""
+		}
+		c.mutex.Unlock()
+		return nil, email
+	}
+	return cfg, email
+}
+
+// anyUser returns the email of a user with a stored token, remembering it
+// for later calls.
+func (c *ModelCatalog) anyUser() string {
+	c.mutex.Lock()
+	email := c.defaultUser
+	c.mutex.Unlock()
+	if email != "" {
+		return email
+	}
+
+	tokens, err := c.auth.store.List(context.Background())
+	if err != nil {
+		catalogLog.Warn("Failed to list tokens for model catalog", "error", err)
+		return ""
+	}
+	for _, token := range tokens {
+		if token.GitHubToken != "" || token.CopilotToken != "" {
+			c.mutex.Lock()
+			c.defaultUser = token.Email
+			c.mutex.Unlock()
+			return token.Email
+		}
+	}
+	return ""
+}
+
+// fetch loads the catalog from Copilot using cfg's token, falling back to
+// models.dev and then to the defaults.
+func (c *ModelCatalog) fetch(cfg *Config) ([]transform.Model, string) {
+	if cfg != nil {
+		models, err := FetchFromCopilot(c.httpClient, cfg)
+		if err == nil && len(models.Data) > 0 {
+			return models.Data, ModelSourceCopilot
+		}
+		catalogLog.Warn("Failed to fetch models from Copilot, trying models.dev", "error", err)
+	}
+
+	models, err := FetchFromModelsDevURL(c.httpClient, c.baseConfig().modelsDevEndpoint())
+	if err == nil {
+		return models.Data, ModelSourceModelsDev
+	}
+	catalogLog.Warn("Failed to fetch from models.dev, using default models", "error", err)
+	return GetDefault(), ModelSourceDefaults
+}
+
+// FetchFromCopilot fetches the models available to cfg's Copilot token.
+// Models whose policy is not enabled for the seat are left out.
+func FetchFromCopilot(httpClient *http.Client, cfg *Config) (*transform.ModelList, error) {
+	modelsURL := cfg.apiBase() + "/models"
+	req, err := http.NewRequest(http.MethodGet, modelsURL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.CopilotToken)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", cfg.Headers.UserAgent)
+	req.Header.Set("Editor-Version", cfg.Headers.EditorVersion)
+	req.Header.Set("Editor-Plugin-Version", cfg.Headers.EditorPluginVersion)
+	req.Header.Set("Copilot-Integration-Id", cfg.Headers.CopilotIntegrationID)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, NewNetworkError("fetch_copilot_models", modelsURL, "request failed", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			catalogLog.Warn("Error closing response body", "error", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewNetworkError("fetch_copilot_models", modelsURL, fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
+	}
+
+	var catalog copilotModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	seen := make(map[string]struct{}, len(catalog.Data))
+	models := make([]transform.Model, 0, len(catalog.Data))
+	for _, m := range catalog.Data {
+		if m.ID == "" || (m.Policy != nil && m.Policy.State != "enabled") {
+			continue
+		}
+		if _, dup := seen[m.ID]; dup {
+			continue
+		}
+		seen[m.ID] = struct{}{}
+		models = append(models, transform.Model{
+			ID:      m.ID,
+			Object:  "model",
+			Created: now,
+			OwnedBy: modelOwner(m.Vendor + " " + m.Name + " " + m.ID),
+		})
+	}
+	return &transform.ModelList{Object: "list", Data: models}, nil
+}
+
+// catalogUser returns the email of the user making r, or "" when r does not
+// identify one. Listing models stays open to clients without credentials.
+func (s *ProxyService) catalogUser(r *http.Request) string {
+	if requestAPIKey(r) == "" && r.URL.Query().Get("email") == "" {
+		return ""
+	}
+	identity, err := s.authenticateRequest(r)
+	if err != nil {
+		catalogLog.Debug("Listing models without a user", "error", err)
+		return ""
+	}
+	return identity.Email
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// staticModelCatalog returns a catalog that serves models without fetching.
+func staticModelCatalog(models ...transform.Model) *ModelCatalog {
+	catalog := NewModelCatalog(&http.Client{}, nil, nil)
+	entry := &catalogEntry{models: models, source: ModelSourceDefaults, expires: time.Now().Add(time.Hour), loaded: make(chan struct{})}
+	entry.loadOnce.Do(func() { close(entry.loaded) })
+	catalog.entries[anonymousSeat] = entry
+	return catalog
+}
+
+// newCatalogTestServer serves Copilot's /models per token and fails models.dev.
+func newCatalogTestServer(t *testing.T, catalogs map[string]*atomic.Value) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/models" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, ok := catalogs[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, body.Load().(string))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newCatalogTestAuth(t *testing.T, tokens ...StoredToken) *AuthService {
+	t.Helper()
+	store := NewMemoryTokenStore()
+	for i := range tokens {
+		tokens[i].GitHubToken = "gh"
+		tokens[i].ExpiresAt = time.Now().Add(time.Hour).Unix()
+		if err := store.Put(context.Background(), &tokens[i]); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	return NewAuthService(&http.Client{}, WithTokenStore(store))
+}
+
+func catalogIDs(models []transform.Model) string {
+	ids := make([]string, 0, len(models))
+	for _, m := range models {
+		ids = append(ids, m.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestFetchFromCopilot(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		_, _ = io.WriteString(w, `{"data":[
+			{"id":"gpt-4.1","name":"GPT-4.1","vendor":"Azure OpenAI","policy":{"state":"enabled"}},
+			{"id":"gpt-4.1","name":"GPT-4.1","vendor":"Azure OpenAI"},
+			{"id":"claude-opus-4","name":"Claude Opus 4","vendor":"Anthropic","policy":{"state":"unconfigured"}},
+			{"id":"gemini-2.5-pro","name":"Gemini 2.5 Pro","vendor":"Google"}
+		]}`)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{CopilotToken: "copilot-test-token"}
+	cfg.Upstream.CopilotAPI = srv.URL
+	models, err := FetchFromCopilot(srv.Client(), cfg)
+	if err != nil {
+		t.Fatalf("FetchFromCopilot failed: %v", err)
+	}
+	if gotAuth != "Bearer copilot-test-token" {
+		t.Errorf("expected Copilot token, got %q", gotAuth)
+	}
+	if got := catalogIDs(models.Data); got != "gpt-4.1,gemini-2.5-pro" {
+		t.Errorf("unexpected models %s", got)
+	}
+	if models.Data[0].OwnedBy != "openai" || models.Data[1].OwnedBy != "google" {
+		t.Errorf("unexpected owners %+v", models.Data)
+	}
+}
+
+func TestModelCatalog_PerSeatType(t *testing.T) {
+	business, individual := &atomic.Value{}, &atomic.Value{}
+	business.Store(`{"data":[{"id":"gpt-4.1"},{"id":"claude-sonnet-4.5"}]}`)
+	individual.Store(`{"data":[{"id":"gpt-4.1"}]}`)
+	srv := newCatalogTestServer(t, map[string]*atomic.Value{"tok-business": business, "tok-individual": individual})
+
+	auth := newCatalogTestAuth(t,
+		StoredToken{Email: "a@example.com", CopilotToken: "tok-business", SKU: "copilot_for_business_seat"},
+		StoredToken{Email: "b@example.com", CopilotToken: "tok-individual", SKU: "monthly_subscriber"},
+		StoredToken{Email: "c@example.com", CopilotToken: "tok-broken", SKU: "free_limited_copilot"})
+	cfg := &Config{}
+	cfg.Upstream.CopilotAPI = srv.URL
+	cfg.Upstream.ModelsDevURL = srv.URL + "/api.json"
+	catalog := NewModelCatalog(srv.Client(), auth, NewConfigStore(cfg, ""))
+
+	if models, source := catalog.Models("a@example.com"); catalogIDs(models) != "gpt-4.1,claude-sonnet-4.5" || source != ModelSourceCopilot {
+		t.Errorf("business seat: got %s from %s", catalogIDs(models), source)
+	}
+	if models, _ := catalog.Models("b@example.com"); catalogIDs(models) != "gpt-4.1" {
+		t.Errorf("individual seat: got %s", catalogIDs(models))
+	}
+	if models, _ := catalog.Models(""); catalogIDs(models) != "gpt-4.1,claude-sonnet-4.5" {
+		t.Errorf("expected any stored user's catalog, got %s", catalogIDs(models))
+	}
+	if models, source := catalog.Models("c@example.com"); source != ModelSourceDefaults || len(models) != len(GetDefault()) {
+		t.Errorf("expected default models when Copilot and models.dev fail, got %d from %s", len(models), source)
+	}
+}
+
+func TestModelCatalog_RefreshesExpiredSeat(t *testing.T) {
+	business := &atomic.Value{}
+	business.Store(`{"data":[{"id":"gpt-4.1"}]}`)
+	srv := newCatalogTestServer(t, map[string]*atomic.Value{"tok-business": business})
+	auth := newCatalogTestAuth(t, StoredToken{Email: "a@example.com", CopilotToken: "tok-business", SKU: "copilot_for_business_seat"})
+	cfg := &Config{}
+	cfg.Upstream.CopilotAPI = srv.URL
+	catalog := NewModelCatalog(srv.Client(), auth, NewConfigStore(cfg, ""))
+
+	if models, _ := catalog.Models("a@example.com"); catalogIDs(models) != "gpt-4.1" {
+		t.Fatalf("unexpected initial catalog %s", catalogIDs(models))
+	}
+
+	business.Store(`{"data":[{"id":"gpt-4.1"},{"id":"gpt-5"}]}`)
+	catalog.mutex.Lock()
+	catalog.entries["copilot_for_business_seat"].expires = time.Now().Add(-time.Second)
+	catalog.mutex.Unlock()
+
+	if models, _ := catalog.Models("a@example.com"); catalogIDs(models) != "gpt-4.1" {
+		t.Errorf("expected the stale catalog while refreshing, got %s", catalogIDs(models))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		models, _ := catalog.Models("a@example.com")
+		if catalogIDs(models) == "gpt-4.1,gpt-5" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired catalog was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
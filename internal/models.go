@@ -6,18 +6,11 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
 )
 
-var (
-	cachedModels *transform.ModelList
-	modelsMutex  sync.RWMutex
-	modelsLoaded bool
-)
-
 // ModelsDevResponse represents the structure from models.dev API
 type ModelsDevResponse map[string]struct {
 	ID     string `json:"id"`
@@ -31,7 +24,12 @@ type ModelsDevResponse map[string]struct {
 
 // FetchFromModelsDev fetches models from models.dev API as fallback
 func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
-	resp, err := httpClient.Get("https://models.dev/api.json")
+	return FetchFromModelsDevURL(httpClient, defaultModelsDevURL)
+}
+
+// FetchFromModelsDevURL fetches models from a models.dev compatible catalog at url.
+func FetchFromModelsDevURL(httpClient *http.Client, url string) (*transform.ModelList, error) {
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +40,7 @@ func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, NewNetworkError("fetch_models", "https://models.dev/api.json", fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
+		return nil, NewNetworkError("fetch_models", url, fmt.Sprintf("API returned HTTP %d", resp.StatusCode), nil)
 	}
 
 	var providers ModelsDevResponse
@@ -60,17 +58,7 @@ func FetchFromModelsDev(httpClient *http.Client) (*transform.ModelList, error) {
 	for modelID, modelInfo := range copilotProvider.Models {
 		ownedBy := modelInfo.OwnedBy
 		if ownedBy == "" {
-			// Determine owner based on model name
-			switch {
-			case containsAny(modelInfo.Name, []string{"claude", "anthropic"}):
-				ownedBy = "anthropic"
-			case containsAny(modelInfo.Name, []string{"gpt", "o1", "o3", "o4", "openai"}):
-				ownedBy = "openai"
-			case containsAny(modelInfo.Name, []string{"gemini", "google"}):
-				ownedBy = "google"
-			default:
-				ownedBy = "github-copilot"
-			}
+			ownedBy = modelOwner(modelInfo.Name)
 		}
 
 		models = append(models, transform.Model{
@@ -112,6 +100,20 @@ func GetDefault() []transform.Model {
 	}
 }
 
+// modelOwner determines the owner of a model from its name or vendor.
+func modelOwner(name string) string {
+	switch {
+	case containsAny(name, []string{"claude", "anthropic"}):
+		return "anthropic"
+	case containsAny(name, []string{"gpt", "o1", "o3", "o4", "openai"}):
+		return "openai"
+	case containsAny(name, []string{"gemini", "google"}):
+		return "google"
+	default:
+		return "github-copilot"
+	}
+}
+
 // containsAny checks if text contains any of the substrings
 func containsAny(text string, substrings []string) bool {
 	textLower := strings.ToLower(text)
@@ -127,14 +129,50 @@ func containsAny(text string, substrings []string) bool {
 type ModelsService struct {
 	coalescingCache CoalescingCacheInterface
 	httpClient      *http.Client
+	config          *ConfigStore
+	catalog         *ModelCatalog
+	userEmail       func(*http.Request) string
 }
 
 // NewModelsService creates a new models service
-func NewModelsService(cache CoalescingCacheInterface, httpClient *http.Client) *ModelsService {
-	return &ModelsService{
+func NewModelsService(cache CoalescingCacheInterface, httpClient *http.Client, opts ...func(*ModelsService)) *ModelsService {
+	s := &ModelsService{
 		coalescingCache: cache,
 		httpClient:      httpClient,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.catalog == nil {
+		s.catalog = NewModelCatalog(httpClient, nil, s.config)
+	}
+	return s
+}
+
+// WithModelsConfig makes the models service filter by the allowed_models of
+// the current snapshot in store instead of reading the config file per request.
+func WithModelsConfig(store *ConfigStore) func(*ModelsService) {
+	return func(s *ModelsService) {
+		s.config = store
+	}
+}
+
+// WithModelCatalog serves the models from catalog. userEmail identifies the
+// user whose seat type is listed; an empty result lists any user's catalog.
+func WithModelCatalog(catalog *ModelCatalog, userEmail func(*http.Request) string) func(*ModelsService) {
+	return func(s *ModelsService) {
+		s.catalog = catalog
+		s.userEmail = userEmail
+	}
+}
+
+// currentConfig returns the configuration snapshot, falling back to the
+// config file when the service was created without a store.
+func (s *ModelsService) currentConfig() (*Config, error) {
+	if s.config != nil {
+		return s.config.Load(), nil
+	}
+	return LoadConfig(true)
 }
 
 // CoalescingCacheInterface interface for request coalescing
@@ -144,69 +182,8 @@ type CoalescingCacheInterface interface {
 } // Handler returns an HTTP handler for the models endpoint.
 // Handler returns an HTTP handler for the models endpoint.
 func (s *ModelsService) Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		// Use request coalescing for identical concurrent requests
-		requestKey := s.coalescingCache.GetRequestKey("GET", "/v1/models", nil)
-
-		result := s.coalescingCache.CoalesceRequest(requestKey, func() interface{} {
-			// Check cache first
-			modelsMutex.RLock()
-			if modelsLoaded && cachedModels != nil {
-				modelsMutex.RUnlock()
-				return cachedModels
-			}
-			modelsMutex.RUnlock()
-
-			// Load models if not cached
-			modelsMutex.Lock()
-			defer modelsMutex.Unlock()
-
-			// Double-check in case another goroutine loaded while we waited
-			if modelsLoaded && cachedModels != nil {
-				return cachedModels
-			}
-
-			Info("Loading models for the first time...")
-
-			// Try models.dev API first (don't hit GitHub Copilot for models list)
-			modelList, err := FetchFromModelsDev(s.httpClient)
-			if err != nil {
-				Warn("Failed to fetch from models.dev, using default models", "error", err)
-
-				// Ultimate fallback to hardcoded models
-				modelList = &transform.ModelList{
-					Object: "list",
-					Data:   GetDefault(),
-				}
-			}
-
-			// Cache the results
-			cachedModels = modelList
-			modelsLoaded = true
-
-			Info("Loaded and cached models", "count", len(modelList.Data))
-			return modelList
-		})
-
-		modelList := result.(*transform.ModelList)
-		// Filter if allowed_models is set in config
-		cfg, cfgErr := LoadConfig(true)
-		filtered := modelList.Data
-		filteredMsg := ""
-		if cfgErr == nil && cfg.AllowedModels != nil && len(cfg.AllowedModels) > 0 {
-			allowedSet := make(map[string]struct{}, len(cfg.AllowedModels))
-			for _, name := range cfg.AllowedModels {
-				allowedSet[name] = struct{}{}
-			}
-			var modelsFiltered []transform.Model
-			for _, m := range filtered {
-				if _, ok := allowedSet[m.ID]; ok {
-					modelsFiltered = append(modelsFiltered, m)
-				}
-			}
-			filtered = modelsFiltered
-			filteredMsg = "(filtered by allowed_models from config)"
-		}
+	return func(w http.ResponseWriter, r *http.Request) {
+		filtered, filteredMsg := s.listModels(r)
 		resp := struct {
 			Object   string            `json:"object"`
 			Data     []transform.Model `json:"data"`
@@ -224,3 +201,48 @@ func (s *ModelsService) Handler() http.HandlerFunc {
 		}
 	}
 }
+
+// listModels returns the model catalog for the requesting user's seat type,
+// filtered by allowed_models. The note is non-empty when filtering was applied.
+func (s *ModelsService) listModels(r *http.Request) ([]transform.Model, string) {
+	email := ""
+	if s.userEmail != nil {
+		email = s.userEmail(r)
+	}
+
+	// Use request coalescing for identical concurrent requests
+	requestKey := s.coalescingCache.GetRequestKey("GET", "/v1/models", email)
+	cfg, cfgErr := s.currentConfig()
+
+	result := s.coalescingCache.CoalesceRequest(requestKey, func() interface{} {
+		models, _ := s.catalog.Models(email)
+		return models
+	})
+
+	// Filter if allowed_models is set in config
+	filtered := result.([]transform.Model)
+	filteredMsg := ""
+	if cfgErr == nil && len(cfg.AllowedModels) > 0 {
+		filtered = filterAllowedModels(filtered, cfg.AllowedModels)
+		filteredMsg = "(filtered by allowed_models from config)"
+	}
+	if cfgErr == nil {
+		filtered = cfg.appendModelAliases(filtered)
+	}
+	return filtered, filteredMsg
+}
+
+// filterAllowedModels returns the models whose ID is in allowed.
+func filterAllowedModels(models []transform.Model, allowed []string) []transform.Model {
+	allowedSet := make(map[string]struct{}, len(allowed))
+	for _, name := range allowed {
+		allowedSet[name] = struct{}{}
+	}
+	var filtered []transform.Model
+	for _, m := range models {
+		if _, ok := allowedSet[m.ID]; ok {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,555 @@
+// Package internal provides the Ollama API translation layer for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// ollamaLog tags records about Ollama API requests.
+var ollamaLog = Component("ollama")
+
+const (
+	ollamaContentType = "application/x-ndjson"
+
+	// ollamaVersion is reported by /api/version; clients use it for feature detection.
+	ollamaVersion = "0.6.0"
+)
+
+// OllamaChatHandler returns an HTTP handler for the Ollama /api/chat endpoint.
+func (s *ProxyService) OllamaChatHandler() http.HandlerFunc {
+	return s.handle(s.processOllamaChatRequest, writeOllamaError)
+}
+
+// OllamaGenerateHandler returns an HTTP handler for the Ollama /api/generate endpoint.
+func (s *ProxyService) OllamaGenerateHandler() http.HandlerFunc {
+	return s.handle(s.processOllamaGenerateRequest, writeOllamaError)
+}
+
+func (s *ProxyService) processOllamaChatRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ollamaLog.DebugContext(ctx, "Starting Ollama chat request", "method", r.Method, "path", r.URL.Path)
+
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
+
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
+	}
+
+	var req transform.OllamaChatRequest
+	if jsonErr := json.Unmarshal(body, &req); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	payload, err := ollamaChatToChatPayload(&req)
+	if err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	return s.forwardOllama(ctx, w, r, identity, payload, req.Model, false)
+}
+
+func (s *ProxyService) processOllamaGenerateRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ollamaLog.DebugContext(ctx, "Starting Ollama generate request", "method", r.Method, "path", r.URL.Path)
+
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
+
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
+	}
+
+	var req transform.OllamaGenerateRequest
+	if jsonErr := json.Unmarshal(body, &req); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	payload, err := ollamaGenerateToChatPayload(&req)
+	if err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	return s.forwardOllama(ctx, w, r, identity, payload, req.Model, true)
+}
+
+// forwardOllama sends a translated chat payload upstream and writes the result
+// back as Ollama chat or generate responses, streamed as NDJSON.
+func (s *ProxyService) forwardOllama(ctx context.Context, w http.ResponseWriter, r *http.Request, identity *requestIdentity, payload map[string]any, model string, generate bool) error {
+	start := time.Now()
+	upstreamModel, _ := payload["model"].(string)
+	upstreamModel = s.config.Load().resolveModelAlias(upstreamModel)
+	payload["model"] = upstreamModel
+	requestInfoFromContext(ctx).setCaller(identity, upstreamModel)
+	if err := identity.authorize(r.URL.Path, upstreamModel); err != nil {
+		return err
+	}
+
+	resp, _, route, err := s.forwardWithFallback(ctx, http.MethodPost, identity.Email, upstreamModel, fixedRoute("/chat/completions", payload, nil))
+	if err != nil {
+		return err
+	}
+	servedModel := route.model
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			ollamaLog.WarnContext(ctx, "Error closing response body", "error", err)
+		}
+	}()
+	setServedModel(ctx, w, identity.Email, servedModel)
+
+	if resp.StatusCode >= statusClientError {
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		upstreamBody, _ := io.ReadAll(resp.Body)
+		writeOllamaError(w, resp.StatusCode, upstreamErrorMessage(upstreamBody))
+		return nil
+	}
+
+	streaming := resp.Header.Get("Content-Type") == "text/event-stream"
+	meter := meterResponseBody(resp, streaming)
+	out := newOllamaWriter(w, model, generate, start)
+
+	if streaming {
+		requestInfoFromContext(ctx).setStreaming()
+		w.Header().Set("Content-Type", ollamaContentType)
+		w.WriteHeader(http.StatusOK)
+		if err := out.translate(ctx, resp.Body); err != nil {
+			return err
+		}
+		s.recordUsage(r.URL.Path, servedModel, identity, meter, streaming)
+		return nil
+	}
+
+	var completion transform.ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return NewProxyError("decode_response", "failed to decode chat completion response", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := out.writeCompletion(&completion); err != nil {
+		return err
+	}
+	s.recordUsage(r.URL.Path, servedModel, identity, meter, streaming)
+	return nil
+}
+
+// ollamaModelName strips the default ":latest" tag Ollama clients append to model names.
+func ollamaModelName(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+// ollamaChatToChatPayload converts an Ollama chat request into a Copilot chat/completions payload.
+func ollamaChatToChatPayload(req *transform.OllamaChatRequest) (map[string]any, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+
+	// Ollama tool calls carry no IDs; assign them in order and hand them to
+	// the tool results that follow.
+	messages := make([]map[string]any, 0, len(req.Messages))
+	var pendingCalls []string
+	nextCall := 0
+	for i, msg := range req.Messages {
+		converted := map[string]any{"role": msg.Role}
+		switch msg.Role {
+		case "system", "user":
+			content, err := ollamaMessageContent(msg)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			converted["content"] = content
+		case "assistant":
+			converted["content"] = msg.Content
+			if len(msg.ToolCalls) > 0 {
+				calls := make([]map[string]any, 0, len(msg.ToolCalls))
+				for _, call := range msg.ToolCalls {
+					id := fmt.Sprintf("call_%d", nextCall)
+					nextCall++
+					pendingCalls = append(pendingCalls, id)
+					arguments := string(call.Function.Arguments)
+					if arguments == "" || arguments == "null" {
+						arguments = "{}"
+					}
+					calls = append(calls, map[string]any{
+						"id":       id,
+						"type":     "function",
+						"function": map[string]any{"name": call.Function.Name, "arguments": arguments},
+					})
+				}
+				converted["tool_calls"] = calls
+			}
+		case "tool":
+			if len(pendingCalls) == 0 {
+				return nil, fmt.Errorf("messages[%d]: tool message without a preceding tool call", i)
+			}
+			converted["tool_call_id"] = pendingCalls[0]
+			pendingCalls = pendingCalls[1:]
+			converted["content"] = msg.Content
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, msg.Role)
+		}
+		messages = append(messages, converted)
+	}
+
+	payload := map[string]any{
+		"model":    ollamaModelName(req.Model),
+		"messages": messages,
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = req.Tools
+	}
+	if err := applyOllamaOptions(payload, req.Options, req.Format, req.Stream); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ollamaGenerateToChatPayload converts an Ollama generate request into a single-turn chat payload.
+func ollamaGenerateToChatPayload(req *transform.OllamaGenerateRequest) (map[string]any, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	if req.Suffix != "" {
+		return nil, fmt.Errorf("suffix (fill-in-the-middle) is not supported")
+	}
+
+	messages := make([]map[string]any, 0, 2)
+	if req.System != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": req.System})
+	}
+	content, err := ollamaMessageContent(transform.OllamaMessage{Role: "user", Content: req.Prompt, Images: req.Images})
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, map[string]any{"role": "user", "content": content})
+
+	payload := map[string]any{
+		"model":    ollamaModelName(req.Model),
+		"messages": messages,
+	}
+	if err := applyOllamaOptions(payload, req.Options, req.Format, req.Stream); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ollamaMessageContent returns plain text content, or content parts when the message has images.
+func ollamaMessageContent(msg transform.OllamaMessage) (any, error) {
+	if len(msg.Images) == 0 {
+		return msg.Content, nil
+	}
+	parts := make([]map[string]any, 0, len(msg.Images)+1)
+	if msg.Content != "" {
+		parts = append(parts, map[string]any{"type": "text", "text": msg.Content})
+	}
+	for i, image := range msg.Images {
+		decoded, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return nil, fmt.Errorf("images[%d]: invalid base64: %w", i, err)
+		}
+		mediaType := http.DetectContentType(decoded)
+		if !strings.HasPrefix(mediaType, "image/") {
+			return nil, fmt.Errorf("images[%d]: unsupported content type %s", i, mediaType)
+		}
+		parts = append(parts, map[string]any{
+			"type":      "image_url",
+			"image_url": map[string]any{"url": "data:" + mediaType + ";base64," + image},
+		})
+	}
+	return parts, nil
+}
+
+// applyOllamaOptions maps Ollama options, format and stream flags onto the chat payload.
+func applyOllamaOptions(payload map[string]any, options *transform.OllamaOptions, format json.RawMessage, stream *bool) error {
+	if options != nil {
+		if options.Temperature != nil {
+			payload["temperature"] = *options.Temperature
+		}
+		if options.TopP != nil {
+			payload["top_p"] = *options.TopP
+		}
+		if options.NumPredict != nil && *options.NumPredict > 0 {
+			payload["max_tokens"] = *options.NumPredict
+		}
+		if len(options.Stop) > 0 {
+			payload["stop"] = options.Stop
+		}
+		if options.Seed != nil {
+			payload["seed"] = *options.Seed
+		}
+	}
+
+	switch trimmed := strings.TrimSpace(string(format)); {
+	case trimmed == "" || trimmed == "null" || trimmed == `""`:
+	case trimmed == `"json"`:
+		payload["response_format"] = map[string]any{"type": "json_object"}
+	case strings.HasPrefix(trimmed, "{"):
+		payload["response_format"] = map[string]any{
+			"type":        "json_schema",
+			"json_schema": map[string]any{"name": "response", "schema": format},
+		}
+	default:
+		return fmt.Errorf("unsupported format %s", trimmed)
+	}
+
+	if stream == nil || *stream {
+		payload["stream"] = true
+		payload["stream_options"] = map[string]any{"include_usage": true}
+	}
+	return nil
+}
+
+// ollamaWriter renders chat completion output as Ollama chat or generate responses.
+type ollamaWriter struct {
+	w         io.Writer
+	model     string
+	generate  bool
+	start     time.Time
+	toolCalls []transform.ToolCall
+	usage     *transform.ChatCompletionUsage
+	reason    string
+}
+
+func newOllamaWriter(w io.Writer, model string, generate bool, start time.Time) *ollamaWriter {
+	return &ollamaWriter{w: w, model: model, generate: generate, start: start}
+}
+
+// translate converts an upstream chat completion event stream into NDJSON lines.
+func (o *ollamaWriter) translate(ctx context.Context, body io.Reader) error {
+	err := readSSEEvents(body, func(event sseEvent) error {
+		data := strings.TrimSpace(event.Data)
+		if data == "" || data == "[DONE]" {
+			return nil
+		}
+		var chunk transform.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			ollamaLog.WarnContext(ctx, "Skipping undecodable stream chunk", "error", err)
+			return nil
+		}
+		if chunk.Usage != nil {
+			o.usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			for _, call := range choice.Delta.ToolCalls {
+				o.appendToolCall(call)
+			}
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				o.reason = *choice.FinishReason
+			}
+			if choice.Delta.Content != "" {
+				if err := o.emit(choice.Delta.Content, nil, false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ollamaLog.ErrorContext(ctx, "Error translating Ollama stream", "error", err)
+		return err
+	}
+
+	if len(o.toolCalls) > 0 {
+		if err := o.emit("", o.toolCalls, false); err != nil {
+			return err
+		}
+	}
+	return o.emit("", nil, true)
+}
+
+// appendToolCall accumulates streamed tool call fragments; Ollama sends each call whole.
+func (o *ollamaWriter) appendToolCall(call transform.ToolCall) {
+	if call.ID != "" || len(o.toolCalls) == 0 || o.toolCalls[len(o.toolCalls)-1].Index != call.Index {
+		o.toolCalls = append(o.toolCalls, call)
+		return
+	}
+	last := &o.toolCalls[len(o.toolCalls)-1]
+	if call.Function.Name != "" {
+		last.Function.Name = call.Function.Name
+	}
+	last.Function.Arguments += call.Function.Arguments
+}
+
+// writeCompletion writes a non-streaming response as a single JSON object.
+// Copilot may return text and tool calls in separate choices, so all
+// choices are combined.
+func (o *ollamaWriter) writeCompletion(completion *transform.ChatCompletionResponse) error {
+	o.usage = &completion.Usage
+	var content strings.Builder
+	for _, choice := range completion.Choices {
+		content.WriteString(choice.Message.Content)
+		o.toolCalls = append(o.toolCalls, choice.Message.ToolCalls...)
+		if choice.FinishReason != "" && o.reason != "tool_calls" {
+			o.reason = choice.FinishReason
+		}
+	}
+	return o.write(content.String(), o.toolCalls, true)
+}
+
+func (o *ollamaWriter) emit(content string, toolCalls []transform.ToolCall, done bool) error {
+	if err := o.write(content, toolCalls, done); err != nil {
+		return err
+	}
+	if flusher, ok := o.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (o *ollamaWriter) write(content string, toolCalls []transform.ToolCall, done bool) error {
+	var stats transform.OllamaMetrics
+	if done {
+		stats = o.doneMetrics()
+	}
+	createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var response any
+	if o.generate {
+		response = transform.OllamaGenerateResponse{
+			Model: o.model, CreatedAt: createdAt, Response: content, Done: done, OllamaMetrics: stats,
+		}
+	} else {
+		message := transform.OllamaMessage{Role: "assistant", Content: content}
+		for _, call := range toolCalls {
+			arguments := json.RawMessage(call.Function.Arguments)
+			if !json.Valid(arguments) {
+				arguments = json.RawMessage("{}")
+			}
+			message.ToolCalls = append(message.ToolCalls, transform.OllamaToolCall{
+				Function: transform.OllamaToolCallFunction{Name: call.Function.Name, Arguments: arguments},
+			})
+		}
+		response = transform.OllamaChatResponse{
+			Model: o.model, CreatedAt: createdAt, Message: message, Done: done, OllamaMetrics: stats,
+		}
+	}
+	return json.NewEncoder(o.w).Encode(response)
+}
+
+func (o *ollamaWriter) doneMetrics() transform.OllamaMetrics {
+	stats := transform.OllamaMetrics{
+		DoneReason:    ollamaDoneReason(o.reason),
+		TotalDuration: time.Since(o.start).Nanoseconds(),
+	}
+	if o.usage != nil {
+		stats.PromptEvalCount = o.usage.PromptTokens
+		stats.EvalCount = o.usage.CompletionTokens
+	}
+	return stats
+}
+
+func ollamaDoneReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "length"
+	case "", "stop", "tool_calls", "function_call":
+		return "stop"
+	default:
+		return finishReason
+	}
+}
+
+// writeOllamaError writes an error in the Ollama API format.
+func writeOllamaError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		ollamaLog.Error("Failed to encode Ollama error response", "error", err)
+	}
+}
+
+// OllamaTagsHandler returns an HTTP handler for /api/tags, listing the same models as /v1/models.
+func (s *ModelsService) OllamaTagsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		models, _ := s.listModels(r)
+		resp := transform.OllamaTagsResponse{Models: make([]transform.OllamaModel, 0, len(models))}
+		for _, model := range models {
+			resp.Models = append(resp.Models, ollamaModel(model))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			ollamaLog.ErrorContext(r.Context(), "Error encoding Ollama tags response", "error", err)
+		}
+	}
+}
+
+// OllamaShowHandler returns an HTTP handler for /api/show.
+func (s *ModelsService) OllamaShowHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOllamaError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req transform.OllamaShowRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(&req); err != nil {
+			writeOllamaError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+		name := req.Model
+		if name == "" {
+			name = req.Name
+		}
+		name = ollamaModelName(name)
+
+		models, _ := s.listModels(r)
+		for _, model := range models {
+			if model.ID != name {
+				continue
+			}
+			info := ollamaModel(model)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(transform.OllamaShowResponse{
+				Template:     "{{ .Prompt }}",
+				Details:      info.Details,
+				ModelInfo:    map[string]any{"general.architecture": info.Details.Family, "general.basename": model.ID},
+				Capabilities: []string{"completion", "tools"},
+				ModifiedAt:   info.ModifiedAt,
+			}); err != nil {
+				ollamaLog.ErrorContext(r.Context(), "Error encoding Ollama show response", "error", err)
+			}
+			return
+		}
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", name))
+	}
+}
+
+// OllamaVersionHandler reports an Ollama version for clients that check it before connecting.
+func OllamaVersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"version": ollamaVersion})
+	}
+}
+
+func ollamaModel(model transform.Model) transform.OllamaModel {
+	digest := sha256.Sum256([]byte(model.ID))
+	return transform.OllamaModel{
+		Name:       model.ID,
+		Model:      model.ID,
+		ModifiedAt: time.Unix(model.Created, 0).UTC().Format(time.RFC3339),
+		Digest:     hex.EncodeToString(digest[:]),
+		Details: transform.OllamaModelDetails{
+			Format:   "api",
+			Family:   model.OwnedBy,
+			Families: []string{model.OwnedBy},
+		},
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// A 1x1 PNG, base64 encoded as Ollama clients send images.
+const testPNGBase64 = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+func TestOllamaChatToChatPayload(t *testing.T) {
+	raw := `{
+		"model": "gpt-4o:latest",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "What is in this picture?", "images": ["` + testPNGBase64 + `"]},
+			{"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "lookup", "arguments": {"q": "pixel"}}}]},
+			{"role": "tool", "content": "a single pixel"}
+		],
+		"format": "json",
+		"options": {"temperature": 0.2, "num_predict": 64, "stop": ["END"]}
+	}`
+
+	var req transform.OllamaChatRequest
+	if err := json.Unmarshal([]byte(raw), &req); err != nil {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	payload, err := ollamaChatToChatPayload(&req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if payload["model"] != "gpt-4o" {
+		t.Errorf("expected :latest tag to be stripped, got %v", payload["model"])
+	}
+	if payload["stream"] != true {
+		t.Error("expected Ollama requests to stream by default")
+	}
+	if payload["max_tokens"] != 64 || payload["temperature"] != 0.2 {
+		t.Errorf("options not mapped: %v", payload)
+	}
+	if format := payload["response_format"].(map[string]any); format["type"] != "json_object" {
+		t.Errorf("unexpected response_format %v", format)
+	}
+
+	messages := payload["messages"].([]map[string]any)
+	parts, ok := messages[1]["content"].([]map[string]any)
+	if !ok || len(parts) != 2 {
+		t.Fatalf("expected text and image parts, got %v", messages[1]["content"])
+	}
+	url := parts[1]["image_url"].(map[string]any)["url"].(string)
+	if !strings.HasPrefix(url, "data:image/png;base64,") {
+		t.Errorf("unexpected image url %q", url)
+	}
+
+	calls := messages[2]["tool_calls"].([]map[string]any)
+	function := calls[0]["function"].(map[string]any)
+	if function["arguments"] != `{"q": "pixel"}` {
+		t.Errorf("expected arguments as a JSON string, got %v", function["arguments"])
+	}
+	if messages[3]["tool_call_id"] != calls[0]["id"] {
+		t.Errorf("tool result not linked to its call: %v vs %v", messages[3]["tool_call_id"], calls[0]["id"])
+	}
+}
+
+func TestOllamaGenerateToChatPayload(t *testing.T) {
+	stream := false
+	req := &transform.OllamaGenerateRequest{Model: "gpt-4o", System: "Be brief.", Prompt: "Hi", Stream: &stream}
+	payload, err := ollamaGenerateToChatPayload(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := payload["stream"]; ok {
+		t.Error("expected stream to be omitted when disabled")
+	}
+	if messages := payload["messages"].([]map[string]any); len(messages) != 2 || messages[1]["content"] != "Hi" {
+		t.Errorf("unexpected messages %v", payload["messages"])
+	}
+
+	req.Suffix = "}"
+	if _, err := ollamaGenerateToChatPayload(req); err == nil {
+		t.Error("expected an error for suffix")
+	}
+}
+
+func TestOllamaWriter_Stream(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"q\""}}]}}]}`,
+		``,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":":1}"}}]},"finish_reason":"tool_calls"}]}`,
+		``,
+		`data: {"id":"c1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":4,"total_tokens":14}}`,
+		``,
+		`data: [DONE]`,
+		``,
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := newOllamaWriter(&out, "gpt-4o", false, time.Now()).translate(t.Context(), strings.NewReader(upstream)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var lines []transform.OllamaChatResponse
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var line transform.OllamaChatResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 4 {
+		t.Fatalf("expected 2 content lines, 1 tool call line and 1 done line, got %d", len(lines))
+	}
+	if lines[0].Message.Content+lines[1].Message.Content != "Hello" {
+		t.Errorf("unexpected content %q %q", lines[0].Message.Content, lines[1].Message.Content)
+	}
+	calls := lines[2].Message.ToolCalls
+	if len(calls) != 1 || calls[0].Function.Name != "lookup" || string(calls[0].Function.Arguments) != `{"q":1}` {
+		t.Errorf("unexpected tool calls %+v", calls)
+	}
+	done := lines[3]
+	if !done.Done || done.DoneReason != "stop" || done.PromptEvalCount != 10 || done.EvalCount != 4 {
+		t.Errorf("unexpected done line %+v", done)
+	}
+}
+
+func TestOllamaWriter_GenerateCompletion(t *testing.T) {
+	completion := &transform.ChatCompletionResponse{
+		Choices: []transform.ChatCompletionChoice{{Message: transform.ChatCompletionMessage{Content: "Hi!"}, FinishReason: "length"}},
+		Usage:   transform.ChatCompletionUsage{PromptTokens: 3, CompletionTokens: 2},
+	}
+	var out bytes.Buffer
+	if err := newOllamaWriter(&out, "gpt-4o", true, time.Now()).writeCompletion(completion); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var resp transform.OllamaGenerateResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if resp.Response != "Hi!" || !resp.Done || resp.DoneReason != "length" || resp.EvalCount != 2 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestOllamaWriter_ChatCompletionSplitChoices(t *testing.T) {
+	// Copilot returns the text and the tool calls of Claude models in separate choices
+	completion := &transform.ChatCompletionResponse{
+		Choices: []transform.ChatCompletionChoice{
+			{Index: 0, Message: transform.ChatCompletionMessage{Role: "assistant", Content: "Looking it up."}, FinishReason: "tool_calls"},
+			{Index: 1, Message: transform.ChatCompletionMessage{Role: "assistant", ToolCalls: []transform.ToolCall{
+				{ID: "call_1", Type: "function", Function: transform.ToolCallFunction{Name: "lookup", Arguments: `{"q":1}`}},
+			}}, FinishReason: "tool_calls"},
+		},
+	}
+	var out bytes.Buffer
+	if err := newOllamaWriter(&out, "claude-sonnet-4", false, time.Now()).writeCompletion(completion); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var resp transform.OllamaChatResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	calls := resp.Message.ToolCalls
+	if resp.Message.Content != "Looking it up." || !resp.Done {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(calls) != 1 || calls[0].Function.Name != "lookup" || string(calls[0].Function.Arguments) != `{"q":1}` {
+		t.Errorf("unexpected tool calls %+v", calls)
+	}
+}
+
+func TestOllamaTagsAndShow(t *testing.T) {
+	catalog := staticModelCatalog(transform.Model{ID: "gpt-4o", Object: "model", OwnedBy: "openai"})
+	s := NewModelsService(NewCoalescingCache(), &http.Client{}, WithModelCatalog(catalog, nil))
+
+	rr := httptest.NewRecorder()
+	s.OllamaTagsHandler()(rr, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	var tags transform.OllamaTagsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &tags); err != nil {
+		t.Fatalf("invalid tags response: %v", err)
+	}
+	if len(tags.Models) == 0 {
+		t.Fatal("expected at least one model")
+	}
+
+	name := tags.Models[0].Name
+	rr = httptest.NewRecorder()
+	s.OllamaShowHandler()(rr, httptest.NewRequest(http.MethodPost, "/api/show", strings.NewReader(`{"model":"`+name+`:latest"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d: %s", name, rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	s.OllamaShowHandler()(rr, httptest.NewRequest(http.MethodPost, "/api/show", strings.NewReader(`{"name":"no-such-model"}`)))
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), `"error"`) {
+		t.Errorf("expected Ollama-style 404, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
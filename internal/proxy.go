@@ -9,13 +9,17 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	mathrand "math/rand"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,9 +30,6 @@ const (
 	maxChatRetries     = 3
 	baseChatRetryDelay = 1 // seconds
 
-	// Circuit breaker configuration
-	circuitBreakerFailureThreshold = 5
-
 	// Request configuration
 	maxRequestBodySize  = 5 * 1024 * 1024 // 5MB
 	streamingBufferSize = 1024
@@ -39,6 +40,9 @@ const (
 	statusCodeRequestTimeout  = 408
 )
 
+// proxyLog tags records about proxied upstream requests.
+var proxyLog = Component("proxy")
+
 const (
 	// ProxyCBStateClosed indicates the circuit breaker is closed.
 	ProxyCBStateClosed = 0
@@ -48,41 +52,31 @@ const (
 	ProxyCBStateHalfOpen = 2
 )
 
-// CircuitBreakerState represents the state of the circuit breaker
-type CircuitBreakerState int
-
-const (
-	// CircuitClosed allows all requests through
-	CircuitClosed CircuitBreakerState = iota
-	// CircuitOpen rejects all requests
-	CircuitOpen
-	// CircuitHalfOpen allows limited requests through
-	CircuitHalfOpen
-)
-
-// CircuitBreaker implements circuit breaker pattern for upstream API calls
-type CircuitBreaker struct {
-	failureCount    int64
-	lastFailureTime time.Time
-	state           CircuitBreakerState
-	timeout         time.Duration
-	mutex           sync.RWMutex
-}
-
 // CoalescingCache handles request coalescing for identical requests
 type CoalescingCache struct {
-	requests map[string]chan interface{}
+	requests map[string]*coalescedCall
 	mutex    sync.RWMutex
 }
 
+// coalescedCall is an in-flight request whose result is shared by all callers.
+type coalescedCall struct {
+	done   chan struct{}
+	result interface{}
+}
+
 // ProxyService provides proxy functionality
 type ProxyService struct {
-	config         *Config
-	httpClient     *http.Client
-	authService    *AuthService
-	workerPool     WorkerPoolInterface
-	circuitBreaker *CircuitBreaker
-	bufferPool     *sync.Pool
+	config      *ConfigStore
+	httpClient  *http.Client
+	authService *AuthService
+	workerPool  WorkerPoolInterface
+	breakers    *CircuitBreakers
+	bufferPool  *sync.Pool
+	apiKeys     *APIKeyStore
+	rateLimiter *RateLimiter
+	usage       *UsageLedger
+	audit       *AuditLog
+	catalog     *ModelCatalog
 }
 
 // WorkerPoolInterface interface for background processing
@@ -93,13 +87,15 @@ type WorkerPoolInterface interface {
 // responseWrapper tracks if headers have been sent
 type responseWrapper struct {
 	http.ResponseWriter
-	headersSent bool
+	headersSent  bool
+	statusCode   atomic.Int32
+	bytesWritten atomic.Int64
 }
 
 // NewCoalescingCache creates a new coalescing cache
 func NewCoalescingCache() *CoalescingCache {
 	return &CoalescingCache{
-		requests: make(map[string]chan interface{}),
+		requests: make(map[string]*coalescedCall),
 	}
 }
 
@@ -121,71 +117,215 @@ func (cc *CoalescingCache) CoalesceRequest(key string, fn func() interface{}) in
 	cc.mutex.Lock()
 
 	// Check if request is already in progress
-	if ch, exists := cc.requests[key]; exists {
+	if call, exists := cc.requests[key]; exists {
 		cc.mutex.Unlock()
+		metrics.CoalescingHits.Inc()
 		// Wait for the existing request to complete
-		return <-ch
+		<-call.done
+		return call.result
 	}
 
-	// Create new channel for this request
-	ch := make(chan interface{}, 1)
-	cc.requests[key] = ch
+	// Register the call for this request
+	call := &coalescedCall{done: make(chan struct{})}
+	cc.requests[key] = call
 	cc.mutex.Unlock()
 
-	// Execute the request
-	result := fn()
-
-	// Broadcast result to all waiting goroutines
-	ch <- result
-	close(ch)
+	// Execute the request and clean up even if fn panics
+	defer func() {
+		cc.mutex.Lock()
+		delete(cc.requests, key)
+		cc.mutex.Unlock()
 
-	// Clean up
-	cc.mutex.Lock()
-	delete(cc.requests, key)
-	cc.mutex.Unlock()
+		// Broadcast result to all waiting goroutines
+		close(call.done)
+	}()
+	call.result = fn()
 
-	return result
+	return call.result
 }
 
 // NewProxyService creates a new proxy service
-func NewProxyService(cfg *Config, httpClient *http.Client, authService *AuthService, workerPool WorkerPoolInterface) *ProxyService {
-	circuitBreaker := &CircuitBreaker{
-		state:   CircuitClosed,
-		timeout: time.Duration(cfg.Timeouts.CircuitBreaker) * time.Second,
-	}
-
+func NewProxyService(cfg *Config, httpClient *http.Client, authService *AuthService, workerPool WorkerPoolInterface, opts ...func(*ProxyService)) *ProxyService {
 	bufferPool := &sync.Pool{
 		New: func() interface{} {
 			return new(bytes.Buffer)
 		},
 	}
 
-	return &ProxyService{
-		config:         cfg,
-		httpClient:     httpClient,
-		authService:    authService,
-		workerPool:     workerPool,
-		circuitBreaker: circuitBreaker,
-		bufferPool:     bufferPool,
+	svc := &ProxyService{
+		config:      NewConfigStore(cfg, ""),
+		httpClient:  httpClient,
+		authService: authService,
+		workerPool:  workerPool,
+		bufferPool:  bufferPool,
+	}
+	svc.breakers = NewCircuitBreakers(func() *Config { return svc.config.Load() })
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
+
+// WithConfigStore makes the proxy read its settings from store, so reloaded
+// configuration applies to the next request.
+func WithConfigStore(store *ConfigStore) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.config = store
+	}
+}
+
+// WithAPIKeyStore enables proxy-issued API key authentication.
+func WithAPIKeyStore(store *APIKeyStore) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.apiKeys = store
+	}
+}
+
+// WithRateLimiter enforces the configured per-user and per-key rate limits.
+func WithRateLimiter(limiter *RateLimiter) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.rateLimiter = limiter
+	}
+}
+
+// WithUsageLedger records per-request token usage in ledger.
+func WithUsageLedger(ledger *UsageLedger) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.usage = ledger
 	}
 }
 
+// WithKnownModels labels request metrics with the models listed in catalog.
+func WithKnownModels(catalog *ModelCatalog) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.catalog = catalog
+	}
+}
+
+// proxyRequestInfo collects details about a proxied request as it is processed.
+type proxyRequestInfo struct {
+	mutex          sync.Mutex
+	model          string
+	email          string
+	keyID          string
+	requestedModel string
+	streaming      bool
+	served         bool          // model is the one that served the request
+	audit          *auditCapture // nil unless the audit log is enabled
+
+	// The caller, authenticated once per request by identify
+	identified  bool
+	identity    *requestIdentity
+	identityErr error
+}
+
+type proxyRequestInfoKey struct{}
+
+// requestInfoFromContext returns the request info attached by handle, or a
+// detached one so callers outside the proxy pipeline need not check for nil.
+func requestInfoFromContext(ctx context.Context) *proxyRequestInfo {
+	if info, ok := ctx.Value(proxyRequestInfoKey{}).(*proxyRequestInfo); ok {
+		return info
+	}
+	return &proxyRequestInfo{}
+}
+
+// setServedModel records the model that served the request.
+func (i *proxyRequestInfo) setServedModel(email, model string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.email = email
+	i.model = model
+	i.served = true
+}
+
+// setCaller records the authenticated caller and the model it asked for.
+func (i *proxyRequestInfo) setCaller(identity *requestIdentity, model string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.email = identity.Email
+	i.model = model
+	i.requestedModel = model
+	if identity.Key != nil {
+		i.keyID = identity.Key.ID
+	}
+}
+
+// captureCompletion starts capturing the completion of the response metered
+// by meter for the audit log. It returns nil when the request is not audited.
+func (i *proxyRequestInfo) captureCompletion(meter *usageMeter) *completionCapture {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.audit == nil {
+		return nil
+	}
+	i.audit.completion = newCompletionCapture(meter.streaming)
+	i.audit.meter = meter
+	return i.audit.completion
+}
+
+func (i *proxyRequestInfo) setStreaming() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.streaming = true
+}
+
+func (i *proxyRequestInfo) snapshot() (email, model string, streaming bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.email, i.model, i.streaming
+}
+
+// proxyProcessFunc processes a single proxied request inside the worker pool.
+type proxyProcessFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request) error
+
+// proxyErrorWriter writes an error response in the client's API format.
+type proxyErrorWriter func(w http.ResponseWriter, statusCode int, message string)
+
 // Handler returns an HTTP handler for the proxy endpoint
 func (s *ProxyService) Handler() http.HandlerFunc {
+	return s.handle(s.processProxyRequest, writePlainProxyError)
+}
+
+// handle wraps a processing function with the rate limits, body limit,
+// worker pool dispatch and timeout handling shared by all proxy endpoints.
+func (s *ProxyService) handle(process proxyProcessFunc, writeError proxyErrorWriter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &proxyRequestInfo{}
+		if s.audit != nil {
+			info.audit = newAuditCapture()
+		}
+
+		// Continue the client's trace, if any, in a server span for the whole request
+		ctx, span := startSpan(extractTraceparent(r.Context(), r.Header), r.Method+" "+r.URL.Path, SpanKindServer,
+			"http.request.method", r.Method, "url.path", r.URL.Path)
+		defer span.End()
+
 		// Create context with extended timeout for long-lived streaming responses
-		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.config.Timeouts.ProxyContext)*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(s.config.Load().Timeouts.ProxyContext)*time.Second)
 		defer cancel()
-
-		// Check circuit breaker
-		if !s.circuitBreaker.canExecute() {
-			Warn("Circuit breaker is open, rejecting request")
-			http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
-			return
-		}
+		ctx = context.WithValue(ctx, proxyRequestInfoKey{}, info)
 
 		// Limit request body size
 		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		auditRequestBody(r, info)
+
+		// Apply per-user and per-key rate limits
+		release, limitErr := s.admitRequest(r, info)
+		if limitErr != nil {
+			writeRateLimitError(w, limitErr, writeError)
+			span.SetHTTPStatus(http.StatusTooManyRequests)
+			email, _, _ := info.snapshot()
+			metrics.observeRequest(r.URL.Path, "", http.StatusTooManyRequests, email, time.Since(start))
+			if info.audit != nil {
+				// Read the rejected request so its record shows what was sent
+				_, _ = io.Copy(io.Discard, r.Body)
+			}
+			s.writeAudit(ctx, r, info, http.StatusTooManyRequests, time.Since(start), limitErr)
+			return
+		}
+		defer release()
 
 		// Use a response wrapper to track if headers have been sent
 		respWrapper := &responseWrapper{ResponseWriter: w, headersSent: false}
@@ -194,52 +334,90 @@ func (s *ProxyService) Handler() http.HandlerFunc {
 		done := make(chan error, 1)
 
 		// Submit request to worker pool
+		_, waitSpan := startSpan(ctx, "worker_pool.wait", SpanKindInternal)
 		s.workerPool.Submit(func() {
+			waitSpan.End()
+			var err error
 			defer func() {
 				if recovery := recover(); recovery != nil {
-					Error("Worker panic recovered", "panic", recovery)
-					done <- NewProxyError("request_processing", "worker panic during request processing", fmt.Errorf("panic: %v", recovery))
+					proxyLog.ErrorContext(ctx, "Worker panic recovered", "panic", recovery)
+					err = NewProxyError("request_processing", "worker panic during request processing", fmt.Errorf("panic: %v", recovery))
 				}
+				s.writeAudit(ctx, r, info, auditStatus(ctx, respWrapper, err), time.Since(start), err)
+				done <- err
 			}()
 
-			err := s.processProxyRequest(ctx, respWrapper, r)
-			done <- err
+			err = process(ctx, respWrapper, r)
 		})
 
 		// Wait for worker to complete or context timeout
+		status := 0
 		select {
 		case err := <-done:
 			if err != nil {
-				Error("Worker error", "error", err)
+				span.RecordError(err)
+				proxyLog.ErrorContext(ctx, "Worker error", "error", err)
 				// Only write error if headers haven't been sent
 				if !respWrapper.headersSent {
-					switch {
-					case strings.Contains(err.Error(), "authentication error"):
-						http.Error(w, err.Error(), http.StatusUnauthorized)
-					case strings.Contains(err.Error(), "token validation failed"):
-						http.Error(w, err.Error(), http.StatusUnauthorized)
-					case strings.Contains(err.Error(), "bad request"):
-						http.Error(w, err.Error(), http.StatusBadRequest)
-					case strings.Contains(err.Error(), "method not allowed"):
-						http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-					default:
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+					var openErr *CircuitOpenError
+					if errors.As(err, &openErr) {
+						w.Header().Set("Retry-After", retryAfterSeconds(openErr.RetryAfter))
 					}
+					status = proxyErrorStatus(err)
+					writeError(w, status, err.Error())
 				}
 			}
 		case <-ctx.Done():
-			Warn("Request timeout in worker pool")
+			proxyLog.WarnContext(ctx, "Request timeout in worker pool")
 			// Only write timeout error if headers haven't been sent
 			if !respWrapper.headersSent {
-				http.Error(w, "Request timeout", http.StatusRequestTimeout)
+				status = http.StatusRequestTimeout
+				writeError(w, status, "Request timeout")
 			}
 		}
+
+		if status == 0 {
+			status = int(respWrapper.statusCode.Load())
+		}
+		email, model, streaming := info.snapshot()
+		span.SetAttributes("gen_ai.request.model", model, "proxy.streaming", streaming)
+		span.SetHTTPStatus(status)
+		metrics.observeRequest(r.URL.Path, s.metricsModel(info, status), status, email, time.Since(start))
+		if streaming {
+			metrics.StreamedBytes.Add(float64(respWrapper.bytesWritten.Load()), r.URL.Path)
+		}
 	}
 }
 
+// proxyErrorStatus maps a processing error to the HTTP status returned to the client.
+func proxyErrorStatus(err error) int {
+	var openErr *CircuitOpenError
+	switch {
+	case errors.As(err, &openErr):
+		return http.StatusServiceUnavailable
+	case strings.Contains(err.Error(), "authentication error"):
+		return http.StatusUnauthorized
+	case strings.Contains(err.Error(), "token validation failed"):
+		return http.StatusUnauthorized
+	case strings.Contains(err.Error(), "forbidden"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "bad request"):
+		return http.StatusBadRequest
+	case strings.Contains(err.Error(), "method not allowed"):
+		return http.StatusMethodNotAllowed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writePlainProxyError(w http.ResponseWriter, statusCode int, message string) {
+	http.Error(w, message, statusCode)
+}
+
 func (rw *responseWrapper) WriteHeader(statusCode int) {
 	if !rw.headersSent {
 		rw.headersSent = true
+		rw.statusCode.Store(int32(statusCode))
 		rw.ResponseWriter.WriteHeader(statusCode)
 	}
 }
@@ -247,120 +425,306 @@ func (rw *responseWrapper) WriteHeader(statusCode int) {
 func (rw *responseWrapper) Write(data []byte) (int, error) {
 	if !rw.headersSent {
 		rw.headersSent = true
+		rw.statusCode.Store(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(data)
+	rw.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+// Flush lets streaming handlers push chunks through the wrapper.
+func (rw *responseWrapper) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
-	return rw.ResponseWriter.Write(data)
 }
 
-func (cb *CircuitBreaker) canExecute() bool {
-	cb.mutex.RLock()
-	defer cb.mutex.RUnlock()
+func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
+	ctx, span := startSpan(ctx, "proxy.process", SpanKindInternal, "url.path", r.URL.Path)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	proxyLog.DebugContext(ctx, "Starting proxy request", "method", r.Method, "path", r.URL.Path)
 
-	// No metrics to update for circuit breaker state changes
+	body, err := readProxyRequestBody(r)
+	if err != nil {
+		return err
+	}
 
-	if cb.state == CircuitClosed {
-		return true
+	identity, err := s.identify(requestInfoFromContext(ctx), r)
+	if err != nil {
+		return err
 	}
 
-	if cb.state == CircuitOpen {
-		if time.Since(cb.lastFailureTime) > cb.timeout {
-			cb.mutex.RUnlock()
-			cb.mutex.Lock()
-			cb.state = CircuitHalfOpen
-			cb.mutex.Unlock()
-			cb.mutex.RLock()
-			return true
+	var payload map[string]any
+	if jsonErr := json.Unmarshal(body, &payload); jsonErr != nil {
+		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+	}
+
+	// One configuration snapshot for alias resolution and API selection
+	baseConfig := s.config.Load()
+	requestedModel, _ := payload["model"].(string)
+	model := baseConfig.resolveModelAlias(requestedModel)
+	if model != requestedModel {
+		proxyLog.DebugContext(ctx, "Resolved model alias", "alias", requestedModel, "model", model)
+		payload["model"] = model
+		body = nil
+	}
+	requestInfoFromContext(ctx).setCaller(identity, model)
+	span.SetAttributes("gen_ai.request.model", model)
+	if err := identity.authorize(r.URL.Path, model); err != nil {
+		return err
+	}
+
+	var clientPath string
+	switch r.URL.Path {
+	case "/v1/completions":
+		clientPath = "/completions"
+	case "/v1/chat/completions":
+		clientPath = "/chat/completions"
+	case "/v1/responses":
+		clientPath = "/responses"
+	default:
+		return fmt.Errorf("unsupported proxy path: %s", r.URL.Path)
+	}
+
+	// Translate between Chat Completions and Responses when a model of the
+	// fallback chain is configured for the other API
+	clientAPI := clientModelAPI(r.URL.Path)
+	sameAPI := fixedRoute(clientPath, payload, body)
+	route := func(candidate string) (*upstreamRoute, error) {
+		upstreamAPI := baseConfig.modelAPI(candidate)
+		if clientAPI == "" || upstreamAPI == "" || upstreamAPI == clientAPI {
+			return sameAPI(candidate)
 		}
-		return false
+		proxyLog.DebugContext(ctx, "Translating request for model API", "model", candidate, "client_api", clientAPI, "upstream_api", upstreamAPI)
+		candidatePayload := maps.Clone(payload)
+		candidatePayload["model"] = candidate
+		translated, err := translateRequestPayload(clientAPI, candidatePayload)
+		if err != nil {
+			return nil, fmt.Errorf("bad request: %w", err)
+		}
+		return &upstreamRoute{model: candidate, path: modelAPIPaths[upstreamAPI], payload: translated, translate: true}, nil
 	}
 
-	// CircuitHalfOpen
-	return true
-}
+	resp, cfg, upstream, err := s.forwardWithFallback(ctx, r.Method, identity.Email, model, route)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			proxyLog.WarnContext(ctx, "Error closing response body", "error", err)
+		}
+	}()
+	servedModel, upstreamPath := upstream.model, upstream.path
+	if servedModel == model {
+		restoreModelAlias(resp, requestedModel, model)
+	}
+	streaming := resp.Header.Get("Content-Type") == "text/event-stream"
+	translate := upstream.translate && resp.StatusCode < statusClientError
+	if translate && !streaming {
+		if err := translateResponseBody(resp, clientAPI); err != nil {
+			return err
+		}
+	}
 
-func (cb *CircuitBreaker) onSuccess() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
+	// Copy response headers
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
 
-	cb.failureCount = 0
-	cb.state = CircuitClosed
-}
+	// Add configurable CORS headers (use cfg which has merged config)
+	setCORSHeaders(w, cfg)
+	setServedModel(ctx, w, identity.Email, servedModel)
 
-func (cb *CircuitBreaker) onFailure() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
+	// Copy status code
+	w.WriteHeader(resp.StatusCode)
 
-	cb.failureCount++
-	cb.lastFailureTime = time.Now()
+	var meter *usageMeter
+	if resp.StatusCode < statusClientError {
+		meter = meterResponseBody(resp, streaming)
+	}
+	if streaming {
+		var streamSpan *Span
+		ctx, streamSpan = startSpan(ctx, "proxy.stream", SpanKindInternal, "upstream.path", upstreamPath, "proxy.translated", translate)
+		body := traceStreamBody(resp, streamSpan)
+		defer func() {
+			streamSpan.SetAttributes("stream.bytes", body.bytes)
+			streamSpan.RecordError(err)
+			streamSpan.End()
+		}()
+	}
 
-	if cb.failureCount >= circuitBreakerFailureThreshold {
-		cb.state = CircuitOpen
+	// Handle streaming vs regular responses
+	switch {
+	case streaming && translate:
+		requestInfoFromContext(ctx).setStreaming()
+		err = translateResponseStream(ctx, w, resp.Body, clientAPI)
+	case streaming && upstreamPath == "/responses":
+		requestInfoFromContext(ctx).setStreaming()
+		err = s.handleResponsesStreamingResponse(w, resp)
+	case streaming:
+		requestInfoFromContext(ctx).setStreaming()
+		err = s.handleStreamingResponse(w, resp)
+	default:
+		err = s.handleRegularResponse(w, resp)
+	}
+	if err == nil {
+		s.recordUsage(r.URL.Path, servedModel, identity, meter, streaming)
 	}
+	return err
 }
 
-func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	Debug("Starting proxy request", "method", r.Method, "path", r.URL.Path)
+// setCORSHeaders adds the configured CORS headers to a proxied response.
+func setCORSHeaders(w http.ResponseWriter, cfg *Config) {
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		w.Header().Set("Access-Control-Allow-Origin", strings.Join(cfg.CORS.AllowedOrigins, ", "))
+	}
+	if len(cfg.CORS.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.CORS.AllowedHeaders, ", "))
+	}
+}
 
+// readProxyRequestBody validates the method and reads the non-empty request body.
+func readProxyRequestBody(r *http.Request) ([]byte, error) {
 	// Validate method
 	if r.Method != http.MethodPost {
-		return fmt.Errorf("method not allowed: %s", r.Method)
+		return nil, fmt.Errorf("method not allowed: %s", r.Method)
 	}
 
 	// Read the request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		Error("Error reading request body", "error", err)
+		proxyLog.ErrorContext(r.Context(), "Error reading request body", "error", err)
 		// Check for "http: request body too large" error and return 413
 		if strings.Contains(err.Error(), "http: request body too large") {
-			return fmt.Errorf("payload too large: %w", err)
+			return nil, fmt.Errorf("payload too large: %w", err)
 		}
-		return fmt.Errorf("bad request: failed to read request body: %w", err)
+		return nil, fmt.Errorf("bad request: failed to read request body: %w", err)
 	}
 	defer func() {
 		if err := r.Body.Close(); err != nil {
-			Warn("Error closing request body", "error", err)
+			proxyLog.WarnContext(r.Context(), "Error closing request body", "error", err)
 		}
 	}()
 
 	// Basic body validation (for demonstration: consider empty body an error)
 	if len(body) == 0 {
-		return fmt.Errorf("bad request: empty request body")
+		return nil, fmt.Errorf("bad request: empty request body")
+	}
+	return body, nil
+}
+
+// requestIdentity is the authenticated caller of a proxy request.
+type requestIdentity struct {
+	Email string
+	// Key is nil when the caller was identified by the ?email= parameter.
+	Key *APIKey
+}
+
+// authorize checks the API key scopes for the requested endpoint and model.
+func (id *requestIdentity) authorize(endpoint, model string) error {
+	if id.Key == nil {
+		return nil
+	}
+	if !id.Key.AllowsEndpoint(endpoint) {
+		return fmt.Errorf("forbidden: API key %s is not allowed to call %s", id.Key.ID, endpoint)
+	}
+	if !id.Key.AllowsModel(model) {
+		return fmt.Errorf("forbidden: API key %s is not allowed to use model '%s'", id.Key.ID, model)
+	}
+	return nil
+}
+
+// authenticateRequest resolves whose Copilot token serves the request. A
+// proxy-issued API key takes precedence; the ?email= parameter is honoured
+// only when api_keys.allow_email_param is set.
+func (s *ProxyService) authenticateRequest(r *http.Request) (*requestIdentity, error) {
+	if secret := requestAPIKey(r); secret != "" {
+		if s.apiKeys == nil {
+			return nil, NewAuthError("API keys are not enabled", nil)
+		}
+		key, err := s.apiKeys.Authenticate(secret)
+		if err != nil {
+			return nil, err
+		}
+		proxyLog.InfoContext(r.Context(), "Authenticated request with API key", "key_id", key.ID, "email", key.Email)
+		return &requestIdentity{Email: key.Email, Key: key}, nil
+	}
+
+	if !s.config.Load().APIKeys.AllowEmailParam {
+		return nil, NewAuthError("API key required: send it as 'Authorization: Bearer <key>' or 'x-api-key'", nil)
 	}
 
+	email, err := requestEmail(r)
+	if err != nil {
+		return nil, err
+	}
+	return &requestIdentity{Email: email}, nil
+}
+
+// identify authenticates r once per request: later calls, e.g. from the
+// endpoint handler after the rate limiter, reuse the first result.
+func (s *ProxyService) identify(info *proxyRequestInfo, r *http.Request) (*requestIdentity, error) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	if !info.identified {
+		info.identity, info.identityErr = s.authenticateRequest(r)
+		info.identified = true
+	}
+	return info.identity, info.identityErr
+}
+
+// requestEmail extracts the user email identifying whose Copilot token to use.
+func requestEmail(r *http.Request) (string, error) {
 	// Get email from URL query parameter
 	email := r.URL.Query().Get("email")
 	if email == "" {
-		return fmt.Errorf("authentication error: missing email in URL parameter")
-	}
-	Info("Extracted email from URL parameter", "email", email, "raw_query", r.URL.RawQuery)
-
-	var payload map[string]any
-	if jsonErr := json.Unmarshal(body, &payload); jsonErr != nil {
-		return fmt.Errorf("bad request: invalid JSON: %w", jsonErr)
+		return "", fmt.Errorf("authentication error: missing email in URL parameter")
 	}
+	proxyLog.InfoContext(r.Context(), "Extracted email from URL parameter", "email", email)
+	return email, nil
+}
 
+// forwardRequest sends payload to the given Copilot API path on behalf of email
+// and returns the upstream response together with the merged per-user config.
+// body is sent verbatim when non-nil, otherwise payload is encoded.
+// The caller is responsible for closing the response body.
+func (s *ProxyService) forwardRequest(ctx context.Context, method, email, upstreamPath string, payload map[string]any, body []byte) (*http.Response, *Config, error) {
 	model, _ := payload["model"].(string)
+	baseConfig := s.config.Load()
 
 	// AllowedModels validation
-	if len(s.config.AllowedModels) > 0 {
-		allowed := slices.Contains(s.config.AllowedModels, model)
+	if len(baseConfig.AllowedModels) > 0 {
+		allowed := slices.Contains(baseConfig.AllowedModels, model)
 		if !allowed {
-			return fmt.Errorf("bad request: model '%s' is not allowed by allowed_models in config", model)
+			return nil, nil, fmt.Errorf("bad request: model '%s' is not allowed by allowed_models in config", model)
 		}
 	}
 
-	// Ensure we have a valid token before making the request
-	cfg, tokenErr := s.authService.EnsureValidToken(email, s.config)
+	// Ensure we have a valid token before making the request. Repeated
+	// failures only trip this user's breaker, not the upstream's.
+	userBreaker, userKey := s.breakers.user(email)
+	if err := s.breakers.allow(userBreaker, userKey); err != nil {
+		return nil, nil, err
+	}
+	cfg, tokenErr := s.authService.EnsureValidTokenContext(ctx, email, baseConfig)
 	if tokenErr != nil {
-		Error("Failed to ensure valid token", "error", tokenErr)
-		return NewAuthError("token validation failed", tokenErr)
+		userBreaker.onFailure()
+		proxyLog.ErrorContext(ctx, "Failed to ensure valid token", "error", tokenErr)
+		return nil, nil, NewAuthError("token validation failed", tokenErr)
 	}
+	userBreaker.onSuccess()
 
-	Debug("Using config for request",
+	proxyLog.DebugContext(ctx, "Using config for request",
 		"user_agent", cfg.Headers.UserAgent,
 		"editor_version", cfg.Headers.EditorVersion,
-		"copilot_token_prefix", cfg.CopilotToken[:10]+"...")
+		"copilot_token", secretFingerprint(cfg.CopilotToken))
 
-	isResponsesEndpoint := r.URL.Path == "/v1/responses"
+	isResponsesEndpoint := upstreamPath == "/responses"
 	openaiIntent := cfg.Headers.OpenaiIntent
 	xInitiator := cfg.Headers.XInitiator
 	visionRequested := false
@@ -374,31 +738,27 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 		}
 		openaiIntent = "conversation-panel"
 		payload["service_tier"] = nil
-		updatedBody, marshalErr := json.Marshal(payload)
+		body = nil
+	} else if upstreamPath == "/chat/completions" {
+		visionRequested = hasVisionInput(payload["messages"])
+	}
+
+	if body == nil {
+		encoded, marshalErr := json.Marshal(payload)
 		if marshalErr != nil {
-			return fmt.Errorf("bad request: failed to encode responses payload: %w", marshalErr)
+			return nil, nil, fmt.Errorf("bad request: failed to encode request payload: %w", marshalErr)
 		}
-		body = updatedBody
+		body = encoded
 	}
 
 	// Create new request to GitHub Copilot
-	var targetURL string
-	switch r.URL.Path {
-	case "/v1/completions":
-		targetURL = copilotAPIBase + "/completions"
-	case "/v1/chat/completions":
-		targetURL = copilotAPIBase + "/chat/completions"
-	case "/v1/responses":
-		targetURL = copilotAPIBase + "/responses"
-	default:
-		return fmt.Errorf("unsupported proxy path: %s", r.URL.Path)
-	}
-	Debug("Sending request to target", "url", targetURL, "body_length", len(body))
+	targetURL := cfg.apiBase() + upstreamPath
+	proxyLog.DebugContext(ctx, "Sending request to target", "url", targetURL, "body_length", len(body))
 
-	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, bytes.NewBuffer(body))
 	if err != nil {
-		Error("Error creating request", "error", err)
-		return NewProxyError("create_request", "failed to create proxy request", err)
+		proxyLog.ErrorContext(ctx, "Error creating request", "error", err)
+		return nil, nil, NewProxyError("create_request", "failed to create proxy request", err)
 	}
 
 	// Set headers (use cfg which has merged config from both service and database)
@@ -411,27 +771,27 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 	req.Header.Set("Copilot-Integration-Id", cfg.Headers.CopilotIntegrationID)
 	req.Header.Set("Openai-Intent", openaiIntent)
 	req.Header.Set("X-Initiator", xInitiator)
-	if isResponsesEndpoint && visionRequested {
+	if visionRequested {
 		req.Header.Set("Copilot-Vision-Request", "true")
 	}
+	setRequestIDHeader(ctx, req)
 
+	breaker, breakerKey := s.breakers.upstream(cfg.apiBase(), model)
+	if err := s.breakers.allow(breaker, breakerKey); err != nil {
+		return nil, nil, err
+	}
 	resp, err := s.makeRequestWithRetry(req, body)
 	if err != nil {
-		s.circuitBreaker.onFailure()
-		Error("Error making request after retries", "error", err)
-		return NewNetworkError("proxy_request", targetURL, "failed to complete request after retries", err)
+		breaker.onFailure()
+		proxyLog.ErrorContext(ctx, "Error making request after retries", "error", err)
+		return nil, nil, NewNetworkError("proxy_request", targetURL, "failed to complete request after retries", err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			Warn("Error closing response body", "error", err)
-		}
-	}()
 
 	// Update circuit breaker based on response
 	if resp.StatusCode < statusCodeServerError {
-		s.circuitBreaker.onSuccess()
+		breaker.onSuccess()
 	} else {
-		s.circuitBreaker.onFailure()
+		breaker.onFailure()
 	}
 
 	// Log error responses with body for debugging
@@ -439,46 +799,27 @@ func (s *ProxyService) processProxyRequest(ctx context.Context, w http.ResponseW
 		// Read a small portion of the response body for logging
 		peekBody := make([]byte, 500)
 		n, _ := resp.Body.Read(peekBody)
-		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(peekBody[:n]), resp.Body))
-		Error("Received error response from upstream",
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(peekBody[:n]), resp.Body), Closer: resp.Body}
+		proxyLog.ErrorContext(ctx, "Received error response from upstream",
 			"status", resp.StatusCode,
 			"target_url", targetURL,
 			"response_body", string(peekBody[:n]),
 			"content_type", resp.Header.Get("Content-Type"))
 	}
 
-	Debug("Received response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
-
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
-
-	// Add configurable CORS headers (use cfg which has merged config)
-	if len(cfg.CORS.AllowedOrigins) > 0 {
-		w.Header().Set("Access-Control-Allow-Origin", strings.Join(cfg.CORS.AllowedOrigins, ", "))
-	}
-	if len(cfg.CORS.AllowedHeaders) > 0 {
-		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.CORS.AllowedHeaders, ", "))
-	}
-
-	// Copy status code
-	w.WriteHeader(resp.StatusCode)
+	proxyLog.DebugContext(ctx, "Received response", "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
+	return resp, cfg, nil
+}
 
-	// Handle streaming vs regular responses
-	if resp.Header.Get("Content-Type") == "text/event-stream" {
-		if isResponsesEndpoint {
-			return s.handleResponsesStreamingResponse(w, resp)
-		}
-		return s.handleStreamingResponse(w, resp)
-	}
-	return s.handleRegularResponse(w, resp)
+// readCloser combines a replacement reader with the original body's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http.Response) error {
-	Debug("Starting streaming response copy")
+	ctx := responseContext(resp)
+	proxyLog.DebugContext(ctx, "Starting streaming response copy")
 
 	if flusher, ok := w.(http.Flusher); ok {
 		// Copy in chunks and flush periodically for better streaming
@@ -488,17 +829,17 @@ func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http
 			if n > 0 {
 				_, writeErr := w.Write(buf[:n])
 				if writeErr != nil {
-					Error("Error writing streaming chunk", "error", writeErr)
+					proxyLog.ErrorContext(ctx, "Error writing streaming chunk", "error", writeErr)
 					return writeErr
 				}
 				flusher.Flush()
 			}
 			if readErr == io.EOF {
-				Debug("Streaming response completed successfully")
+				proxyLog.DebugContext(ctx, "Streaming response completed successfully")
 				break
 			}
 			if readErr != nil {
-				Error("Error reading streaming response", "error", readErr)
+				proxyLog.ErrorContext(ctx, "Error reading streaming response", "error", readErr)
 				return readErr
 			}
 		}
@@ -506,7 +847,7 @@ func (s *ProxyService) handleStreamingResponse(w http.ResponseWriter, resp *http
 		// Fallback to direct copy if no flusher available
 		_, err := io.Copy(w, resp.Body)
 		if err != nil {
-			Error("Error copying streaming response", "error", err)
+			proxyLog.ErrorContext(ctx, "Error copying streaming response", "error", err)
 			return err
 		}
 	}
@@ -524,7 +865,8 @@ func newStreamIDTracker() *streamIDTracker {
 }
 
 func (s *ProxyService) handleResponsesStreamingResponse(w http.ResponseWriter, resp *http.Response) error {
-	Debug("Starting responses streaming response copy with ID sync")
+	ctx := responseContext(resp)
+	proxyLog.DebugContext(ctx, "Starting responses streaming response copy with ID sync")
 
 	flusher, canFlush := w.(http.Flusher)
 	reader := bufio.NewReader(resp.Body)
@@ -593,7 +935,7 @@ func (s *ProxyService) handleResponsesStreamingResponse(w http.ResponseWriter, r
 	for {
 		line, readErr := reader.ReadString('\n')
 		if readErr != nil && readErr != io.EOF {
-			Error("Error reading streaming response", "error", readErr)
+			proxyLog.ErrorContext(ctx, "Error reading streaming response", "error", readErr)
 			return readErr
 		}
 
@@ -639,7 +981,7 @@ func (s *ProxyService) handleResponsesStreamingResponse(w http.ResponseWriter, r
 		}
 	}
 
-	Debug("Responses streaming response completed successfully")
+	proxyLog.DebugContext(ctx, "Responses streaming response completed successfully")
 	return nil
 }
 
@@ -674,13 +1016,18 @@ func handleOutputItemAdded(parsed map[string]any, tracker *streamIDTracker, fall
 
 	itemID, _ := item["id"].(string)
 	if itemID == "" {
-		itemID = fmt.Sprintf("oi_%d_%s", outputIndex, randomBase36(16))
+		itemID = newOutputItemID(outputIndex)
 		item["id"] = itemID
 	}
 	tracker.outputItems[outputIndex] = itemID
 	return marshalStreamEvent(parsed, fallback)
 }
 
+// newOutputItemID returns a fresh ID for the Responses output item at outputIndex.
+func newOutputItemID(outputIndex int) string {
+	return fmt.Sprintf("oi_%d_%s", outputIndex, randomBase36(16))
+}
+
 func handleOutputItemDone(parsed map[string]any, tracker *streamIDTracker, fallback string) string {
 	outputIndex, ok := getIntFromInterface(parsed["output_index"])
 	if !ok {
@@ -791,18 +1138,26 @@ func hasVisionInput(input any) bool {
 }
 
 func getPayloadItems(input any) []any {
-	items, ok := input.([]any)
-	if !ok {
+	switch items := input.(type) {
+	case []any:
+		return items
+	case []map[string]any:
+		// Payloads built in-process (e.g. translated requests) use typed slices
+		converted := make([]any, len(items))
+		for i, item := range items {
+			converted[i] = item
+		}
+		return converted
+	default:
 		return nil
 	}
-	return items
 }
 
 func containsVisionContent(value any) bool {
 	if value == nil {
 		return false
 	}
-	if array, ok := value.([]any); ok {
+	if array := getPayloadItems(value); array != nil {
 		for _, entry := range array {
 			if containsVisionContent(entry) {
 				return true
@@ -814,21 +1169,23 @@ func containsVisionContent(value any) bool {
 	if !ok {
 		return false
 	}
-	if typeValue, ok := record["type"].(string); ok && strings.ToLower(typeValue) == "input_image" {
-		return true
+	if typeValue, ok := record["type"].(string); ok {
+		switch strings.ToLower(typeValue) {
+		case "input_image", "image_url":
+			return true
+		}
 	}
-	if content, ok := record["content"].([]any); ok {
-		for _, entry := range content {
-			if containsVisionContent(entry) {
-				return true
-			}
+	for _, entry := range getPayloadItems(record["content"]) {
+		if containsVisionContent(entry) {
+			return true
 		}
 	}
 	return false
 }
 
 func (s *ProxyService) handleRegularResponse(w http.ResponseWriter, resp *http.Response) error {
-	Debug("Starting regular response copy")
+	ctx := responseContext(resp)
+	proxyLog.DebugContext(ctx, "Starting regular response copy")
 
 	// Use buffer pool for regular responses
 	buf := s.bufferPool.Get().(*bytes.Buffer)
@@ -837,22 +1194,29 @@ func (s *ProxyService) handleRegularResponse(w http.ResponseWriter, resp *http.R
 
 	_, err := io.CopyBuffer(w, resp.Body, buf.Bytes()[:0])
 	if err != nil {
-		Error("Error copying response", "error", err)
+		proxyLog.ErrorContext(ctx, "Error copying response", "error", err)
 		return err
 	}
 
-	Debug("Regular response completed successfully")
+	proxyLog.DebugContext(ctx, "Regular response completed successfully")
 	return nil
 }
 
+// makeRequestWithRetry sends the request, retrying network errors and
+// retriable statuses. Waits follow upstream Retry-After and rate-limit hints
+// when present; a retry is skipped when the requested wait exceeds
+// maxRetryHintWait or the remaining context deadline, and the last response is
+// returned with a normalised Retry-After header.
 func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*http.Response, error) {
-	var lastResp *http.Response
-	var lastErr error
+	ctx := req.Context()
+	spanCtx, span := startSpan(ctx, "upstream.request", SpanKindInternal, "http.request.method", req.Method, "url.full", req.URL.String())
+	defer span.End()
 
-	for attempt := 1; attempt <= maxChatRetries; attempt++ {
+	for attempt := 1; ; attempt++ {
 		// Create a new request for each attempt with the original context
-		retryReq, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), bytes.NewBuffer(body))
+		retryReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL.String(), bytes.NewBuffer(body))
 		if err != nil {
+			span.RecordError(err)
 			return nil, err
 		}
 
@@ -863,64 +1227,95 @@ func (s *ProxyService) makeRequestWithRetry(req *http.Request, body []byte) (*ht
 			}
 		}
 
-		Debug("Making request attempt", "attempt", attempt, "max_attempts", maxChatRetries)
+		// Each attempt is a client span; the upstream continues the trace from it
+		attemptCtx, attemptSpan := startSpan(spanCtx, "upstream.attempt", SpanKindClient,
+			"http.request.method", req.Method, "url.full", req.URL.String(), "http.request.resend_count", attempt-1)
+		injectTraceparent(attemptCtx, retryReq.Header)
+		span.SetAttributes("upstream.attempts", attempt)
+
+		proxyLog.DebugContext(ctx, "Making request attempt", "attempt", attempt, "max_attempts", maxChatRetries)
 
 		resp, err := s.httpClient.Do(retryReq)
 		if err != nil {
-			lastErr = err
+			attemptSpan.RecordError(err)
+			attemptSpan.End()
 			if attempt == maxChatRetries {
-				Error("Request failed after max attempts", "attempts", maxChatRetries, "error", err)
+				proxyLog.ErrorContext(ctx, "Request failed after max attempts", "attempts", maxChatRetries, "error", err)
+				span.RecordError(err)
 				return nil, err
 			}
 
-			// Context-aware waiting instead of blocking sleep
-			waitTime := time.Duration(baseChatRetryDelay*attempt*attempt) * time.Second
-			Warn("Request failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
-
-			timer := time.NewTimer(waitTime)
-			select {
-			case <-timer.C:
-				// Continue with retry
-			case <-req.Context().Done():
-				timer.Stop()
-				return nil, req.Context().Err()
+			waitTime := retryDelay(attempt, 0, false)
+			if !fitsDeadline(ctx, waitTime) {
+				proxyLog.WarnContext(ctx, "Request failed, not retrying past context deadline", "attempt", attempt, "wait_time", waitTime, "error", err)
+				span.RecordError(err)
+				return nil, err
+			}
+			proxyLog.WarnContext(ctx, "Request failed, retrying", "attempt", attempt, "wait_time", waitTime, "error", err)
+			metrics.UpstreamRetries.Inc("error")
+			span.AddEvent("retry", "wait_ms", waitTime, "error", err.Error())
+
+			if err := sleepContext(ctx, waitTime); err != nil {
+				return nil, err
 			}
 			continue
 		}
 
-		lastResp = resp
+		// The attempt span ends when the response headers arrive, so its
+		// duration is the time to the first upstream byte
+		attemptSpan.SetHTTPStatus(resp.StatusCode)
+		attemptSpan.End()
+		recordUpstreamRequestID(ctx, resp)
 
 		// Check if we should retry based on status code
 		if !s.isRetriableError(resp.StatusCode, nil) {
-			Debug("Request successful", "attempt", attempt, "status", resp.StatusCode)
+			proxyLog.DebugContext(ctx, "Request successful", "attempt", attempt, "status", resp.StatusCode)
+			span.SetHTTPStatus(resp.StatusCode)
 			return resp, nil
 		}
 
-		// Close the response body before retrying
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			Warn("Failed to close response body during retry", "error", closeErr)
-		}
-
 		if attempt == maxChatRetries {
-			Warn("Request failed after max attempts", "attempts", maxChatRetries, "status", resp.StatusCode)
+			proxyLog.WarnContext(ctx, "Request failed after max attempts", "attempts", maxChatRetries, "status", resp.StatusCode)
+			setClientRetryAfter(resp)
+			span.SetHTTPStatus(resp.StatusCode)
 			return resp, nil // Return the last response even if it failed
 		}
 
-		// Context-aware waiting for status code retries
-		waitTime := time.Duration(baseChatRetryDelay*attempt*attempt) * time.Second
-		Warn("Request failed, retrying", "status", resp.StatusCode, "attempt", attempt, "wait_time", waitTime)
+		hint, hasHint := upstreamRetryDelay(resp.Header, time.Now())
+		waitTime := retryDelay(attempt, hint, hasHint)
+		if (hasHint && hint > maxRetryHintWait) || !fitsDeadline(ctx, waitTime) {
+			proxyLog.WarnContext(ctx, "Upstream asked for a longer wait than we can retry within, returning response",
+				"status", resp.StatusCode, "attempt", attempt, "retry_after", hint, "wait_time", waitTime)
+			setClientRetryAfter(resp)
+			span.SetHTTPStatus(resp.StatusCode)
+			return resp, nil
+		}
 
-		timer := time.NewTimer(waitTime)
-		select {
-		case <-timer.C:
-			// Continue with retry
-		case <-req.Context().Done():
-			timer.Stop()
-			return nil, req.Context().Err()
+		// Close the response body before retrying
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			proxyLog.WarnContext(ctx, "Failed to close response body during retry", "error", closeErr)
+		}
+
+		proxyLog.WarnContext(ctx, "Request failed, retrying", "status", resp.StatusCode, "attempt", attempt, "wait_time", waitTime, "upstream_hint", hasHint)
+		metrics.UpstreamRetries.Inc(strconv.Itoa(resp.StatusCode))
+		span.AddEvent("retry", "wait_ms", waitTime, "http.response.status_code", resp.StatusCode)
+
+		if err := sleepContext(ctx, waitTime); err != nil {
+			return nil, err
 		}
 	}
+}
 
-	return lastResp, lastErr
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (s *ProxyService) isRetriableError(statusCode int, err error) bool {
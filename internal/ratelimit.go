@@ -0,0 +1,385 @@
+// Package internal provides per-user and per-key rate limiting for github-copilot-svcs.
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitStateFileName = "ratelimit_state.json"
+	rateLimitFlushDelay    = 5 * time.Second
+	concurrencyRetryAfter  = time.Second
+
+	// Rejection reasons
+	RateLimitReasonRPM         = "requests_per_minute"
+	RateLimitReasonConcurrency = "concurrency"
+	RateLimitReasonDaily       = "daily_quota"
+	RateLimitReasonMonthly     = "monthly_quota"
+)
+
+// RateLimitPolicy limits one user or API key. Zero values mean unlimited.
+type RateLimitPolicy struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	Burst             int `json:"burst"` // Default: requests_per_minute
+	MaxConcurrent     int `json:"max_concurrent"`
+	DailyQuota        int `json:"daily_quota"`
+	MonthlyQuota      int `json:"monthly_quota"`
+}
+
+func (p RateLimitPolicy) unlimited() bool {
+	return p.RequestsPerMinute == 0 && p.MaxConcurrent == 0 && p.DailyQuota == 0 && p.MonthlyQuota == 0
+}
+
+func (p RateLimitPolicy) validate(field string) error {
+	values := map[string]int{
+		"requests_per_minute": p.RequestsPerMinute,
+		"burst":               p.Burst,
+		"max_concurrent":      p.MaxConcurrent,
+		"daily_quota":         p.DailyQuota,
+		"monthly_quota":       p.MonthlyQuota,
+	}
+	for name, value := range values {
+		if value < 0 {
+			return NewValidationError(field+"."+name, value, "must not be negative", nil)
+		}
+	}
+	return nil
+}
+
+// RateLimitError is returned when a request exceeds its policy.
+type RateLimitError struct {
+	Reason     string
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	switch e.Reason {
+	case RateLimitReasonConcurrency:
+		return fmt.Sprintf("rate limit exceeded: more than %d concurrent requests", e.Limit)
+	case RateLimitReasonDaily:
+		return fmt.Sprintf("quota exceeded: daily limit of %d requests reached", e.Limit)
+	case RateLimitReasonMonthly:
+		return fmt.Sprintf("quota exceeded: monthly limit of %d requests reached", e.Limit)
+	default:
+		return fmt.Sprintf("rate limit exceeded: %d requests per minute", e.Limit)
+	}
+}
+
+// rateLimitSubject is the persisted and in-memory state of one limited identity.
+type rateLimitSubject struct {
+	Tokens     float64   `json:"tokens"`
+	LastRefill time.Time `json:"last_refill"`
+	Day        string    `json:"day"`
+	DayCount   int       `json:"day_count"`
+	Month      string    `json:"month"`
+	MonthCount int       `json:"month_count"`
+
+	inFlight int
+}
+
+// RateLimiter enforces token-bucket request rates, concurrency caps and
+// daily/monthly quotas per subject. Quota counters and buckets are saved to a
+// state file shortly after they change and on Close.
+type RateLimiter struct {
+	mutex      sync.Mutex
+	writeMutex sync.Mutex // serialises Flush so an older snapshot never overwrites a newer one
+	subjects   map[string]*rateLimitSubject
+	statePath  string
+	flushTimer *time.Timer
+	now        func() time.Time
+}
+
+// NewRateLimiter creates a limiter persisting its state at statePath. An empty
+// path keeps state in memory only. Existing state is loaded if present.
+func NewRateLimiter(statePath string) *RateLimiter {
+	l := &RateLimiter{
+		subjects:  make(map[string]*rateLimitSubject),
+		statePath: statePath,
+		now:       time.Now,
+	}
+	if err := l.load(); err != nil {
+		Warn("Failed to load rate limit state, starting fresh", "path", statePath, "error", err)
+	}
+	return l
+}
+
+// DefaultRateLimitStatePath returns the configured state file, or the default next to config.json.
+func DefaultRateLimitStatePath(cfg *Config) string {
+	if cfg.RateLimits.StateFile != "" {
+		return cfg.RateLimits.StateFile
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return rateLimitStateFileName
+	}
+	return filepath.Join(filepath.Dir(configPath), rateLimitStateFileName)
+}
+
+func (l *RateLimiter) load() error {
+	if l.statePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var subjects map[string]*rateLimitSubject
+	if err := json.Unmarshal(data, &subjects); err != nil {
+		return err
+	}
+	for key, subject := range subjects {
+		if subject != nil {
+			l.subjects[key] = subject
+		}
+	}
+	return nil
+}
+
+// rateLimit applies a policy to the requests of one subject.
+type rateLimit struct {
+	subject string
+	policy  RateLimitPolicy
+}
+
+// Acquire admits a request for subject under policy. On success it returns a
+// release function that must be called when the request finishes.
+func (l *RateLimiter) Acquire(subject string, policy RateLimitPolicy) (func(), *RateLimitError) {
+	return l.acquire(rateLimit{subject: subject, policy: policy})
+}
+
+// acquire admits a request only if every one of limits allows it, so a
+// rejection by one limit does not consume the quota of another.
+func (l *RateLimiter) acquire(limits ...rateLimit) (func(), *RateLimitError) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	var admitted []*rateLimitSubject
+	var buckets []bool
+	for _, limit := range limits {
+		if limit.policy.unlimited() {
+			continue
+		}
+		state := l.subject(limit.subject, now)
+		if err := state.check(limit.policy, now); err != nil {
+			return nil, err
+		}
+		admitted = append(admitted, state)
+		buckets = append(buckets, limit.policy.RequestsPerMinute > 0)
+	}
+	if len(admitted) == 0 {
+		return func() {}, nil
+	}
+
+	for i, state := range admitted {
+		if buckets[i] {
+			state.Tokens--
+		}
+		state.DayCount++
+		state.MonthCount++
+		state.inFlight++
+	}
+	l.scheduleFlush()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			for _, state := range admitted {
+				state.inFlight--
+			}
+		})
+	}, nil
+}
+
+// subject returns the state of subject with its quota periods rolled over
+// to now. Callers must hold the mutex.
+func (l *RateLimiter) subject(subject string, now time.Time) *rateLimitSubject {
+	state, ok := l.subjects[subject]
+	if !ok {
+		state = &rateLimitSubject{}
+		l.subjects[subject] = state
+	}
+	utc := now.UTC()
+	day, month := utc.Format("2006-01-02"), utc.Format("2006-01")
+	if state.Day != day {
+		state.Day, state.DayCount = day, 0
+	}
+	if state.Month != month {
+		state.Month, state.MonthCount = month, 0
+	}
+	return state
+}
+
+// check refills the token bucket and reports whether policy admits one more
+// request. It does not count the request.
+func (state *rateLimitSubject) check(policy RateLimitPolicy, now time.Time) *RateLimitError {
+	utc := now.UTC()
+	if policy.MonthlyQuota > 0 && state.MonthCount >= policy.MonthlyQuota {
+		nextMonth := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return &RateLimitError{Reason: RateLimitReasonMonthly, Limit: policy.MonthlyQuota, RetryAfter: nextMonth.Sub(utc)}
+	}
+	if policy.DailyQuota > 0 && state.DayCount >= policy.DailyQuota {
+		nextDay := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		return &RateLimitError{Reason: RateLimitReasonDaily, Limit: policy.DailyQuota, RetryAfter: nextDay.Sub(utc)}
+	}
+	if policy.MaxConcurrent > 0 && state.inFlight >= policy.MaxConcurrent {
+		return &RateLimitError{Reason: RateLimitReasonConcurrency, Limit: policy.MaxConcurrent, RetryAfter: concurrencyRetryAfter}
+	}
+
+	if policy.RequestsPerMinute > 0 {
+		capacity := float64(policy.Burst)
+		if capacity <= 0 {
+			capacity = float64(policy.RequestsPerMinute)
+		}
+		ratePerSecond := float64(policy.RequestsPerMinute) / float64(time.Minute/time.Second)
+
+		if state.LastRefill.IsZero() {
+			state.Tokens = capacity
+		} else {
+			elapsed := now.Sub(state.LastRefill).Seconds()
+			state.Tokens = math.Min(capacity, state.Tokens+math.Max(elapsed, 0)*ratePerSecond)
+		}
+		state.LastRefill = now
+
+		if state.Tokens < 1 {
+			wait := time.Duration((1 - state.Tokens) / ratePerSecond * float64(time.Second))
+			return &RateLimitError{Reason: RateLimitReasonRPM, Limit: policy.RequestsPerMinute, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// scheduleFlush saves the state file after rateLimitFlushDelay unless a save
+// is already pending. Callers must hold the mutex.
+func (l *RateLimiter) scheduleFlush() {
+	if l.statePath == "" || l.flushTimer != nil {
+		return
+	}
+	l.flushTimer = time.AfterFunc(rateLimitFlushDelay, func() {
+		if err := l.Flush(); err != nil {
+			Warn("Failed to save rate limit state", "path", l.statePath, "error", err)
+		}
+	})
+}
+
+// Flush writes the current counters to the state file.
+func (l *RateLimiter) Flush() error {
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	l.mutex.Lock()
+	if l.flushTimer != nil {
+		l.flushTimer.Stop()
+		l.flushTimer = nil
+	}
+	data, err := json.MarshalIndent(l.subjects, "", "  ")
+	l.mutex.Unlock()
+	if err != nil || l.statePath == "" {
+		return err
+	}
+	return writeFileAtomic(l.statePath, data, tokenFilePerm)
+}
+
+// Close flushes pending state. The limiter remains usable afterwards.
+func (l *RateLimiter) Close() error {
+	return l.Flush()
+}
+
+// rateLimitPolicyFor resolves the policy of a user: the group mapped to email
+// in rate_limits.users, falling back to rate_limits.default.
+func (c *Config) rateLimitPolicyFor(email string) RateLimitPolicy {
+	if policy, ok := c.mappedRateLimitPolicy(email); ok {
+		return policy
+	}
+	return c.RateLimits.Default
+}
+
+// mappedRateLimitPolicy returns the policy of the group mapped to subject in
+// rate_limits.users, if any. API keys are only limited on their own when
+// mapped; otherwise their owner's policy alone applies.
+func (c *Config) mappedRateLimitPolicy(subject string) (RateLimitPolicy, bool) {
+	group, ok := c.RateLimits.Users[subject]
+	if !ok {
+		return RateLimitPolicy{}, false
+	}
+	policy, ok := c.RateLimits.Groups[group]
+	return policy, ok
+}
+
+func (c *Config) validateRateLimits() error {
+	if err := c.RateLimits.Default.validate("rate_limits.default"); err != nil {
+		return err
+	}
+	for name, policy := range c.RateLimits.Groups {
+		if err := policy.validate("rate_limits.groups." + name); err != nil {
+			return err
+		}
+	}
+	for subject, group := range c.RateLimits.Users {
+		if _, ok := c.RateLimits.Groups[group]; !ok {
+			return NewValidationError("rate_limits.users."+subject, group, "references an undefined group", nil)
+		}
+	}
+	return nil
+}
+
+// admitRequest checks the request against its rate limit policies. The
+// owner's policy always applies to the owner's email, so issuing more keys
+// does not raise a user's limits; a key mapped in rate_limits.users is
+// limited on its own as well. Requests whose identity cannot be resolved are
+// admitted so the proxy handler reports the usual validation or
+// authentication error. The returned release function must be called once
+// the request has finished. Rejected callers are recorded on info for
+// request metrics and the audit log.
+func (s *ProxyService) admitRequest(r *http.Request, info *proxyRequestInfo) (func(), *RateLimitError) {
+	if s.rateLimiter == nil || r.Method != http.MethodPost {
+		return func() {}, nil
+	}
+
+	identity, err := s.identify(info, r)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	cfg := s.config.Load()
+	limits := []rateLimit{{subject: identity.Email, policy: cfg.rateLimitPolicyFor(identity.Email)}}
+	if identity.Key != nil {
+		if policy, ok := cfg.mappedRateLimitPolicy(identity.Key.ID); ok {
+			limits = append(limits, rateLimit{subject: identity.Key.ID, policy: policy})
+		}
+	}
+
+	release, limitErr := s.rateLimiter.acquire(limits...)
+	if limitErr != nil {
+		keyID := ""
+		if identity.Key != nil {
+			keyID = identity.Key.ID
+		}
+		Warn("Rate limit exceeded", "email", identity.Email, "key_id", keyID, "reason", limitErr.Reason, "retry_after", limitErr.RetryAfter)
+		metrics.RateLimitRejections.Inc(limitErr.Reason)
+		info.setCaller(identity, "")
+		return nil, limitErr
+	}
+	return release, nil
+}
+
+// writeRateLimitError writes a 429 response with Retry-After in the error
+// format of the endpoint.
+func writeRateLimitError(w http.ResponseWriter, err *RateLimitError, writeError proxyErrorWriter) {
+	w.Header().Set("Retry-After", retryAfterSeconds(err.RetryAfter))
+	writeError(w, http.StatusTooManyRequests, err.Error())
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, path string, now *time.Time) *RateLimiter {
+	t.Helper()
+	l := NewRateLimiter(path)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(t, "", &now)
+	policy := RateLimitPolicy{RequestsPerMinute: 60, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire("user@example.com", policy)
+		if err != nil {
+			t.Fatalf("request %d within burst rejected: %v", i, err)
+		}
+		release()
+	}
+
+	_, limitErr := l.Acquire("user@example.com", policy)
+	if limitErr == nil || limitErr.Reason != RateLimitReasonRPM {
+		t.Fatalf("expected requests-per-minute rejection, got %v", limitErr)
+	}
+	if limitErr.RetryAfter <= 0 || limitErr.RetryAfter > time.Second {
+		t.Errorf("expected retry within one second, got %v", limitErr.RetryAfter)
+	}
+
+	if _, err := l.Acquire("other@example.com", policy); err != nil {
+		t.Errorf("expected subjects to be limited independently, got %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := l.Acquire("user@example.com", policy); err != nil {
+		t.Errorf("expected a token after refill, got %v", err)
+	}
+}
+
+func TestRateLimiter_Concurrency(t *testing.T) {
+	now := time.Now()
+	l := newTestRateLimiter(t, "", &now)
+	policy := RateLimitPolicy{MaxConcurrent: 1}
+
+	release, err := l.Acquire("key_a", policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := l.Acquire("key_a", policy); err == nil {
+		t.Fatal("expected second concurrent request to be rejected")
+	}
+	release()
+	release() // releasing twice must not free an extra slot
+	if _, err := l.Acquire("key_a", policy); err != nil {
+		t.Errorf("expected slot to be free after release, got %v", err)
+	}
+	if _, err := l.Acquire("key_a", policy); err == nil {
+		t.Error("expected double release to be ignored")
+	}
+}
+
+func TestRateLimiter_QuotasPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2025, 3, 31, 23, 0, 0, 0, time.UTC)
+	policy := RateLimitPolicy{DailyQuota: 2, MonthlyQuota: 3}
+
+	l := newTestRateLimiter(t, path, &now)
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire("user@example.com", policy)
+		if err != nil {
+			t.Fatalf("request %d within quota rejected: %v", i, err)
+		}
+		release()
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	// A restarted limiter keeps the counters.
+	l = newTestRateLimiter(t, path, &now)
+	_, limitErr := l.Acquire("user@example.com", policy)
+	if limitErr == nil || limitErr.Reason != RateLimitReasonDaily {
+		t.Fatalf("expected daily quota rejection after restart, got %v", limitErr)
+	}
+	if limitErr.RetryAfter != time.Hour {
+		t.Errorf("expected retry at midnight UTC, got %v", limitErr.RetryAfter)
+	}
+
+	// The next day is a new month too, so both counters reset.
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire("user@example.com", policy); err != nil {
+			t.Fatalf("expected quota reset on the new day, got %v", err)
+		}
+	}
+	now = now.Add(24 * time.Hour)
+	if _, err := l.Acquire("user@example.com", policy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, limitErr = l.Acquire("user@example.com", policy); limitErr == nil || limitErr.Reason != RateLimitReasonMonthly {
+		t.Errorf("expected monthly quota rejection, got %v", limitErr)
+	}
+}
+
+func TestConfig_RateLimitPolicyFor(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimits.Default = RateLimitPolicy{RequestsPerMinute: 10}
+	cfg.RateLimits.Groups = map[string]RateLimitPolicy{
+		"team":  {RequestsPerMinute: 100},
+		"batch": {MaxConcurrent: 2},
+	}
+	cfg.RateLimits.Users = map[string]string{
+		"alice@example.com": "team",
+		"key_batch":         "batch",
+	}
+
+	if got := cfg.rateLimitPolicyFor("bob@example.com"); got.RequestsPerMinute != 10 {
+		t.Errorf("expected default policy, got %+v", got)
+	}
+	if got := cfg.rateLimitPolicyFor("alice@example.com"); got.RequestsPerMinute != 100 {
+		t.Errorf("expected team policy, got %+v", got)
+	}
+	if got, ok := cfg.mappedRateLimitPolicy("key_batch"); !ok || got.MaxConcurrent != 2 {
+		t.Errorf("expected mapped key policy, got %+v, %v", got, ok)
+	}
+	if _, ok := cfg.mappedRateLimitPolicy("key_other"); ok {
+		t.Error("expected unmapped keys to have no policy of their own")
+	}
+
+	cfg.RateLimits.Users["carol@example.com"] = "missing"
+	if err := cfg.validateRateLimits(); err == nil {
+		t.Error("expected validation error for an undefined group")
+	}
+}
+
+func TestAdmitRequest_KeysShareOwnerLimits(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimits.Default = RateLimitPolicy{DailyQuota: 3}
+	cfg.RateLimits.Groups = map[string]RateLimitPolicy{"single": {DailyQuota: 1}}
+	store := NewAPIKeyStore(filepath.Join(t.TempDir(), "api_keys.json"))
+	s := &ProxyService{config: NewConfigStore(cfg, ""), apiKeys: store, rateLimiter: NewRateLimiter("")}
+
+	var secrets []string
+	for i := 0; i < 3; i++ {
+		secret, key, err := store.Create("user@example.com", "", APIKeyScopes{}, 0)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if i == 0 {
+			cfg.RateLimits.Users = map[string]string{key.ID: "single"}
+		}
+		secrets = append(secrets, secret)
+	}
+	admit := func(secret string) *RateLimitError {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		release, limitErr := s.admitRequest(req, &proxyRequestInfo{})
+		if release != nil {
+			release()
+		}
+		return limitErr
+	}
+
+	// The first key is limited on its own as well as by its owner's quota
+	if err := admit(secrets[0]); err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	if err := admit(secrets[0]); err == nil {
+		t.Fatal("expected the key's own quota to apply")
+	}
+	// The rejection above did not count against the owner, whose quota is
+	// shared by all of their keys
+	for _, secret := range secrets[1:] {
+		if err := admit(secret); err != nil {
+			t.Fatalf("unexpected rejection: %v", err)
+		}
+	}
+	if err := admit(secrets[2]); err == nil || err.Reason != RateLimitReasonDaily {
+		t.Errorf("expected another key to share the owner's quota, got %v", err)
+	}
+}
+
+func TestProxyService_RateLimitResponse(t *testing.T) {
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	cfg.RateLimits.Default = RateLimitPolicy{DailyQuota: 1}
+	cfg.APIKeys.AllowEmailParam = true
+	wp := NewWorkerPool(1)
+	defer wp.Stop()
+	limiter := NewRateLimiter("")
+	s := NewProxyService(cfg, &http.Client{}, nil, wp, WithRateLimiter(limiter))
+
+	// Consume the quota directly so the request below is rejected before it
+	// reaches the upstream.
+	if _, err := limiter.Acquire("user@example.com", cfg.RateLimits.Default); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The 429 uses the error format of each endpoint
+	tests := []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/v1/chat/completions", s.Handler(), "quota exceeded: daily limit of 1 requests reached"},
+		{"/v1/messages", s.MessagesHandler(), `"type":"rate_limit_error"`},
+		{"/api/chat", s.OllamaChatHandler(), `{"error":"quota exceeded`},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, tt.path+"?email=user@example.com", nil)
+		tt.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected 429, got %d", tt.path, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected Retry-After header", tt.path)
+		}
+		if !strings.Contains(rr.Body.String(), tt.body) {
+			t.Errorf("%s: expected %s in %q", tt.path, tt.body, rr.Body.String())
+		}
+	}
+}
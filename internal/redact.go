@@ -0,0 +1,163 @@
+// Package internal provides secret redaction for github-copilot-svcs.
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// secretHeaders carry credentials, as does every header whose name contains "token".
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// secretLogKeys are log attribute names whose values are always secret, in
+// addition to the secret header names.
+var secretLogKeys = []string{"api_key", "client_secret", "device_code", "password", "secret"}
+
+// secretPattern matches GitHub tokens (ghu_, gho_, ...), Copilot tokens
+// (tid=...) and proxy API keys inside free text.
+var secretPattern = regexp.MustCompile(`\bgh[opsur]_[A-Za-z0-9]{20,}\b|\bgithub_pat_[A-Za-z0-9_]{20,}|\btid=[^"\s]+|\b` + APIKeyPrefix + `[A-Za-z0-9_-]+`)
+
+// Credentials that are only recognizable by their context: bearer values,
+// credential query parameters and email addresses, plain or URL-encoded.
+var (
+	bearerPattern      = regexp.MustCompile(`(?i)\b((?:authorization:\s*)?(?:bearer|token|basic)\s+)([A-Za-z0-9._~+/=-]{16,})`)
+	secretParamPattern = regexp.MustCompile(`(?i)([?&](?:access_token|api_key|code|device_code|key|token)=)([^&#\s"]+)`)
+	emailPattern       = regexp.MustCompile(`[A-Za-z0-9._+-]+(?:@|%40)[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+)
+
+// isSecretHeader reports whether a header carries credentials.
+func isSecretHeader(name string) bool {
+	for _, secret := range secretHeaders {
+		if strings.EqualFold(name, secret) {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(name), "token")
+}
+
+// isSecretLogKey reports whether a log attribute holds a credential, e.g.
+// "authorization", "github_token" or "device_code".
+func isSecretLogKey(key string) bool {
+	key = strings.ToLower(key)
+	return slices.Contains(secretLogKeys, key) || isSecretHeader(strings.ReplaceAll(key, "_", "-"))
+}
+
+// isEmailLogKey reports whether a log attribute holds an email address.
+func isEmailLogKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "email" || strings.HasSuffix(key, "_email")
+}
+
+// secretFingerprint replaces a secret with a short hash, so log lines about
+// the same credential can still be matched up without revealing it.
+func secretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "[redacted:" + hex.EncodeToString(sum[:4]) + "]"
+}
+
+// maskEmail keeps the first character and the domain of an address, e.g.
+// "a***@example.com". URL-encoded addresses stay encoded.
+func maskEmail(email string) string {
+	separator := "@"
+	at := strings.LastIndex(email, separator)
+	if encoded := strings.LastIndex(email, "%40"); encoded > at {
+		separator, at = "%40", encoded
+	}
+	if at <= 0 {
+		return secretFingerprint(email)
+	}
+	return email[:1] + "***" + separator + email[at+len(separator):]
+}
+
+// redactSecrets masks the credentials and email addresses found in text.
+func redactSecrets(text string) string {
+	text = secretPattern.ReplaceAllStringFunc(text, secretFingerprint)
+	text = bearerPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := bearerPattern.FindStringSubmatch(match)
+		return parts[1] + secretFingerprint(parts[2])
+	})
+	text = secretParamPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := secretParamPattern.FindStringSubmatch(match)
+		return parts[1] + secretFingerprint(parts[2])
+	})
+	return emailPattern.ReplaceAllStringFunc(text, maskEmail)
+}
+
+// redactHeader returns a copy of header with credentials replaced.
+func redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			if isSecretHeader(name) {
+				value = secretFingerprint(value)
+			} else {
+				value = redactSecrets(value)
+			}
+			redacted[name] = append(redacted[name], value)
+		}
+	}
+	return redacted
+}
+
+// redactLogAttr masks credentials and email addresses in a log attribute,
+// recognized by the attribute name or by the format of the value.
+func redactLogAttr(a slog.Attr) slog.Attr {
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		members := value.Group()
+		redacted := make([]slog.Attr, len(members))
+		for i, member := range members {
+			redacted[i] = redactLogAttr(member)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString:
+		text := value.String()
+		switch {
+		case text == "":
+			return a
+		case isSecretLogKey(a.Key):
+			return slog.String(a.Key, secretFingerprint(text))
+		case isEmailLogKey(a.Key):
+			return slog.String(a.Key, maskEmail(text))
+		}
+		return slog.String(a.Key, redactSecrets(text))
+	case slog.KindAny:
+		if header, ok := value.Any().(http.Header); ok {
+			return slog.Any(a.Key, redactHeader(header))
+		}
+		text := fmt.Sprint(value.Any())
+		if isSecretLogKey(a.Key) {
+			return slog.String(a.Key, secretFingerprint(text))
+		}
+		if redacted := redactSecrets(text); redacted != text {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
+
+// redactLogAttrs applies redactLogAttr to each of attrs.
+func redactLogAttrs(attrs []slog.Attr) []slog.Attr {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactLogAttr(a)
+	}
+	return redacted
+}
+
+// redactLogRecord returns a copy of r with its message and attributes redacted.
+func redactLogRecord(r slog.Record) slog.Record {
+	redacted := slog.NewRecord(r.Time, r.Level, redactSecrets(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactLogAttr(a))
+		return true
+	})
+	return redacted
+}
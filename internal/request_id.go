@@ -0,0 +1,205 @@
+// Package internal provides request correlation IDs for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Correlation headers. X-Request-ID is accepted from clients, generated when
+// missing and sent to every upstream; X-Upstream-Request-ID returns the ID
+// the Copilot API assigned to the request.
+const (
+	RequestIDHeader         = "X-Request-ID"
+	UpstreamRequestIDHeader = "X-Upstream-Request-ID"
+	githubRequestIDHeader   = "X-GitHub-Request-Id"
+)
+
+// maxRequestIDLength bounds client-supplied IDs so they cannot bloat logs.
+const maxRequestIDLength = 128
+
+// requestCorrelation carries the IDs of one client request. The upstream ID
+// is filled in once the Copilot API has answered.
+type requestCorrelation struct {
+	id         string
+	mutex      sync.Mutex
+	upstreamID string
+}
+
+type requestCorrelationKey struct{}
+
+func correlationFromContext(ctx context.Context) *requestCorrelation {
+	if ctx == nil {
+		return nil
+	}
+	correlation, _ := ctx.Value(requestCorrelationKey{}).(*requestCorrelation)
+	return correlation
+}
+
+// WithRequestID returns a context carrying id as its request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestCorrelationKey{}, &requestCorrelation{id: id})
+}
+
+// RequestIDFromContext returns the request ID of ctx, or "" outside a request.
+func RequestIDFromContext(ctx context.Context) string {
+	if correlation := correlationFromContext(ctx); correlation != nil {
+		return correlation.id
+	}
+	return ""
+}
+
+// UpstreamRequestIDFromContext returns the ID the upstream assigned to the
+// request of ctx, or "" when no upstream response has been received.
+func UpstreamRequestIDFromContext(ctx context.Context) string {
+	if correlation := correlationFromContext(ctx); correlation != nil {
+		return correlation.upstream()
+	}
+	return ""
+}
+
+func (c *requestCorrelation) upstream() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.upstreamID
+}
+
+// recordUpstreamRequestID stores the upstream's request ID from resp in the
+// correlation of ctx. The last upstream response of a request wins, so the
+// ID returned to the client belongs to the response it received.
+func recordUpstreamRequestID(ctx context.Context, resp *http.Response) {
+	correlation := correlationFromContext(ctx)
+	if correlation == nil || resp == nil {
+		return
+	}
+	id := resp.Header.Get("X-Request-Id")
+	if id == "" {
+		id = resp.Header.Get(githubRequestIDHeader)
+	}
+	if id == "" {
+		return
+	}
+	correlation.mutex.Lock()
+	defer correlation.mutex.Unlock()
+	correlation.upstreamID = id
+}
+
+// setRequestIDHeader forwards the request ID of ctx on an outgoing request.
+func setRequestIDHeader(ctx context.Context, req *http.Request) {
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// correlationLogAttrs returns the IDs of ctx as log attributes.
+func correlationLogAttrs(ctx context.Context) []slog.Attr {
+	correlation := correlationFromContext(ctx)
+	if correlation == nil {
+		return nil
+	}
+	attrs := []slog.Attr{slog.String("request_id", correlation.id)}
+	if upstreamID := correlation.upstream(); upstreamID != "" {
+		attrs = append(attrs, slog.String("upstream_request_id", upstreamID))
+	}
+	return attrs
+}
+
+// responseContext returns the context of the request that produced resp.
+func responseContext(resp *http.Response) context.Context {
+	if resp != nil && resp.Request != nil {
+		return resp.Request.Context()
+	}
+	return context.Background()
+}
+
+// newRequestID returns a random 128-bit hex ID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a client-supplied ID is safe to log and
+// forward: short and limited to URL-safe punctuation.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware accepts the client's X-Request-ID or generates one,
+// carries it in the request context and returns it, together with the
+// upstream's ID when there is one, in the response headers.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		ctx := WithRequestID(r.Context(), id)
+		next.ServeHTTP(&requestIDResponseWriter{ResponseWriter: w, correlation: correlationFromContext(ctx)}, r.WithContext(ctx))
+	})
+}
+
+// requestIDResponseWriter sets the correlation headers just before the
+// response headers are sent, replacing any copied from the upstream.
+type requestIDResponseWriter struct {
+	http.ResponseWriter
+	correlation *requestCorrelation
+	wroteHeader bool
+}
+
+func (w *requestIDResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		header.Set(RequestIDHeader, w.correlation.id)
+		header.Del(UpstreamRequestIDHeader)
+		if upstreamID := w.correlation.upstream(); upstreamID != "" {
+			header.Set(UpstreamRequestIDHeader, upstreamID)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *requestIDResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush forwards to the underlying writer so streamed responses are not held back.
+func (w *requestIDResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack forwards to the underlying writer.
+func (w *requestIDResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *requestIDResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
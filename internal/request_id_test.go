@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"client ID kept", "client-123", "client-123"},
+		{"missing ID generated", "", ""},
+		{"unsafe ID replaced", "bad id\nwith newline", ""},
+		{"overlong ID replaced", strings.Repeat("a", maxRequestIDLength+1), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			got := rr.Header().Get(RequestIDHeader)
+			if got != seen || got == "" {
+				t.Fatalf("expected the context ID %q in the response, got %q", seen, got)
+			}
+			if tt.expected != "" && got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if tt.expected == "" && (got == tt.header || len(got) != 32) {
+				t.Errorf("expected a generated ID, got %q", got)
+			}
+		})
+	}
+}
+
+func TestRequestID_PropagatedThroughProxy(t *testing.T) {
+	var upstreamSaw string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamSaw = r.Header.Get(RequestIDHeader)
+		w.Header().Set("X-Request-Id", "upstream-42")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"error":"bad request"}`)
+	})
+
+	var logs bytes.Buffer
+	previous := globalLogSink.Load()
+	globalLogSink.Store(newLogSink("debug", WithLogFormat(LogFormatJSON), WithLogOutput(&logs)))
+	t.Cleanup(func() { globalLogSink.Store(previous) })
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set(RequestIDHeader, "client-abc")
+	rr := httptest.NewRecorder()
+	RequestIDMiddleware(LoggingMiddleware(s.Handler())).ServeHTTP(rr, req)
+
+	if upstreamSaw != "client-abc" {
+		t.Errorf("expected the request ID to be sent upstream, got %q", upstreamSaw)
+	}
+	if got := rr.Header().Values(RequestIDHeader); len(got) != 1 || got[0] != "client-abc" {
+		t.Errorf("expected only our request ID in the response, got %v", got)
+	}
+	if got := rr.Header().Get(UpstreamRequestIDHeader); got != "upstream-42" {
+		t.Errorf("expected the upstream request ID in the response, got %q", got)
+	}
+
+	var upstreamError, httpResponse map[string]any
+	for line := range strings.Lines(logs.String()) {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("unparseable log record %q: %v", line, err)
+		}
+		switch record["msg"] {
+		case "Received error response from upstream":
+			upstreamError = record
+		case "HTTP Response":
+			httpResponse = record
+		}
+		if record["request_id"] != "client-abc" {
+			t.Errorf("record without the request ID: %s", line)
+		}
+	}
+	if upstreamError["upstream_request_id"] != "upstream-42" || httpResponse["upstream_request_id"] != "upstream-42" {
+		t.Errorf("expected the upstream ID next to the request ID, got %v and %v", upstreamError, httpResponse)
+	}
+}
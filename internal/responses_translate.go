@@ -0,0 +1,1056 @@
+// Package internal provides Chat Completions and Responses API translation for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+// Upstream APIs selectable per model in model_apis.
+const (
+	ModelAPIChat      = "chat"
+	ModelAPIResponses = "responses"
+)
+
+// modelAPIPaths maps an upstream API to its Copilot path.
+var modelAPIPaths = map[string]string{
+	ModelAPIChat:      "/chat/completions",
+	ModelAPIResponses: "/responses",
+}
+
+// clientModelAPI returns the API a proxy endpoint speaks, or "" when the
+// endpoint is never translated.
+func clientModelAPI(endpoint string) string {
+	switch endpoint {
+	case "/v1/chat/completions":
+		return ModelAPIChat
+	case "/v1/responses":
+		return ModelAPIResponses
+	default:
+		return ""
+	}
+}
+
+// modelAPI returns the upstream API configured for model, or "" when the
+// client's own API should be used. Exact entries win over globs and longer
+// globs win over shorter ones.
+func (c *Config) modelAPI(model string) string {
+	if model == "" || len(c.ModelAPIs) == 0 {
+		return ""
+	}
+	if api, ok := c.ModelAPIs[model]; ok {
+		return api
+	}
+	best := ""
+	for pattern := range c.ModelAPIs {
+		matched, err := path.Match(pattern, model)
+		if err != nil || !matched {
+			continue
+		}
+		if len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return c.ModelAPIs[best]
+}
+
+func (c *Config) validateModelAPIs() error {
+	for pattern, api := range c.ModelAPIs {
+		field := "model_apis." + pattern
+		if pattern == "" {
+			return NewValidationError("model_apis", "", "model name cannot be empty", nil)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return NewValidationError(field, pattern, "invalid glob pattern", err)
+		}
+		if _, ok := modelAPIPaths[api]; !ok {
+			return NewValidationError(field, api, "must be one of chat, responses", nil)
+		}
+	}
+	return nil
+}
+
+// translateRequestPayload converts a payload in clientAPI's format into the
+// other API's format.
+func translateRequestPayload(clientAPI string, payload map[string]any) (map[string]any, error) {
+	if clientAPI == ModelAPIResponses {
+		return responsesToChatPayload(payload)
+	}
+	return chatToResponsesPayload(payload)
+}
+
+// chatToResponsesPayload converts a chat/completions payload into a Responses API payload.
+func chatToResponsesPayload(payload map[string]any) (map[string]any, error) {
+	out := map[string]any{"model": payload["model"]}
+	copyPayloadFields(out, payload, "stream", "temperature", "top_p", "user", "parallel_tool_calls", "metadata", "store")
+	for _, key := range []string{"max_completion_tokens", "max_tokens"} {
+		if value, ok := payload[key]; ok {
+			out["max_output_tokens"] = value
+			break
+		}
+	}
+	if effort, ok := payload["reasoning_effort"]; ok {
+		out["reasoning"] = map[string]any{"effort": effort}
+	}
+	if format, ok := payload["response_format"].(map[string]any); ok {
+		textFormat := map[string]any{"type": format["type"]}
+		if schema, ok := format["json_schema"].(map[string]any); ok {
+			maps.Copy(textFormat, schema)
+		}
+		out["text"] = map[string]any{"format": textFormat}
+	}
+
+	messages, ok := payload["messages"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("messages must be an array")
+	}
+	input := make([]any, 0, len(messages))
+	for i, raw := range messages {
+		msg, ok := raw.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] must be an object", i)
+		}
+		role, _ := msg["role"].(string)
+		switch role {
+		case "tool":
+			input = append(input, map[string]any{
+				"type":    "function_call_output",
+				"call_id": msg["tool_call_id"],
+				"output":  contentText(msg["content"]),
+			})
+		case "assistant":
+			if content := chatToResponsesContent(msg["content"], "output_text"); content != nil {
+				input = append(input, map[string]any{"type": "message", "role": role, "content": content})
+			}
+			calls, _ := msg["tool_calls"].([]any)
+			for _, rawCall := range calls {
+				call, _ := rawCall.(map[string]any)
+				function, _ := call["function"].(map[string]any)
+				input = append(input, map[string]any{
+					"type":      "function_call",
+					"call_id":   call["id"],
+					"name":      function["name"],
+					"arguments": function["arguments"],
+				})
+			}
+		default:
+			content := chatToResponsesContent(msg["content"], "input_text")
+			if content == nil {
+				content = ""
+			}
+			input = append(input, map[string]any{"type": "message", "role": role, "content": content})
+		}
+	}
+	out["input"] = input
+
+	if tools, ok := payload["tools"].([]any); ok {
+		converted := make([]any, 0, len(tools))
+		for _, raw := range tools {
+			tool, _ := raw.(map[string]any)
+			function, ok := tool["function"].(map[string]any)
+			if !ok || tool["type"] != "function" {
+				converted = append(converted, raw)
+				continue
+			}
+			entry := map[string]any{"type": "function"}
+			maps.Copy(entry, function)
+			converted = append(converted, entry)
+		}
+		out["tools"] = converted
+	}
+	switch choice := payload["tool_choice"].(type) {
+	case string:
+		out["tool_choice"] = choice
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			out["tool_choice"] = map[string]any{"type": "function", "name": function["name"]}
+		} else {
+			out["tool_choice"] = choice
+		}
+	}
+	return out, nil
+}
+
+// chatToResponsesContent converts chat message content into Responses input
+// content. Strings pass through; text parts become textType parts.
+func chatToResponsesContent(content any, textType string) any {
+	switch v := content.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return v
+	case []any:
+		parts := make([]any, 0, len(v))
+		for _, raw := range v {
+			part, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				parts = append(parts, map[string]any{"type": textType, "text": part["text"]})
+			case "image_url":
+				image := map[string]any{"type": "input_image"}
+				if url, ok := part["image_url"].(map[string]any); ok {
+					image["image_url"] = url["url"]
+					if detail, ok := url["detail"]; ok {
+						image["detail"] = detail
+					}
+				} else {
+					image["image_url"] = part["image_url"]
+				}
+				parts = append(parts, image)
+			default:
+				parts = append(parts, part)
+			}
+		}
+		return parts
+	default:
+		return nil
+	}
+}
+
+// responsesToChatPayload converts a Responses API payload into a chat/completions payload.
+func responsesToChatPayload(payload map[string]any) (map[string]any, error) {
+	out := map[string]any{"model": payload["model"]}
+	copyPayloadFields(out, payload, "stream", "temperature", "top_p", "user", "parallel_tool_calls", "metadata", "store")
+	if value, ok := payload["max_output_tokens"]; ok {
+		out["max_tokens"] = value
+	}
+	if reasoning, ok := payload["reasoning"].(map[string]any); ok && reasoning["effort"] != nil {
+		out["reasoning_effort"] = reasoning["effort"]
+	}
+	if text, ok := payload["text"].(map[string]any); ok {
+		if format, ok := text["format"].(map[string]any); ok {
+			out["response_format"] = responsesToChatFormat(format)
+		}
+	}
+	if stream, _ := payload["stream"].(bool); stream {
+		// Usage is only reported on chat streams when asked for
+		out["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	messages := make([]any, 0)
+	if instructions, ok := payload["instructions"].(string); ok && instructions != "" {
+		messages = append(messages, map[string]any{"role": "system", "content": instructions})
+	}
+	switch input := payload["input"].(type) {
+	case nil:
+	case string:
+		messages = append(messages, map[string]any{"role": "user", "content": input})
+	case []any:
+		for i, raw := range input {
+			item, ok := raw.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("input[%d] must be an object", i)
+			}
+			itemType, _ := item["type"].(string)
+			switch itemType {
+			case "function_call":
+				call := map[string]any{
+					"id":       item["call_id"],
+					"type":     "function",
+					"function": map[string]any{"name": item["name"], "arguments": item["arguments"]},
+				}
+				// Calls following an assistant message belong to the same turn
+				if last, ok := lastChatMessage(messages, "assistant"); ok {
+					calls, _ := last["tool_calls"].([]any)
+					last["tool_calls"] = append(calls, call)
+				} else {
+					messages = append(messages, map[string]any{"role": "assistant", "content": nil, "tool_calls": []any{call}})
+				}
+			case "function_call_output":
+				messages = append(messages, map[string]any{
+					"role":         "tool",
+					"tool_call_id": item["call_id"],
+					"content":      contentText(item["output"]),
+				})
+			case "message", "":
+				role, _ := item["role"].(string)
+				if role == "developer" {
+					role = "system"
+				}
+				messages = append(messages, map[string]any{"role": role, "content": responsesToChatContent(item["content"])})
+			default:
+				Debug("Dropping Responses input item with no chat equivalent", "type", itemType)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("input must be a string or an array")
+	}
+	out["messages"] = messages
+
+	if tools, ok := payload["tools"].([]any); ok {
+		converted := make([]any, 0, len(tools))
+		for _, raw := range tools {
+			tool, _ := raw.(map[string]any)
+			if tool["type"] != "function" {
+				Debug("Dropping Responses tool with no chat equivalent", "type", tool["type"])
+				continue
+			}
+			function := maps.Clone(tool)
+			delete(function, "type")
+			converted = append(converted, map[string]any{"type": "function", "function": function})
+		}
+		if len(converted) > 0 {
+			out["tools"] = converted
+		}
+	}
+	switch choice := payload["tool_choice"].(type) {
+	case string:
+		out["tool_choice"] = choice
+	case map[string]any:
+		if choice["type"] == "function" {
+			out["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": choice["name"]}}
+		}
+	}
+	return out, nil
+}
+
+// responsesToChatContent converts Responses message content into chat
+// content. Text-only content is joined into a string.
+func responsesToChatContent(content any) any {
+	items, ok := content.([]any)
+	if !ok {
+		return content
+	}
+	parts := make([]map[string]any, 0, len(items))
+	for _, raw := range items {
+		part, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch part["type"] {
+		case "input_text", "output_text", "text":
+			text, _ := part["text"].(string)
+			parts = append(parts, map[string]any{"type": "text", "text": text})
+		case "input_image":
+			url := map[string]any{"url": part["image_url"]}
+			if detail, ok := part["detail"]; ok {
+				url["detail"] = detail
+			}
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": url})
+		}
+	}
+	return chatContentFromParts(parts)
+}
+
+// responsesToChatFormat converts a Responses text.format into a chat response_format.
+func responsesToChatFormat(format map[string]any) map[string]any {
+	if format["type"] != "json_schema" {
+		return map[string]any{"type": format["type"]}
+	}
+	schema := maps.Clone(format)
+	delete(schema, "type")
+	return map[string]any{"type": "json_schema", "json_schema": schema}
+}
+
+// lastChatMessage returns the last message when it has the given role.
+func lastChatMessage(messages []any, role string) (map[string]any, bool) {
+	if len(messages) == 0 {
+		return nil, false
+	}
+	last, ok := messages[len(messages)-1].(map[string]any)
+	if !ok || last["role"] != role {
+		return nil, false
+	}
+	return last, true
+}
+
+func copyPayloadFields(dst, src map[string]any, keys ...string) {
+	for _, key := range keys {
+		if value, ok := src[key]; ok {
+			dst[key] = value
+		}
+	}
+}
+
+// contentText flattens message content into a string. Non-text values are
+// encoded as JSON.
+func contentText(content any) string {
+	switch v := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []any:
+		texts := make([]string, 0, len(v))
+		for _, raw := range v {
+			if part, ok := raw.(map[string]any); ok {
+				if text, ok := part["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, "\n")
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+// responsesResponse is the subset of a Responses API response the proxy translates.
+type responsesResponse struct {
+	ID                string                `json:"id"`
+	CreatedAt         int64                 `json:"created_at"`
+	Model             string                `json:"model"`
+	Status            string                `json:"status"`
+	IncompleteDetails *responsesIncomplete  `json:"incomplete_details"`
+	Error             *responsesError       `json:"error"`
+	Output            []responsesOutputItem `json:"output"`
+	Usage             *responsesUsage       `json:"usage"`
+}
+
+type responsesIncomplete struct {
+	Reason string `json:"reason"`
+}
+
+type responsesError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type responsesOutputItem struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type responsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	OutputTokens       int `json:"output_tokens"`
+	TotalTokens        int `json:"total_tokens"`
+	InputTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// responsesStreamEvent is the subset of a Responses API stream event the proxy translates.
+type responsesStreamEvent struct {
+	Type     string               `json:"type"`
+	ItemID   string               `json:"item_id"`
+	Delta    string               `json:"delta"`
+	Item     *responsesOutputItem `json:"item"`
+	Response *responsesResponse   `json:"response"`
+	Message  string               `json:"message"`
+}
+
+// translateResponseBody replaces a successful upstream JSON body with its
+// translation into clientAPI's format.
+func translateResponseBody(resp *http.Response, clientAPI string) error {
+	var translated any
+	if clientAPI == ModelAPIResponses {
+		var completion transform.ChatCompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return NewProxyError("decode_response", "failed to decode chat completion response", err)
+		}
+		translated = chatToResponsesResponse(&completion)
+	} else {
+		var response responsesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return NewProxyError("decode_response", "failed to decode responses response", err)
+		}
+		translated = responsesToChatResponse(&response)
+	}
+
+	data, err := json.Marshal(translated)
+	if err != nil {
+		return NewProxyError("encode_response", "failed to encode translated response", err)
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Body = readCloser{Reader: bytes.NewReader(data), Closer: resp.Body}
+	return nil
+}
+
+// translateResponseStream converts an upstream event stream into clientAPI's stream format.
+func translateResponseStream(ctx context.Context, w io.Writer, body io.Reader, clientAPI string) error {
+	if clientAPI == ModelAPIResponses {
+		return newResponsesStreamWriter(w).translate(ctx, body)
+	}
+	return newChatStreamWriter(w).translate(ctx, body)
+}
+
+// chatToResponsesResponse converts a chat completion into a Responses API
+// response. Copilot may split text and tool calls across several choices, so
+// all choices are merged.
+func chatToResponsesResponse(completion *transform.ChatCompletionResponse) map[string]any {
+	var text strings.Builder
+	var calls []transform.ToolCall
+	finishReason := ""
+	for _, choice := range completion.Choices {
+		text.WriteString(choice.Message.Content)
+		calls = append(calls, choice.Message.ToolCalls...)
+		if choice.FinishReason != "" && finishReason != "tool_calls" {
+			finishReason = choice.FinishReason
+		}
+	}
+
+	output := make([]any, 0, len(calls)+1)
+	if text.Len() > 0 {
+		output = append(output, responsesMessageItem(newOutputItemID(len(output)), "completed", text.String()))
+	}
+	for _, call := range calls {
+		output = append(output, responsesFunctionCallItem(newOutputItemID(len(output)), "completed", call.ID, call.Function.Name, call.Function.Arguments))
+	}
+
+	response := newResponsesObject(responsesID(completion.ID), completion.Model, completion.Created, output)
+	completeResponsesObject(response, finishReason, &completion.Usage)
+	return response
+}
+
+// responsesToChatResponse converts a Responses API response into a chat completion.
+func responsesToChatResponse(response *responsesResponse) *transform.ChatCompletionResponse {
+	message := transform.ChatCompletionMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, item := range response.Output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				if part.Type == "output_text" {
+					text.WriteString(part.Text)
+				}
+			}
+		case "function_call":
+			message.ToolCalls = append(message.ToolCalls, transform.ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: transform.ToolCallFunction{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	message.Content = text.String()
+
+	return &transform.ChatCompletionResponse{
+		ID:      chatCompletionID(response.ID),
+		Object:  "chat.completion",
+		Created: response.CreatedAt,
+		Model:   response.Model,
+		Choices: []transform.ChatCompletionChoice{{
+			Message:      message,
+			FinishReason: chatFinishReason(response, len(message.ToolCalls) > 0),
+		}},
+		Usage: chatUsageFromResponses(response.Usage),
+	}
+}
+
+func newResponsesObject(id, model string, createdAt int64, output []any) map[string]any {
+	return map[string]any{
+		"id":         id,
+		"object":     "response",
+		"created_at": createdAt,
+		"model":      model,
+		"status":     "in_progress",
+		"output":     output,
+	}
+}
+
+// completeResponsesObject sets the final status and usage of a Responses API
+// response from a chat finish reason.
+func completeResponsesObject(response map[string]any, finishReason string, usage *transform.ChatCompletionUsage) {
+	response["status"] = "completed"
+	switch finishReason {
+	case "length":
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]any{"reason": "max_output_tokens"}
+	case "content_filter":
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]any{"reason": "content_filter"}
+	}
+	if usage != nil {
+		cached := 0
+		if usage.PromptTokensDetails != nil {
+			cached = usage.PromptTokensDetails.CachedTokens
+		}
+		response["usage"] = map[string]any{
+			"input_tokens":          usage.PromptTokens,
+			"input_tokens_details":  map[string]any{"cached_tokens": cached},
+			"output_tokens":         usage.CompletionTokens,
+			"output_tokens_details": map[string]any{"reasoning_tokens": 0},
+			"total_tokens":          usage.TotalTokens,
+		}
+	}
+}
+
+func responsesMessageItem(id, status, text string) map[string]any {
+	return map[string]any{
+		"type":    "message",
+		"id":      id,
+		"status":  status,
+		"role":    "assistant",
+		"content": []any{map[string]any{"type": "output_text", "text": text, "annotations": []any{}}},
+	}
+}
+
+func responsesFunctionCallItem(id, status, callID, name, arguments string) map[string]any {
+	return map[string]any{
+		"type":      "function_call",
+		"id":        id,
+		"status":    status,
+		"call_id":   callID,
+		"name":      name,
+		"arguments": arguments,
+	}
+}
+
+// chatFinishReason maps a Responses API status onto a chat finish reason.
+func chatFinishReason(response *responsesResponse, hasToolCalls bool) string {
+	if response.IncompleteDetails != nil {
+		switch response.IncompleteDetails.Reason {
+		case "max_output_tokens":
+			return "length"
+		case "content_filter":
+			return "content_filter"
+		}
+	}
+	if hasToolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func chatUsageFromResponses(usage *responsesUsage) transform.ChatCompletionUsage {
+	if usage == nil {
+		return transform.ChatCompletionUsage{}
+	}
+	converted := transform.ChatCompletionUsage{
+		PromptTokens:     usage.InputTokens,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+	if converted.TotalTokens == 0 {
+		converted.TotalTokens = usage.InputTokens + usage.OutputTokens
+	}
+	if usage.InputTokensDetails != nil && usage.InputTokensDetails.CachedTokens > 0 {
+		converted.PromptTokensDetails = &transform.PromptTokensDetails{CachedTokens: usage.InputTokensDetails.CachedTokens}
+	}
+	return converted
+}
+
+// responsesID returns a Responses API ID for an upstream chat completion ID.
+func responsesID(id string) string {
+	if id == "" {
+		return "resp_" + randomBase36(24)
+	}
+	if strings.HasPrefix(id, "resp_") {
+		return id
+	}
+	return "resp_" + id
+}
+
+// chatCompletionID returns a chat completion ID for an upstream Responses API ID.
+func chatCompletionID(id string) string {
+	if id == "" {
+		return "chatcmpl-" + randomBase36(24)
+	}
+	return "chatcmpl-" + strings.TrimPrefix(id, "resp_")
+}
+
+// chatStreamWriter converts Responses API stream events into chat completion chunks.
+type chatStreamWriter struct {
+	w       io.Writer
+	tracker *streamIDTracker
+
+	started      bool
+	id           string
+	model        string
+	created      int64
+	tools        map[string]int // function_call item ID -> tool call index
+	finishReason string
+	usage        *transform.ChatCompletionUsage
+}
+
+func newChatStreamWriter(w io.Writer) *chatStreamWriter {
+	return &chatStreamWriter{w: w, tracker: newStreamIDTracker(), tools: make(map[string]int)}
+}
+
+func (c *chatStreamWriter) translate(ctx context.Context, body io.Reader) error {
+	err := readSSEEvents(body, func(event sseEvent) error {
+		data := strings.TrimSpace(event.Data)
+		if data == "" || data == "[DONE]" {
+			return nil
+		}
+		// Copilot does not keep item IDs stable across events; sync them first
+		data = fixResponseStreamIDs(data, event.Event, c.tracker)
+		var parsed responsesStreamEvent
+		if err := json.Unmarshal([]byte(data), &parsed); err != nil {
+			WarnContext(ctx, "Skipping undecodable stream event", "error", err)
+			return nil
+		}
+		if parsed.Type == "" {
+			parsed.Type = event.Event
+		}
+		return c.handleEvent(&parsed)
+	})
+	if err != nil {
+		ErrorContext(ctx, "Error translating responses stream", "error", err)
+		return err
+	}
+	return c.finish()
+}
+
+func (c *chatStreamWriter) handleEvent(event *responsesStreamEvent) error {
+	if event.Response != nil {
+		if event.Response.ID != "" && c.id == "" {
+			c.id = chatCompletionID(event.Response.ID)
+		}
+		if event.Response.Model != "" {
+			c.model = event.Response.Model
+		}
+		if event.Response.CreatedAt != 0 {
+			c.created = event.Response.CreatedAt
+		}
+	}
+
+	switch event.Type {
+	case "response.created", "response.in_progress":
+		return c.start()
+	case "response.output_text.delta":
+		if err := c.start(); err != nil {
+			return err
+		}
+		return c.emitChunk(map[string]any{"content": event.Delta}, nil)
+	case "response.output_item.added":
+		if event.Item == nil || event.Item.Type != "function_call" {
+			return nil
+		}
+		if err := c.start(); err != nil {
+			return err
+		}
+		index := len(c.tools)
+		c.tools[event.Item.ID] = index
+		return c.emitChunk(map[string]any{"tool_calls": []any{map[string]any{
+			"index":    index,
+			"id":       event.Item.CallID,
+			"type":     "function",
+			"function": map[string]any{"name": event.Item.Name, "arguments": event.Item.Arguments},
+		}}}, nil)
+	case "response.function_call_arguments.delta":
+		index, ok := c.tools[event.ItemID]
+		if !ok {
+			return nil
+		}
+		return c.emitChunk(map[string]any{"tool_calls": []any{map[string]any{
+			"index":    index,
+			"function": map[string]any{"arguments": event.Delta},
+		}}}, nil)
+	case "response.completed", "response.incomplete":
+		if event.Response != nil {
+			c.finishReason = chatFinishReason(event.Response, len(c.tools) > 0)
+			if event.Response.Usage != nil {
+				usage := chatUsageFromResponses(event.Response.Usage)
+				c.usage = &usage
+			}
+		}
+	case "response.failed", "error":
+		message := event.Message
+		if event.Response != nil && event.Response.Error != nil {
+			message = event.Response.Error.Message
+		}
+		if message == "" {
+			message = "upstream response failed"
+		}
+		return c.emit(map[string]any{"error": map[string]any{"message": message, "type": "api_error"}})
+	}
+	return nil
+}
+
+func (c *chatStreamWriter) start() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	if c.id == "" {
+		c.id = chatCompletionID("")
+	}
+	return c.emitChunk(map[string]any{"role": "assistant", "content": ""}, nil)
+}
+
+func (c *chatStreamWriter) finish() error {
+	if err := c.start(); err != nil {
+		return err
+	}
+	if c.finishReason == "" {
+		c.finishReason = "stop"
+		if len(c.tools) > 0 {
+			c.finishReason = "tool_calls"
+		}
+	}
+	if err := c.emitChunk(map[string]any{}, c.finishReason); err != nil {
+		return err
+	}
+	if c.usage != nil {
+		chunk := c.chunk()
+		chunk["choices"] = []any{}
+		chunk["usage"] = c.usage
+		if err := c.emit(chunk); err != nil {
+			return err
+		}
+	}
+	return writeSSEEvent(c.w, "", []byte("[DONE]"))
+}
+
+func (c *chatStreamWriter) chunk() map[string]any {
+	return map[string]any{
+		"id":      c.id,
+		"object":  "chat.completion.chunk",
+		"created": c.created,
+		"model":   c.model,
+	}
+}
+
+func (c *chatStreamWriter) emitChunk(delta map[string]any, finishReason any) error {
+	chunk := c.chunk()
+	chunk["choices"] = []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finishReason}}
+	return c.emit(chunk)
+}
+
+func (c *chatStreamWriter) emit(payload map[string]any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return writeSSEEvent(c.w, "", data)
+}
+
+// responsesStreamWriter converts chat completion chunks into Responses API
+// stream events. Item IDs are assigned and kept stable by streamIDTracker.
+type responsesStreamWriter struct {
+	w       io.Writer
+	tracker *streamIDTracker
+
+	started      bool
+	id           string
+	model        string
+	created      int64
+	sequence     int
+	output       []any
+	open         *responsesOpenItem
+	finishReason string
+	usage        *transform.ChatCompletionUsage
+}
+
+// responsesOpenItem is the output item currently being streamed.
+type responsesOpenItem struct {
+	outputIndex int
+	itemType    string
+	toolIndex   int
+	callID      string
+	name        string
+	content     strings.Builder
+}
+
+func newResponsesStreamWriter(w io.Writer) *responsesStreamWriter {
+	return &responsesStreamWriter{w: w, tracker: newStreamIDTracker()}
+}
+
+func (r *responsesStreamWriter) translate(ctx context.Context, body io.Reader) error {
+	err := readSSEEvents(body, func(event sseEvent) error {
+		data := strings.TrimSpace(event.Data)
+		if data == "" || data == "[DONE]" {
+			return nil
+		}
+		var chunk transform.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			WarnContext(ctx, "Skipping undecodable stream chunk", "error", err)
+			return nil
+		}
+		return r.handleChunk(&chunk)
+	})
+	if err != nil {
+		ErrorContext(ctx, "Error translating chat stream", "error", err)
+		return err
+	}
+	return r.finish()
+}
+
+func (r *responsesStreamWriter) handleChunk(chunk *transform.ChatCompletionChunk) error {
+	if err := r.start(chunk); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		r.usage = chunk.Usage
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			if r.open == nil || r.open.itemType != "message" {
+				if err := r.openMessage(); err != nil {
+					return err
+				}
+			}
+			r.open.content.WriteString(choice.Delta.Content)
+			if err := r.emit("response.output_text.delta", map[string]any{
+				"output_index":  r.open.outputIndex,
+				"content_index": 0,
+				"delta":         choice.Delta.Content,
+			}); err != nil {
+				return err
+			}
+		}
+
+		for _, call := range choice.Delta.ToolCalls {
+			if r.open == nil || r.open.itemType != "function_call" || r.open.toolIndex != call.Index ||
+				(call.ID != "" && call.ID != r.open.callID) {
+				if err := r.openFunctionCall(call); err != nil {
+					return err
+				}
+			}
+			if call.Function.Arguments != "" {
+				r.open.content.WriteString(call.Function.Arguments)
+				if err := r.emit("response.function_call_arguments.delta", map[string]any{
+					"output_index": r.open.outputIndex,
+					"delta":        call.Function.Arguments,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if choice.FinishReason != nil && *choice.FinishReason != "" && r.finishReason != "tool_calls" {
+			r.finishReason = *choice.FinishReason
+		}
+	}
+	return nil
+}
+
+func (r *responsesStreamWriter) start(chunk *transform.ChatCompletionChunk) error {
+	if r.started {
+		return nil
+	}
+	r.started = true
+	id := ""
+	if chunk != nil {
+		id, r.model, r.created = chunk.ID, chunk.Model, chunk.Created
+	}
+	r.id = responsesID(id)
+	if err := r.emit("response.created", map[string]any{"response": newResponsesObject(r.id, r.model, r.created, []any{})}); err != nil {
+		return err
+	}
+	return r.emit("response.in_progress", map[string]any{"response": newResponsesObject(r.id, r.model, r.created, []any{})})
+}
+
+func (r *responsesStreamWriter) openMessage() error {
+	if err := r.closeItem(); err != nil {
+		return err
+	}
+	r.open = &responsesOpenItem{outputIndex: len(r.output), itemType: "message"}
+	if err := r.emit("response.output_item.added", map[string]any{
+		"output_index": r.open.outputIndex,
+		"item":         map[string]any{"type": "message", "status": "in_progress", "role": "assistant", "content": []any{}},
+	}); err != nil {
+		return err
+	}
+	return r.emit("response.content_part.added", map[string]any{
+		"output_index":  r.open.outputIndex,
+		"content_index": 0,
+		"part":          map[string]any{"type": "output_text", "text": "", "annotations": []any{}},
+	})
+}
+
+func (r *responsesStreamWriter) openFunctionCall(call transform.ToolCall) error {
+	if err := r.closeItem(); err != nil {
+		return err
+	}
+	r.open = &responsesOpenItem{
+		outputIndex: len(r.output),
+		itemType:    "function_call",
+		toolIndex:   call.Index,
+		callID:      call.ID,
+		name:        call.Function.Name,
+	}
+	return r.emit("response.output_item.added", map[string]any{
+		"output_index": r.open.outputIndex,
+		"item":         responsesFunctionCallItem("", "in_progress", call.ID, call.Function.Name, ""),
+	})
+}
+
+func (r *responsesStreamWriter) closeItem() error {
+	open := r.open
+	if open == nil {
+		return nil
+	}
+	r.open = nil
+	id := r.tracker.outputItems[open.outputIndex]
+	content := open.content.String()
+
+	var item map[string]any
+	if open.itemType == "message" {
+		if err := r.emit("response.output_text.done", map[string]any{
+			"output_index":  open.outputIndex,
+			"content_index": 0,
+			"text":          content,
+		}); err != nil {
+			return err
+		}
+		if err := r.emit("response.content_part.done", map[string]any{
+			"output_index":  open.outputIndex,
+			"content_index": 0,
+			"part":          map[string]any{"type": "output_text", "text": content, "annotations": []any{}},
+		}); err != nil {
+			return err
+		}
+		item = responsesMessageItem(id, "completed", content)
+	} else {
+		if err := r.emit("response.function_call_arguments.done", map[string]any{
+			"output_index": open.outputIndex,
+			"arguments":    content,
+		}); err != nil {
+			return err
+		}
+		item = responsesFunctionCallItem(id, "completed", open.callID, open.name, content)
+	}
+	r.output = append(r.output, item)
+	return r.emit("response.output_item.done", map[string]any{"output_index": open.outputIndex, "item": item})
+}
+
+func (r *responsesStreamWriter) finish() error {
+	if err := r.start(nil); err != nil {
+		return err
+	}
+	if err := r.closeItem(); err != nil {
+		return err
+	}
+	response := newResponsesObject(r.id, r.model, r.created, r.output)
+	completeResponsesObject(response, r.finishReason, r.usage)
+	event := "response.completed"
+	if response["status"] == "incomplete" {
+		event = "response.incomplete"
+	}
+	return r.emit(event, map[string]any{"response": response})
+}
+
+// emit writes a Responses API event, letting fixResponseStreamIDs assign and
+// propagate the item ID of the event's output index.
+func (r *responsesStreamWriter) emit(event string, payload map[string]any) error {
+	payload["type"] = event
+	payload["sequence_number"] = r.sequence
+	r.sequence++
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return writeSSEEvent(r.w, event, []byte(fixResponseStreamIDs(string(data), event, r.tracker)))
+}
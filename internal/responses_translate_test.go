@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xdlhzdh/github-copilot-svcs/pkg/transform"
+)
+
+func TestConfigModelAPI(t *testing.T) {
+	cfg := &Config{ModelAPIs: map[string]string{
+		"gpt-5-codex": ModelAPIResponses,
+		"gpt-5*":      ModelAPIChat,
+		"gpt-5.1-*":   ModelAPIResponses,
+	}}
+	for model, want := range map[string]string{
+		"gpt-5-codex":     ModelAPIResponses,
+		"gpt-5-mini":      ModelAPIChat,
+		"gpt-5.1-codex":   ModelAPIResponses,
+		"claude-sonnet-4": "",
+	} {
+		if got := cfg.modelAPI(model); got != want {
+			t.Errorf("modelAPI(%s) = %q, want %q", model, got, want)
+		}
+	}
+	if err := cfg.validateModelAPIs(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	cfg.ModelAPIs["o3"] = "completions"
+	if err := cfg.validateModelAPIs(); err == nil {
+		t.Error("expected an unknown API to be rejected")
+	}
+}
+
+func TestChatToResponsesPayload(t *testing.T) {
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(`{
+		"model": "gpt-5-codex", "stream": true, "max_tokens": 256,
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [{"type": "text", "text": "What is this?"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,AAA"}}]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":1}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "found"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "lookup"}}
+	}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := chatToResponsesPayload(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["max_output_tokens"] != float64(256) || got["stream"] != true {
+		t.Errorf("unexpected scalar fields %v", got)
+	}
+	input := got["input"].([]any)
+	if len(input) != 4 {
+		t.Fatalf("expected 4 input items, got %d: %v", len(input), input)
+	}
+	user := input[1].(map[string]any)["content"].([]any)
+	if user[0].(map[string]any)["type"] != "input_text" || user[1].(map[string]any)["image_url"] != "data:image/png;base64,AAA" {
+		t.Errorf("unexpected user content %v", user)
+	}
+	call := input[2].(map[string]any)
+	if call["type"] != "function_call" || call["call_id"] != "call_1" || call["name"] != "lookup" {
+		t.Errorf("unexpected function call %v", call)
+	}
+	output := input[3].(map[string]any)
+	if output["type"] != "function_call_output" || output["output"] != "found" {
+		t.Errorf("unexpected function call output %v", output)
+	}
+	tool := got["tools"].([]any)[0].(map[string]any)
+	if tool["name"] != "lookup" || tool["parameters"] == nil {
+		t.Errorf("unexpected tool %v", tool)
+	}
+	if choice := got["tool_choice"].(map[string]any); choice["name"] != "lookup" {
+		t.Errorf("unexpected tool_choice %v", choice)
+	}
+}
+
+func TestResponsesToChatPayload(t *testing.T) {
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(`{
+		"model": "gpt-4.1", "stream": true, "instructions": "Be brief.", "max_output_tokens": 64,
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "Look it up"}]},
+			{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "Checking."}]},
+			{"type": "function_call", "call_id": "call_1", "name": "lookup", "arguments": "{}"},
+			{"type": "function_call", "call_id": "call_2", "name": "lookup", "arguments": "{}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "found"},
+			{"type": "reasoning", "summary": []}
+		],
+		"tools": [{"type": "function", "name": "lookup", "parameters": {"type": "object"}}, {"type": "web_search"}]
+	}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := responsesToChatPayload(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["max_tokens"] != float64(64) || got["stream_options"] == nil {
+		t.Errorf("unexpected scalar fields %v", got)
+	}
+	messages := got["messages"].([]any)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %d: %v", len(messages), messages)
+	}
+	if system := messages[0].(map[string]any); system["role"] != "system" || system["content"] != "Be brief." {
+		t.Errorf("unexpected system message %v", system)
+	}
+	if user := messages[1].(map[string]any); user["content"] != "Look it up" {
+		t.Errorf("expected text parts to be joined, got %v", user["content"])
+	}
+	assistant := messages[2].(map[string]any)
+	if assistant["content"] != "Checking." || len(assistant["tool_calls"].([]any)) != 2 {
+		t.Errorf("expected both calls on the assistant turn, got %v", assistant)
+	}
+	if tool := messages[3].(map[string]any); tool["role"] != "tool" || tool["tool_call_id"] != "call_1" {
+		t.Errorf("unexpected tool message %v", tool)
+	}
+	tools := got["tools"].([]any)
+	if len(tools) != 1 || tools[0].(map[string]any)["function"].(map[string]any)["name"] != "lookup" {
+		t.Errorf("unexpected tools %v", tools)
+	}
+}
+
+func TestTranslateResponseJSON(t *testing.T) {
+	completion := &transform.ChatCompletionResponse{
+		ID: "chatcmpl-1", Model: "gpt-4.1",
+		Choices: []transform.ChatCompletionChoice{
+			{Message: transform.ChatCompletionMessage{Role: "assistant", Content: "Let me check."}, FinishReason: "stop"},
+			{Message: transform.ChatCompletionMessage{Role: "assistant", ToolCalls: []transform.ToolCall{
+				{ID: "call_1", Type: "function", Function: transform.ToolCallFunction{Name: "lookup", Arguments: "{}"}},
+			}}, FinishReason: "tool_calls"},
+		},
+		Usage: transform.ChatCompletionUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+	}
+	response := chatToResponsesResponse(completion)
+	encoded, _ := json.Marshal(response)
+	var decoded responsesResponse
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "resp_chatcmpl-1" || decoded.Status != "completed" || len(decoded.Output) != 2 {
+		t.Fatalf("unexpected response %s", encoded)
+	}
+	if decoded.Usage.InputTokens != 10 || decoded.Usage.OutputTokens != 5 {
+		t.Errorf("unexpected usage %+v", decoded.Usage)
+	}
+
+	back := responsesToChatResponse(&decoded)
+	choice := back.Choices[0]
+	if choice.Message.Content != "Let me check." || len(choice.Message.ToolCalls) != 1 || choice.FinishReason != "tool_calls" {
+		t.Errorf("unexpected round trip %+v", choice)
+	}
+	if back.Usage.PromptTokens != 10 || back.Usage.TotalTokens != 15 {
+		t.Errorf("unexpected usage %+v", back.Usage)
+	}
+}
+
+func TestResponsesStreamWriter(t *testing.T) {
+	upstream := strings.Join([]string{
+		`data: {"id":"c1","model":"gpt-4.1","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"lo"}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]}}]}`,
+		`data: {"id":"c1","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":10,"completion_tokens":4,"total_tokens":14}}`,
+		`data: [DONE]`,
+	}, "\n\n") + "\n\n"
+
+	var out bytes.Buffer
+	if err := newResponsesStreamWriter(&out).translate(t.Context(), strings.NewReader(upstream)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var events []string
+	itemIDs := map[float64]map[string]bool{}
+	var completed responsesStreamEvent
+	err := readSSEEvents(&out, func(event sseEvent) error {
+		events = append(events, event.Event)
+		var parsed map[string]any
+		if err := json.Unmarshal([]byte(event.Data), &parsed); err != nil {
+			return err
+		}
+		if index, ok := parsed["output_index"].(float64); ok {
+			id, _ := parsed["item_id"].(string)
+			if item, ok := parsed["item"].(map[string]any); ok {
+				id, _ = item["id"].(string)
+			}
+			if itemIDs[index] == nil {
+				itemIDs[index] = map[string]bool{}
+			}
+			itemIDs[index][id] = true
+		}
+		if event.Event == "response.completed" {
+			return json.Unmarshal([]byte(event.Data), &completed)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse translated stream: %v", err)
+	}
+
+	want := []string{
+		"response.created", "response.in_progress",
+		"response.output_item.added", "response.content_part.added", "response.output_text.delta", "response.output_text.delta",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done",
+		"response.output_item.added", "response.function_call_arguments.delta",
+		"response.function_call_arguments.done", "response.output_item.done",
+		"response.completed",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected events:\n got  %v\n want %v", events, want)
+	}
+	for index, ids := range itemIDs {
+		if len(ids) != 1 || ids[""] {
+			t.Errorf("expected one stable item ID for output %v, got %v", index, ids)
+		}
+	}
+	if len(completed.Response.Output) != 2 || completed.Response.Output[1].Arguments != `{"q":1}` {
+		t.Errorf("unexpected completed output %+v", completed.Response.Output)
+	}
+	if completed.Response.Usage == nil || completed.Response.Usage.OutputTokens != 4 {
+		t.Errorf("unexpected usage %+v", completed.Response.Usage)
+	}
+}
+
+func TestChatStreamWriter(t *testing.T) {
+	upstream := strings.Join([]string{
+		"event: response.created\ndata: {\"type\":\"response.created\",\"response\":{\"id\":\"resp_1\",\"model\":\"gpt-5-codex\",\"created_at\":1}}",
+		"event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"output_index\":0,\"delta\":\"Hi\"}",
+		"event: response.output_item.added\ndata: {\"type\":\"response.output_item.added\",\"output_index\":1,\"item\":{\"type\":\"function_call\",\"id\":\"fc_a\",\"call_id\":\"call_1\",\"name\":\"lookup\",\"arguments\":\"\"}}",
+		"event: response.function_call_arguments.delta\ndata: {\"type\":\"response.function_call_arguments.delta\",\"output_index\":1,\"item_id\":\"fc_b\",\"delta\":\"{}\"}",
+		"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"id\":\"resp_1\",\"status\":\"completed\",\"usage\":{\"input_tokens\":3,\"output_tokens\":2}}}",
+	}, "\n\n") + "\n\n"
+
+	var out bytes.Buffer
+	if err := newChatStreamWriter(&out).translate(t.Context(), strings.NewReader(upstream)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	translated := out.String()
+	var chunks []map[string]any
+	err := readSSEEvents(strings.NewReader(translated), func(event sseEvent) error {
+		if event.Data == "[DONE]" {
+			return nil
+		}
+		var chunk map[string]any
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse translated stream: %v", err)
+	}
+	if !strings.HasSuffix(translated, "data: [DONE]\n\n") {
+		t.Error("expected the stream to end with [DONE]")
+	}
+	if len(chunks) != 6 {
+		t.Fatalf("expected 6 chunks, got %d: %s", len(chunks), translated)
+	}
+	if chunks[0]["id"] != "chatcmpl-1" || chunks[0]["model"] != "gpt-5-codex" {
+		t.Errorf("unexpected first chunk %v", chunks[0])
+	}
+	args := chunks[3]["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)
+	if args["index"] != float64(0) || args["function"].(map[string]any)["arguments"] != "{}" {
+		t.Errorf("expected argument delta for tool 0, got %v", args)
+	}
+	if reason := chunks[4]["choices"].([]any)[0].(map[string]any)["finish_reason"]; reason != "tool_calls" {
+		t.Errorf("expected finish_reason tool_calls, got %v", reason)
+	}
+	if usage := chunks[5]["usage"].(map[string]any); usage["total_tokens"] != float64(5) {
+		t.Errorf("unexpected usage chunk %v", usage)
+	}
+}
+
+func TestProcessProxyRequest_TranslatesModelAPI(t *testing.T) {
+	mock := NewMockUpstream()
+	s := newUpstreamTestService(t, mock.Handler().ServeHTTP)
+	s.config.Load().ModelAPIs = map[string]string{"gpt-5-codex": ModelAPIResponses, "gpt-4.1": ModelAPIChat}
+
+	post := func(path, body string) string {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path+"?email=user@example.com", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		return rr.Body.String()
+	}
+
+	body := post("/v1/chat/completions", `{"model":"gpt-5-codex","messages":[{"role":"user","content":"hi there"}]}`)
+	var completion transform.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(body), &completion); err != nil || len(completion.Choices) != 1 {
+		t.Fatalf("invalid completion %s: %v", body, err)
+	}
+	if completion.Object != "chat.completion" || completion.Choices[0].Message.Content != "Echo: hi there" {
+		t.Errorf("unexpected completion %s", body)
+	}
+
+	body = post("/v1/chat/completions", `{"model":"gpt-5-codex","stream":true,"messages":[{"role":"user","content":"hi there"}]}`)
+	if !strings.Contains(body, `"content":"there"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("unexpected chat stream %s", body)
+	}
+	if mock.Calls("/responses") != 2 || mock.Calls("/chat/completions") != 0 {
+		t.Errorf("expected chat requests to reach /responses, got %d", mock.Calls("/responses"))
+	}
+
+	body = post("/v1/responses", `{"model":"gpt-4.1","input":"hello"}`)
+	var response responsesResponse
+	if err := json.Unmarshal([]byte(body), &response); err != nil || len(response.Output) != 1 {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	if response.Output[0].Content[0].Text != "Echo: hello" || response.Usage == nil {
+		t.Errorf("unexpected response %s", body)
+	}
+
+	body = post("/v1/responses", `{"model":"gpt-4.1","stream":true,"input":"hello"}`)
+	if !strings.Contains(body, "event: response.output_text.delta") || !strings.Contains(body, "event: response.completed") {
+		t.Errorf("unexpected responses stream %s", body)
+	}
+	if mock.Calls("/chat/completions") != 2 {
+		t.Errorf("expected responses requests to reach /chat/completions, got %d", mock.Calls("/chat/completions"))
+	}
+}
+
+func TestProcessProxyRequest_TranslatesPerFallbackModel(t *testing.T) {
+	mock := NewMockUpstream()
+	var mutex sync.Mutex
+	var calls []string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]any
+		_ = json.Unmarshal(body, &payload)
+		model, _ := payload["model"].(string)
+		_, chatShape := payload["messages"]
+		mutex.Lock()
+		calls = append(calls, fmt.Sprintf("%s %s chat=%v", r.URL.Path, model, chatShape))
+		mutex.Unlock()
+		if strings.HasPrefix(model, "down-") {
+			w.Header().Set("retry-after-ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		mock.Handler().ServeHTTP(w, r)
+	})
+	cfg := s.config.Load()
+	cfg.ModelAPIs = map[string]string{"down-responses": ModelAPIResponses, "gpt-5-codex": ModelAPIResponses}
+	cfg.ModelFallbacks = map[string][]string{
+		"down-responses": {"gpt-4.1"},     // responses API falling back to the client's API
+		"down-chat":      {"gpt-5-codex"}, // client's API falling back to the responses API
+	}
+
+	for _, tt := range []struct {
+		model, served, call string
+	}{
+		{"down-responses", "gpt-4.1", "/chat/completions gpt-4.1 chat=true"},
+		{"down-chat", "gpt-5-codex", "/responses gpt-5-codex chat=false"},
+	} {
+		mutex.Lock()
+		calls = nil
+		mutex.Unlock()
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+			strings.NewReader(`{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi there"}]}`))
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Header().Get(servedModelHeader) != tt.served {
+			t.Fatalf("%s: expected 200 from %s, got %d from %q: %s", tt.model, tt.served, rr.Code, rr.Header().Get(servedModelHeader), rr.Body.String())
+		}
+		var completion transform.ChatCompletionResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &completion); err != nil || len(completion.Choices) != 1 ||
+			completion.Object != "chat.completion" || completion.Choices[0].Message.Content != "Echo: hi there" {
+			t.Errorf("%s: expected a chat completion, got %s", tt.model, rr.Body.String())
+		}
+		mutex.Lock()
+		if len(calls) == 0 || calls[len(calls)-1] != tt.call {
+			t.Errorf("%s: expected the fallback to be sent as %q, got %v", tt.model, tt.call, calls)
+		}
+		mutex.Unlock()
+	}
+}
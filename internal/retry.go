@@ -0,0 +1,135 @@
+// Package internal provides upstream retry timing for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRetryHintWait is the longest upstream-requested wait the proxy sleeps
+	// through itself; longer waits are passed back to the client instead.
+	maxRetryHintWait = 60 * time.Second
+
+	// retryJitterFraction is the extra random delay added on top of an upstream hint.
+	retryJitterFraction = 0.2
+
+	// Unix timestamps above this are treated as absolute reset times rather than delays.
+	minUnixResetTimestamp = 1_000_000_000
+)
+
+// rateLimitResetHeaders are consulted, in order, when Retry-After is absent.
+var rateLimitResetHeaders = []string{
+	"x-ratelimit-reset-requests",
+	"x-ratelimit-reset-tokens",
+	"x-ratelimit-reset",
+}
+
+// upstreamRetryDelay returns how long upstream asked us to wait, taken from
+// retry-after-ms, Retry-After or the x-ratelimit-reset* headers.
+func upstreamRetryDelay(h http.Header, now time.Time) (time.Duration, bool) {
+	if value := h.Get("retry-after-ms"); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	if value := h.Get("Retry-After"); value != "" {
+		if delay, ok := parseRetryAfter(value, now); ok {
+			return delay, true
+		}
+	}
+
+	var longest time.Duration
+	found := false
+	for _, name := range rateLimitResetHeaders {
+		if value := h.Get(name); value != "" {
+			if delay, ok := parseRateLimitReset(value, now); ok {
+				found = true
+				longest = max(longest, delay)
+			}
+		}
+	}
+	return longest, found
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// parseRateLimitReset parses a rate-limit reset given as a Go-style duration
+// ("6m0s", "20ms"), as seconds, or as an absolute Unix timestamp.
+func parseRateLimitReset(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > minUnixResetTimestamp {
+			return max(time.Unix(int64(seconds), 0).Sub(now), 0), true
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if delay, err := time.ParseDuration(value); err == nil && delay >= 0 {
+		return delay, true
+	}
+	return 0, false
+}
+
+// retryDelay returns the wait before the next attempt. An upstream hint is
+// honoured with a little extra jitter so clients sharing a limit do not retry
+// in lockstep; otherwise the quadratic backoff is spread with equal jitter.
+func retryDelay(attempt int, hint time.Duration, hasHint bool) time.Duration {
+	if hasHint {
+		return hint + randomDuration(time.Duration(float64(hint)*retryJitterFraction))
+	}
+	backoff := time.Duration(baseChatRetryDelay*attempt*attempt) * time.Second
+	return backoff/2 + randomDuration(backoff/2)
+}
+
+func randomDuration(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(limit) + 1))
+}
+
+// fitsDeadline reports whether waiting for wait still leaves time before the context deadline.
+func fitsDeadline(ctx context.Context, wait time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	return time.Until(deadline) > wait
+}
+
+// retryAfterSeconds formats a delay as a whole-second Retry-After value, rounding up.
+func retryAfterSeconds(delay time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(delay.Seconds())), 1))
+}
+
+// setClientRetryAfter normalises the upstream backoff hints on a rate-limited
+// or unavailable response into a Retry-After header the client can act on.
+func setClientRetryAfter(resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	if delay, ok := upstreamRetryDelay(resp.Header, time.Now()); ok {
+		resp.Header.Set("Retry-After", retryAfterSeconds(delay))
+	}
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRetryDelay(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+		found   bool
+	}{
+		{"none", nil, 0, false},
+		{"retry-after seconds", map[string]string{"Retry-After": "7"}, 7 * time.Second, true},
+		{"retry-after date", map[string]string{"Retry-After": now.Add(30 * time.Second).Format(http.TimeFormat)}, 30 * time.Second, true},
+		{"retry-after-ms wins", map[string]string{"retry-after-ms": "1500", "Retry-After": "9"}, 1500 * time.Millisecond, true},
+		{"openai reset durations", map[string]string{"x-ratelimit-reset-requests": "2s", "x-ratelimit-reset-tokens": "6m0s"}, 6 * time.Minute, true},
+		{"unix reset", map[string]string{"x-ratelimit-reset": "1735732845"}, 45 * time.Second, true},
+		{"garbage", map[string]string{"Retry-After": "soon"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got, found := upstreamRetryDelay(h, now)
+			if got != tt.want || found != tt.found {
+				t.Errorf("upstreamRetryDelay() = %v, %v; want %v, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestRetryDelay_Jitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		hinted := retryDelay(1, 10*time.Second, true)
+		if hinted < 10*time.Second || hinted > 12*time.Second {
+			t.Fatalf("hinted delay %v outside [10s, 12s]", hinted)
+		}
+		backoff := retryDelay(2, 0, false)
+		if backoff < 2*time.Second || backoff > 4*time.Second {
+			t.Fatalf("backoff delay %v outside [2s, 4s]", backoff)
+		}
+	}
+}
+
+func newRetryTestService() *ProxyService {
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	return NewProxyService(cfg, &http.Client{}, nil, nil)
+}
+
+func TestMakeRequestWithRetry_HonorsRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	start := time.Now()
+	resp, err := newRetryTestService().makeRequestWithRetry(req, []byte("{}"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("expected success on second attempt, got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected Retry-After: 0 to skip the default backoff, took %v", elapsed)
+	}
+}
+
+func TestMakeRequestWithRetry_SkipsLongWaits(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("x-ratelimit-reset-requests", "2m30s")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"message":"rate limited"}}`))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	resp, err := newRetryTestService().makeRequestWithRetry(req, []byte("{}"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected no retry for a wait beyond the limit, got %d calls", calls.Load())
+	}
+	if got := resp.Header.Get("Retry-After"); got != "150" {
+		t.Errorf("expected Retry-After 150, got %q", got)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) == 0 {
+		t.Error("expected the upstream error body to remain readable")
+	}
+}
+
+func TestMakeRequestWithRetry_RespectsDeadline(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, nil)
+	resp, err := newRetryTestService().makeRequestWithRetry(req, []byte("{}"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if calls.Load() != 1 || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected immediate 429 without retry, got status %d after %d calls", resp.StatusCode, calls.Load())
+	}
+	if got := resp.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+}
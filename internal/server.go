@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -25,10 +26,20 @@ const (
 
 // Server represents the HTTP server and its dependencies
 type Server struct {
-	config     *Config
-	httpServer *http.Server
-	httpClient *http.Client
-	workerPool *WorkerPool
+	config      *ConfigStore
+	httpServer  *http.Server
+	httpClient  *http.Client
+	workerPool  *WorkerPool
+	rateLimiter *RateLimiter
+	catalog     *ModelCatalog
+	tracer      *Tracer
+	audit       *AuditLog
+	tokenStore  TokenStore
+	// Background contexts are created in NewServer so Stop never races Start
+	reloadCtx   context.Context
+	stopReload  context.CancelFunc
+	catalogCtx  context.Context
+	stopCatalog context.CancelFunc
 }
 
 // WorkerPool handles background processing
@@ -37,6 +48,7 @@ type WorkerPool struct {
 	jobQueue chan func()
 	quit     chan bool
 	wg       sync.WaitGroup
+	busy     atomic.Int64
 }
 
 // NewWorkerPool creates a new worker pool
@@ -63,7 +75,7 @@ func (wp *WorkerPool) start() {
 			for {
 				select {
 				case job := <-wp.jobQueue:
-					job()
+					wp.run(job)
 				case <-wp.quit:
 					return
 				}
@@ -72,11 +84,27 @@ func (wp *WorkerPool) start() {
 	}
 }
 
+func (wp *WorkerPool) run(job func()) {
+	wp.busy.Add(1)
+	defer wp.busy.Add(-1)
+	job()
+}
+
 // Submit adds a job to the worker pool
 func (wp *WorkerPool) Submit(job func()) {
 	wp.jobQueue <- job
 }
 
+// QueueDepth returns the number of jobs waiting for a worker.
+func (wp *WorkerPool) QueueDepth() int {
+	return len(wp.jobQueue)
+}
+
+// BusyWorkers returns the number of workers currently running a job.
+func (wp *WorkerPool) BusyWorkers() int {
+	return int(wp.busy.Load())
+}
+
 // Stop gracefully stops the worker pool
 func (wp *WorkerPool) Stop() {
 	close(wp.quit)
@@ -114,32 +142,90 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 		"x_initiator", cfg.Headers.XInitiator)
 
 	workerPool := NewWorkerPool(runtime.NumCPU() * workerMultiplier)
+	metrics.TrackWorkerPool(workerPool)
 
-	// Create auth service
-	authService := NewAuthService(httpClient)
+	tracer, err := NewTracer(cfg)
+	if err != nil {
+		Warn("Tracing disabled", "error", err)
+	} else if tracer != nil {
+		Info("Tracing enabled", "exporter", cfg.Tracing.Exporter)
+	}
+	SetTracer(tracer)
+
+	// Shared configuration snapshot, swapped on reload
+	configPath, err := GetConfigPath()
+	if err != nil {
+		Warn("Config path unavailable, configuration reload disabled", "error", err)
+		configPath = ""
+	}
+	configStore := NewConfigStore(cfg, configPath)
 
-	// Create coalescing cache for models
-	coalescingCache := NewCoalescingCache()
-	modelsService := NewModelsService(coalescingCache, httpClient)
+	// Create auth service
+	tokenStore := NewTokenStore(cfg, httpClient)
+	authService := NewAuthService(httpClient, WithTokenStore(tokenStore))
 
 	// Create proxy service
-	proxyService := NewProxyService(cfg, httpClient, authService, workerPool)
+	usageLedger := NewUsageLedger(DefaultUsageLedgerPath(cfg))
+	rateLimiter := NewRateLimiter(DefaultRateLimitStatePath(cfg))
+	apiKeys := NewAPIKeyStore(DefaultAPIKeysPath(cfg))
+	if cfg.APIKeys.AllowEmailParam {
+		Warn("api_keys.allow_email_param is set: any client can use a user's Copilot seat with ?email= and no API key")
+	} else if !apiKeys.HasKeys() {
+		Warn("No API keys issued; every proxy request is rejected until one is created with 'keys create <email>'")
+	}
+	catalog := NewModelCatalog(httpClient, authService, configStore)
+	proxyOpts := []func(*ProxyService){
+		WithConfigStore(configStore),
+		WithAPIKeyStore(apiKeys),
+		WithRateLimiter(rateLimiter),
+		WithUsageLedger(usageLedger),
+		WithKnownModels(catalog),
+	}
+	if vcr := newVCRFromConfig(cfg); vcr != nil {
+		proxyOpts = append(proxyOpts, WithVCR(vcr))
+	}
+	auditLog, err := NewAuditLog(cfg)
+	if err != nil {
+		Error("Audit log disabled", "error", err)
+	} else if auditLog != nil {
+		Info("Audit log enabled", "dir", auditLog.dir)
+		proxyOpts = append(proxyOpts, WithAuditLog(auditLog))
+	}
+	proxyService := NewProxyService(cfg, httpClient, authService, workerPool, proxyOpts...)
+	metrics.TrackCircuitBreakers(proxyService.breakers)
+
+	// Create models service backed by the live Copilot catalog
+	modelsService := NewModelsService(NewCoalescingCache(), httpClient,
+		WithModelsConfig(configStore),
+		WithModelCatalog(catalog, proxyService.catalogUser))
 
 	// Create auth API service
-	authAPIService := NewAuthAPIService(authService, cfg)
+	authAPIService := NewAuthAPIService(authService, cfg, WithAuthAPIConfig(configStore))
 
 	// Create health checker
 	healthChecker := NewHealthChecker(httpClient, "dev") // TODO: get version from build
+	healthChecker.AddCheck(authService.checkTokenCache)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/models", modelsService.Handler())
 	mux.HandleFunc("/v1/chat/completions", proxyService.Handler())
 	mux.HandleFunc("/v1/completions", proxyService.Handler())
 	mux.HandleFunc("/v1/responses", proxyService.Handler())
+	mux.HandleFunc("/v1/embeddings", proxyService.EmbeddingsHandler())
+	mux.HandleFunc("/v1/messages", proxyService.MessagesHandler())
+	mux.HandleFunc("/v1/messages/count_tokens", proxyService.CountTokensHandler())
+	mux.HandleFunc("/api/chat", proxyService.OllamaChatHandler())
+	mux.HandleFunc("/api/generate", proxyService.OllamaGenerateHandler())
+	mux.HandleFunc("/api/tags", modelsService.OllamaTagsHandler())
+	mux.HandleFunc("/api/show", modelsService.OllamaShowHandler())
+	mux.HandleFunc("/api/version", OllamaVersionHandler())
 	mux.HandleFunc("/v1/auth/github/stage1", authAPIService.Stage1Handler())
 	mux.HandleFunc("/v1/auth/github/stage2", authAPIService.Stage2Handler())
 	mux.HandleFunc("/v1/auth/github", authAPIService.Handler()) // Deprecated, for backward compatibility
 	mux.HandleFunc("/v1/health", healthChecker.Handler())
+	mux.HandleFunc("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/usage", requireAdmin(configStore, UsageHandler(usageLedger)))
+	mux.HandleFunc("/admin/circuit-breakers", requireAdmin(configStore, CircuitBreakersHandler(proxyService.breakers)))
 
 	// Add pprof endpoints for profiling
 	mux.HandleFunc("/debug/pprof/", http.DefaultServeMux.ServeHTTP)
@@ -158,9 +244,10 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 
 	// Apply middleware in reverse order (last applied = first executed)
 	handler = SecurityHeadersMiddleware(handler)
-	handler = CORSMiddleware(cfg)(handler)
+	handler = ReloadableCORSMiddleware(configStore)(handler)
 	handler = LoggingMiddleware(handler)
 	handler = RecoveryMiddleware(handler)
+	handler = RequestIDMiddleware(handler)
 	// Note: TimeoutMiddleware could be added here if needed per-request timeouts
 	// handler = TimeoutMiddleware(time.Duration(cfg.Timeouts.ProxyContext) * time.Second)(handler)
 
@@ -172,19 +259,34 @@ func NewServer(cfg *Config, httpClient *http.Client) *Server {
 		IdleTimeout:  time.Duration(cfg.Timeouts.ServerIdle) * time.Second,
 	}
 
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	catalogCtx, stopCatalog := context.WithCancel(context.Background())
+
 	return &Server{
-		config:     cfg,
-		httpServer: httpServer,
-		httpClient: httpClient,
-		workerPool: workerPool,
+		config:      configStore,
+		httpServer:  httpServer,
+		httpClient:  httpClient,
+		workerPool:  workerPool,
+		rateLimiter: rateLimiter,
+		catalog:     catalog,
+		tracer:      tracer,
+		audit:       auditLog,
+		tokenStore:  tokenStore,
+		reloadCtx:   reloadCtx,
+		stopReload:  stopReload,
+		catalogCtx:  catalogCtx,
+		stopCatalog: stopCatalog,
 	}
 }
 
 // Start starts the HTTP server with graceful shutdown
 func (s *Server) Start() error {
 	s.setupGracefulShutdown()
+	s.setupConfigReload()
 
-	port := s.config.Port
+	go s.catalog.Run(s.catalogCtx)
+
+	port := s.config.Load().Port
 	if port == 0 {
 		port = 8081
 	}
@@ -198,7 +300,13 @@ func (s *Server) Start() error {
 	fmt.Printf("  - Chat: http://localhost:%d/v1/chat/completions\n", port)
 	fmt.Printf("  - Completions: http://localhost:%d/v1/completions\n", port)
 	fmt.Printf("  - Responses: http://localhost:%d/v1/responses\n", port)
+	fmt.Printf("  - Embeddings: http://localhost:%d/v1/embeddings\n", port)
+	fmt.Printf("  - Messages (Anthropic): http://localhost:%d/v1/messages\n", port)
+	fmt.Printf("  - Ollama API: http://localhost:%d/api/chat, /api/generate, /api/tags, /api/show\n", port)
 	fmt.Printf("  - Health: http://localhost:%d/v1/health\n", port)
+	fmt.Printf("  - Metrics: http://localhost:%d/metrics\n", port)
+	fmt.Printf("  - Usage (admin): http://localhost:%d/admin/usage\n", port)
+	fmt.Printf("  - Circuit breakers (admin): http://localhost:%d/admin/circuit-breakers\n", port)
 	fmt.Printf("  - Auth Stage 1: http://localhost:%d/v1/auth/github/stage1\n", port)
 	fmt.Printf("  - Auth Stage 2: http://localhost:%d/v1/auth/github/stage2\n", port)
 	fmt.Printf("  - Auth (Full): http://localhost:%d/v1/auth/github\n", port)
@@ -215,6 +323,9 @@ func (s *Server) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	s.stopReload()
+	s.stopCatalog()
+
 	fmt.Println("Stopping worker pool...")
 	s.workerPool.Stop()
 	fmt.Println("Worker pool stopped.")
@@ -227,6 +338,20 @@ func (s *Server) Stop() error {
 	}
 	fmt.Println("HTTP server shutdown complete.")
 
+	if err := s.rateLimiter.Close(); err != nil {
+		fmt.Printf("Error saving rate limit state: %v\n", err)
+	}
+	if s.tracer != nil {
+		if err := s.tracer.Shutdown(); err != nil {
+			fmt.Printf("Error flushing traces: %v\n", err)
+		}
+	}
+	if s.audit != nil {
+		if err := s.audit.Close(); err != nil {
+			fmt.Printf("Error closing audit log: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
@@ -244,14 +369,51 @@ func (s *Server) setupGracefulShutdown() {
 	}()
 }
 
+// setupConfigReload reloads the configuration on SIGHUP and whenever the
+// config file changes. In-flight requests keep the snapshot they started with.
+func (s *Server) setupConfigReload() {
+	ctx := s.reloadCtx
+	go s.config.Watch(ctx, defaultConfigWatchInterval)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				Info("Received SIGHUP, reloading configuration")
+				_ = s.config.Reload()
+				s.reloadTokenCipher()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reloadTokenCipher loads the token encryption key again, e.g. after rotate-key.
+func (s *Server) reloadTokenCipher() {
+	store, ok := s.tokenStore.(*FileTokenStore)
+	if !ok {
+		return
+	}
+	if err := store.ReloadCipher(); err != nil {
+		Error("Failed to reload token encryption key, keeping current key", "error", err)
+		return
+	}
+	Info("Token encryption key reloaded")
+}
+
 // warmupConnections 预热到 GitHub 的网络连接
 // 在代理环境中，首次 TLS 握手可能需要更长时间
 // 通过在后台提前建立连接，可以避免用户请求时的超时
 func (s *Server) warmupConnections() {
+	cfg := s.config.Load()
 	endpoints := []string{
-		"https://github.com/login/device/code",
-		"https://api.github.com",
-		"https://api.githubcopilot.com",
+		cfg.deviceCodeEndpoint(),
+		cfg.copilotTokenEndpoint(),
+		cfg.apiBase(),
 	}
 
 	Info("Starting connection warmup", "endpoints", len(endpoints))
@@ -264,7 +426,7 @@ func (s *Server) warmupConnections() {
 				return
 			}
 
-			req.Header.Set("User-Agent", s.config.Headers.UserAgent)
+			req.Header.Set("User-Agent", cfg.Headers.UserAgent)
 
 			// 使用较短的超时，因为只是预热
 			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -0,0 +1,94 @@
+// Package internal provides server-sent event helpers for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sseEvent is a single decoded server-sent event.
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSEEvents parses a text/event-stream body and calls fn for every complete event.
+// Comment lines are skipped. Returning an error from fn stops reading.
+func readSSEEvents(r io.Reader, fn func(sseEvent) error) error {
+	reader := bufio.NewReader(r)
+	var (
+		current   sseEvent
+		dataLines []string
+		hasFields bool
+	)
+
+	dispatch := func() error {
+		if !hasFields {
+			return nil
+		}
+		current.Data = strings.Join(dataLines, "\n")
+		err := fn(current)
+		current = sseEvent{}
+		dataLines = dataLines[:0]
+		hasFields = false
+		return err
+	}
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+			// Comment / keep-alive line
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			hasFields = true
+			switch field {
+			case "id":
+				current.ID = value
+			case "event":
+				current.Event = value
+			case "data":
+				dataLines = append(dataLines, value)
+			}
+		}
+
+		if readErr == io.EOF {
+			return dispatch()
+		}
+	}
+}
+
+// writeSSEEvent writes a single event and flushes it to the client when possible.
+func writeSSEEvent(w io.Writer, event string, data []byte) error {
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "\n"); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package internal provides the in-process Copilot token cache for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenRefreshMargin is how many seconds before ExpiresAt a token is refreshed.
+const tokenRefreshMargin = 300
+
+// TokenCacheStats reports token cache activity.
+type TokenCacheStats struct {
+	Entries     int   `json:"entries"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Refreshes   int64 `json:"refreshes"`
+	StaleServed int64 `json:"stale_served"`
+}
+
+// tokenCache keeps per-user Copilot tokens in memory so that most proxied
+// requests avoid a token store round-trip. Concurrent loads and refreshes for
+// the same email are collapsed into a single call.
+type tokenCache struct {
+	mutex   sync.RWMutex
+	entries map[string]StoredToken
+	flights *CoalescingCache
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	refreshes   atomic.Int64
+	staleServed atomic.Int64
+}
+
+// tokenCacheResult is the value shared by coalesced token loads.
+type tokenCacheResult struct {
+	token StoredToken
+	err   error
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		entries: make(map[string]StoredToken),
+		flights: NewCoalescingCache(),
+	}
+}
+
+func (c *tokenCache) get(email string) (StoredToken, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	token, ok := c.entries[email]
+	return token, ok
+}
+
+func (c *tokenCache) put(token StoredToken) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[token.Email] = token
+}
+
+func (c *tokenCache) stats() TokenCacheStats {
+	c.mutex.RLock()
+	entries := len(c.entries)
+	c.mutex.RUnlock()
+	return TokenCacheStats{
+		Entries:     entries,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Refreshes:   c.refreshes.Load(),
+		StaleServed: c.staleServed.Load(),
+	}
+}
+
+// storedTokenFromConfig extracts the token fields of cfg for email.
+func storedTokenFromConfig(email string, cfg *Config) StoredToken {
+	return StoredToken{
+		Email:        email,
+		GitHubToken:  cfg.GitHubToken,
+		CopilotToken: cfg.CopilotToken,
+		ExpiresAt:    cfg.ExpiresAt,
+		RefreshIn:    cfg.RefreshIn,
+		APIEndpoint:  cfg.CopilotAPIEndpoint,
+		SKU:          cfg.CopilotSKU,
+	}
+}
+
+// TokenCacheStats returns the token cache counters.
+func (s *AuthService) TokenCacheStats() TokenCacheStats {
+	return s.cache.stats()
+}
+
+// cachedToken returns a fresh token for email, loading and refreshing it
+// through a single coalesced call when the cache has none. When the load
+// fails, a cached token that has not yet expired is served instead.
+func (s *AuthService) cachedToken(ctx context.Context, email string, baseConfig *Config) (StoredToken, error) {
+	now := time.Now().Unix()
+	cached, ok := s.cache.get(email)
+	if ok && cached.CopilotToken != "" && cached.ExpiresAt > now+tokenRefreshMargin {
+		s.cache.hits.Add(1)
+		return cached, nil
+	}
+	s.cache.misses.Add(1)
+
+	result, _ := s.cache.flights.CoalesceRequest(email, func() interface{} {
+		// The load is shared by concurrent callers, so one caller's
+		// cancellation must not fail the others
+		token, err := s.loadFreshToken(context.WithoutCancel(ctx), email, baseConfig)
+		return tokenCacheResult{token: token, err: err}
+	}).(tokenCacheResult)
+	if result.err == nil {
+		return result.token, nil
+	}
+
+	if cached, ok := s.cache.get(email); ok && cached.CopilotToken != "" && cached.ExpiresAt > time.Now().Unix() {
+		s.cache.staleServed.Add(1)
+		WarnContext(ctx, "Serving cached token after load failure",
+			"email", email,
+			"expires_in", cached.ExpiresAt-time.Now().Unix(),
+			"error", result.err)
+		return cached, nil
+	}
+	return StoredToken{}, result.err
+}
+
+// loadFreshToken reads the token for email from the store, refreshes it if it
+// is close to expiry and stores the result in the cache.
+func (s *AuthService) loadFreshToken(ctx context.Context, email string, baseConfig *Config) (StoredToken, error) {
+	storeCtx, storeSpan := startSpan(ctx, "token_store.get", SpanKindClient)
+	cfg, err := s.loadToken(storeCtx, email)
+	storeSpan.RecordError(err)
+	storeSpan.End()
+	if err != nil {
+		return StoredToken{}, err
+	}
+	applyBaseConfig(cfg, baseConfig)
+
+	if cfg.CopilotToken == "" {
+		return StoredToken{}, NewAuthError("no token available - authentication required", nil)
+	}
+	if cfg.ExpiresAt <= time.Now().Unix()+tokenRefreshMargin {
+		s.cache.refreshes.Add(1)
+		refreshCtx, refreshSpan := startSpan(ctx, "auth.refresh_token", SpanKindInternal)
+		err := s.RefreshTokenWithContext(refreshCtx, email, cfg)
+		refreshSpan.RecordError(err)
+		refreshSpan.End()
+		if err != nil {
+			return StoredToken{}, err
+		}
+	}
+
+	token := storedTokenFromConfig(email, cfg)
+	s.cache.put(token)
+	return token, nil
+}
+
+// checkTokenCache reports token cache counters as a health check.
+func (s *AuthService) checkTokenCache(_ context.Context) HealthCheck {
+	start := time.Now()
+	stats := s.cache.stats()
+
+	status := StatusHealthy
+	message := "Token cache operating normally"
+	if stats.StaleServed > 0 {
+		message = "Token cache has served stale tokens after load failures"
+	}
+
+	return HealthCheck{
+		Name:        "token_cache",
+		Status:      status,
+		Message:     message,
+		Duration:    time.Since(start),
+		LastChecked: time.Now(),
+		Details: map[string]interface{}{
+			"entries":      stats.Entries,
+			"hits":         stats.Hits,
+			"misses":       stats.Misses,
+			"refreshes":    stats.Refreshes,
+			"stale_served": stats.StaleServed,
+		},
+	}
+}
@@ -0,0 +1,149 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/internal"
+)
+
+// countingTokenStore wraps a MemoryTokenStore, counting reads and optionally failing them.
+type countingTokenStore struct {
+	*internal.MemoryTokenStore
+	gets atomic.Int64
+	fail atomic.Bool
+}
+
+func (s *countingTokenStore) Get(ctx context.Context, email string) (*internal.StoredToken, error) {
+	s.gets.Add(1)
+	if s.fail.Load() {
+		return nil, errors.New("token store unreachable")
+	}
+	return s.MemoryTokenStore.Get(ctx, email)
+}
+
+func newCountingTokenStore(t *testing.T, expiresAt int64) *countingTokenStore {
+	t.Helper()
+	store := &countingTokenStore{MemoryTokenStore: internal.NewMemoryTokenStore()}
+	err := store.Put(context.Background(), &internal.StoredToken{
+		Email:        "user@example.com",
+		GitHubToken:  "gh",
+		CopilotToken: "cp",
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	return store
+}
+
+func TestTokenCache_ServesFromCache(t *testing.T) {
+	store := newCountingTokenStore(t, time.Now().Unix()+3600)
+	authSvc := internal.NewAuthService(&http.Client{}, internal.WithTokenStore(store))
+
+	for i := 0; i < 5; i++ {
+		cfg, err := authSvc.EnsureValidToken("user@example.com", createAuthTestConfig())
+		if err != nil {
+			t.Fatalf("EnsureValidToken failed: %v", err)
+		}
+		if cfg.CopilotToken != "cp" {
+			t.Errorf("unexpected token %s", cfg.CopilotToken)
+		}
+	}
+
+	if got := store.gets.Load(); got != 1 {
+		t.Errorf("expected a single token store read, got %d", got)
+	}
+	stats := authSvc.TokenCacheStats()
+	if stats.Hits != 4 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestTokenCache_SingleflightRefresh(t *testing.T) {
+	store := newCountingTokenStore(t, time.Now().Unix()-10)
+
+	var refreshes atomic.Int64
+	refreshFunc := func(c *internal.Config) error {
+		refreshes.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		c.CopilotToken = "refreshed"
+		c.ExpiresAt = time.Now().Unix() + 3600
+		return nil
+	}
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithTokenStore(store),
+		internal.WithRefreshFunc(refreshFunc),
+	)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg, err := authSvc.EnsureValidToken("user@example.com", createAuthTestConfig())
+			if err == nil && cfg.CopilotToken != "refreshed" {
+				err = errors.New("unexpected token " + cfg.CopilotToken)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("EnsureValidToken failed: %v", err)
+		}
+	}
+	if got := refreshes.Load(); got != 1 {
+		t.Errorf("expected concurrent refreshes to collapse into one, got %d", got)
+	}
+	if stats := authSvc.TokenCacheStats(); stats.Refreshes != 1 {
+		t.Errorf("expected refresh count 1, got %+v", stats)
+	}
+}
+
+func TestTokenCache_StaleOnError(t *testing.T) {
+	store := newCountingTokenStore(t, time.Now().Unix()-10)
+
+	// The refreshed token is still valid but inside the refresh margin, so the
+	// next request goes back to the token store.
+	refreshFunc := func(c *internal.Config) error {
+		c.CopilotToken = "short-lived"
+		c.ExpiresAt = time.Now().Unix() + 120
+		return nil
+	}
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithTokenStore(store),
+		internal.WithRefreshFunc(refreshFunc),
+	)
+
+	if _, err := authSvc.EnsureValidToken("user@example.com", createAuthTestConfig()); err != nil {
+		t.Fatalf("EnsureValidToken failed: %v", err)
+	}
+
+	store.fail.Store(true)
+	cfg, err := authSvc.EnsureValidToken("user@example.com", createAuthTestConfig())
+	if err != nil {
+		t.Fatalf("expected stale token to be served, got error: %v", err)
+	}
+	if cfg.CopilotToken != "short-lived" {
+		t.Errorf("unexpected token %s", cfg.CopilotToken)
+	}
+	if stats := authSvc.TokenCacheStats(); stats.StaleServed != 1 {
+		t.Errorf("expected one stale token served, got %+v", stats)
+	}
+
+	// Users without a cached token still see the failure.
+	if _, err := authSvc.EnsureValidToken("other@example.com", createAuthTestConfig()); err == nil {
+		t.Error("expected error for uncached user while token store is unreachable")
+	}
+}
@@ -0,0 +1,615 @@
+// Package internal provides at-rest encryption of stored tokens for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Environment variables selecting the token encryption key. The first one
+// set wins; encryption.key_file in the config sits between the key file and
+// the passphrase.
+const (
+	EncryptionKeyEnv        = "COPILOT_ENCRYPTION_KEY"        // hex or base64 encoded 32-byte key
+	EncryptionKeyFileEnv    = "COPILOT_ENCRYPTION_KEY_FILE"   // file holding such a key
+	EncryptionPassphraseEnv = "COPILOT_ENCRYPTION_PASSPHRASE" // passphrase run through PBKDF2
+
+	// The rotate-key command reads the new key from these instead of
+	// generating one into the key file.
+	NewEncryptionKeyEnv        = "COPILOT_NEW_ENCRYPTION_KEY"
+	NewEncryptionPassphraseEnv = "COPILOT_NEW_ENCRYPTION_PASSPHRASE"
+)
+
+const (
+	// encryptedValuePrefix marks a sealed token; the rest is a base64 sealedValue.
+	encryptedValuePrefix = "enc:v1:"
+
+	encryptionKeySize = 32 // AES-256
+	kdfSaltSize       = 16
+	kdfIterations     = 600_000 // PBKDF2-HMAC-SHA256, as recommended by OWASP
+
+	// Key files left behind by an interrupted rotation stay usable for decryption.
+	newKeyFileSuffix = ".new"
+	oldKeyFileSuffix = ".old"
+)
+
+// ErrEncryptionKeyMissing is returned when a stored token is encrypted but no
+// encryption key is configured.
+var ErrEncryptionKeyMissing = errors.New("stored tokens are encrypted but no encryption key is configured")
+
+// sealedValue is the envelope of one encrypted token: the token sealed with a
+// random data key, and the data key sealed with the key-encryption key.
+type sealedValue struct {
+	KeyID      string `json:"kid"`
+	Salt       []byte `json:"salt,omitempty"` // PBKDF2 salt when the key comes from a passphrase
+	WrappedKey []byte `json:"wk"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// keyEncryptionKey wraps and unwraps data keys. Keys that are not current
+// are only used to read values written before a rotation.
+type keyEncryptionKey struct {
+	id      string
+	salt    []byte
+	aead    cipher.AEAD
+	current bool
+}
+
+func newKeyEncryptionKey(key, salt []byte, current bool) (*keyEncryptionKey, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &keyEncryptionKey{id: hex.EncodeToString(sum[:8]), salt: salt, aead: aead, current: current}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts plaintext with aead under a random nonce, which it prepends.
+func sealAEAD(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAEAD(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// passphraseKey derives the keys for the salts found in sealed values.
+type passphraseKey struct {
+	passphrase string
+	current    bool
+}
+
+// TokenCipher envelope-encrypts stored credentials. Every value gets its own
+// AES-256-GCM data key, which is sealed with the key-encryption key taken
+// from a key file, an environment variable or a passphrase.
+type TokenCipher struct {
+	primary     *keyEncryptionKey
+	mutex       sync.Mutex
+	keys        map[string]*keyEncryptionKey // by id, including keys derived from passphrases
+	passphrases []passphraseKey
+}
+
+// NewTokenCipher returns a cipher sealing new values with key.
+func NewTokenCipher(key []byte) (*TokenCipher, error) {
+	primary, err := newKeyEncryptionKey(key, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCipher{primary: primary, keys: map[string]*keyEncryptionKey{primary.id: primary}}, nil
+}
+
+// NewPassphraseTokenCipher returns a cipher whose key is derived from
+// passphrase with PBKDF2 and a random salt stored in every sealed value.
+func NewPassphraseTokenCipher(passphrase string) (*TokenCipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("encryption passphrase cannot be empty")
+	}
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	primary, err := derivePassphraseKey(passphrase, salt, true)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCipher{
+		primary:     primary,
+		keys:        map[string]*keyEncryptionKey{primary.id: primary},
+		passphrases: []passphraseKey{{passphrase: passphrase, current: true}},
+	}, nil
+}
+
+func derivePassphraseKey(passphrase string, salt []byte, current bool) (*keyEncryptionKey, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, kdfIterations, encryptionKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyEncryptionKey(key, salt, current)
+}
+
+// withPrevious returns a cipher that seals with c and can still open values
+// sealed by previous, whose keys are no longer current.
+func (c *TokenCipher) withPrevious(previous *TokenCipher) *TokenCipher {
+	combined := &TokenCipher{
+		primary:     c.primary,
+		keys:        make(map[string]*keyEncryptionKey),
+		passphrases: append([]passphraseKey(nil), c.passphrases...),
+	}
+	for id, key := range c.keys {
+		combined.keys[id] = key
+	}
+	if previous == nil {
+		return combined
+	}
+	previous.mutex.Lock()
+	defer previous.mutex.Unlock()
+	for id, key := range previous.keys {
+		if _, ok := combined.keys[id]; !ok {
+			old := *key
+			old.current = false
+			combined.keys[id] = &old
+		}
+	}
+	for _, passphrase := range previous.passphrases {
+		known := slices.ContainsFunc(combined.passphrases, func(p passphraseKey) bool {
+			return p.passphrase == passphrase.passphrase
+		})
+		if !known {
+			combined.passphrases = append(combined.passphrases, passphraseKey{passphrase: passphrase.passphrase})
+		}
+	}
+	return combined
+}
+
+// addDecryptionKey lets c open values sealed with key without sealing new ones with it.
+func (c *TokenCipher) addDecryptionKey(key []byte) error {
+	kek, err := newKeyEncryptionKey(key, nil, false)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.keys[kek.id]; !ok {
+		c.keys[kek.id] = kek
+	}
+	return nil
+}
+
+// lookup returns the key-encryption key that sealed value, deriving it from
+// a passphrase when needed.
+func (c *TokenCipher) lookup(value *sealedValue) (*keyEncryptionKey, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.keys[value.KeyID]; ok {
+		return key, nil
+	}
+	if len(value.Salt) > 0 {
+		for _, passphrase := range c.passphrases {
+			key, err := derivePassphraseKey(passphrase.passphrase, value.Salt, passphrase.current)
+			if err != nil {
+				return nil, err
+			}
+			if key.id == value.KeyID {
+				c.keys[key.id] = key
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("token was encrypted with an unknown key %s", value.KeyID)
+}
+
+// isEncryptedValue reports whether a stored token is sealed.
+func isEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+// Encrypt seals plaintext. context binds the value to where it is stored, so
+// it cannot be copied into another user's record. Empty values stay empty.
+func (c *TokenCipher) Encrypt(plaintext, context string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAEAD(dataAEAD, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealAEAD(c.primary.aead, dataKey, []byte(c.primary.id))
+	if err != nil {
+		return "", err
+	}
+	envelope, err := json.Marshal(sealedValue{KeyID: c.primary.id, Salt: c.primary.salt, WrappedKey: wrappedKey, Ciphertext: ciphertext})
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + base64.RawURLEncoding.EncodeToString(envelope), nil
+}
+
+// Decrypt opens a value sealed by Encrypt with the same context. Values
+// without the encryption prefix are returned unchanged.
+func (c *TokenCipher) Decrypt(value, context string) (string, error) {
+	plaintext, _, err := c.decrypt(value, context)
+	return plaintext, err
+}
+
+// decrypt also reports whether value should be sealed again: it is plaintext
+// or was sealed with a key that is no longer current.
+func (c *TokenCipher) decrypt(value, context string) (plaintext string, stale bool, err error) {
+	if !isEncryptedValue(value) {
+		return value, value != "", nil
+	}
+	if c == nil {
+		return "", false, ErrEncryptionKeyMissing
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", false, fmt.Errorf("malformed encrypted token: %w", err)
+	}
+	var envelope sealedValue
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return "", false, fmt.Errorf("malformed encrypted token: %w", err)
+	}
+	key, err := c.lookup(&envelope)
+	if err != nil {
+		return "", false, err
+	}
+	dataKey, err := openAEAD(key.aead, envelope.WrappedKey, []byte(key.id))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to unwrap token key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	opened, err := openAEAD(dataAEAD, envelope.Ciphertext, []byte(context))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+	return string(opened), !key.current, nil
+}
+
+// LoadTokenCipher returns the cipher for the key configured through the
+// environment or cfg, or nil when token encryption is not configured.
+func LoadTokenCipher(cfg *Config) (*TokenCipher, error) {
+	if key := os.Getenv(EncryptionKeyEnv); key != "" {
+		decoded, err := decodeEncryptionKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", EncryptionKeyEnv, err)
+		}
+		return NewTokenCipher(decoded)
+	}
+	if path := encryptionKeyFile(cfg); path != "" {
+		return loadKeyFileCipher(path)
+	}
+	if passphrase := os.Getenv(EncryptionPassphraseEnv); passphrase != "" {
+		return NewPassphraseTokenCipher(passphrase)
+	}
+	return nil, nil
+}
+
+// encryptionKeyFile returns the configured key file, if any.
+func encryptionKeyFile(cfg *Config) string {
+	if path := os.Getenv(EncryptionKeyFileEnv); path != "" {
+		return path
+	}
+	if cfg != nil {
+		return cfg.Encryption.KeyFile
+	}
+	return ""
+}
+
+// loadKeyFileCipher reads the key at path. Keys left next to it by an
+// interrupted rotation are added for decryption only.
+func loadKeyFileCipher(path string) (*TokenCipher, error) {
+	key, err := readKeyFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// A rotation stopped between retiring the old key and installing the new one
+		key, err = readKeyFile(path + newKeyFileSuffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewTokenCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key file %s: %w", path, err)
+	}
+	for _, leftover := range []string{path + newKeyFileSuffix, path + oldKeyFileSuffix} {
+		if key, err := readKeyFile(leftover); err == nil {
+			if err := c.addDecryptionKey(key); err != nil {
+				Warn("Ignoring invalid leftover encryption key", "file", leftover, "error", err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		Warn("Encryption key file is accessible by other users", "file", path, "mode", info.Mode().Perm().String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+	key, err := decodeEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// decodeEncryptionKey accepts a 32-byte key encoded as hex or base64.
+func decodeEncryptionKey(text string) ([]byte, error) {
+	text = strings.TrimSpace(text)
+	if key, err := hex.DecodeString(text); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := encoding.DecodeString(text); err == nil && len(key) == encryptionKeySize {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("must be a %d-byte key encoded as hex or base64", encryptionKeySize)
+}
+
+// generateKeyFile writes a new random key to path with owner-only permissions.
+func generateKeyFile(path string) ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), tokenFilePerm); err != nil {
+		return nil, fmt.Errorf("failed to write encryption key file: %w", err)
+	}
+	return key, nil
+}
+
+// Encryption contexts of the token fields in config.json.
+const (
+	configGitHubTokenContext  = "config/github_token"
+	configCopilotTokenContext = "config/copilot_token"
+)
+
+// decryptConfigTokens opens the tokens read from config.json and reports
+// whether any of them should be sealed again.
+func decryptConfigTokens(cfg *Config, c *TokenCipher) (stale bool, err error) {
+	fields := []struct {
+		value   *string
+		context string
+	}{
+		{&cfg.GitHubToken, configGitHubTokenContext},
+		{&cfg.CopilotToken, configCopilotTokenContext},
+	}
+	for _, field := range fields {
+		plaintext, fieldStale, err := c.decrypt(*field.value, field.context)
+		if err != nil {
+			return false, fmt.Errorf("failed to decrypt config tokens: %w", err)
+		}
+		*field.value = plaintext
+		stale = stale || fieldStale
+	}
+	return stale, nil
+}
+
+// sealConfigTokens rewrites the token fields of the config file at path under
+// the primary key of c, leaving the rest of the file untouched. It returns
+// whether the file changed.
+func sealConfigTokens(path string, c *TokenCipher) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var stored struct {
+		GitHubToken  string `json:"github_token"`
+		CopilotToken string `json:"copilot_token"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, field := range []struct{ value, context string }{
+		{stored.GitHubToken, configGitHubTokenContext},
+		{stored.CopilotToken, configCopilotTokenContext},
+	} {
+		plaintext, stale, err := c.decrypt(field.value, field.context)
+		if err != nil {
+			return false, err
+		}
+		if !stale {
+			continue
+		}
+		sealed, err := c.Encrypt(plaintext, field.context)
+		if err != nil {
+			return false, err
+		}
+		// Replace the JSON string in place so the file keeps its layout
+		oldLiteral, _ := json.Marshal(field.value)
+		newLiteral, _ := json.Marshal(sealed)
+		if bytes.Count(data, oldLiteral) != 1 {
+			return false, errors.New("token value is not unique in the config file")
+		}
+		data = bytes.Replace(data, oldLiteral, newLiteral, 1)
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, writeFileAtomic(path, data, tokenFilePerm)
+}
+
+// migrateConfigTokens seals plaintext tokens found in the config file at
+// path. Failures are logged; the tokens stay usable either way.
+func migrateConfigTokens(path string, c *TokenCipher) {
+	changed, err := sealConfigTokens(path, c)
+	if err != nil {
+		Warn("Failed to encrypt tokens in config file", "path", path, "error", err)
+		return
+	}
+	if changed {
+		Info("Encrypted tokens in config file", "path", path)
+	}
+}
+
+// sealTokenFields returns a copy of token with its secrets sealed.
+func sealTokenFields(token *StoredToken, c *TokenCipher) (*StoredToken, error) {
+	sealed := *token
+	var err error
+	if sealed.GitHubToken, err = c.Encrypt(token.GitHubToken, token.Email+"/github_token"); err != nil {
+		return nil, err
+	}
+	if sealed.CopilotToken, err = c.Encrypt(token.CopilotToken, token.Email+"/copilot_token"); err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// openTokenFields decrypts the secrets of token in place and reports whether
+// they should be sealed again.
+func openTokenFields(token *StoredToken, c *TokenCipher) (stale bool, err error) {
+	github, githubStale, err := c.decrypt(token.GitHubToken, token.Email+"/github_token")
+	if err != nil {
+		return false, err
+	}
+	copilot, copilotStale, err := c.decrypt(token.CopilotToken, token.Email+"/copilot_token")
+	if err != nil {
+		return false, err
+	}
+	token.GitHubToken, token.CopilotToken = github, copilot
+	return githubStale || copilotStale, nil
+}
+
+// KeyRotationResult reports what RotateTokenEncryption re-encrypted.
+type KeyRotationResult struct {
+	ConfigUpdated bool
+	TokenFiles    int
+	KeyFile       string // key file holding the new key; empty for keys from the environment
+}
+
+// RotateTokenEncryption re-encrypts the tokens in the config file at
+// configPath and in the file token store under a new key. The new key comes
+// from COPILOT_NEW_ENCRYPTION_KEY or COPILOT_NEW_ENCRYPTION_PASSPHRASE, or is
+// generated into keyFile (default: the configured key file). A generated key
+// is written next to the old one first and only replaces it once every token
+// has been re-encrypted, so an interrupted rotation can simply be repeated.
+func RotateTokenEncryption(cfg *Config, configPath, keyFile string) (*KeyRotationResult, error) {
+	current, err := LoadTokenCipher(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load current encryption key: %w", err)
+	}
+
+	result := &KeyRotationResult{}
+	var next *TokenCipher
+	switch {
+	case os.Getenv(NewEncryptionKeyEnv) != "":
+		key, err := decodeEncryptionKey(os.Getenv(NewEncryptionKeyEnv))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", NewEncryptionKeyEnv, err)
+		}
+		next, err = NewTokenCipher(key)
+		if err != nil {
+			return nil, err
+		}
+	case os.Getenv(NewEncryptionPassphraseEnv) != "":
+		next, err = NewPassphraseTokenCipher(os.Getenv(NewEncryptionPassphraseEnv))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if keyFile == "" {
+			keyFile = encryptionKeyFile(cfg)
+		}
+		if keyFile == "" {
+			return nil, fmt.Errorf("no key file configured: set encryption.key_file, pass --key-file, or set %s or %s", NewEncryptionKeyEnv, NewEncryptionPassphraseEnv)
+		}
+		key, err := generateKeyFile(keyFile + newKeyFileSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if next, err = NewTokenCipher(key); err != nil {
+			return nil, err
+		}
+		result.KeyFile = keyFile
+	}
+	combined := next.withPrevious(current)
+
+	if configPath != "" {
+		if _, statErr := os.Stat(configPath); statErr == nil {
+			if result.ConfigUpdated, err = sealConfigTokens(configPath, combined); err != nil {
+				return nil, fmt.Errorf("failed to re-encrypt config tokens: %w", err)
+			}
+		}
+	}
+
+	if cfg.TokenStore.Type == TokenStoreFile {
+		store := NewFileTokenStore(fileTokenStoreDir(cfg), WithTokenCipher(combined))
+		if result.TokenFiles, err = store.reseal(); err != nil {
+			return nil, fmt.Errorf("failed to re-encrypt token files: %w", err)
+		}
+	}
+
+	if result.KeyFile != "" {
+		if err := replaceKeyFile(result.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// replaceKeyFile moves path.new into place, keeping the previous key as
+// path.old until the new one is installed.
+func replaceKeyFile(path string) error {
+	if err := os.Rename(path, path+oldKeyFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to retire old encryption key: %w", err)
+	}
+	if err := os.Rename(path+newKeyFileSuffix, path); err != nil {
+		return fmt.Errorf("failed to install new encryption key: %w", err)
+	}
+	if err := os.Remove(path + oldKeyFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old encryption key: %w", err)
+	}
+	return nil
+}
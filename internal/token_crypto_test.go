@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTokenCipher(t *testing.T, fill byte) *TokenCipher {
+	t.Helper()
+	c, err := NewTokenCipher([]byte(strings.Repeat(string(fill), encryptionKeySize)))
+	if err != nil {
+		t.Fatalf("NewTokenCipher failed: %v", err)
+	}
+	return c
+}
+
+// writeTestKeyFile writes a hex key file and points the environment at it.
+func writeTestKeyFile(t *testing.T, fill byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token.key")
+	key := hex.EncodeToString([]byte(strings.Repeat(string(fill), encryptionKeySize)))
+	if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	t.Setenv(EncryptionKeyFileEnv, path)
+	return path
+}
+
+func TestTokenCipher_RoundTrip(t *testing.T) {
+	c := newTestTokenCipher(t, 'a')
+	sealed, err := c.Encrypt(testGitHubToken, "alice@example.com/github_token")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if !isEncryptedValue(sealed) || strings.Contains(sealed, testGitHubToken) {
+		t.Fatalf("expected a sealed value, got %q", sealed)
+	}
+
+	plaintext, stale, err := c.decrypt(sealed, "alice@example.com/github_token")
+	if err != nil || stale || plaintext != testGitHubToken {
+		t.Errorf("decrypt = %q, %v, %v", plaintext, stale, err)
+	}
+	if _, err := c.Decrypt(sealed, "bob@example.com/github_token"); err == nil {
+		t.Error("expected a value copied to another context to be rejected")
+	}
+	if _, err := newTestTokenCipher(t, 'b').Decrypt(sealed, "alice@example.com/github_token"); err == nil {
+		t.Error("expected decryption with another key to fail")
+	}
+	var missing *TokenCipher
+	if _, err := missing.Decrypt(sealed, "alice@example.com/github_token"); !errors.Is(err, ErrEncryptionKeyMissing) {
+		t.Errorf("expected ErrEncryptionKeyMissing, got %v", err)
+	}
+	if plaintext, stale, _ := missing.decrypt("plain", "ctx"); plaintext != "plain" || !stale {
+		t.Errorf("expected plaintext to pass through as stale, got %q, %v", plaintext, stale)
+	}
+}
+
+func TestTokenCipher_Passphrase(t *testing.T) {
+	c, err := NewPassphraseTokenCipher("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("NewPassphraseTokenCipher failed: %v", err)
+	}
+	sealed, err := c.Encrypt(testCopilotToken, configCopilotTokenContext)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// A fresh cipher derives the key again from the salt in the value
+	again, _ := NewPassphraseTokenCipher("correct horse battery staple")
+	if plaintext, stale, err := again.decrypt(sealed, configCopilotTokenContext); err != nil || stale || plaintext != testCopilotToken {
+		t.Errorf("decrypt = %q, %v, %v", plaintext, stale, err)
+	}
+	wrong, _ := NewPassphraseTokenCipher("wrong")
+	if _, err := wrong.Decrypt(sealed, configCopilotTokenContext); err == nil {
+		t.Error("expected a wrong passphrase to fail")
+	}
+}
+
+func TestFileTokenStore_EncryptsPlaintextFiles(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	token := &StoredToken{Email: testEmail, GitHubToken: testGitHubToken, CopilotToken: testCopilotToken, ExpiresAt: 100}
+	if err := NewFileTokenStore(dir).Put(ctx, token); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	store := NewFileTokenStore(dir, WithTokenCipher(newTestTokenCipher(t, 'a')))
+	got, err := store.Get(ctx, testEmail)
+	if err != nil || *got != *token {
+		t.Fatalf("Get = %+v, %v", got, err)
+	}
+
+	path := store.path(testEmail)
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), testGitHubToken) || strings.Contains(string(data), "tid=") {
+		t.Errorf("expected the token file to be encrypted on read, got %s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != tokenFilePerm {
+		t.Errorf("expected mode %v, got %v", os.FileMode(tokenFilePerm), info.Mode().Perm())
+	}
+	if _, err := NewFileTokenStore(dir).Get(ctx, testEmail); !errors.Is(err, ErrEncryptionKeyMissing) {
+		t.Errorf("expected ErrEncryptionKeyMissing without a key, got %v", err)
+	}
+}
+
+func TestConfig_EncryptsTokens(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+	t.Setenv(EncryptionKeyEnv, "")
+	t.Setenv(EncryptionPassphraseEnv, "")
+	path := filepath.Join(t.TempDir(), "config.json")
+	plaintext := `{
+  "port": 8081,
+  "github_token": "` + testGitHubToken + `",
+  "copilot_token": "` + testCopilotToken + `"
+}
+`
+	if err := os.WriteFile(path, []byte(plaintext), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	// Without a key the plaintext config is read as is
+	cfg, err := readConfigFile(path)
+	if err != nil || cfg.GitHubToken != testGitHubToken {
+		t.Fatalf("readConfigFile = %v, %v", cfg, err)
+	}
+
+	// With a key it is migrated in place
+	writeTestKeyFile(t, 'a')
+	cfg, err = readConfigFile(path)
+	if err != nil || cfg.GitHubToken != testGitHubToken || cfg.CopilotToken != testCopilotToken {
+		t.Fatalf("readConfigFile = %v, %v", cfg, err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), testGitHubToken) || !strings.Contains(string(data), `"port": 8081`) {
+		t.Errorf("expected the tokens to be encrypted in place, got %s", data)
+	}
+
+	cfg.CopilotToken = "tid=rotated"
+	if err := cfg.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if strings.Contains(string(data), "tid=rotated") || cfg.CopilotToken != "tid=rotated" {
+		t.Errorf("expected SaveConfig to encrypt only the stored copy, got %s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != tokenFilePerm {
+		t.Errorf("expected mode %v, got %v", os.FileMode(tokenFilePerm), info.Mode().Perm())
+	}
+	if reread, err := readConfigFile(path); err != nil || reread.CopilotToken != "tid=rotated" {
+		t.Errorf("readConfigFile = %v, %v", reread, err)
+	}
+
+	t.Setenv(EncryptionKeyFileEnv, "")
+	if _, err := readConfigFile(path); !errors.Is(err, ErrEncryptionKeyMissing) {
+		t.Errorf("expected ErrEncryptionKeyMissing without a key, got %v", err)
+	}
+}
+
+func TestRotateTokenEncryption(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+	t.Setenv(EncryptionKeyEnv, "")
+	t.Setenv(EncryptionPassphraseEnv, "")
+	t.Setenv(NewEncryptionKeyEnv, "")
+	t.Setenv(NewEncryptionPassphraseEnv, "")
+	keyFile := writeTestKeyFile(t, 'a')
+
+	cfg := &Config{GitHubToken: testGitHubToken}
+	cfg.TokenStore.Type = TokenStoreFile
+	cfg.TokenStore.Dir = t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := cfg.SaveConfig(configPath); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	oldCipher, _ := LoadTokenCipher(cfg)
+	token := &StoredToken{Email: testEmail, GitHubToken: testGitHubToken, CopilotToken: testCopilotToken}
+	if err := NewFileTokenStore(cfg.TokenStore.Dir, WithTokenCipher(oldCipher)).Put(context.Background(), token); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	result, err := RotateTokenEncryption(cfg, configPath, "")
+	if err != nil {
+		t.Fatalf("RotateTokenEncryption failed: %v", err)
+	}
+	if !result.ConfigUpdated || result.TokenFiles != 1 || result.KeyFile != keyFile {
+		t.Errorf("unexpected result %+v", result)
+	}
+	for _, leftover := range []string{keyFile + newKeyFileSuffix, keyFile + oldKeyFileSuffix} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to be removed, got %v", leftover, err)
+		}
+	}
+
+	newCipher, err := LoadTokenCipher(cfg)
+	if err != nil {
+		t.Fatalf("LoadTokenCipher failed: %v", err)
+	}
+	got, err := NewFileTokenStore(cfg.TokenStore.Dir, WithTokenCipher(newCipher)).Get(context.Background(), testEmail)
+	if err != nil || *got != *token {
+		t.Errorf("Get with the new key = %+v, %v", got, err)
+	}
+	if _, err := NewFileTokenStore(cfg.TokenStore.Dir, WithTokenCipher(oldCipher)).Get(context.Background(), testEmail); err == nil {
+		t.Error("expected the old key to no longer decrypt the token file")
+	}
+	if reread, err := readConfigFile(configPath); err != nil || reread.GitHubToken != testGitHubToken {
+		t.Errorf("readConfigFile after rotation = %v, %v", reread, err)
+	}
+}
+
+func TestFileTokenStore_ReloadCipher(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("COPILOT_TOKEN", "")
+	t.Setenv(EncryptionKeyEnv, "")
+	t.Setenv(EncryptionPassphraseEnv, "")
+	t.Setenv(NewEncryptionKeyEnv, "")
+	t.Setenv(NewEncryptionPassphraseEnv, "")
+	writeTestKeyFile(t, 'a')
+
+	cfg := &Config{}
+	cfg.TokenStore.Type = TokenStoreFile
+	cfg.TokenStore.Dir = t.TempDir()
+	ctx := context.Background()
+	store, _ := NewTokenStore(cfg, nil).(*FileTokenStore)
+	token := &StoredToken{Email: testEmail, GitHubToken: testGitHubToken, CopilotToken: testCopilotToken}
+	if err := store.Put(ctx, token); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if _, err := RotateTokenEncryption(cfg, "", ""); err != nil {
+		t.Fatalf("RotateTokenEncryption failed: %v", err)
+	}
+	if _, err := store.Get(ctx, testEmail); err == nil {
+		t.Fatal("expected the running store to miss the rotated key before a reload")
+	}
+	// A token refreshed before the reload is still sealed with the old key
+	other := &StoredToken{Email: "bob@example.com", GitHubToken: testGitHubToken, CopilotToken: testCopilotToken}
+	if err := store.Put(ctx, other); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if err := store.ReloadCipher(); err != nil {
+		t.Fatalf("ReloadCipher failed: %v", err)
+	}
+	for _, want := range []*StoredToken{token, other} {
+		if got, err := store.Get(ctx, want.Email); err != nil || *got != *want {
+			t.Errorf("Get(%s) after reload = %+v, %v", want.Email, got, err)
+		}
+	}
+
+	// Reading re-encrypted the old token under the new key
+	current, _ := LoadTokenCipher(cfg)
+	if _, err := NewFileTokenStore(cfg.TokenStore.Dir, WithTokenCipher(current)).Get(ctx, other.Email); err != nil {
+		t.Errorf("expected the new key alone to open the token, got %v", err)
+	}
+}
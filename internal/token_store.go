@@ -0,0 +1,598 @@
+// Package internal provides per-user token storage backends for github-copilot-svcs.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token store backend types
+const (
+	TokenStoreHTTP   = "http"
+	TokenStoreFile   = "file"
+	TokenStoreMemory = "memory"
+
+	tokenStoreDirName     = "tokens"
+	tokenFileExt          = ".json"
+	tokenFilePerm         = 0o600
+	tokenStoreHTTPTimeout = 5 * time.Second
+)
+
+// ErrTokenNotFound is returned by a TokenStore when no token exists for the email.
+var ErrTokenNotFound = errors.New("token not found")
+
+// StoredToken holds the per-user credentials persisted by a TokenStore.
+type StoredToken struct {
+	Email        string `json:"email"`
+	GitHubToken  string `json:"github_token"`
+	CopilotToken string `json:"copilot_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshIn    int64  `json:"refresh_in"`
+	APIEndpoint  string `json:"api_endpoint,omitempty"` // endpoints.api issued with the Copilot token
+	SKU          string `json:"sku,omitempty"`          // Copilot seat type issued with the token
+}
+
+// TokenStore persists GitHub and Copilot tokens keyed by user email.
+type TokenStore interface {
+	// Get returns the token for email, or ErrTokenNotFound.
+	Get(ctx context.Context, email string) (*StoredToken, error)
+	// Put creates or replaces the token for token.Email.
+	Put(ctx context.Context, token *StoredToken) error
+	// Delete removes the token for email. Deleting a missing token is not an error.
+	Delete(ctx context.Context, email string) error
+	// List returns all stored tokens ordered by email.
+	List(ctx context.Context) ([]*StoredToken, error)
+}
+
+// NewTokenStore creates the token store backend selected in cfg.
+func NewTokenStore(cfg *Config, httpClient *http.Client) TokenStore {
+	switch cfg.TokenStore.Type {
+	case TokenStoreFile:
+		loadCipher := func() (*TokenCipher, error) { return LoadTokenCipher(cfg) }
+		tokenCipher, err := loadCipher()
+		if err != nil {
+			Error("Failed to load token encryption key", "error", err)
+			return NewFileTokenStore(fileTokenStoreDir(cfg), withTokenCipherError(err), withTokenCipherLoader(loadCipher))
+		}
+		if tokenCipher == nil {
+			Info("Token files are stored unencrypted; configure an encryption key to protect them")
+		}
+		return NewFileTokenStore(fileTokenStoreDir(cfg), WithTokenCipher(tokenCipher), withTokenCipherLoader(loadCipher))
+	case TokenStoreMemory:
+		return NewMemoryTokenStore()
+	default:
+		storeURL := cfg.TokenStore.URL
+		if storeURL == "" {
+			storeURL = getDatabaseURL()
+		}
+		return NewHTTPTokenStore(httpClient, storeURL)
+	}
+}
+
+// fileTokenStoreDir returns the directory of the file token store.
+func fileTokenStoreDir(cfg *Config) string {
+	if cfg.TokenStore.Dir != "" {
+		return cfg.TokenStore.Dir
+	}
+	return defaultTokenStoreDir()
+}
+
+func defaultTokenStoreDir() string {
+	path, err := GetConfigPath()
+	if err != nil {
+		return tokenStoreDirName
+	}
+	return filepath.Join(filepath.Dir(path), tokenStoreDirName)
+}
+
+// HTTPTokenStore stores tokens in the AutoReview UI copilot-auth-status API.
+type HTTPTokenStore struct {
+	httpClient *http.Client
+	url        string
+}
+
+// NewHTTPTokenStore creates a token store backed by the copilot-auth-status HTTP API at url.
+func NewHTTPTokenStore(httpClient *http.Client, url string) *HTTPTokenStore {
+	return &HTTPTokenStore{httpClient: httpClient, url: url}
+}
+
+// httpTokenRecord is the wire format used by the copilot-auth-status API.
+type httpTokenRecord struct {
+	Email        string          `json:"email"`
+	GithubToken  string          `json:"githubToken"`
+	CopilotToken string          `json:"copilotToken"`
+	ExpiresAt    json.RawMessage `json:"expiresAt"`
+	RefreshIn    json.RawMessage `json:"refreshIn"`
+	APIEndpoint  string          `json:"apiEndpoint,omitempty"`
+	SKU          string          `json:"sku,omitempty"`
+}
+
+func (r *httpTokenRecord) toStoredToken() *StoredToken {
+	return &StoredToken{
+		Email:        r.Email,
+		GitHubToken:  r.GithubToken,
+		CopilotToken: r.CopilotToken,
+		ExpiresAt:    parseFlexibleInt(r.ExpiresAt),
+		RefreshIn:    parseFlexibleInt(r.RefreshIn),
+		APIEndpoint:  r.APIEndpoint,
+		SKU:          r.SKU,
+	}
+}
+
+// parseFlexibleInt accepts both JSON numbers and numeric strings, as the API returns either.
+func parseFlexibleInt(raw json.RawMessage) int64 {
+	if len(raw) == 0 {
+		return 0
+	}
+	var n int64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if parsed, parseErr := strconv.ParseInt(s, 10, 64); parseErr == nil {
+			return parsed
+		}
+	}
+	return 0
+}
+
+// Get fetches the token for email from the HTTP API.
+func (s *HTTPTokenStore) Get(ctx context.Context, email string) (*StoredToken, error) {
+	var result struct {
+		Success bool            `json:"success"`
+		Data    httpTokenRecord `json:"data"`
+	}
+	status, err := s.do(ctx, http.MethodGet, s.url+"?email="+url.QueryEscape(email), nil, &result)
+	if status == http.StatusNotFound {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, NewAuthError("failed to fetch token from token store", nil)
+	}
+	token := result.Data.toStoredToken()
+	if token.Email == "" {
+		token.Email = email
+	}
+	return token, nil
+}
+
+// Put stores the token through the HTTP API.
+func (s *HTTPTokenStore) Put(ctx context.Context, token *StoredToken) error {
+	requestBody := map[string]interface{}{
+		"email":        token.Email,
+		"githubToken":  token.GitHubToken,
+		"copilotToken": token.CopilotToken,
+		"expiresAt":    token.ExpiresAt,
+		"refreshIn":    token.RefreshIn,
+	}
+	if token.APIEndpoint != "" {
+		requestBody["apiEndpoint"] = token.APIEndpoint
+	}
+	if token.SKU != "" {
+		requestBody["sku"] = token.SKU
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if _, err := s.do(ctx, http.MethodPost, s.url, requestBody, &result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return NewAuthError("failed to update token in token store", nil)
+	}
+	return nil
+}
+
+// Delete removes the token for email through the HTTP API.
+func (s *HTTPTokenStore) Delete(ctx context.Context, email string) error {
+	status, err := s.do(ctx, http.MethodDelete, s.url+"?email="+url.QueryEscape(email), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// List returns all tokens known to the HTTP API.
+func (s *HTTPTokenStore) List(ctx context.Context) ([]*StoredToken, error) {
+	var result struct {
+		Success bool              `json:"success"`
+		Data    []httpTokenRecord `json:"data"`
+	}
+	if _, err := s.do(ctx, http.MethodGet, s.url, nil, &result); err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, NewAuthError("failed to list tokens from token store", nil)
+	}
+	tokens := make([]*StoredToken, 0, len(result.Data))
+	for i := range result.Data {
+		tokens = append(tokens, result.Data[i].toStoredToken())
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+func (s *HTTPTokenStore) do(ctx context.Context, method, target string, body, out interface{}) (int, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, tokenStoreHTTPTimeout)
+	defer cancel()
+
+	var reader *strings.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reader = strings.NewReader(string(jsonData))
+	} else {
+		reader = strings.NewReader("")
+	}
+
+	req, err := http.NewRequestWithContext(reqCtx, method, target, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	setRequestIDHeader(ctx, req)
+	injectTraceparent(ctx, req.Header)
+
+	start := time.Now()
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		WarnContext(ctx, "Token store request failed", "method", method, "url", s.url, "error", err)
+		return 0, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			WarnContext(ctx, "Error closing response body", "error", err)
+		}
+	}()
+	DebugContext(ctx, "Token store request", "method", method, "url", s.url, "status", resp.StatusCode, "duration_ms", time.Since(start).Milliseconds())
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, NewNetworkError("token_store_"+strings.ToLower(method), s.url, fmt.Sprintf("HTTP %d response", resp.StatusCode), nil)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// FileTokenStore stores one JSON document per user in a local directory.
+// With a cipher the GitHub and Copilot tokens in each document are
+// encrypted, and plaintext documents are encrypted when they are read.
+type FileTokenStore struct {
+	dir        string
+	mutex      sync.Mutex
+	cipher     *TokenCipher
+	cipherErr  error
+	loadCipher func() (*TokenCipher, error)
+}
+
+// NewFileTokenStore creates a file-backed token store rooted at dir.
+// The directory is created on first write.
+func NewFileTokenStore(dir string, opts ...func(*FileTokenStore)) *FileTokenStore {
+	s := &FileTokenStore{dir: dir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithTokenCipher encrypts the tokens in each document with c.
+func WithTokenCipher(c *TokenCipher) func(*FileTokenStore) {
+	return func(s *FileTokenStore) {
+		s.cipher = c
+	}
+}
+
+// withTokenCipherError makes every operation fail with err, so that a broken
+// key configuration never falls back to plaintext storage.
+func withTokenCipherError(err error) func(*FileTokenStore) {
+	return func(s *FileTokenStore) {
+		s.cipherErr = err
+	}
+}
+
+// withTokenCipherLoader sets how ReloadCipher loads the key again.
+func withTokenCipherLoader(load func() (*TokenCipher, error)) func(*FileTokenStore) {
+	return func(s *FileTokenStore) {
+		s.loadCipher = load
+	}
+}
+
+// ReloadCipher loads the encryption key again so that a running server picks
+// up a key replaced by rotate-key. The previous key is kept for decryption
+// only, and documents still sealed with it are re-encrypted when read. On
+// error the current key stays active.
+func (s *FileTokenStore) ReloadCipher() error {
+	if s.loadCipher == nil {
+		return nil
+	}
+	next, err := s.loadCipher()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if next == nil {
+		if s.cipher != nil {
+			return errors.New("encryption key is no longer configured")
+		}
+		return nil
+	}
+	s.cipher = next.withPrevious(s.cipher)
+	s.cipherErr = nil
+	return nil
+}
+
+func (s *FileTokenStore) path(email string) string {
+	return filepath.Join(s.dir, url.PathEscape(email)+tokenFileExt)
+}
+
+// Get reads the token document for email.
+func (s *FileTokenStore) Get(_ context.Context, email string) (*StoredToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cipherErr != nil {
+		return nil, s.cipherErr
+	}
+	return s.read(s.path(email))
+}
+
+// read decodes and decrypts the document at path. Callers must hold the lock.
+func (s *FileTokenStore) read(path string) (*StoredToken, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var token StoredToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token file %s: %w", path, err)
+	}
+	stale, err := openTokenFields(&token, s.cipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file %s: %w", path, err)
+	}
+	if stale && s.cipher != nil {
+		if err := s.write(path, &token); err != nil {
+			Warn("Failed to encrypt token file", "file", path, "error", err)
+		} else {
+			Info("Encrypted token file", "file", path)
+		}
+	}
+	return &token, nil
+}
+
+// write encrypts token, if a cipher is set, and atomically writes it to path
+// with owner-only permissions. Callers must hold the lock.
+func (s *FileTokenStore) write(path string, token *StoredToken) error {
+	if s.cipher != nil {
+		sealed, err := sealTokenFields(token, s.cipher)
+		if err != nil {
+			return err
+		}
+		token = sealed
+	}
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, tokenFilePerm)
+}
+
+// Put atomically writes the token document with owner-only permissions.
+func (s *FileTokenStore) Put(_ context.Context, token *StoredToken) error {
+	if token.Email == "" {
+		return NewValidationError("email", "", "email cannot be empty", nil)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cipherErr != nil {
+		return s.cipherErr
+	}
+	return s.write(s.path(token.Email), token)
+}
+
+// Delete removes the token document for email.
+func (s *FileTokenStore) Delete(_ context.Context, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cipherErr != nil {
+		return s.cipherErr
+	}
+	if err := os.Remove(s.path(email)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List reads every token document in the store directory.
+func (s *FileTokenStore) List(_ context.Context) ([]*StoredToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cipherErr != nil {
+		return nil, s.cipherErr
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*StoredToken, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), tokenFileExt) {
+			continue
+		}
+		token, readErr := s.read(filepath.Join(s.dir, entry.Name()))
+		if readErr != nil {
+			Warn("Skipping unreadable token file", "file", entry.Name(), "error", readErr)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// reseal rewrites every token document under the primary key of the store
+// cipher and returns the number of documents written.
+func (s *FileTokenStore) reseal() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), tokenFileExt) {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		token, err := s.read(path)
+		if err != nil {
+			return count, err
+		}
+		if err := s.write(path, token); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the target directory and renames it into place.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func() {
+		if removeErr := os.Remove(tmpName); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			Warn("Failed to remove temporary file", "file", tmpName, "error", removeErr)
+		}
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		cleanup()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		cleanup()
+		return err
+	}
+	return nil
+}
+
+// MemoryTokenStore keeps tokens in process memory. It is intended for tests.
+type MemoryTokenStore struct {
+	tokens map[string]StoredToken
+	mutex  sync.RWMutex
+}
+
+// NewMemoryTokenStore creates an empty in-memory token store.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]StoredToken)}
+}
+
+// Get returns a copy of the token for email.
+func (s *MemoryTokenStore) Get(_ context.Context, email string) (*StoredToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	token, ok := s.tokens[email]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &token, nil
+}
+
+// Put stores a copy of token.
+func (s *MemoryTokenStore) Put(_ context.Context, token *StoredToken) error {
+	if token.Email == "" {
+		return NewValidationError("email", "", "email cannot be empty", nil)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[token.Email] = *token
+	return nil
+}
+
+// Delete removes the token for email.
+func (s *MemoryTokenStore) Delete(_ context.Context, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.tokens, email)
+	return nil
+}
+
+// List returns copies of all tokens.
+func (s *MemoryTokenStore) List(_ context.Context) ([]*StoredToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tokens := make([]*StoredToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		t := token
+		tokens = append(tokens, &t)
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+func sortTokens(tokens []*StoredToken) {
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Email < tokens[j].Email })
+}
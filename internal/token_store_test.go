@@ -0,0 +1,201 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/internal"
+)
+
+func testTokenStoreRoundTrip(t *testing.T, store internal.TokenStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing@example.com"); !errors.Is(err, internal.ErrTokenNotFound) {
+		t.Fatalf("expected ErrTokenNotFound, got %v", err)
+	}
+
+	tokens := []*internal.StoredToken{
+		{Email: "bob@example.com", GitHubToken: "gh-bob", CopilotToken: "cp-bob", ExpiresAt: 200, RefreshIn: 100},
+		{Email: "alice@example.com", GitHubToken: "gh-alice", CopilotToken: "cp-alice", ExpiresAt: 300, RefreshIn: 150},
+	}
+	for _, token := range tokens {
+		if err := store.Put(ctx, token); err != nil {
+			t.Fatalf("Put(%s) failed: %v", token.Email, err)
+		}
+	}
+
+	got, err := store.Get(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if *got != *tokens[1] {
+		t.Errorf("Get returned %+v, want %+v", got, tokens[1])
+	}
+
+	list, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Email != "alice@example.com" || list[1].Email != "bob@example.com" {
+		t.Errorf("List returned unexpected tokens: %+v", list)
+	}
+
+	if err := store.Delete(ctx, "bob@example.com"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(ctx, "bob@example.com"); !errors.Is(err, internal.ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound after delete, got %v", err)
+	}
+	if err := store.Delete(ctx, "bob@example.com"); err != nil {
+		t.Errorf("deleting a missing token should not fail, got %v", err)
+	}
+
+	if err := store.Put(ctx, &internal.StoredToken{}); err == nil {
+		t.Error("expected error when storing a token without email")
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	testTokenStoreRoundTrip(t, internal.NewMemoryTokenStore())
+}
+
+func TestFileTokenStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tokens")
+	testTokenStoreRoundTrip(t, internal.NewFileTokenStore(dir))
+}
+
+func TestFileTokenStore_Permissions(t *testing.T) {
+	dir := t.TempDir()
+	store := internal.NewFileTokenStore(dir)
+
+	if err := store.Put(context.Background(), &internal.StoredToken{Email: "user@example.com", CopilotToken: "cp"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected exactly one file (no temp leftovers), got %d", len(entries))
+	}
+	info, err := entries[0].Info()
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected token file permissions 0600, got %o", perm)
+	}
+}
+
+func TestHTTPTokenStore(t *testing.T) {
+	var posted map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("email") == "missing@example.com" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(`{"success":true,"data":{"email":"user@example.com","githubToken":"gh","copilotToken":"cp","expiresAt":"1700000000","refreshIn":1500}}`))
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte(`{"success":true}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	store := internal.NewHTTPTokenStore(server.Client(), server.URL)
+	ctx := context.Background()
+
+	token, err := store.Get(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if token.CopilotToken != "cp" || token.ExpiresAt != 1700000000 || token.RefreshIn != 1500 {
+		t.Errorf("unexpected token: %+v", token)
+	}
+
+	if _, err := store.Get(ctx, "missing@example.com"); !errors.Is(err, internal.ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+
+	if err := store.Put(ctx, &internal.StoredToken{Email: "user@example.com", CopilotToken: "new"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if posted["email"] != "user@example.com" || posted["copilotToken"] != "new" {
+		t.Errorf("unexpected posted body: %v", posted)
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	tests := []struct {
+		storeType string
+		check     func(internal.TokenStore) bool
+	}{
+		{"", func(s internal.TokenStore) bool { _, ok := s.(*internal.HTTPTokenStore); return ok }},
+		{internal.TokenStoreHTTP, func(s internal.TokenStore) bool { _, ok := s.(*internal.HTTPTokenStore); return ok }},
+		{internal.TokenStoreFile, func(s internal.TokenStore) bool { _, ok := s.(*internal.FileTokenStore); return ok }},
+		{internal.TokenStoreMemory, func(s internal.TokenStore) bool { _, ok := s.(*internal.MemoryTokenStore); return ok }},
+	}
+
+	for _, tt := range tests {
+		t.Run("type="+tt.storeType, func(t *testing.T) {
+			cfg := createAuthTestConfig()
+			cfg.TokenStore.Type = tt.storeType
+			cfg.TokenStore.Dir = t.TempDir()
+			if !tt.check(internal.NewTokenStore(cfg, &http.Client{})) {
+				t.Errorf("unexpected store implementation for type %q", tt.storeType)
+			}
+		})
+	}
+}
+
+func TestAuthService_EnsureValidToken_UsesTokenStore(t *testing.T) {
+	store := internal.NewMemoryTokenStore()
+	ctx := context.Background()
+	if err := store.Put(ctx, &internal.StoredToken{
+		Email:        "user@example.com",
+		GitHubToken:  "gh",
+		CopilotToken: "expired",
+		ExpiresAt:    time.Now().Unix() - 10,
+	}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	refreshFunc := func(c *internal.Config) error {
+		c.CopilotToken = "refreshed"
+		c.ExpiresAt = time.Now().Unix() + 3600
+		return nil
+	}
+	authSvc := internal.NewAuthService(&http.Client{},
+		internal.WithTokenStore(store),
+		internal.WithRefreshFunc(refreshFunc),
+	)
+
+	cfg, err := authSvc.EnsureValidToken("user@example.com", createAuthTestConfig())
+	if err != nil {
+		t.Fatalf("EnsureValidToken failed: %v", err)
+	}
+	if cfg.CopilotToken != "refreshed" {
+		t.Errorf("expected refreshed token, got %s", cfg.CopilotToken)
+	}
+
+	if _, err := authSvc.EnsureValidToken("unknown@example.com", createAuthTestConfig()); err == nil {
+		t.Error("expected error for unknown user")
+	}
+}
@@ -0,0 +1,670 @@
+// Package internal provides distributed tracing for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Trace exporters selectable through tracing.exporter.
+const (
+	TraceExporterOTLP = "otlp" // OTLP/HTTP JSON to a collector
+	TraceExporterFile = "file" // OTLP JSON lines appended to a file
+)
+
+const (
+	defaultTraceEndpoint    = "http://localhost:4318/v1/traces"
+	defaultTraceServiceName = "github-copilot-svcs"
+	tracesFileName          = "traces.jsonl"
+
+	traceparentHeader   = "traceparent"
+	traceBatchSize      = 256
+	traceQueueSize      = 4096
+	traceFlushInterval  = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+	traceScopeName      = "github.com/xdlhzdh/github-copilot-svcs"
+	traceFlagSampled    = 0x01
+	traceparentVersion  = "00"
+	traceparentFieldLen = 55 // 00-<32 hex>-<16 hex>-<2 hex>
+)
+
+// SpanKind follows the OTLP span kinds.
+type SpanKind int
+
+// Span kinds used by the proxy.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// OTLP status codes.
+const (
+	spanStatusUnset = 0
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// spanContext identifies a span across process boundaries.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// traceparent formats sc as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), sc.flags)
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	value = strings.TrimSpace(value)
+	if len(value) < traceparentFieldLen {
+		return sc, false
+	}
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.flags = byte(flags)
+	return sc, sc.valid()
+}
+
+type spanContextKey struct{}
+
+func spanContextFromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok
+}
+
+// extractTraceparent returns ctx carrying the client's trace context from
+// header. It is kept even when tracing is disabled so the trace continues
+// upstream.
+func extractTraceparent(ctx context.Context, header http.Header) context.Context {
+	if sc, ok := parseTraceparent(header.Get(traceparentHeader)); ok {
+		return context.WithValue(ctx, spanContextKey{}, sc)
+	}
+	return ctx
+}
+
+// injectTraceparent sets the traceparent header for the current span of ctx.
+func injectTraceparent(ctx context.Context, header http.Header) {
+	if sc, ok := spanContextFromContext(ctx); ok {
+		header.Set(traceparentHeader, sc.traceparent())
+	}
+}
+
+// spanAttr is one span attribute or event attribute.
+type spanAttr struct {
+	key   string
+	value any
+}
+
+func spanAttrs(kv []any) []spanAttr {
+	attrs := make([]spanAttr, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			attrs = append(attrs, spanAttr{key: key, value: kv[i+1]})
+		}
+	}
+	return attrs
+}
+
+type spanEvent struct {
+	name  string
+	time  time.Time
+	attrs []spanAttr
+}
+
+// Span is one timed operation of a trace. All methods are safe on a nil
+// Span, which is what startSpan returns while tracing is disabled.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   SpanKind
+	ctx    spanContext
+	parent [8]byte
+	start  time.Time
+
+	mutex         sync.Mutex
+	end           time.Time
+	attrs         []spanAttr
+	events        []spanEvent
+	status        int
+	statusMessage string
+	ended         bool
+}
+
+// startSpan starts a span named name as a child of the current span of ctx
+// and returns a context carrying it. key/value pairs become attributes.
+func startSpan(ctx context.Context, name string, kind SpanKind, kv ...any) (context.Context, *Span) {
+	tracer := currentTracer()
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer: tracer,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  spanAttrs(kv),
+	}
+	if parent, ok := spanContextFromContext(ctx); ok {
+		span.ctx.traceID = parent.traceID
+		span.ctx.flags = parent.flags
+		span.parent = parent.spanID
+	} else {
+		putRandom(span.ctx.traceID[:])
+		span.ctx.flags = traceFlagSampled
+	}
+	putRandom(span.ctx.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span.ctx), span
+}
+
+func putRandom(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
+
+// SetAttributes adds key/value pairs to the span.
+func (s *Span) SetAttributes(kv ...any) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs = append(s.attrs, spanAttrs(kv)...)
+}
+
+// AddEvent records a point in time within the span, such as the first byte
+// of a stream.
+func (s *Span) AddEvent(name string, kv ...any) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, spanEvent{name: name, time: time.Now(), attrs: spanAttrs(kv)})
+}
+
+// RecordError marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = spanStatusError
+	s.statusMessage = err.Error()
+}
+
+// SetHTTPStatus records an HTTP status code, marking the span as failed for
+// 5xx responses, and for 4xx responses on client spans.
+func (s *Span) SetHTTPStatus(statusCode int) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs = append(s.attrs, spanAttr{key: "http.response.status_code", value: statusCode})
+	if statusCode >= statusServerError || (s.kind == SpanKindClient && statusCode >= statusClientError) {
+		s.status = spanStatusError
+		s.statusMessage = http.StatusText(statusCode)
+	}
+}
+
+// End finishes the span and hands it to the exporter. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// spanExporter writes finished spans, encoded as an OTLP JSON request.
+type spanExporter interface {
+	export(ctx context.Context, payload []byte) error
+	close() error
+}
+
+// Tracer batches finished spans and exports them in the background.
+type Tracer struct {
+	serviceName string
+	exporter    spanExporter
+	queue       chan *Span
+	flush       chan chan struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	dropped     atomic.Int64
+	closeOnce   sync.Once
+}
+
+// NewTracer returns a tracer for the tracing section of cfg, or nil when
+// tracing is disabled.
+func NewTracer(cfg *Config) (*Tracer, error) {
+	var exporter spanExporter
+	switch cfg.Tracing.Exporter {
+	case "":
+		return nil, nil
+	case TraceExporterOTLP:
+		endpoint := cfg.Tracing.Endpoint
+		if endpoint == "" {
+			endpoint = defaultTraceEndpoint
+		}
+		exporter = &otlpHTTPExporter{endpoint: endpoint, client: &http.Client{Timeout: traceExportTimeout}}
+	case TraceExporterFile:
+		file, err := os.OpenFile(DefaultTracesPath(cfg), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open traces file: %w", err)
+		}
+		exporter = &fileSpanExporter{file: file}
+	default:
+		return nil, NewValidationError("tracing.exporter", cfg.Tracing.Exporter, "must be otlp or file", nil)
+	}
+
+	serviceName := cfg.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTraceServiceName
+	}
+	t := &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+		queue:       make(chan *Span, traceQueueSize),
+		flush:       make(chan chan struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// DefaultTracesPath returns the traces file: tracing.file when set, otherwise
+// traces.jsonl next to the config file.
+func DefaultTracesPath(cfg *Config) string {
+	if cfg != nil && cfg.Tracing.File != "" {
+		return cfg.Tracing.File
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return tracesFileName
+	}
+	return filepath.Join(filepath.Dir(configPath), tracesFileName)
+}
+
+// activeTracer is the process-wide tracer, shared like the global logger; nil
+// disables tracing.
+var activeTracer atomic.Pointer[Tracer]
+
+// SetTracer installs t as the process-wide tracer. A nil t disables tracing.
+func SetTracer(t *Tracer) {
+	activeTracer.Store(t)
+}
+
+func currentTracer() *Tracer {
+	return activeTracer.Load()
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		// Never block a request on the exporter; count what is lost
+		if t.dropped.Add(1) == 1 {
+			Warn("Trace queue full, dropping spans")
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= traceBatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			drain()
+			close(flushed)
+		case <-t.stop:
+			drain()
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	payload, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		Warn("Failed to encode spans", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	if err := t.exporter.export(ctx, payload); err != nil {
+		Warn("Failed to export spans", "spans", len(spans), "error", err)
+	}
+}
+
+// Flush exports all finished spans now.
+func (t *Tracer) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case t.flush <- flushed:
+		<-flushed
+	case <-t.done:
+	}
+}
+
+// Shutdown exports the remaining spans and releases the exporter.
+func (t *Tracer) Shutdown() error {
+	var err error
+	t.closeOnce.Do(func() {
+		if activeTracer.Load() == t {
+			activeTracer.Store(nil)
+		}
+		close(t.stop)
+		<-t.done
+		if dropped := t.dropped.Load(); dropped > 0 {
+			Warn("Spans dropped because the trace queue was full", "spans", dropped)
+		}
+		err = t.exporter.close()
+	})
+	return err
+}
+
+// OTLP JSON encoding, see opentelemetry-proto's trace_service.proto. IDs are
+// hex strings and 64-bit integers are decimal strings.
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Flags             uint32         `json:"flags"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (t *Tracer) otlpRequest(spans []*Span) otlpTraceRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, span.otlp())
+	}
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]spanAttr{{key: "service.name", value: t.serviceName}})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: traceScopeName},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.traceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.spanID[:]),
+		Flags:             uint32(s.ctx.flags),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attrs),
+		Status:            otlpStatus{Code: s.status, Message: s.statusMessage},
+	}
+	if s.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if span.Status.Code == spanStatusUnset && span.Status.Message == "" && s.kind == SpanKindServer {
+		span.Status.Code = spanStatusOK
+	}
+	for _, event := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(event.time.UnixNano(), 10),
+			Name:         event.name,
+			Attributes:   otlpAttributes(event.attrs),
+		})
+	}
+	return span
+}
+
+func otlpAttributes(attrs []spanAttr) []otlpKeyValue {
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var value otlpAnyValue
+		switch v := attr.value.(type) {
+		case string:
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case time.Duration:
+			s := strconv.FormatInt(v.Milliseconds(), 10)
+			value.IntValue = &s
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpKeyValue{Key: attr.key, Value: value})
+	}
+	return encoded
+}
+
+// otlpHTTPExporter posts spans to an OTLP/HTTP collector using the JSON
+// encoding.
+type otlpHTTPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpHTTPExporter) export(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			Warn("Error closing response body", "error", err)
+		}
+	}()
+	if resp.StatusCode >= statusClientError {
+		return NewNetworkError("export_spans", e.endpoint, fmt.Sprintf("HTTP %d response", resp.StatusCode), nil)
+	}
+	return nil
+}
+
+func (e *otlpHTTPExporter) close() error { return nil }
+
+// fileSpanExporter appends one OTLP JSON request per line, the format of the
+// OpenTelemetry Collector's file exporter.
+type fileSpanExporter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func (e *fileSpanExporter) export(_ context.Context, payload []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.file.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *fileSpanExporter) close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.file.Close()
+}
+
+func (c *Config) validateTracing() error {
+	switch c.Tracing.Exporter {
+	case "", TraceExporterOTLP, TraceExporterFile:
+	default:
+		return NewValidationError("tracing.exporter", c.Tracing.Exporter, "must be otlp or file", nil)
+	}
+	if c.Tracing.Endpoint != "" && !isUpstreamURL(c.Tracing.Endpoint) {
+		return NewValidationError("tracing.endpoint", c.Tracing.Endpoint, "must be an http or https URL", nil)
+	}
+	return nil
+}
+
+// tracedBody counts the bytes of a streamed upstream body and records when
+// the first one arrives.
+type tracedBody struct {
+	io.ReadCloser
+	span  *Span
+	bytes int64
+}
+
+// traceStreamBody wraps resp.Body to report on span. It leaves the body
+// untouched while tracing is disabled.
+func traceStreamBody(resp *http.Response, span *Span) *tracedBody {
+	if span == nil {
+		return &tracedBody{}
+	}
+	body := &tracedBody{ReadCloser: resp.Body, span: span}
+	resp.Body = body
+	return body
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if b.bytes == 0 {
+			b.span.AddEvent("first_byte")
+		}
+		b.bytes += int64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"future version with extra field", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"version 00 with extra field", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := parseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%v for %q", tt.ok, tt.value)
+			}
+			if ok && tt.value[:2] == traceparentVersion && sc.traceparent() != tt.value {
+				t.Errorf("round trip changed %q to %q", tt.value, sc.traceparent())
+			}
+		})
+	}
+}
+
+// readTraceFile decodes the spans of an OTLP JSON lines file by name.
+func readTraceFile(t *testing.T, path string) map[string]otlpSpan {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open traces: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	spans := make(map[string]otlpSpan)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var request otlpTraceRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatalf("invalid OTLP line %s: %v", scanner.Text(), err)
+		}
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func TestTracing_ProxyRequestSpans(t *testing.T) {
+	var upstreamTraceparent string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	})
+
+	cfg := &Config{}
+	cfg.Tracing.Exporter = TraceExporterFile
+	cfg.Tracing.File = filepath.Join(t.TempDir(), "traces.jsonl")
+	tracer, err := NewTracer(cfg)
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	SetTracer(tracer)
+	t.Cleanup(func() { _ = tracer.Shutdown() })
+
+	clientTrace := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set(traceparentHeader, clientTrace)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	spans := readTraceFile(t, cfg.Tracing.File)
+	root, ok := spans["POST /v1/chat/completions"]
+	if !ok {
+		t.Fatalf("missing server span, got %v", spans)
+	}
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentSpanID != "00f067aa0ba902b7" || root.Kind != SpanKindServer {
+		t.Errorf("server span does not continue the client trace: %+v", root)
+	}
+
+	parents := map[string]string{
+		"worker_pool.wait":        "POST /v1/chat/completions",
+		"proxy.process":           "POST /v1/chat/completions",
+		"auth.ensure_valid_token": "proxy.process",
+		"token_store.get":         "auth.ensure_valid_token",
+		"upstream.request":        "proxy.process",
+		"upstream.attempt":        "upstream.request",
+		"proxy.stream":            "proxy.process",
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("missing span %s", name)
+			continue
+		}
+		if span.TraceID != root.TraceID || span.ParentSpanID != spans[parent].SpanID {
+			t.Errorf("span %s is not a child of %s", name, parent)
+		}
+	}
+
+	attempt := spans["upstream.attempt"]
+	if want := "00-" + root.TraceID + "-" + attempt.SpanID + "-01"; upstreamTraceparent != want {
+		t.Errorf("expected upstream traceparent %s, got %s", want, upstreamTraceparent)
+	}
+	if events := spans["proxy.stream"].Events; len(events) != 1 || events[0].Name != "first_byte" {
+		t.Errorf("expected a first_byte event on the stream span, got %+v", events)
+	}
+}
+
+func TestTracing_DisabledPassesTraceparentThrough(t *testing.T) {
+	SetTracer(nil)
+	var upstreamTraceparent string
+	s := newUpstreamTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"c1","choices":[]}`)
+	})
+
+	clientTrace := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set(traceparentHeader, clientTrace)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	if upstreamTraceparent != clientTrace {
+		t.Errorf("expected the client traceparent upstream, got %q", upstreamTraceparent)
+	}
+}
+
+func TestTracing_OTLPExporter(t *testing.T) {
+	received := make(chan otlpTraceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var request otlpTraceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid OTLP body: %v", err)
+		}
+		received <- request
+	}))
+	defer collector.Close()
+
+	cfg := &Config{}
+	cfg.Tracing.Exporter = TraceExporterOTLP
+	cfg.Tracing.Endpoint = collector.URL + "/v1/traces"
+	cfg.Tracing.ServiceName = "copilot-test"
+	tracer, err := NewTracer(cfg)
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	SetTracer(tracer)
+
+	_, span := startSpan(t.Context(), "test.span", SpanKindInternal, "count", 3, "ok", true)
+	span.End()
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	request := <-received
+	resource := request.ResourceSpans[0]
+	if name := resource.Resource.Attributes[0]; name.Key != "service.name" || *name.Value.StringValue != "copilot-test" {
+		t.Errorf("unexpected resource %+v", resource.Resource)
+	}
+	exported := resource.ScopeSpans[0].Spans[0]
+	if exported.Name != "test.span" || len(exported.TraceID) != 32 || len(exported.SpanID) != 16 || exported.ParentSpanID != "" {
+		t.Errorf("unexpected span %+v", exported)
+	}
+	if attr := exported.Attributes[0]; attr.Key != "count" || *attr.Value.IntValue != "3" {
+		t.Errorf("unexpected attribute %+v", attr)
+	}
+	if currentTracer() != nil {
+		t.Error("expected Shutdown to uninstall the tracer")
+	}
+}
@@ -0,0 +1,79 @@
+// Package internal provides upstream endpoint resolution for github-copilot-svcs.
+package internal
+
+import (
+	"net/url"
+	"strings"
+)
+
+// defaultModelsDevURL is the models.dev catalog used as a model list fallback.
+const defaultModelsDevURL = "https://models.dev/api.json"
+
+// deviceCodeEndpoint returns the GitHub device code URL.
+func (c *Config) deviceCodeEndpoint() string {
+	return upstreamOverride(c.Upstream.DeviceCodeURL, copilotDeviceCodeURL)
+}
+
+// accessTokenEndpoint returns the GitHub OAuth access token URL.
+func (c *Config) accessTokenEndpoint() string {
+	return upstreamOverride(c.Upstream.AccessTokenURL, copilotTokenURL)
+}
+
+// copilotTokenEndpoint returns the URL that exchanges a GitHub token for a Copilot token.
+func (c *Config) copilotTokenEndpoint() string {
+	return upstreamOverride(c.Upstream.CopilotTokenURL, copilotAPIKeyURL)
+}
+
+// modelsDevEndpoint returns the models.dev catalog URL.
+func (c *Config) modelsDevEndpoint() string {
+	return upstreamOverride(c.Upstream.ModelsDevURL, defaultModelsDevURL)
+}
+
+// apiBase returns the Copilot API base URL for requests made with c's token.
+// A configured override wins; otherwise the endpoints.api value issued with
+// the token is used, so business and enterprise seats reach their own host.
+func (c *Config) apiBase() string {
+	if c.Upstream.CopilotAPI != "" {
+		return strings.TrimRight(c.Upstream.CopilotAPI, "/")
+	}
+	if endpoint := c.CopilotAPIEndpoint; endpoint != "" {
+		if u, err := url.Parse(endpoint); err == nil && u.Scheme == "https" && u.Host != "" {
+			return strings.TrimRight(endpoint, "/")
+		}
+		Warn("Ignoring invalid Copilot API endpoint from token", "endpoint", endpoint)
+	}
+	return copilotAPIBase
+}
+
+// upstreamOverride returns override when it is set and fallback otherwise.
+func upstreamOverride(override, fallback string) string {
+	if override != "" {
+		return override
+	}
+	return fallback
+}
+
+// isUpstreamURL reports whether raw is an absolute http or https URL.
+func isUpstreamURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (c *Config) validateUpstream() error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"upstream.copilot_api", c.Upstream.CopilotAPI},
+		{"upstream.device_code_url", c.Upstream.DeviceCodeURL},
+		{"upstream.access_token_url", c.Upstream.AccessTokenURL},
+		{"upstream.copilot_token_url", c.Upstream.CopilotTokenURL},
+		{"upstream.models_dev_url", c.Upstream.ModelsDevURL},
+	}
+	for _, field := range fields {
+		if field.value != "" && !isUpstreamURL(field.value) {
+			return NewValidationError(field.name, field.value, "must be an absolute http or https URL", nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigAPIBase(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		endpoint string
+		want     string
+	}{
+		{"default", "", "", copilotAPIBase},
+		{"token endpoint", "", "https://api.business.githubcopilot.com/", "https://api.business.githubcopilot.com"},
+		{"insecure token endpoint ignored", "", "http://api.example.com", copilotAPIBase},
+		{"override wins", "http://127.0.0.1:9000/", "https://api.business.githubcopilot.com", "http://127.0.0.1:9000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{CopilotAPIEndpoint: tt.endpoint}
+			cfg.Upstream.CopilotAPI = tt.override
+			if got := cfg.apiBase(); got != tt.want {
+				t.Errorf("apiBase() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUpstream(t *testing.T) {
+	cfg := &Config{}
+	cfg.Upstream.DeviceCodeURL = "http://localhost:8081/login/device/code"
+	if err := cfg.validateUpstream(); err != nil {
+		t.Errorf("expected local stub URL to be accepted, got %v", err)
+	}
+	cfg.Upstream.CopilotTokenURL = "localhost:8081/token"
+	if err := cfg.validateUpstream(); err == nil || !strings.Contains(err.Error(), "upstream.copilot_token_url") {
+		t.Errorf("expected validation error for copilot_token_url, got %v", err)
+	}
+}
+
+func TestRefreshToken_StoresAPIEndpoint(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token gh-test-token" {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"token":      "copilot-new",
+			"expires_at": time.Now().Add(time.Hour).Unix(),
+			"refresh_in": 1500,
+			"endpoints":  map[string]string{"api": "https://api.business.githubcopilot.com"},
+		})
+	}))
+	defer stub.Close()
+
+	store := NewMemoryTokenStore()
+	auth := NewAuthService(stub.Client(), WithTokenStore(store))
+	cfg := &Config{GitHubToken: "gh-test-token"}
+	cfg.Upstream.CopilotTokenURL = stub.URL + "/copilot_internal/v2/token"
+
+	if err := auth.RefreshToken("user@example.com", cfg); err != nil {
+		t.Fatalf("RefreshToken failed: %v", err)
+	}
+	token, err := store.Get(context.Background(), "user@example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if token.CopilotToken != "copilot-new" || token.APIEndpoint != "https://api.business.githubcopilot.com" {
+		t.Errorf("unexpected stored token %+v", token)
+	}
+}
+
+func TestForwardRequest_UsesTokenAPIEndpoint(t *testing.T) {
+	var gotPath string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[]}`))
+	}))
+	defer upstream.Close()
+
+	store := NewMemoryTokenStore()
+	if err := store.Put(context.Background(), &StoredToken{
+		Email:        "user@example.com",
+		GitHubToken:  "gh",
+		CopilotToken: "copilot-test-token",
+		ExpiresAt:    time.Now().Add(time.Hour).Unix(),
+		APIEndpoint:  upstream.URL,
+	}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	cfg := &Config{}
+	SetDefaultTimeouts(cfg)
+	wp := NewWorkerPool(1)
+	defer wp.Stop()
+	s := NewProxyService(cfg, upstream.Client(), NewAuthService(upstream.Client(), WithTokenStore(store)), wp)
+
+	resp, _, err := s.forwardRequest(context.Background(), http.MethodPost, "user@example.com", "/chat/completions",
+		map[string]any{"model": "gpt-4o"}, nil)
+	if err != nil {
+		t.Fatalf("forwardRequest failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || gotPath != "/chat/completions" {
+		t.Errorf("expected request at the token's endpoint, got status %d path %q", resp.StatusCode, gotPath)
+	}
+}
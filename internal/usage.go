@@ -0,0 +1,468 @@
+// Package internal provides token usage accounting for github-copilot-svcs.
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usageLedgerFileName = "usage.jsonl"
+
+	// maxUsageCaptureBytes bounds how much of a response body or a single SSE
+	// line is buffered while looking for its usage block.
+	maxUsageCaptureBytes = 8 << 20
+
+	// Usage summary grouping fields
+	UsageGroupEmail    = "email"
+	UsageGroupModel    = "model"
+	UsageGroupEndpoint = "endpoint"
+	UsageGroupDay      = "day"
+)
+
+// TokenUsage holds the token counts reported by the upstream for one request.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	CachedTokens     int `json:"cached_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *TokenUsage) add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.CachedTokens += other.CachedTokens
+	u.TotalTokens += other.TotalTokens
+}
+
+// parseUsage reads a usage object in either the Chat Completions shape
+// (prompt_tokens/completion_tokens) or the Responses shape (input_tokens/output_tokens).
+func parseUsage(raw any) (TokenUsage, bool) {
+	obj, ok := raw.(map[string]any)
+	if !ok {
+		return TokenUsage{}, false
+	}
+
+	var usage TokenUsage
+	found := false
+	read := func(target *int, keys ...string) {
+		for _, key := range keys {
+			if value, ok := getIntFromInterface(obj[key]); ok {
+				*target = value
+				found = true
+				return
+			}
+		}
+	}
+	read(&usage.PromptTokens, "prompt_tokens", "input_tokens")
+	read(&usage.CompletionTokens, "completion_tokens", "output_tokens")
+	read(&usage.TotalTokens, "total_tokens")
+
+	for _, key := range []string{"prompt_tokens_details", "input_tokens_details"} {
+		if details, ok := obj[key].(map[string]any); ok {
+			if cached, ok := getIntFromInterface(details["cached_tokens"]); ok {
+				usage.CachedTokens = cached
+			}
+		}
+	}
+
+	if found && usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage, found
+}
+
+// usageFromJSON extracts usage from a response body or stream event. Responses
+// API events carry it under response.usage.
+func usageFromJSON(data []byte) (TokenUsage, bool) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return TokenUsage{}, false
+	}
+	if usage, ok := parseUsage(doc["usage"]); ok {
+		return usage, true
+	}
+	if response, ok := doc["response"].(map[string]any); ok {
+		return parseUsage(response["usage"])
+	}
+	return TokenUsage{}, false
+}
+
+// usageMeter observes response bytes as they are copied to the client and
+// picks out the usage block: the whole body for JSON responses, the last
+// data line carrying usage for event streams.
+type usageMeter struct {
+	streaming bool
+	buf       bytes.Buffer
+	overflow  bool
+	usage     TokenUsage
+	found     bool
+}
+
+func newUsageMeter(streaming bool) *usageMeter {
+	return &usageMeter{streaming: streaming}
+}
+
+func (m *usageMeter) Write(p []byte) (int, error) {
+	if !m.streaming {
+		if !m.overflow {
+			if m.buf.Len()+len(p) > maxUsageCaptureBytes {
+				m.overflow = true
+				m.buf.Reset()
+			} else {
+				m.buf.Write(p)
+			}
+		}
+		return len(p), nil
+	}
+
+	for rest := p; len(rest) > 0; {
+		line, tail, complete := bytes.Cut(rest, []byte("\n"))
+		rest = tail
+		if !m.overflow {
+			if m.buf.Len()+len(line) > maxUsageCaptureBytes {
+				m.overflow = true
+				m.buf.Reset()
+			} else {
+				m.buf.Write(line)
+			}
+		}
+		if !complete {
+			break
+		}
+		m.scanLine()
+	}
+	return len(p), nil
+}
+
+func (m *usageMeter) scanLine() {
+	line := bytes.TrimRight(m.buf.Bytes(), "\r")
+	if !m.overflow {
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok && bytes.Contains(data, []byte(`"usage"`)) {
+			if usage, ok := usageFromJSON(bytes.TrimSpace(data)); ok {
+				m.usage, m.found = usage, true
+			}
+		}
+	}
+	m.buf.Reset()
+	m.overflow = false
+}
+
+// Usage returns the usage seen so far and whether any was found.
+func (m *usageMeter) Usage() (TokenUsage, bool) {
+	if m.streaming {
+		if m.buf.Len() > 0 {
+			m.scanLine()
+		}
+		return m.usage, m.found
+	}
+	if m.overflow {
+		return TokenUsage{}, false
+	}
+	return usageFromJSON(m.buf.Bytes())
+}
+
+// meterResponseBody tees the upstream response body through a usage meter
+// and, for audited requests, a completion capture.
+func meterResponseBody(resp *http.Response, streaming bool) *usageMeter {
+	meter := newUsageMeter(streaming)
+	var sink io.Writer = meter
+	if completion := requestInfoFromContext(responseContext(resp)).captureCompletion(meter); completion != nil {
+		sink = io.MultiWriter(meter, completion)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, sink), resp.Body}
+	return meter
+}
+
+// UsageRecord is one entry in the usage ledger.
+type UsageRecord struct {
+	Time      time.Time `json:"time"`
+	Email     string    `json:"email"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model"`
+	Streaming bool      `json:"streaming"`
+	Reported  bool      `json:"reported"` // false when upstream sent no usage block
+	TokenUsage
+}
+
+// UsageFilter selects ledger records. Empty fields match everything.
+type UsageFilter struct {
+	Email string
+	Model string
+	Since time.Time
+	Until time.Time
+}
+
+func (f UsageFilter) matches(rec *UsageRecord) bool {
+	if f.Email != "" && !strings.EqualFold(f.Email, rec.Email) {
+		return false
+	}
+	if f.Model != "" && f.Model != rec.Model {
+		return false
+	}
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// UsageSummary aggregates records sharing the same group-by values.
+type UsageSummary struct {
+	Email    string `json:"email,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Day      string `json:"day,omitempty"`
+	Requests int    `json:"requests"`
+	TokenUsage
+}
+
+// UsageLedger is an append-only JSON Lines file of per-request token usage.
+type UsageLedger struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewUsageLedger creates a ledger backed by the file at path.
+func NewUsageLedger(path string) *UsageLedger {
+	return &UsageLedger{path: path}
+}
+
+// DefaultUsageLedgerPath returns the configured ledger file, or the default next to config.json.
+func DefaultUsageLedgerPath(cfg *Config) string {
+	if cfg != nil && cfg.Usage.File != "" {
+		return cfg.Usage.File
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return usageLedgerFileName
+	}
+	return filepath.Join(filepath.Dir(configPath), usageLedgerFileName)
+}
+
+// Append writes rec to the end of the ledger.
+func (l *UsageLedger) Append(rec UsageRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, tokenFilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Records returns the ledger entries matching filter in file order. Lines
+// that cannot be decoded are skipped.
+func (l *UsageLedger) Records(filter UsageFilter) ([]UsageRecord, error) {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	skipped := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec UsageRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			skipped++
+			continue
+		}
+		if filter.matches(&rec) {
+			records = append(records, rec)
+		}
+	}
+	if skipped > 0 {
+		Warn("Skipped malformed usage ledger lines", "path", l.path, "count", skipped)
+	}
+	return records, scanner.Err()
+}
+
+// SummarizeUsage aggregates records by the given fields (email, model,
+// endpoint, day). The result is sorted by total tokens, largest first.
+func SummarizeUsage(records []UsageRecord, groupBy []string) ([]UsageSummary, error) {
+	for _, field := range groupBy {
+		switch field {
+		case UsageGroupEmail, UsageGroupModel, UsageGroupEndpoint, UsageGroupDay:
+		default:
+			return nil, fmt.Errorf("invalid group_by field %q: must be email, model, endpoint or day", field)
+		}
+	}
+
+	index := make(map[UsageSummary]*UsageSummary)
+	var summaries []*UsageSummary
+	for _, rec := range records {
+		var key UsageSummary
+		for _, field := range groupBy {
+			switch field {
+			case UsageGroupEmail:
+				key.Email = rec.Email
+			case UsageGroupModel:
+				key.Model = rec.Model
+			case UsageGroupEndpoint:
+				key.Endpoint = rec.Endpoint
+			case UsageGroupDay:
+				key.Day = rec.Time.UTC().Format("2006-01-02")
+			}
+		}
+		summary, ok := index[key]
+		if !ok {
+			summary = &UsageSummary{Email: key.Email, Model: key.Model, Endpoint: key.Endpoint, Day: key.Day}
+			index[key] = summary
+			summaries = append(summaries, summary)
+		}
+		summary.Requests++
+		summary.add(rec.TokenUsage)
+	}
+
+	result := make([]UsageSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, *summary)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].TotalTokens > result[j].TotalTokens
+	})
+	return result, nil
+}
+
+// recordUsage appends the metered usage of a completed proxy request to the ledger.
+func (s *ProxyService) recordUsage(endpoint, model string, identity *requestIdentity, meter *usageMeter, streaming bool) {
+	if meter == nil {
+		return
+	}
+	usage, reported := meter.Usage()
+	s.appendUsage(endpoint, model, identity, usage, reported, streaming)
+}
+
+// appendUsage writes one request's token usage to the ledger, if enabled.
+func (s *ProxyService) appendUsage(endpoint, model string, identity *requestIdentity, usage TokenUsage, reported, streaming bool) {
+	if s.usage == nil {
+		return
+	}
+	rec := UsageRecord{
+		Time:       time.Now().UTC(),
+		Email:      identity.Email,
+		Endpoint:   endpoint,
+		Model:      model,
+		Streaming:  streaming,
+		Reported:   reported,
+		TokenUsage: usage,
+	}
+	if identity.Key != nil {
+		rec.KeyID = identity.Key.ID
+	}
+	if err := s.usage.Append(rec); err != nil {
+		Warn("Failed to record token usage", "error", err)
+	}
+}
+
+// UsageHandler serves usage summaries from the ledger. Query parameters:
+// email, model, since and until (RFC 3339 or a duration back from now, e.g.
+// 24h) and group_by (comma-separated, default "email,model").
+func UsageHandler(ledger *UsageLedger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteHTTPError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		filter := UsageFilter{Email: query.Get("email"), Model: query.Get("model")}
+		var err error
+		now := time.Now()
+		if filter.Since, err = parseUsageTime(query.Get("since"), now); err != nil {
+			WriteValidationError(w, "invalid since: "+err.Error())
+			return
+		}
+		if filter.Until, err = parseUsageTime(query.Get("until"), now); err != nil {
+			WriteValidationError(w, "invalid until: "+err.Error())
+			return
+		}
+		groupBy := []string{UsageGroupEmail, UsageGroupModel}
+		if value := query.Get("group_by"); value != "" {
+			groupBy = splitList(value)
+		}
+
+		records, err := ledger.Records(filter)
+		if err != nil {
+			Error("Failed to read usage ledger", "error", err)
+			WriteInternalError(w)
+			return
+		}
+		summaries, err := SummarizeUsage(records, groupBy)
+		if err != nil {
+			WriteValidationError(w, err.Error())
+			return
+		}
+		var total UsageSummary
+		for _, summary := range summaries {
+			total.Requests += summary.Requests
+			total.add(summary.TokenUsage)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"group_by": groupBy,
+			"usage":    summaries,
+			"total":    total,
+		})
+	}
+}
+
+// parseUsageTime parses an RFC 3339 time, a YYYY-MM-DD date or a duration
+// before now. An empty value yields the zero time.
+func parseUsageTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time, date or duration", value)
+}
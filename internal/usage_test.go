@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageMeter_JSON(t *testing.T) {
+	meter := newUsageMeter(false)
+	body := `{"id":"chatcmpl-1","usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17,"prompt_tokens_details":{"cached_tokens":8}}}`
+	_, _ = io.Copy(meter, strings.NewReader(body))
+
+	usage, ok := meter.Usage()
+	want := TokenUsage{PromptTokens: 12, CompletionTokens: 5, CachedTokens: 8, TotalTokens: 17}
+	if !ok || usage != want {
+		t.Errorf("Usage() = %+v, %v; want %+v", usage, ok, want)
+	}
+}
+
+func TestUsageMeter_ChatStream(t *testing.T) {
+	meter := newUsageMeter(true)
+	stream := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n" +
+		"data: [DONE]\n\n"
+
+	// Feed the stream in small pieces so lines span writes.
+	for i := 0; i < len(stream); i += 7 {
+		_, _ = meter.Write([]byte(stream[i:min(i+7, len(stream))]))
+	}
+
+	usage, ok := meter.Usage()
+	if !ok || usage.PromptTokens != 3 || usage.CompletionTokens != 2 || usage.TotalTokens != 5 {
+		t.Errorf("unexpected usage %+v, %v", usage, ok)
+	}
+}
+
+func TestUsageMeter_ResponsesCompleted(t *testing.T) {
+	meter := newUsageMeter(true)
+	stream := "event: response.created\ndata: {\"type\":\"response.created\",\"response\":{\"usage\":null}}\n\n" +
+		"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":40,\"output_tokens\":9,\"input_tokens_details\":{\"cached_tokens\":32}}}}"
+	_, _ = meter.Write([]byte(stream))
+
+	usage, ok := meter.Usage()
+	want := TokenUsage{PromptTokens: 40, CompletionTokens: 9, CachedTokens: 32, TotalTokens: 49}
+	if !ok || usage != want {
+		t.Errorf("Usage() = %+v, %v; want %+v", usage, ok, want)
+	}
+}
+
+func TestUsageLedger_AppendAndSummarize(t *testing.T) {
+	ledger := NewUsageLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	day := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	records := []UsageRecord{
+		{Time: day, Email: "a@example.com", Model: "gpt-4o", Endpoint: "/v1/chat/completions", TokenUsage: TokenUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}},
+		{Time: day.Add(time.Hour), Email: "a@example.com", Model: "gpt-4o", Endpoint: "/v1/responses", TokenUsage: TokenUsage{PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30}},
+		{Time: day.Add(48 * time.Hour), Email: "b@example.com", Model: "claude-sonnet-4", Endpoint: "/v1/messages", TokenUsage: TokenUsage{PromptTokens: 100, CompletionTokens: 1, TotalTokens: 101}},
+	}
+	for _, rec := range records {
+		if err := ledger.Append(rec); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	got, err := ledger.Records(UsageFilter{Email: "A@example.com"})
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected 2 records for a@example.com, got %d (%v)", len(got), err)
+	}
+	got, _ = ledger.Records(UsageFilter{Since: day.Add(24 * time.Hour)})
+	if len(got) != 1 || got[0].Email != "b@example.com" {
+		t.Errorf("expected only the later record, got %+v", got)
+	}
+
+	all, _ := ledger.Records(UsageFilter{})
+	summaries, err := SummarizeUsage(all, []string{UsageGroupEmail, UsageGroupModel})
+	if err != nil {
+		t.Fatalf("SummarizeUsage failed: %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].Email != "b@example.com" {
+		t.Fatalf("expected two groups sorted by total tokens, got %+v", summaries)
+	}
+	if summaries[1].Requests != 2 || summaries[1].TotalTokens != 45 {
+		t.Errorf("unexpected aggregate %+v", summaries[1])
+	}
+
+	if _, err := SummarizeUsage(all, []string{"colour"}); err == nil {
+		t.Error("expected an error for an unknown group_by field")
+	}
+}
+
+func TestProxyService_RecordsUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\n")
+		_, _ = io.WriteString(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":1,\"total_tokens\":8}}\n\n")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	ledger := NewUsageLedger(filepath.Join(t.TempDir(), "usage.jsonl"))
+	s := &ProxyService{usage: ledger}
+	resp, err := http.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	meter := meterResponseBody(resp, true)
+	rr := httptest.NewRecorder()
+	if err := s.handleStreamingResponse(rr, resp); err != nil {
+		t.Fatalf("streaming failed: %v", err)
+	}
+	if !strings.Contains(rr.Body.String(), "[DONE]") {
+		t.Error("expected the stream to reach the client unchanged")
+	}
+	s.recordUsage("/v1/chat/completions", "gpt-4o", &requestIdentity{Email: "a@example.com"}, meter, true)
+
+	records, _ := ledger.Records(UsageFilter{})
+	if len(records) != 1 || !records[0].Reported || records[0].TotalTokens != 8 || !records[0].Streaming {
+		t.Fatalf("unexpected ledger contents %+v", records)
+	}
+
+	// The admin endpoint summarizes the same ledger.
+	rr = httptest.NewRecorder()
+	UsageHandler(ledger)(rr, httptest.NewRequest(http.MethodGet, "/admin/usage?group_by=model", nil))
+	var body struct {
+		Usage []UsageSummary `json:"usage"`
+		Total UsageSummary   `json:"total"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid response %q: %v", rr.Body.String(), err)
+	}
+	if len(body.Usage) != 1 || body.Usage[0].Model != "gpt-4o" || body.Total.TotalTokens != 8 {
+		t.Errorf("unexpected summary %+v", body)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	cfg := &Config{}
+
+	local := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	local.RemoteAddr = "127.0.0.1:5000"
+	remote := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	remote.RemoteAddr = "203.0.113.5:5000"
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		req   *http.Request
+		auth  string
+		want  int
+	}{
+		{"loopback without token", "", local, "", http.StatusNoContent},
+		{"remote without token", "", remote, "", http.StatusForbidden},
+		{"remote with token", "s3cret", remote, "Bearer s3cret", http.StatusNoContent},
+		{"loopback with wrong token", "s3cret", local, "Bearer nope", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.Admin.Token = tc.token
+			req := tc.req.Clone(tc.req.Context())
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rr := httptest.NewRecorder()
+			requireAdmin(NewConfigStore(cfg, ""), handler)(rr, req)
+			if rr.Code != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Package internal provides upstream record/replay (VCR) for github-copilot-svcs.
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VCR modes.
+const (
+	VCRRecord = "record"
+	VCRReplay = "replay"
+)
+
+// vcrRedacted replaces secrets in recorded exchanges.
+const vcrRedacted = "[redacted]"
+
+// Cassette holds recorded upstream exchanges.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded upstream request and its response.
+type Interaction struct {
+	Request    RecordedRequest  `json:"request"`
+	Response   RecordedResponse `json:"response"`
+	RecordedAt time.Time        `json:"recorded_at"`
+}
+
+// RecordedRequest is an upstream request with its secrets redacted.
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// RecordedResponse is an upstream response. The body is kept as the chunks
+// it arrived in, so streaming responses replay with their original timing.
+type RecordedResponse struct {
+	Status int             `json:"status"`
+	Header http.Header     `json:"header,omitempty"`
+	Chunks []RecordedChunk `json:"chunks"`
+}
+
+// RecordedChunk is a piece of a response body and how long after the
+// previous chunk, or the response headers, it arrived.
+type RecordedChunk struct {
+	DelayMS int64  `json:"delay_ms"`
+	Data    string `json:"data"`
+}
+
+// LoadCassette reads the cassette at path.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+// VCR records upstream exchanges into a cassette file or serves them back
+// from it instead of calling the upstream.
+type VCR struct {
+	mode         string
+	path         string
+	ignoreTiming bool
+	next         http.RoundTripper
+
+	mutex    sync.Mutex
+	cassette *Cassette
+	loadErr  error
+	used     []bool
+}
+
+// NewVCR creates a VCR in mode (VCRRecord or VCRReplay) for the cassette at
+// path. Recording starts a new cassette; replaying loads it on first use.
+func NewVCR(mode, path string, opts ...func(*VCR)) *VCR {
+	v := &VCR{mode: mode, path: path}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if mode == VCRRecord {
+		v.cassette = &Cassette{}
+	}
+	return v
+}
+
+// WithoutVCRTiming replays response chunks without their recorded delays.
+func WithoutVCRTiming() func(*VCR) {
+	return func(v *VCR) {
+		v.ignoreTiming = true
+	}
+}
+
+// newVCRFromConfig returns the VCR configured in cfg, or nil.
+func newVCRFromConfig(cfg *Config) *VCR {
+	if cfg.VCR.Mode == "" {
+		return nil
+	}
+	var opts []func(*VCR)
+	if cfg.VCR.IgnoreTiming {
+		opts = append(opts, WithoutVCRTiming())
+	}
+	Warn("Upstream VCR enabled", "mode", cfg.VCR.Mode, "cassette", cfg.VCR.Cassette)
+	return NewVCR(cfg.VCR.Mode, cfg.VCR.Cassette, opts...)
+}
+
+func (c *Config) validateVCR() error {
+	switch c.VCR.Mode {
+	case "":
+		return nil
+	case VCRRecord, VCRReplay:
+	default:
+		return NewValidationError("vcr.mode", c.VCR.Mode, "must be one of record, replay", nil)
+	}
+	if c.VCR.Cassette == "" {
+		return NewValidationError("vcr.cassette", "", "cassette path is required when vcr.mode is set", nil)
+	}
+	return nil
+}
+
+// WithVCR sends the proxy's upstream requests through v.
+func WithVCR(v *VCR) func(*ProxyService) {
+	return func(s *ProxyService) {
+		s.httpClient = v.Wrap(s.httpClient)
+	}
+}
+
+// Wrap returns a copy of client whose requests go through the VCR.
+func (v *VCR) Wrap(client *http.Client) *http.Client {
+	wrapped := *client
+	v.next = client.Transport
+	if v.next == nil {
+		v.next = http.DefaultTransport
+	}
+	wrapped.Transport = v
+	return &wrapped
+}
+
+// RoundTrip records or replays req depending on the VCR mode.
+func (v *VCR) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	recorded := RecordedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: redactVCRHeader(req.Header),
+		Body:   redactVCRBody(string(body)),
+	}
+	if v.mode == VCRReplay {
+		return v.replay(req, recorded)
+	}
+	return v.record(req, recorded)
+}
+
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (v *VCR) record(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	resp, err := v.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := &Interaction{
+		Request: recorded,
+		Response: RecordedResponse{
+			Status: resp.StatusCode,
+			Header: redactVCRHeader(resp.Header),
+		},
+		RecordedAt: time.Now().UTC(),
+	}
+	resp.Body = &vcrRecordingBody{vcr: v, body: resp.Body, interaction: interaction, last: time.Now()}
+	return resp, nil
+}
+
+// save appends interaction to the cassette and writes it to disk.
+func (v *VCR) save(interaction *Interaction) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.cassette.Interactions = append(v.cassette.Interactions, *interaction)
+	data, err := json.MarshalIndent(v.cassette, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(v.path, data, tokenFilePerm)
+	}
+	if err != nil {
+		Error("Failed to write VCR cassette", "cassette", v.path, "error", err)
+		return
+	}
+	Debug("Recorded upstream interaction", "cassette", v.path, "url", interaction.Request.URL, "status", interaction.Response.Status)
+}
+
+// vcrRecordingBody captures each chunk read from an upstream body and saves
+// the interaction once the body is exhausted or closed.
+type vcrRecordingBody struct {
+	vcr         *VCR
+	body        io.ReadCloser
+	interaction *Interaction
+	last        time.Time
+	once        sync.Once
+}
+
+func (b *vcrRecordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		now := time.Now()
+		b.interaction.Response.Chunks = append(b.interaction.Response.Chunks, RecordedChunk{
+			DelayMS: now.Sub(b.last).Milliseconds(),
+			Data:    redactVCRBody(string(p[:n])),
+		})
+		b.last = now
+	}
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *vcrRecordingBody) Close() error {
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *vcrRecordingBody) finish() {
+	b.once.Do(func() { b.vcr.save(b.interaction) })
+}
+
+func (v *VCR) replay(req *http.Request, recorded RecordedRequest) (*http.Response, error) {
+	interaction, err := v.match(recorded)
+	if err != nil {
+		return nil, err
+	}
+	header := interaction.Response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Content-Length")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Response.Status, http.StatusText(interaction.Response.Status)),
+		StatusCode:    interaction.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &vcrReplayBody{req: req, chunks: interaction.Response.Chunks, ignoreTiming: v.ignoreTiming},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// match returns the first unused interaction for the same method, path and
+// body, falling back to one with a different body and then to reusing the
+// last matching interaction.
+func (v *VCR) match(recorded RecordedRequest) (*Interaction, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.cassette == nil && v.loadErr == nil {
+		v.cassette, v.loadErr = LoadCassette(v.path)
+		if v.loadErr == nil {
+			v.used = make([]bool, len(v.cassette.Interactions))
+		}
+	}
+	if v.loadErr != nil {
+		return nil, fmt.Errorf("vcr: cassette unavailable: %w", v.loadErr)
+	}
+
+	path := requestPath(recorded.URL)
+	body := canonicalJSON(recorded.Body)
+	sameBody, samePath, reuse := -1, -1, -1
+	for i, interaction := range v.cassette.Interactions {
+		if interaction.Request.Method != recorded.Method || requestPath(interaction.Request.URL) != path {
+			continue
+		}
+		bodyMatches := canonicalJSON(interaction.Request.Body) == body
+		if bodyMatches {
+			reuse = i
+		}
+		if v.used[i] {
+			continue
+		}
+		if bodyMatches {
+			sameBody = i
+			break
+		}
+		if samePath < 0 {
+			samePath = i
+		}
+	}
+	for _, i := range []int{sameBody, samePath, reuse} {
+		if i >= 0 {
+			v.used[i] = true
+			return &v.cassette.Interactions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("vcr: no recorded interaction for %s %s in %s", recorded.Method, path, v.path)
+}
+
+func requestPath(rawURL string) string {
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		rawURL = rawURL[i+len("://"):]
+		if j := strings.IndexByte(rawURL, '/'); j >= 0 {
+			return rawURL[j:]
+		}
+		return "/"
+	}
+	return rawURL
+}
+
+// canonicalJSON re-encodes a JSON body so key order and whitespace do not
+// affect matching. Other bodies are returned unchanged.
+func canonicalJSON(body string) string {
+	var parsed any
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return body
+	}
+	encoded, err := json.Marshal(parsed)
+	if err != nil {
+		return body
+	}
+	return string(encoded)
+}
+
+// vcrReplayBody returns recorded chunks, waiting for each one's delay.
+type vcrReplayBody struct {
+	req          *http.Request
+	chunks       []RecordedChunk
+	pending      []byte
+	ignoreTiming bool
+}
+
+func (b *vcrReplayBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if len(b.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if !b.ignoreTiming && chunk.DelayMS > 0 {
+			timer := time.NewTimer(time.Duration(chunk.DelayMS) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-b.req.Context().Done():
+				timer.Stop()
+				return 0, b.req.Context().Err()
+			}
+		}
+		b.pending = []byte(chunk.Data)
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *vcrReplayBody) Close() error {
+	b.chunks, b.pending = nil, nil
+	return nil
+}
+
+func redactVCRHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for name := range redacted {
+		if isSecretHeader(name) {
+			redacted[name] = []string{vcrRedacted}
+		}
+	}
+	return redacted
+}
+
+func redactVCRBody(body string) string {
+	return secretPattern.ReplaceAllString(body, vcrRedacted)
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const vcrTestStream = "data: {\"id\":\"c1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+	"data: {\"id\":\"c1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+	"data: [DONE]\n\n"
+
+func streamChat(t *testing.T, s *ProxyService) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?email=user@example.com",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Body.String()
+}
+
+func TestVCR_RecordAndReplay(t *testing.T) {
+	cassettePath := filepath.Join(t.TempDir(), "stream.json")
+	recorder := newUpstreamTestService(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Set-Cookie", "session=secret")
+		for _, event := range strings.SplitAfter(vcrTestStream, "\n\n") {
+			_, _ = io.WriteString(w, event)
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	WithVCR(NewVCR(VCRRecord, cassettePath))(recorder)
+	live := streamChat(t, recorder)
+
+	cassette, err := LoadCassette(cassettePath)
+	if err != nil {
+		t.Fatalf("LoadCassette failed: %v", err)
+	}
+	if len(cassette.Interactions) != 1 {
+		t.Fatalf("expected one interaction, got %d", len(cassette.Interactions))
+	}
+	interaction := cassette.Interactions[0]
+	if got := interaction.Request.Header.Get("Authorization"); got != vcrRedacted {
+		t.Errorf("expected Authorization to be redacted, got %q", got)
+	}
+	if got := interaction.Response.Header.Get("Set-Cookie"); got != vcrRedacted {
+		t.Errorf("expected Set-Cookie to be redacted, got %q", got)
+	}
+	chunks := interaction.Response.Chunks
+	if len(chunks) < 2 || chunks[len(chunks)-1].DelayMS < 10 {
+		t.Errorf("expected timed chunks, got %+v", chunks)
+	}
+
+	replayer := newUpstreamTestService(t, func(w http.ResponseWriter, _ *http.Request) {
+		t.Error("replay must not call the upstream")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	WithVCR(NewVCR(VCRReplay, cassettePath))(replayer)
+	start := time.Now()
+	if replayed := streamChat(t, replayer); replayed != live {
+		t.Errorf("replayed stream differs:\n%s\nwant:\n%s", replayed, live)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected replay to keep the chunk timing, took %v", elapsed)
+	}
+}
+
+func TestVCR_ReplayMatching(t *testing.T) {
+	cassette := &Cassette{Interactions: []Interaction{
+		{Request: RecordedRequest{Method: http.MethodPost, URL: "https://api.githubcopilot.com/chat/completions", Body: `{"model":"gpt-4o","n":1}`},
+			Response: RecordedResponse{Status: http.StatusOK, Chunks: []RecordedChunk{{Data: "first"}}}},
+		{Request: RecordedRequest{Method: http.MethodPost, URL: "https://api.githubcopilot.com/chat/completions", Body: `{"model":"gpt-5"}`},
+			Response: RecordedResponse{Status: http.StatusOK, Chunks: []RecordedChunk{{Data: "second"}}}},
+	}}
+	v := NewVCR(VCRReplay, "cassette.json")
+	v.cassette, v.used = cassette, make([]bool, 2)
+
+	for _, tt := range []struct{ body, want string }{
+		{`{"model": "gpt-5"}`, "second"},
+		{`{"n":1,"model":"gpt-4o"}`, "first"},
+		{`{"model":"gpt-5"}`, "second"},
+	} {
+		interaction, err := v.match(RecordedRequest{Method: http.MethodPost, URL: "http://127.0.0.1:9090/chat/completions", Body: tt.body})
+		if err != nil {
+			t.Fatalf("match failed: %v", err)
+		}
+		if got := interaction.Response.Chunks[0].Data; got != tt.want {
+			t.Errorf("body %s matched %q, want %q", tt.body, got, tt.want)
+		}
+	}
+	if _, err := v.match(RecordedRequest{Method: http.MethodPost, URL: "/embeddings"}); err == nil {
+		t.Error("expected an error for an unrecorded path")
+	}
+}
+
+func TestRedactVCRBody(t *testing.T) {
+	body := `{"token":"tid=abc;exp=1;sku=x","github":"gho_0123456789abcdefghijABCD"}`
+	got := redactVCRBody(body)
+	if strings.Contains(got, "tid=abc") || strings.Contains(got, "gho_") {
+		t.Errorf("expected tokens to be redacted, got %s", got)
+	}
+}
@@ -0,0 +1,25 @@
+package transform
+
+import "encoding/json"
+
+// EmbeddingsResponse is an OpenAI-compatible /embeddings response.
+type EmbeddingsResponse struct {
+	Object string          `json:"object"`
+	Data   []Embedding     `json:"data"`
+	Model  string          `json:"model"`
+	Usage  EmbeddingsUsage `json:"usage"`
+}
+
+// Embedding is one input's vector. It is kept raw so both float arrays and
+// base64 strings (encoding_format "base64") pass through unchanged.
+type Embedding struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+// EmbeddingsUsage ...
+type EmbeddingsUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
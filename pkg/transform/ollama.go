@@ -0,0 +1,124 @@
+package transform
+
+import "encoding/json"
+
+// OllamaChatRequest is an Ollama /api/chat request.
+type OllamaChatRequest struct {
+	Model     string            `json:"model"`
+	Messages  []OllamaMessage   `json:"messages"`
+	Tools     []json.RawMessage `json:"tools,omitempty"`
+	Format    json.RawMessage   `json:"format,omitempty"`
+	Options   *OllamaOptions    `json:"options,omitempty"`
+	Stream    *bool             `json:"stream,omitempty"` // Ollama streams unless stream is false
+	KeepAlive json.RawMessage   `json:"keep_alive,omitempty"`
+}
+
+// OllamaGenerateRequest is an Ollama /api/generate request.
+type OllamaGenerateRequest struct {
+	Model     string          `json:"model"`
+	Prompt    string          `json:"prompt"`
+	Suffix    string          `json:"suffix,omitempty"`
+	System    string          `json:"system,omitempty"`
+	Images    []string        `json:"images,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	Options   *OllamaOptions  `json:"options,omitempty"`
+	Stream    *bool           `json:"stream,omitempty"`
+	Raw       bool            `json:"raw,omitempty"`
+	KeepAlive json.RawMessage `json:"keep_alive,omitempty"`
+}
+
+// OllamaMessage is a single chat turn. Images are base64 encoded without a data URL prefix.
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// OllamaToolCall ...
+type OllamaToolCall struct {
+	Function OllamaToolCallFunction `json:"function"`
+}
+
+// OllamaToolCallFunction carries the arguments as a JSON object rather than a string.
+type OllamaToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// OllamaOptions holds the subset of model options that map onto chat completion parameters.
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+// OllamaChatResponse is one /api/chat response object, or one NDJSON line when streaming.
+type OllamaChatResponse struct {
+	Model     string        `json:"model"`
+	CreatedAt string        `json:"created_at"`
+	Message   OllamaMessage `json:"message"`
+	Done      bool          `json:"done"`
+	OllamaMetrics
+}
+
+// OllamaGenerateResponse is one /api/generate response object, or one NDJSON line when streaming.
+type OllamaGenerateResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	Done      bool   `json:"done"`
+	OllamaMetrics
+}
+
+// OllamaMetrics are reported on the final (done) response.
+type OllamaMetrics struct {
+	DoneReason      string `json:"done_reason,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+}
+
+// OllamaTagsResponse is the /api/tags model listing.
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+// OllamaModel ...
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails ...
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// OllamaShowRequest is an /api/show request. Older clients send name instead of model.
+type OllamaShowRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name"`
+}
+
+// OllamaShowResponse ...
+type OllamaShowResponse struct {
+	Modelfile    string             `json:"modelfile"`
+	Parameters   string             `json:"parameters"`
+	Template     string             `json:"template"`
+	Details      OllamaModelDetails `json:"details"`
+	ModelInfo    map[string]any     `json:"model_info"`
+	Capabilities []string           `json:"capabilities"`
+	ModifiedAt   string             `json:"modified_at"`
+}
@@ -502,6 +502,7 @@ func setupTestServer() (server *internal.Server, baseURL string, cleanup func(),
 	internal.SetDefaultHeaders(cfg)
 	internal.SetDefaultCORS(cfg)
 	internal.SetDefaultTimeouts(cfg)
+	cfg.APIKeys.AllowEmailParam = true // requests identify the user with ?email=
 
 	// Create HTTP client for the server
 	httpClient := &http.Client{
@@ -0,0 +1,84 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/internal"
+	"github.com/xdlhzdh/github-copilot-svcs/test/testutils"
+)
+
+// TestMockCopilotEndToEnd authenticates through the mock device flow and
+// sends completions through the real proxy.
+func TestMockCopilotEndToEnd(t *testing.T) {
+	mock := testutils.MockCopilot(t)
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	authService := internal.NewAuthService(httpClient, internal.WithTokenStore(internal.NewMemoryTokenStore()))
+
+	authConfig := *mock.Config
+	dc, err := authService.AuthenticateStage1(&authConfig)
+	if err != nil {
+		t.Fatalf("AuthenticateStage1 failed: %v", err)
+	}
+	if err := authService.AuthenticateStage2("dev@example.com", dc.DeviceCode, dc.Interval, dc.ExpiresIn, &authConfig, false); err != nil {
+		t.Fatalf("AuthenticateStage2 failed: %v", err)
+	}
+
+	workerPool := internal.NewWorkerPool(2)
+	defer workerPool.Stop()
+	proxy := internal.NewProxyService(mock.Config, httpClient, authService, workerPool)
+	srv := httptest.NewServer(proxy.Handler())
+	defer srv.Close()
+
+	post := func(path, body string) (int, string) {
+		t.Helper()
+		resp, err := http.Post(srv.URL+path+"?email=dev@example.com", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := post("/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi there"}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, body)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(body), &completion); err != nil || len(completion.Choices) != 1 {
+		t.Fatalf("Invalid completion %s: %v", body, err)
+	}
+	if got := completion.Choices[0].Message.Content; got != "Echo: hi there" {
+		t.Errorf("Expected echo reply, got %q", got)
+	}
+
+	status, body = post("/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi there"}]}`)
+	if status != http.StatusOK || !strings.Contains(body, `"content":"there"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Unexpected stream (%d): %s", status, body)
+	}
+
+	status, body = post("/v1/responses", `{"model":"gpt-5","input":"hello"}`)
+	if status != http.StatusOK || !strings.Contains(body, "Echo: hello") {
+		t.Errorf("Unexpected response (%d): %s", status, body)
+	}
+
+	status, _ = post("/v1/chat/completions", `{"model":"mock-error-400","messages":[{"role":"user","content":"hi"}]}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected injected 400, got %d", status)
+	}
+	if mock.Upstream.Calls("/copilot_internal/v2/token") != 1 {
+		t.Errorf("Expected one token exchange, got %d", mock.Upstream.Calls("/copilot_internal/v2/token"))
+	}
+}
@@ -0,0 +1,38 @@
+package integration_test
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xdlhzdh/github-copilot-svcs/test/testutils"
+)
+
+// TestReplayChatStream replays a recorded streaming completion through the proxy.
+func TestReplayChatStream(t *testing.T) {
+	srv := testutils.ReplayProxy(t, filepath.Join("..", "fixtures", "cassettes", "chat_stream.json"))
+
+	resp, err := http.Post(srv.URL+"/v1/chat/completions?email="+testutils.VCREmail, "application/json",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Say hello"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read stream: %v", err)
+	}
+	stream := string(body)
+	if !strings.Contains(stream, `"content":"Hel"`) || !strings.Contains(stream, `"content":"lo!"`) {
+		t.Errorf("Expected the recorded deltas, got %s", stream)
+	}
+	if !strings.HasSuffix(stream, "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to end with [DONE], got %s", stream)
+	}
+}
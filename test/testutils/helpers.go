@@ -30,6 +30,8 @@ func MockConfig() *internal.Config {
 
 	internal.SetDefaultTimeouts(cfg)
 	internal.SetDefaultHeaders(cfg)
+	// Tests select the user with ?email= rather than issuing API keys
+	cfg.APIKeys.AllowEmailParam = true
 
 	return cfg
 }
@@ -131,6 +133,9 @@ func CleanupEnv() {
 	if err := os.Unsetenv("LOG_LEVEL"); err != nil {
 		panic(err)
 	}
+	if err := os.Unsetenv("LOG_FORMAT"); err != nil {
+		panic(err)
+	}
 }
 
 // InitLogger initializes the logger for tests
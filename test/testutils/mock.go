@@ -0,0 +1,34 @@
+package testutils
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xdlhzdh/github-copilot-svcs/internal"
+)
+
+// MockCopilotServer is a running mock Copilot upstream.
+type MockCopilotServer struct {
+	*httptest.Server
+	Upstream *internal.MockUpstream
+	// Config is a test configuration whose upstream URLs point at the mock.
+	Config *internal.Config
+}
+
+// MockCopilot starts a mock Copilot upstream, implementing the GitHub device
+// flow, the Copilot token exchange and the completion endpoints, and stops it
+// when the test ends.
+func MockCopilot(t *testing.T, opts ...func(*internal.MockUpstream)) *MockCopilotServer {
+	t.Helper()
+	upstream := internal.NewMockUpstream(opts...)
+	srv := httptest.NewServer(upstream.Handler())
+	t.Cleanup(srv.Close)
+
+	cfg := MockConfig()
+	internal.SetDefaultCORS(cfg)
+	cfg.Upstream.CopilotAPI = srv.URL
+	cfg.Upstream.DeviceCodeURL = srv.URL + "/login/device/code"
+	cfg.Upstream.AccessTokenURL = srv.URL + "/login/oauth/access_token"
+	cfg.Upstream.CopilotTokenURL = srv.URL + "/copilot_internal/v2/token"
+	return &MockCopilotServer{Server: srv, Upstream: upstream, Config: cfg}
+}
@@ -0,0 +1,64 @@
+package testutils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xdlhzdh/github-copilot-svcs/internal"
+)
+
+// VCREmail is the user the VCR proxies hold a token for. Send it as ?email=.
+const VCREmail = "vcr@example.com"
+
+// ReplayProxy starts the proxy endpoints with every upstream exchange served
+// from the cassette at path, so a recorded bug replays deterministically.
+func ReplayProxy(t *testing.T, path string, opts ...func(*internal.VCR)) *httptest.Server {
+	t.Helper()
+	return vcrProxy(t, internal.NewVCR(internal.VCRReplay, path, opts...), "", "test-copilot-token")
+}
+
+// RecordProxy starts the proxy endpoints against the Copilot API at
+// upstreamURL, using copilotToken, and records every upstream exchange into
+// the cassette at path.
+func RecordProxy(t *testing.T, path, upstreamURL, copilotToken string) *httptest.Server {
+	t.Helper()
+	return vcrProxy(t, internal.NewVCR(internal.VCRRecord, path), upstreamURL, copilotToken)
+}
+
+func vcrProxy(t *testing.T, vcr *internal.VCR, upstreamURL, copilotToken string) *httptest.Server {
+	t.Helper()
+	store := internal.NewMemoryTokenStore()
+	if err := store.Put(context.Background(), &internal.StoredToken{
+		Email:        VCREmail,
+		GitHubToken:  "test-github-token",
+		CopilotToken: copilotToken,
+		ExpiresAt:    time.Now().Add(time.Hour).Unix(),
+	}); err != nil {
+		t.Fatalf("failed to store token: %v", err)
+	}
+
+	cfg := MockConfig()
+	cfg.Upstream.CopilotAPI = upstreamURL
+	httpClient := &http.Client{Timeout: time.Duration(cfg.Timeouts.HTTPClient) * time.Second}
+	workerPool := internal.NewWorkerPool(2)
+	t.Cleanup(workerPool.Stop)
+	proxy := internal.NewProxyService(cfg, httpClient,
+		internal.NewAuthService(httpClient, internal.WithTokenStore(store)), workerPool,
+		internal.WithVCR(vcr))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", proxy.Handler())
+	mux.HandleFunc("/v1/completions", proxy.Handler())
+	mux.HandleFunc("/v1/responses", proxy.Handler())
+	mux.HandleFunc("/v1/embeddings", proxy.EmbeddingsHandler())
+	mux.HandleFunc("/v1/messages", proxy.MessagesHandler())
+	mux.HandleFunc("/api/chat", proxy.OllamaChatHandler())
+	mux.HandleFunc("/api/generate", proxy.OllamaGenerateHandler())
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}